@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	docopt "github.com/docopt/docopt-go"
@@ -56,6 +57,14 @@ Daemon Commands:
 		shows how long it has been running.
 	status
 		returns information about the daemon status.
+	reload:
+		reloads the configuration file without stopping the daemon,
+		only restarting what depends on modified settings. The
+		current configuration is kept if the new one is invalid.
+		Sending SIGHUP to the daemon does the same.
+	restart:
+		restarts one subsystem of the daemon: webserver, stats,
+		scheduler, or the IRC connection of a tracker (irc-TRACKER).
 
 Commands:
 
@@ -83,7 +92,17 @@ Commands:
 		backup user files (stats, history, configuration file) to a
 		timestamped zip file. Automatically triggered every day.
 	downloads search:
-		return all known downloads on which an artist has worked.
+		search downloads with a query made of terms such as
+		artist:"Miles Davis" tag:jazz year:1970..1979 -state:rejected.
+		Fields: artist, title, tag, label, catnum, year, format,
+		quality, source, tracker, state, size, snatched, folder.
+		Ranges use "..", either bound being optional, for years,
+		sizes (500MB..1GB) and snatch dates (2020-01..2020-06-15).
+		Terms without a field are looked for in artists, titles and
+		folder names. A leading "-" excludes matching downloads,
+		such terms must come after "--" on the command line.
+		Results can be sorted by id, folder, title, label, year, size,
+		snatched or state, a leading "-" reversing the order.
 	downloads metadata:
 		return information about a specific download. Takes downloads
 		db ID as argument.
@@ -91,7 +110,17 @@ Commands:
 		sort all unsorted downloads, or sort a specific release
 		(identified by its path). sorting allows you to tag which
 		release to keep and which to only seed; selected downloads
-		can be exported to an external folder.
+		can be exported to an external folder. If a music file
+		template is configured, exported tracks are renamed using
+		their tags, and disc folders become "Disc 1", "Disc 2"...,
+		unless using hard links. If configured, tracker metadata is
+		also written to their tags, as with library tag.
+		Sort rules from the library configuration decide without
+		asking for the unsorted downloads they match (by the filter
+		that snatched them, tags, artists, format, quality, source or
+		size): they can accept them with a given main artist policy
+		(first, all, various, or a name), alias and category, reject
+		or defer them. A report shows which rule sorted each download.
 	downloads sort-id:
 		sort all unsorted downloads, or sort a specific release
 		(identified by its db ID). sorting allows you to tag which
@@ -100,6 +129,14 @@ Commands:
 	downloads list:
 		list all downloads, of filter by state: unsorted, accepted, 
 	    exported, rejected.
+	downloads duplicates:
+		find downloads of the same release, from the same tracker group
+		or with the same artists, title and year. They are ranked by
+		quality (24bit, lossless with a perfect log, WEB, other
+		lossless, lossy), the best one is kept and the others are
+		suggested for rejection or for seeding only. With --apply,
+		unsorted downloads that are not kept are rejected, so that
+		they are not exported to the library when sorting.
 	downloads clean:
 		clean up the downloads directory by moving all empty folders,
 		and folders with only tracker metadata, to a dedicated subfolder.
@@ -109,19 +146,58 @@ Commands:
 		record labels, years. Call 'fusermount -u MOUNT_POINT' to stop.
 	library reorganize:
 		renames all releases in the library (including parent folders) 
-		using tracker metadata and the user-defined folder template.
+		using tracker metadata and the user-defined folder template,
+		or the template defined for their category or release type.
+		All moves, playlist edits and deleted folders are recorded in
+		the library journal, and shown the same way with --simulate.
+	library tag:
+		write tracker metadata into the tags of the FLAC files of all
+		releases in the library: album artist, label, catalog number,
+		release type, genres from the tracker tags, and the tracker
+		torrent and group IDs (as BLUE_TORRENTID, BLUE_GROUPID...).
+		The saved cover is embedded in files without one, if
+		configured. Hard links to downloads are never modified.
+		--simulate shows the tags that would change.
+	library history:
+		list the runs recorded in the library journal (reorganizations,
+		exports from sorting downloads, undos), the most recent first.
+	library undo:
+		revert the changes of a run from the library journal, the most
+		recent one by default. Playlists edited since cannot be restored.
+	library list:
+		list all releases in the library database, which is updated
+		when exporting downloads and reorganizing the library.
+	library search:
+		search releases in the library database, with the same queries
+		as downloads search, except that there is no state, and that
+		releases can be found by the date they were exported to the
+		library (exported:2020-05). Results can be sorted by id, folder,
+		title, label, year, size or exported.
+	library stats:
+		number of releases in the library by artist, label, year and
+		format, and their total size.
 	library fuse:
 		similar to downloads fuse, but for your music library.
 	reseed:
 		reseed a downloaded release using tracker metadata. Does not check
 		the torrent files actually match the contents in the given PATH.
+	token create:
+		create a named token for the web server API, with comma-separated
+		scopes among: read-stats, read-downloads, snatch, admin. It can
+		be restricted to some trackers, and expire after a number of days.
+		The token is only displayed once, only its hash is kept.
+	token list:
+		list all API tokens.
+	token revoke:
+		revoke the API token with the given name.
 	
 Configuration Commands:
 
 	show-config:
 		displays what varroa has parsed from the configuration file
 		(useful for checking the YAML is correctly formatted, and the
-		filters are correctly interpreted).
+		filters are correctly interpreted). Library templates are
+		shown with an example generated from sample metadata.
 	encrypt:
 		encrypts your configuration file. The encrypted version can
 		be used in place of the plaintext version, if you're
@@ -134,7 +210,8 @@ Configuration Commands:
 		decrypts your encrypted configuration file.
 
 Usage:
-	varroa (start [--no-daemon]|stop|uptime|status)
+	varroa (start [--no-daemon]|stop|uptime|status|reload)
+	varroa restart <SUBSYSTEM>
 	varroa stats
 	varroa refresh-metadata <PATH>...
 	varroa refresh-metadata-by-id <TRACKER> <ID>...
@@ -143,9 +220,10 @@ Usage:
 	varroa info <TRACKER> <ID>...
 	varroa backup
 	varroa show-config
-	varroa (downloads|dl) (search <ARTIST>|metadata <ID>|sort [--new] [<PATH>...]|sort-id [<ID>...]|list [<STATE>]|clean|fuse <MOUNT_POINT>)
-	varroa library (fuse <MOUNT_POINT>|reorganize [--simulate|--interactive])
+	varroa (downloads|dl) (search [--json] [--sort=<FIELD>] [--] <QUERY>...|metadata <ID>|sort [--new] [<PATH>...]|sort-id [<ID>...]|list [<STATE>]|duplicates [--apply]|clean|fuse <MOUNT_POINT>)
+	varroa library (fuse <MOUNT_POINT>|reorganize [--simulate|--interactive]|tag [--simulate]|history|undo [<RUN_ID>]|list [--json] [--sort=<FIELD>]|search [--json] [--sort=<FIELD>] [--] <QUERY>...|stats)
 	varroa reseed <TRACKER> <PATH>
+	varroa token (create <NAME> --scopes=<SCOPES> [--trackers=<TRACKERS>] [--days=<DAYS>]|list|revoke <NAME>)
 	varroa (encrypt|decrypt)
 	varroa --version
 
@@ -153,9 +231,15 @@ Options:
  	-h, --help             Show this screen.
 	--no-daemon            Starts varroa but without turning it into a daemon. No log will be kept. Ctrl+C to quit.
  	--fl                   Use personal Freeleech torrent if available.
-	--simulate             Simulate library reorganization to show what would be renamed.
+	--simulate             Simulate library reorganization or tagging to show what would be modified.
 	--interactive          Library reorganization requires user confirmation for each release if necessary.
 	--new                  Only sort new releases (ignore previously sorted ones)
+	--json                 Output search results as JSON.
+	--sort=<FIELD>         Sort search results by this field.
+	--apply                Reject unsorted duplicates that are not kept.
+	--scopes=<SCOPES>      Comma-separated scopes of the API token.
+	--trackers=<TRACKERS>  Comma-separated trackers the API token is restricted to.
+	--days=<DAYS>          Number of days before the API token expires.
   	--version              Show version.
 `
 )
@@ -173,6 +257,9 @@ type varroaArguments struct {
 	stop                    bool
 	uptime                  bool
 	status                  bool
+	reload                  bool
+	restart                 bool
+	subsystem               string
 	stats                   bool
 	refreshMetadata         bool
 	refreshMetadataByID     bool
@@ -184,25 +271,42 @@ type varroaArguments struct {
 	encrypt                 bool
 	decrypt                 bool
 	downloadSearch          bool
+	query                   string
+	sortBy                  string
+	jsonOutput              bool
 	downloadInfo            bool
 	downloadSort            bool
 	downloadSortID          bool
 	downloadList            bool
+	downloadDuplicates      bool
+	applyDuplicates         bool
 	downloadState           string
 	downloadClean           bool
 	downloadFuse            bool
 	libraryFuse             bool
 	libraryReorg            bool
 	libraryReorgInteractive bool
-	libraryReorgSimulate    bool
+	libraryTag              bool
+	librarySimulate         bool
+	libraryHistory          bool
+	libraryList             bool
+	librarySearch           bool
+	libraryStats            bool
+	libraryUndo             bool
+	libraryRunID            string
 	reseed                  bool
+	tokenCreate             bool
+	tokenList               bool
+	tokenRevoke             bool
+	tokenName               string
+	newToken                *varroa.APIToken
+	newTokenValue           string
 	useFLToken              bool
 	ignoreSorted            bool
 	torrentIDs              []int
 	logFile                 string
 	trackerLabel            string
 	paths                   []string
-	artistName              string
 	mountPoint              string
 	requiresDaemon          bool
 	canUseDaemon            bool
@@ -226,7 +330,13 @@ func (b *varroaArguments) parseCLI(osArgs []string) error {
 	b.stop = args["stop"].(bool)
 	b.uptime = args["uptime"].(bool)
 	b.status = args["status"].(bool)
-	b.stats = args["stats"].(bool)
+	b.reload = args["reload"].(bool)
+	b.restart = args["restart"].(bool)
+	if b.restart {
+		b.subsystem = args["<SUBSYSTEM>"].(string)
+	}
+	// library stats is a different command
+	b.stats = args["stats"].(bool) && !args["library"].(bool)
 	b.reseed = args["reseed"].(bool)
 	//b.enhance = args["enhance"].(bool)
 	b.refreshMetadataByID = args["refresh-metadata-by-id"].(bool)
@@ -241,7 +351,11 @@ func (b *varroaArguments) parseCLI(osArgs []string) error {
 	if args["downloads"].(bool) || args["dl"].(bool) {
 		b.downloadSearch = args["search"].(bool)
 		if b.downloadSearch {
-			b.artistName = args["<ARTIST>"].(string)
+			b.query = varroa.DownloadsQueryFromArgs(args["<QUERY>"].([]string))
+			b.jsonOutput = args["--json"].(bool)
+			if sortBy, ok := args["--sort"].(string); ok {
+				b.sortBy = sortBy
+			}
 		}
 		b.downloadInfo = args["metadata"].(bool)
 		b.downloadSort = args["sort"].(bool)
@@ -250,14 +364,44 @@ func (b *varroaArguments) parseCLI(osArgs []string) error {
 		}
 		b.downloadSortID = args["sort-id"].(bool)
 		b.downloadList = args["list"].(bool)
+		b.downloadDuplicates = args["duplicates"].(bool)
+		if b.downloadDuplicates {
+			b.applyDuplicates = args["--apply"].(bool)
+		}
 		b.downloadClean = args["clean"].(bool)
 		b.downloadFuse = args["fuse"].(bool)
 	}
+	if args["token"].(bool) {
+		b.tokenCreate = args["create"].(bool)
+		b.tokenList = args["list"].(bool)
+		b.tokenRevoke = args["revoke"].(bool)
+		if b.tokenCreate || b.tokenRevoke {
+			b.tokenName = args["<NAME>"].(string)
+		}
+	}
 	if args["library"].(bool) {
 		b.libraryFuse = args["fuse"].(bool)
 		b.libraryReorg = args["reorganize"].(bool)
-		b.libraryReorgSimulate = args["--simulate"].(bool)
+		b.librarySimulate = args["--simulate"].(bool)
+		b.libraryTag = args["tag"].(bool)
 		b.libraryReorgInteractive = args["--interactive"].(bool)
+		b.libraryHistory = args["history"].(bool)
+		b.libraryList = args["list"].(bool)
+		b.librarySearch = args["search"].(bool)
+		b.libraryStats = args["stats"].(bool)
+		if b.librarySearch {
+			b.query = varroa.DownloadsQueryFromArgs(args["<QUERY>"].([]string))
+		}
+		if b.libraryList || b.librarySearch {
+			b.jsonOutput = args["--json"].(bool)
+			if sortBy, ok := args["--sort"].(string); ok {
+				b.sortBy = sortBy
+			}
+		}
+		b.libraryUndo = args["undo"].(bool)
+		if b.libraryUndo && args["<RUN_ID>"] != nil {
+			b.libraryRunID = args["<RUN_ID>"].(string)
+		}
 	}
 	if b.reseed || b.downloadSort {
 		b.paths = args["<PATH>"].([]string)
@@ -315,6 +459,24 @@ func (b *varroaArguments) parseCLI(osArgs []string) error {
 	if b.snatch {
 		b.useFLToken = args["--fl"].(bool)
 	}
+	if b.tokenCreate {
+		var trackers []string
+		if value, ok := args["--trackers"].(string); ok {
+			trackers = strings.Split(value, ",")
+		}
+		var days int
+		if value, ok := args["--days"].(string); ok {
+			days, err = strconv.Atoi(value)
+			if err != nil || days <= 0 {
+				return errors.New("invalid number of days, must be a positive integer")
+			}
+		}
+		// generating the token here so that its plaintext value is never sent to the daemon
+		b.newToken, b.newTokenValue, err = varroa.NewAPIToken(b.tokenName, strings.Split(args["--scopes"].(string), ","), trackers, days)
+		if err != nil {
+			return err
+		}
+	}
 	if b.checkLog {
 		logPath := args["<LOG_FILE>"].(string)
 		if !fs.FileExists(logPath) {
@@ -359,11 +521,11 @@ func (b *varroaArguments) parseCLI(osArgs []string) error {
 	// sorting which commands can use the daemon if it's there but should manage if it is not
 	b.requiresDaemon = true
 	b.canUseDaemon = true
-	if b.refreshMetadataByID || b.refreshMetadata || b.snatch || b.checkLog || b.backup || b.stats || b.downloadSearch || b.downloadInfo || b.downloadSort || b.downloadSortID || b.downloadList || b.info || b.downloadClean || b.downloadFuse || b.libraryFuse || b.libraryReorg || b.reseed {
+	if b.refreshMetadataByID || b.refreshMetadata || b.snatch || b.checkLog || b.backup || b.stats || b.downloadSearch || b.downloadInfo || b.downloadSort || b.downloadSortID || b.downloadList || b.info || b.downloadClean || b.downloadFuse || b.libraryFuse || b.libraryReorg || b.libraryTag || b.libraryHistory || b.libraryUndo || b.libraryList || b.librarySearch || b.libraryStats || b.reseed || b.tokenCreate || b.tokenList || b.tokenRevoke {
 		b.requiresDaemon = false
 	}
 	// sorting which commands should not interact with the daemon in any case
-	if b.refreshMetadata || b.backup || b.showConfig || b.decrypt || b.encrypt || b.downloadSearch || b.downloadInfo || b.downloadSort || b.downloadSortID || b.downloadList || b.downloadClean || b.downloadFuse || b.libraryFuse || b.libraryReorg {
+	if b.refreshMetadata || b.backup || b.showConfig || b.decrypt || b.encrypt || b.downloadSearch || b.downloadInfo || b.downloadSort || b.downloadSortID || b.downloadList || b.downloadClean || b.downloadFuse || b.libraryFuse || b.libraryReorg || b.libraryTag || b.libraryHistory || b.libraryUndo || b.libraryList || b.librarySearch || b.libraryStats {
 		b.canUseDaemon = false
 	}
 	return nil
@@ -384,6 +546,13 @@ func (b *varroaArguments) commandToDaemon() []byte {
 	if b.status {
 		out.Command = "status"
 	}
+	if b.reload {
+		out.Command = "reload"
+	}
+	if b.restart {
+		out.Command = "restart"
+		out.Args = []string{b.subsystem}
+	}
 	if b.refreshMetadataByID {
 		out.Command = "refresh-metadata-by-id"
 		out.Args = intslice.ToStringSlice(b.torrentIDs)
@@ -405,6 +574,9 @@ func (b *varroaArguments) commandToDaemon() []byte {
 		out.Command = "reseed"
 		out.Args = b.paths
 	}
+	if b.tokenCreate || b.tokenList || b.tokenRevoke {
+		out = b.tokenOrders()
+	}
 	commandBytes, err := json.Marshal(out)
 	if err != nil {
 		logthis.Error(errors.Wrap(err, "cannot parse command"), logthis.NORMAL)
@@ -412,3 +584,24 @@ func (b *varroaArguments) commandToDaemon() []byte {
 	}
 	return commandBytes
 }
+
+// tokenOrders for managing API tokens, directly or through the daemon.
+func (b *varroaArguments) tokenOrders() varroa.IncomingJSON {
+	var out varroa.IncomingJSON
+	switch {
+	case b.tokenCreate:
+		tokenBytes, err := json.Marshal(b.newToken)
+		if err != nil {
+			logthis.Error(errors.Wrap(err, "cannot parse token"), logthis.NORMAL)
+			return out
+		}
+		out.Command = "token-add"
+		out.Args = []string{string(tokenBytes)}
+	case b.tokenList:
+		out.Command = "token-list"
+	case b.tokenRevoke:
+		out.Command = "token-revoke"
+		out.Args = []string{b.tokenName}
+	}
+	return out
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/signal"
@@ -79,7 +80,7 @@ func main() {
 			fmt.Println(config)
 			return
 		}
-		if cli.downloadSearch || cli.downloadInfo || cli.downloadSort || cli.downloadSortID || cli.downloadList || cli.downloadClean {
+		if cli.downloadSearch || cli.downloadInfo || cli.downloadSort || cli.downloadSortID || cli.downloadList || cli.downloadDuplicates || cli.downloadClean {
 			if !config.DownloadFolderConfigured {
 				logthis.Error(errors.New("Cannot scan for downloads, downloads folder not configured"), logthis.NORMAL)
 				return
@@ -171,13 +172,44 @@ func main() {
 			defer downloads.Close()
 
 			if cli.downloadSearch {
-				hits := downloads.FindByArtist(cli.artistName)
-				if len(hits) == 0 {
+				hits, err := downloads.Search(cli.query, cli.sortBy)
+				if err != nil {
+					logthis.Error(err, logthis.NORMAL)
+					return
+				}
+				if cli.jsonOutput {
+					out, err := json.MarshalIndent(hits, "", "  ")
+					if err != nil {
+						logthis.Error(err, logthis.NORMAL)
+						return
+					}
+					fmt.Println(string(out))
+				} else if len(hits) == 0 {
 					fmt.Println("Nothing found.")
 				} else {
-					for _, dl := range hits {
-						fmt.Println(dl.ShortString())
+					fmt.Print(varroa.DownloadsTable(hits))
+				}
+				return
+			}
+			if cli.downloadDuplicates {
+				groups, err := downloads.Duplicates()
+				if err != nil {
+					logthis.Error(err, logthis.NORMAL)
+					return
+				}
+				if len(groups) == 0 {
+					fmt.Println("No duplicates found.")
+					return
+				}
+				for _, g := range groups {
+					fmt.Println(g.String())
+				}
+				if cli.applyDuplicates {
+					rejected, err := downloads.ApplyDuplicates(env, groups)
+					if err != nil {
+						logthis.Error(err, logthis.NORMAL)
 					}
+					fmt.Printf("%d unsorted duplicate(s) rejected.\n", len(rejected))
 				}
 				return
 			}
@@ -212,15 +244,108 @@ func main() {
 				return
 			}
 			logthis.Info("Reorganizing releases in the library directory. ", logthis.NORMAL)
-			if cli.libraryReorgSimulate {
+			if cli.librarySimulate {
 				fmt.Println(ui.Green("This will simulate the library reorganization, applying the library folder template to all releases, using known tracker metadata. Nothing will actually be renamed or moved."))
 			} else {
 				fmt.Println(ui.Green("This will apply the library folder template to all releases, using known tracker metadata. It will overwrite any specific name that may have been set manually."))
 			}
 			if ui.Accept("Confirm") {
-				if err = varroa.ReorganizeLibrary(cli.libraryReorgSimulate, cli.libraryReorgInteractive); err != nil {
+				if err = varroa.ReorganizeLibrary(cli.librarySimulate, cli.libraryReorgInteractive); err != nil {
+					logthis.Error(err, logthis.NORMAL)
+				}
+			}
+			return
+		}
+		if cli.libraryTag {
+			if !config.LibraryConfigured {
+				logthis.Info("Library is not configured, missing relevant configuration section.", logthis.NORMAL)
+				return
+			}
+			if !cli.librarySimulate && !ui.Accept("Write tracker metadata to the tags of all FLAC files in the library") {
+				return
+			}
+			if err = varroa.TagLibrary(cli.librarySimulate); err != nil {
+				logthis.Error(err, logthis.NORMAL)
+			}
+			return
+		}
+		if cli.libraryList || cli.librarySearch || cli.libraryStats {
+			if !config.LibraryConfigured {
+				logthis.Info("Library is not configured, missing relevant configuration section.", logthis.NORMAL)
+				return
+			}
+			library, err := varroa.OpenLibraryDB(varroa.DefaultLibraryDB, config.Library)
+			if err != nil {
+				logthis.Error(err, logthis.NORMAL)
+				return
+			}
+			defer library.Close()
+			// indexing existing libraries the first time
+			if count, err := library.Count(); err == nil && count == 0 {
+				fmt.Println(ui.Green("Scanning library for releases with tracker metadata."))
+				if err := library.Scan(); err != nil {
+					logthis.Error(err, logthis.NORMAL)
+					return
+				}
+			}
+			if cli.libraryStats {
+				stats, err := library.Stats()
+				if err != nil {
+					logthis.Error(err, logthis.NORMAL)
+					return
+				}
+				fmt.Print(stats.String())
+				return
+			}
+			hits, err := library.Search(cli.query, cli.sortBy)
+			if err != nil {
+				logthis.Error(err, logthis.NORMAL)
+				return
+			}
+			if cli.jsonOutput {
+				out, err := json.MarshalIndent(hits, "", "  ")
+				if err != nil {
 					logthis.Error(err, logthis.NORMAL)
+					return
 				}
+				fmt.Println(string(out))
+			} else if len(hits) == 0 {
+				fmt.Println("Nothing found.")
+			} else {
+				fmt.Print(varroa.LibraryTable(hits))
+			}
+			return
+		}
+		if cli.libraryHistory {
+			history, err := varroa.LibraryHistory()
+			if err != nil {
+				logthis.Error(err, logthis.NORMAL)
+				return
+			}
+			fmt.Print(history)
+			return
+		}
+		if cli.libraryUndo {
+			if !config.LibraryConfigured {
+				logthis.Info("Library is not configured, missing relevant configuration section.", logthis.NORMAL)
+				return
+			}
+			run := "the most recent run"
+			if cli.libraryRunID != "" {
+				run = "run " + cli.libraryRunID
+			}
+			if !ui.Accept("Revert the changes made to the library by " + run) {
+				return
+			}
+			undo, clean, err := varroa.UndoLibraryRun(cli.libraryRunID)
+			if undo != nil {
+				fmt.Print(undo.String())
+			}
+			if clean != nil {
+				fmt.Print(clean.String())
+			}
+			if err != nil {
+				logthis.Error(err, logthis.NORMAL)
 			}
 			return
 		}
@@ -240,7 +365,7 @@ func main() {
 				return
 			}
 			logthis.Info("Mounting FUSE filesystem in "+cli.mountPoint, logthis.NORMAL)
-			if err = varroa.FuseMount(config.Library.Directory, cli.mountPoint, varroa.DefaultLibraryDB); err != nil {
+			if err = varroa.FuseMount(config.Library.Directory, cli.mountPoint, varroa.DefaultLibraryFuseDB); err != nil {
 				logthis.Error(err, logthis.NORMAL)
 				return
 			}
@@ -289,6 +414,16 @@ func main() {
 		}
 		// launch goroutines
 		varroa.GoGoRoutines(env, cli.noDaemon)
+		// reloading the configuration on SIGHUP
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				if err := varroa.ReloadConfiguration(env); err != nil {
+					logthis.Error(err, logthis.NORMAL)
+				}
+			}
+		}()
 
 		if !cli.noDaemon {
 			// wait until daemon is stopped.
@@ -297,16 +432,17 @@ func main() {
 		} else {
 			// wait for ^C to quit.
 			fmt.Println(ui.Red("Running in no-daemon mode. Ctrl+C to quit."))
-			c := make(chan os.Signal)
+			c := make(chan os.Signal, 1)
 			signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 			// waiting...
 			<-c
 			fmt.Println(ui.Red("Terminating."))
 		}
-
 		if err := varroa.Notify("Stopping varroa!", varroa.FullName, "info", env); err != nil {
 			logthis.Error(err, logthis.NORMAL)
 		}
+		// stopping subsystems and waiting for work in progress
+		varroa.StopGoRoutines(env)
 		return
 	}
 
@@ -320,6 +456,21 @@ func main() {
 			fmt.Println(varroa.InfoUsage)
 			return
 		}
+		// managing tokens only requires the tokens database
+		if cli.tokenCreate || cli.tokenList || cli.tokenRevoke {
+			tokens, err := varroa.NewTokensDB(varroa.DefaultTokensDB)
+			if err != nil {
+				logthis.Error(err, logthis.NORMAL)
+				return
+			}
+			defer tokens.Close()
+			if err := varroa.ManageAPITokens(cli.tokenOrders()); err != nil {
+				logthis.Error(err, logthis.NORMAL)
+				return
+			}
+			showNewToken(cli)
+			return
+		}
 		// setting up since the daemon isn't running
 		if err := env.SetUp(false); err != nil {
 			logthis.Error(errors.Wrap(err, varroa.ErrorSettingUp), logthis.NORMAL)
@@ -384,6 +535,7 @@ func main() {
 			logthis.Error(errors.Wrap(err, varroa.ErrorSendingCommandToDaemon), logthis.NORMAL)
 			return
 		}
+		showNewToken(cli)
 		// at last, sending signals for shutdown
 		if cli.stop {
 			d.Stop(daemonProcess)
@@ -392,6 +544,14 @@ func main() {
 	}
 }
 
+// showNewToken once, since only its hash is kept.
+func showNewToken(cli *varroaArguments) {
+	if cli.tokenCreate {
+		fmt.Println("API token " + cli.tokenName + ": " + ui.Green(cli.newTokenValue))
+		fmt.Println("Keep it safe, it cannot be displayed again.")
+	}
+}
+
 func closeDB() {
 	// closing statsDB properly
 	if stats, err := varroa.NewDatabase(filepath.Join(varroa.StatsDir, varroa.DefaultHistoryDB)); err == nil {
@@ -1,6 +1,7 @@
 package varroa
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -29,6 +30,7 @@ import (
 const (
 	archivesDir         = "archives"
 	archiveNameTemplate = "varroa_%s.zip"
+	lastSnatchesNumber  = 5
 )
 
 // SendOrders from the CLI to the running daemon
@@ -83,55 +85,7 @@ Loop:
 					logthis.Error(errors.Wrap(jsonErr, "Error parsing incoming command from unix socket"), logthis.NORMAL)
 					continue
 				}
-				var t *tracker.Gazelle
-				var err error
-				if orders.Site != "" {
-					t, err = e.Tracker(orders.Site)
-					if err != nil {
-						logthis.Error(errors.Wrap(err, "Error parsing tracker label for command from unix socket"), logthis.NORMAL)
-						continue
-					}
-				}
-
-				switch orders.Command {
-				case "stats":
-					if err := GenerateStats(e); err != nil {
-						logthis.Error(errors.Wrap(err, ErrorGeneratingGraphs), logthis.NORMAL)
-					}
-				case "refresh-metadata-by-id":
-					if err := RefreshMetadata(e, t, orders.Args); err != nil {
-						logthis.Error(errors.Wrap(err, ErrorRefreshingMetadata), logthis.NORMAL)
-					}
-				case "snatch":
-					if err := SnatchTorrents(e, t, orders.Args, orders.FLToken); err != nil {
-						logthis.Error(errors.Wrap(err, ErrorSnatchingTorrent), logthis.NORMAL)
-					}
-				case "info":
-					if err := ShowTorrentInfo(e, t, orders.Args); err != nil {
-						logthis.Error(errors.Wrap(err, ErrorShowingTorrentInfo), logthis.NORMAL)
-					}
-				case "check-log":
-					if err := CheckLog(t, orders.Args); err != nil {
-						logthis.Error(errors.Wrap(err, ErrorCheckingLog), logthis.NORMAL)
-					}
-				case "uptime":
-					if e.startTime.IsZero() {
-						logthis.Info("Daemon is not running.", logthis.NORMAL)
-					} else {
-						logthis.Info("varroa musica daemon up for "+time.Since(e.startTime).String()+".", logthis.NORMAL)
-					}
-				case "status":
-					if e.startTime.IsZero() {
-						logthis.Info("Daemon is not running.", logthis.NORMAL)
-					} else {
-						logthis.Info(statusString(e), logthis.NORMAL)
-					}
-				case "reseed":
-					if err := Reseed(t, orders.Args); err != nil {
-						logthis.Error(errors.Wrap(err, ErrorReseed), logthis.NORMAL)
-					}
-				case ipc.StopCommand:
-					logthis.Info("Stopping daemon...", logthis.NORMAL)
+				if stop := executeOrders(e, orders, loggedOutput{}); stop {
 					break Loop
 				}
 				e.daemonUnixSocket.Outgoing <- []byte(ipc.StopCommand)
@@ -145,6 +99,166 @@ Loop:
 	e.daemonUnixSocket.StopCurrent()
 }
 
+// commandOutput receives the messages of a command, to send them back to whoever sent it.
+type commandOutput interface {
+	Info(msg string)
+	Error(err error)
+}
+
+// loggedOutput of commands sent from the CLI, which gets the daemon logs.
+type loggedOutput struct{}
+
+func (loggedOutput) Info(msg string) {
+	logthis.Info(msg, logthis.NORMAL)
+}
+
+func (loggedOutput) Error(err error) {
+	logthis.Error(err, logthis.NORMAL)
+}
+
+// executeOrders received from the CLI or from IRC, returns true if the daemon must stop.
+func executeOrders(e *Environment, orders IncomingJSON, out commandOutput) bool {
+	var t *tracker.Gazelle
+	var err error
+	if orders.Site != "" {
+		t, err = e.Tracker(orders.Site)
+		if err != nil {
+			out.Error(errors.Wrap(err, "Error parsing tracker label for command"))
+			return false
+		}
+	}
+
+	switch orders.Command {
+	case "stats":
+		if err := GenerateStats(e); err != nil {
+			out.Error(errors.Wrap(err, ErrorGeneratingGraphs))
+		}
+		if err := showLastStats(e, out); err != nil {
+			out.Error(errors.Wrap(err, errorGettingStats))
+		}
+	case "refresh-metadata-by-id":
+		if err := RefreshMetadata(e, t, orders.Args); err != nil {
+			out.Error(errors.Wrap(err, ErrorRefreshingMetadata))
+		}
+	case "snatch":
+		if err := snatchTorrents(e, t, orders.Args, orders.FLToken, out); err != nil {
+			out.Error(errors.Wrap(err, ErrorSnatchingTorrent))
+		}
+	case "info":
+		if err := showTorrentInfo(e, t, orders.Args, out); err != nil {
+			out.Error(errors.Wrap(err, ErrorShowingTorrentInfo))
+		}
+	case "check-log":
+		if err := CheckLog(t, orders.Args); err != nil {
+			out.Error(errors.Wrap(err, ErrorCheckingLog))
+		}
+	case "uptime":
+		if e.startTime.IsZero() {
+			out.Info("Daemon is not running.")
+		} else {
+			out.Info("varroa musica daemon up for " + time.Since(e.startTime).String() + ".")
+		}
+	case "status":
+		if e.startTime.IsZero() {
+			out.Info("Daemon is not running.")
+		} else {
+			out.Info(statusString(e))
+		}
+	case "reseed":
+		if err := Reseed(t, orders.Args); err != nil {
+			out.Error(errors.Wrap(err, ErrorReseed))
+		}
+	case "pause":
+		toggleAutosnatch(e, orders.Site, true, out)
+	case "resume":
+		toggleAutosnatch(e, orders.Site, false, out)
+	case "last":
+		if err := showLastSnatches(e, lastSnatchesNumber, out); err != nil {
+			out.Error(errors.Wrap(err, errorGettingLastSnatches))
+		}
+	case tokenAddCommand, tokenListCommand, tokenRevokeCommand:
+		if err := ManageAPITokens(orders); err != nil {
+			out.Error(errors.Wrap(err, errorManagingTokens))
+		}
+	case restartCommand:
+		if len(orders.Args) != 1 {
+			out.Info("Restarting requires the name of a subsystem: " + strings.Join(e.lifecycle.Names(), ", "))
+			break
+		}
+		if err := e.lifecycle.Restart(orders.Args[0]); err != nil {
+			out.Error(errors.Wrap(err, "Error restarting "+orders.Args[0]))
+		} else {
+			out.Info("Restarted " + orders.Args[0] + ".")
+		}
+	case reloadCommand:
+		if err := ReloadConfiguration(e); err != nil {
+			out.Error(err)
+		}
+	case ipc.StopCommand:
+		out.Info("Stopping daemon...")
+		return true
+	}
+	return false
+}
+
+// toggleAutosnatch for a tracker, or all trackers if none is given.
+func toggleAutosnatch(e *Environment, trackerLabel string, disable bool, out commandOutput) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, as := range e.config.Autosnatch {
+		if trackerLabel != "" && as.Tracker != trackerLabel {
+			continue
+		}
+		as.disabledAutosnatching = disable
+		if disable {
+			out.Info("Autosnatching paused for tracker " + as.Tracker + ".")
+		} else {
+			out.Info("Autosnatching resumed for tracker " + as.Tracker + ".")
+		}
+	}
+}
+
+// showLastSnatches from the history, most recent first.
+func showLastSnatches(e *Environment, number int, out commandOutput) error {
+	stats, err := NewStatsDB(filepath.Join(StatsDir, DefaultHistoryDB))
+	if err != nil {
+		return errors.Wrap(err, "could not access the stats database")
+	}
+	releases, err := stats.GetLastSnatches(number)
+	if err != nil {
+		if err == storm.ErrNotFound {
+			out.Info("Nothing has been snatched yet.")
+			return nil
+		}
+		return err
+	}
+	for _, r := range releases {
+		out.Info(fmt.Sprintf("%s | %s | %s: %s [%s]", r.Timestamp.Format("2006-01-02 15:04"), r.Tracker, r.TorrentID, r.ShortString(), r.Filter))
+	}
+	return nil
+}
+
+// showLastStats collected for all trackers with stats.
+func showLastStats(e *Environment, out commandOutput) error {
+	conf := currentConfig()
+	if !conf.statsConfigured {
+		return nil
+	}
+	stats, err := NewStatsDB(filepath.Join(StatsDir, DefaultHistoryDB))
+	if err != nil {
+		return errors.Wrap(err, "could not access the stats database")
+	}
+	for _, s := range conf.Stats {
+		lastStats, err := stats.GetLastCollected(s.Tracker, 1)
+		if err != nil || len(lastStats) == 0 {
+			out.Info("No stats collected yet for tracker " + s.Tracker + ".")
+			continue
+		}
+		out.Info(s.Tracker + ": " + lastStats[0].String())
+	}
+	return nil
+}
+
 func statusString(e *Environment) string {
 	// version
 	status := fmt.Sprintf(FullVersion+"\n", FullName, Version)
@@ -163,6 +277,12 @@ func statusString(e *Environment) string {
 		}
 	}
 
+	// subsystems
+	health := e.lifecycle.Health()
+	for _, name := range e.lifecycle.Names() {
+		status += "Subsystem " + name + ": " + health[name] + "\n"
+	}
+
 	// TODO last autosnatched release for tracker X: date
 	return status
 }
@@ -206,6 +326,7 @@ func RefreshMetadata(e *Environment, t *tracker.Gazelle, IDStrings []string) err
 	if len(IDStrings) == 0 {
 		return errors.New("Error: no ID provided")
 	}
+	conf := currentConfig()
 
 	stats, err := NewStatsDB(filepath.Join(StatsDir, DefaultHistoryDB))
 	if err != nil {
@@ -219,14 +340,14 @@ func RefreshMetadata(e *Environment, t *tracker.Gazelle, IDStrings []string) err
 		if err := stats.db.DB.Select(findIDsQuery).First(&found); err != nil {
 			if err == storm.ErrNotFound {
 				// not found, try to locate download directory nonetheless
-				if e.config.DownloadFolderConfigured {
+				if conf.DownloadFolderConfigured {
 					logthis.Info("Release not found in history, trying to locate in downloads directory.", logthis.NORMAL)
 					// get data from tracker
 					if err := info.LoadFromID(t, id); err != nil {
 						logthis.Error(errors.Wrap(err, errorCouldNotGetTorrentInfo), logthis.NORMAL)
 						break
 					}
-					fullFolder := filepath.Join(e.config.General.DownloadDir, info.FolderName)
+					fullFolder := filepath.Join(conf.General.DownloadDir, info.FolderName)
 					if fs.DirExists(fullFolder) {
 						if daemon.WasReborn() {
 							go info.SaveFromTracker(fullFolder, t)
@@ -252,7 +373,7 @@ func RefreshMetadata(e *Environment, t *tracker.Gazelle, IDStrings []string) err
 				logthis.Error(errors.Wrap(err, errorCouldNotGetTorrentInfo), logthis.NORMAL)
 				break
 			}
-			fullFolder := filepath.Join(e.config.General.DownloadDir, info.FolderName)
+			fullFolder := filepath.Join(conf.General.DownloadDir, info.FolderName)
 			if daemon.WasReborn() {
 				go info.SaveFromTracker(fullFolder, t)
 			} else {
@@ -294,6 +415,10 @@ func RefreshLibraryMetadata(path string, t *tracker.Gazelle, id string) error {
 
 // SnatchTorrents on a tracker using their TorrentIDs
 func SnatchTorrents(e *Environment, t *tracker.Gazelle, IDStrings []string, useFLToken bool) error {
+	return snatchTorrents(e, t, IDStrings, useFLToken, loggedOutput{})
+}
+
+func snatchTorrents(e *Environment, t *tracker.Gazelle, IDStrings []string, useFLToken bool, out commandOutput) error {
 	if len(IDStrings) == 0 {
 		return errors.New("Error: no ID provided")
 	}
@@ -304,9 +429,9 @@ func SnatchTorrents(e *Environment, t *tracker.Gazelle, IDStrings []string, useF
 			return errors.New("Error snatching torrent with ID #" + id)
 		}
 		if release.IsMusicRelease() {
-			logthis.Info("Successfully snatched torrent "+release.ShortString(), logthis.NORMAL)
+			out.Info("Successfully snatched torrent " + release.ShortString())
 		} else {
-			logthis.Info("Successfully snatched non-music torrent", logthis.NORMAL)
+			out.Info("Successfully snatched non-music torrent")
 		}
 	}
 	return nil
@@ -314,9 +439,14 @@ func SnatchTorrents(e *Environment, t *tracker.Gazelle, IDStrings []string, useF
 
 // ShowTorrentInfo of a list of releases on a tracker
 func ShowTorrentInfo(e *Environment, t *tracker.Gazelle, IDStrings []string) error {
+	return showTorrentInfo(e, t, IDStrings, loggedOutput{})
+}
+
+func showTorrentInfo(e *Environment, t *tracker.Gazelle, IDStrings []string, out commandOutput) error {
 	if len(IDStrings) == 0 {
 		return errors.New("Error: no ID provided")
 	}
+	conf := currentConfig()
 
 	stats, err := NewStatsDB(filepath.Join(StatsDir, DefaultHistoryDB))
 	if err != nil {
@@ -325,60 +455,60 @@ func ShowTorrentInfo(e *Environment, t *tracker.Gazelle, IDStrings []string) err
 
 	// get info
 	for _, id := range IDStrings {
-		logthis.Info(fmt.Sprintf("+ Info about %s / %s: \n", t.Name, id), logthis.NORMAL)
+		out.Info(fmt.Sprintf("+ Info about %s / %s: \n", t.Name, id))
 		// get release info from ID
 		info := &TrackerMetadata{}
 		if err := info.LoadFromID(t, id); err != nil {
-			logthis.Error(errors.Wrap(err, fmt.Sprintf("Could not get info about torrent %s on %s, may not exist", id, t.Name)), logthis.NORMAL)
+			out.Error(errors.Wrap(err, fmt.Sprintf("Could not get info about torrent %s on %s, may not exist", id, t.Name)))
 			continue
 		}
 		release := info.Release()
-		logthis.Info(info.TextDescription(true)+"\n", logthis.NORMAL)
+		out.Info(info.TextDescription(true) + "\n")
 
 		// find if in history
 		var found Release
 		if selectErr := stats.db.DB.Select(q.And(q.Eq("Tracker", t.Name), q.Eq("TorrentID", id))).First(&found); selectErr != nil {
-			logthis.Info("+ This torrent has not been snatched with varroa.", logthis.NORMAL)
+			out.Info("+ This torrent has not been snatched with varroa.")
 		} else {
-			logthis.Info("+ This torrent has been snatched with varroa.", logthis.NORMAL)
+			out.Info("+ This torrent has been snatched with varroa.")
 		}
 
 		// checking the files are still there (if snatched with or without varroa)
-		if e.config.DownloadFolderConfigured {
-			releaseFolder := filepath.Join(e.config.General.DownloadDir, info.FolderName)
+		if conf.DownloadFolderConfigured {
+			releaseFolder := filepath.Join(conf.General.DownloadDir, info.FolderName)
 			if fs.DirExists(releaseFolder) {
-				logthis.Info(fmt.Sprintf("Files seem to still be in the download directory: %s", releaseFolder), logthis.NORMAL)
+				out.Info(fmt.Sprintf("Files seem to still be in the download directory: %s", releaseFolder))
 				// TODO maybe display when the metadata was last updated?
 			} else {
-				logthis.Info("The files could not be found in the download directory.", logthis.NORMAL)
+				out.Info("The files could not be found in the download directory.")
 			}
 		}
 
 		// check and print if info/release triggers filters
-		autosnatchConfig, err := e.config.GetAutosnatch(t.Name)
+		autosnatchConfig, err := conf.GetAutosnatch(t.Name)
 		if err != nil {
-			logthis.Info("Cannot find autosnatch configuration for tracker "+t.Name, logthis.NORMAL)
+			out.Info("Cannot find autosnatch configuration for tracker " + t.Name)
 		} else {
-			logthis.Info("+ Showing autosnatch filters results for this release:\n", logthis.NORMAL)
-			for _, filter := range e.config.Filters {
+			out.Info("+ Showing autosnatch filters results for this release:\n")
+			for _, filter := range conf.Filters {
 				// checking if filter is specifically set for this tracker (if nothing is indicated, all trackers match)
 				if len(filter.Tracker) != 0 && !strslice.Contains(filter.Tracker, t.Name) {
-					logthis.Info(fmt.Sprintf(infoFilterIgnoredForTracker, filter.Name, t.Name), logthis.NORMAL)
+					out.Info(fmt.Sprintf(infoFilterIgnoredForTracker, filter.Name, t.Name))
 					continue
 				}
 				// checking if a filter is triggered
 				if release.Satisfies(filter) && release.HasCompatibleTrackerInfo(filter, autosnatchConfig.BlacklistedUploaders, info) {
 					// checking if duplicate
 					if !filter.AllowDuplicates && stats.AlreadySnatchedDuplicate(release) {
-						logthis.Info(filter.Name+": "+infoNotSnatchingDuplicate, logthis.NORMAL)
+						out.Info(filter.Name + ": " + infoNotSnatchingDuplicate)
 						continue
 					}
 					// checking if a torrent from the same group has already been downloaded
 					if filter.UniqueInGroup && stats.AlreadySnatchedFromGroup(release) {
-						logthis.Info(filter.Name+": "+infoNotSnatchingUniqueInGroup, logthis.NORMAL)
+						out.Info(filter.Name + ": " + infoNotSnatchingUniqueInGroup)
 						continue
 					}
-					logthis.Info(fmt.Sprintf(infoFilterTriggered, filter.Name), logthis.NORMAL)
+					out.Info(fmt.Sprintf(infoFilterTriggered, filter.Name))
 				}
 			}
 		}
@@ -574,8 +704,43 @@ func checkFreeDiskSpace(e *Environment) error {
 	return errors.New("download directory not configured")
 }
 
+// monitorSnatchedReleasesTask logs the error instead of returning it, for the scheduler.
+func monitorSnatchedReleasesTask(e *Environment) {
+	if err := MonitorSnatchedReleases(e); err != nil {
+		logthis.Error(errors.Wrap(err, errorMonitoringSnatched), logthis.NORMAL)
+	}
+}
+
 // automatedTasks is a list of cronjobs for maintenance, backup, or non-critical operations
-func automatedTasks(e *Environment) {
+// schedulerSubsystem runs the periodic maintenance tasks.
+type schedulerSubsystem struct {
+	e         *Environment
+	scheduler *gocron.Scheduler
+	stopped   chan bool
+}
+
+func (ss *schedulerSubsystem) Name() string {
+	return subsystemScheduler
+}
+
+func (ss *schedulerSubsystem) Start(ctx context.Context) error {
+	ss.scheduler = automatedTasks(ss.e)
+	ss.stopped = ss.scheduler.Start()
+	return nil
+}
+
+func (ss *schedulerSubsystem) Stop(ctx context.Context) error {
+	ss.stopped <- true
+	ss.scheduler.Clear()
+	return nil
+}
+
+func (ss *schedulerSubsystem) Health() error {
+	return nil
+}
+
+// automatedTasks scheduled periodically.
+func automatedTasks(e *Environment) *gocron.Scheduler {
 	// new scheduler
 	s := gocron.NewScheduler()
 
@@ -608,6 +773,9 @@ func automatedTasks(e *Environment) {
 	}
 	// 5. update database stats
 	s.Every(1).Day().At("00:05").Do(GenerateStats, e)
-	// launch scheduler
-	<-s.Start()
+	// 6. check snatched releases for changes on the trackers
+	if e.config.General.MonitorSnatchedPeriodHour != 0 {
+		s.Every(uint64(e.config.General.MonitorSnatchedPeriodHour)).Hours().Do(monitorSnatchedReleasesTask, e)
+	}
+	return s
 }
@@ -14,6 +14,7 @@ import (
 )
 
 var config *Config
+var configMutex sync.RWMutex
 var onceConfig sync.Once
 
 type Config struct {
@@ -34,10 +35,12 @@ type Config struct {
 	webserverHTTP               bool
 	webserverHTTPS              bool
 	webserverMetadata           bool
+	webserverSorting            bool
 	gitlabPagesConfigured       bool
 	pushoverConfigured          bool
 	ircNotifsConfigured         bool
 	webhooksConfigured          bool
+	desktopNotifsConfigured     bool
 	DownloadFolderConfigured    bool
 	LibraryConfigured           bool
 	playlistDirectoryConfigured bool
@@ -49,35 +52,54 @@ type Config struct {
 func NewConfig(path string) (*Config, error) {
 	var newConfigErr error
 	onceConfig.Do(func() {
-		// TODO check path has yamlExt!
-		newConf := &Config{}
-		encryptedConfigurationFile := strings.TrimSuffix(path, yamlExt) + encryptedExt
-		if fs.FileExists(encryptedConfigurationFile) && !fs.FileExists(path) {
-			// if using encrypted config file, ask for the passphrase and retrieve it from the daemon side
-			passphraseBytes, err := SavePassphraseForDaemon()
-			if err != nil {
-				newConfigErr = err
-				return
-			}
-			configBytes, err := decrypt(encryptedConfigurationFile, passphraseBytes)
-			if err != nil {
-				newConfigErr = err
-				return
-			}
-			if err := newConf.LoadFromBytes(configBytes); err != nil {
-				newConfigErr = err
-				return
-			}
-		} else {
-			if err := newConf.Load(path); err != nil {
-				newConfigErr = err
-				return
-			}
+		newConf, err := readConfig(path)
+		if err != nil {
+			newConfigErr = err
+			return
 		}
 		// set the global pointer once everything is OK.
-		config = newConf
+		setCurrentConfig(newConf)
 	})
-	return config, newConfigErr
+	return currentConfig(), newConfigErr
+}
+
+// currentConfig loaded by NewConfig, or by reloading the configuration.
+func currentConfig() *Config {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config
+}
+
+func setCurrentConfig(c *Config) {
+	configMutex.Lock()
+	config = c
+	configMutex.Unlock()
+}
+
+// readConfig and check it, whether the configuration file is encrypted or not.
+func readConfig(path string) (*Config, error) {
+	// TODO check path has yamlExt!
+	newConf := &Config{}
+	encryptedConfigurationFile := strings.TrimSuffix(path, yamlExt) + encryptedExt
+	if fs.FileExists(encryptedConfigurationFile) && !fs.FileExists(path) {
+		// if using encrypted config file, ask for the passphrase and retrieve it from the daemon side
+		passphraseBytes, err := SavePassphraseForDaemon()
+		if err != nil {
+			return nil, err
+		}
+		configBytes, err := decrypt(encryptedConfigurationFile, passphraseBytes)
+		if err != nil {
+			return nil, err
+		}
+		if err := newConf.LoadFromBytes(configBytes); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := newConf.Load(path); err != nil {
+			return nil, err
+		}
+	}
+	return newConf, nil
 }
 
 func (c *Config) String() string {
@@ -106,6 +128,9 @@ func (c *Config) String() string {
 	if c.webhooksConfigured {
 		txt += c.Notifications.WebHooks.String() + "\n"
 	}
+	if c.desktopNotifsConfigured {
+		txt += c.Notifications.Desktop.String() + "\n"
+	}
 	if c.gitlabPagesConfigured {
 		txt += c.GitlabPages.String() + "\n"
 	}
@@ -195,6 +220,12 @@ func (c *Config) check() error {
 			return errors.Wrap(err, "Error reading webhooks configuration")
 		}
 	}
+	// desktop notifications checks
+	if c.Notifications != nil && c.Notifications.Desktop != nil {
+		if err := c.Notifications.Desktop.check(); err != nil {
+			return errors.Wrap(err, "Error reading desktop notifications configuration")
+		}
+	}
 	// gitlab checks
 	if c.GitlabPages != nil {
 		if err := c.GitlabPages.check(); err != nil {
@@ -234,6 +265,7 @@ func (c *Config) check() error {
 	c.pushoverConfigured = c.Notifications != nil && c.Notifications.Pushover != nil
 	c.ircNotifsConfigured = c.Notifications != nil && c.Notifications.Irc != nil
 	c.webhooksConfigured = c.Notifications != nil && c.Notifications.WebHooks != nil
+	c.desktopNotifsConfigured = c.Notifications != nil && c.Notifications.Desktop != nil
 	c.DownloadFolderConfigured = c.General.DownloadDir != ""
 	c.webserverHTTP = c.webserverConfigured && c.WebServer.PortHTTP != 0
 	c.webserverHTTPS = c.webserverConfigured && c.WebServer.PortHTTPS != 0
@@ -241,6 +273,8 @@ func (c *Config) check() error {
 	c.playlistDirectoryConfigured = c.LibraryConfigured && c.Library.PlaylistDirectory != ""
 	c.mpdConfigured = c.MPD != nil
 	c.webserverMetadata = c.DownloadFolderConfigured && c.webserverConfigured && c.WebServer.ServeMetadata
+	// sorting from the web interface can move files around, it requires authentication
+	c.webserverSorting = c.webserverMetadata && c.LibraryConfigured && c.WebServer.AllowDownloads && c.WebServer.Password != ""
 	c.metadataConfigured = c.Metadata != nil
 	c.discogsTokenConfigured = c.metadataConfigured && c.Metadata.DiscogsToken != ""
 
@@ -281,9 +315,11 @@ func (c *Config) check() error {
 	}
 	if c.webhooksConfigured {
 		// check all webhook trackers point to defined Trackers
-		for _, a := range c.Notifications.WebHooks.Trackers {
-			if !strslice.Contains(configuredTrackers, a) {
-				return fmt.Errorf("stats enabled, but tracker %s undefined", a)
+		for _, wh := range c.Notifications.WebHooks.all() {
+			for _, a := range wh.Trackers {
+				if !strslice.Contains(configuredTrackers, a) {
+					return fmt.Errorf("webhook %s enabled, but tracker %s undefined", wh.Name, a)
+				}
 			}
 		}
 	}
@@ -34,7 +34,7 @@ func GetPassphrase() (string, error) {
 func SavePassphraseForDaemon() ([]byte, error) {
 	var passphrase string
 	var err error
-	if !daemon.WasReborn() {
+	if !daemon.WasReborn() && os.Getenv(envPassphrase) == "" {
 		// if necessary, ask for passphrase and add to env
 		passphrase, err = GetPassphrase()
 		if err != nil {
@@ -45,7 +45,7 @@ func SavePassphraseForDaemon() ([]byte, error) {
 			return []byte{}, errors.Wrap(err, errorSettingEnv)
 		}
 	} else {
-		// getting passphrase from env if necessary
+		// getting passphrase from env if necessary, or if it is already known when reloading the configuration
 		passphrase = os.Getenv(envPassphrase)
 	}
 	if passphrase == "" {
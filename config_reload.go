@@ -0,0 +1,139 @@
+package varroa
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sevlyar/go-daemon"
+	"gitlab.com/catastrophic/assistance/logthis"
+	"gitlab.com/catastrophic/assistance/strslice"
+)
+
+const (
+	reloadCommand        = "reload"
+	errorReloadingConfig = "Error reloading configuration, keeping the current one"
+)
+
+// subsystemChanges between two configurations, by subsystem name.
+type subsystemChanges struct {
+	added     []string
+	removed   []string
+	restarted []string
+}
+
+// autosnatchFor a tracker, or nil.
+func (c *Config) autosnatchFor(label string) *ConfigAutosnatch {
+	for _, as := range c.Autosnatch {
+		if as.Tracker == label {
+			return as
+		}
+	}
+	return nil
+}
+
+// compareSubsystems to find out which subsystems need to be started, stopped or restarted for the new configuration.
+func compareSubsystems(old, new *Config) subsystemChanges {
+	var changes subsystemChanges
+	compare := func(name string, wasConfigured, isConfigured, changed bool) {
+		switch {
+		case !wasConfigured && isConfigured:
+			changes.added = append(changes.added, name)
+		case wasConfigured && !isConfigured:
+			changes.removed = append(changes.removed, name)
+		case wasConfigured && changed:
+			changes.restarted = append(changes.restarted, name)
+		}
+	}
+	// the IRC connection sending notifications and receiving commands has to be restarted if its settings change
+	ircNotificationsChanged := old.ircNotifsConfigured != new.ircNotifsConfigured || old.ircNotifsConfigured && !reflect.DeepEqual(old.Notifications.Irc, new.Notifications.Irc)
+	for _, label := range new.TrackerLabels() {
+		oldAutosnatch, newAutosnatch := old.autosnatchFor(label), new.autosnatchFor(label)
+		changed := !reflect.DeepEqual(oldAutosnatch, newAutosnatch)
+		if ircNotificationsChanged && (old.ircNotifsConfigured && old.Notifications.Irc.Tracker == label || new.ircNotifsConfigured && new.Notifications.Irc.Tracker == label) {
+			changed = true
+		}
+		compare(subsystemIRCPrefix+label, oldAutosnatch != nil, newAutosnatch != nil, changed)
+	}
+	compare(subsystemStats, old.statsConfigured, new.statsConfigured, !reflect.DeepEqual(old.Stats, new.Stats) || !reflect.DeepEqual(old.GitlabPages, new.GitlabPages))
+	// the pages served depend on the library and download directory configuration
+	webServerChanged := !reflect.DeepEqual(old.WebServer, new.WebServer) || old.webserverMetadata != new.webserverMetadata || old.webserverSorting != new.webserverSorting || !reflect.DeepEqual(old.Library, new.Library)
+	compare(subsystemWebServer, old.webserverConfigured, new.webserverConfigured, webServerChanged)
+	// the downloads database is opened once, with the directories it was first given
+	compare(subsystemDownloads, old.webserverMetadata, new.webserverMetadata, false)
+	compare(subsystemScheduler, true, true, !reflect.DeepEqual(old.General, new.General) || !reflect.DeepEqual(old.GitlabPages, new.GitlabPages))
+	return changes
+}
+
+// ReloadConfiguration from disk, swapping it with the current one if it is valid, and restarting only the subsystems
+// whose settings have changed.
+func ReloadConfiguration(e *Environment) error {
+	newConf, err := readConfig(DefaultConfigurationFile)
+	// checking the configuration sets the output, the daemon only logs to its file
+	if daemon.WasReborn() {
+		logthis.SetStdOutput(false)
+	}
+	if err != nil {
+		return errors.Wrap(err, errorReloadingConfig)
+	}
+	// logging in new or modified trackers would require setting up everything again
+	if !reflect.DeepEqual(e.config.Trackers, newConf.Trackers) {
+		return errors.New(errorReloadingConfig + ": tracker changes require restarting the daemon")
+	}
+
+	oldConf := e.swapConfiguration(newConf)
+	logthis.Info("Configuration reloaded.", logthis.NORMAL)
+
+	if err := e.applyConfiguration(); err != nil {
+		logthis.Error(errors.Wrap(err, "Error applying new configuration"), logthis.NORMAL)
+	}
+	// starting, stopping and restarting subsystems
+	changes := compareSubsystems(oldConf, newConf)
+	configured := e.configuredSubsystems()
+	var failed []string
+	for _, s := range configured {
+		var err error
+		switch {
+		case strslice.Contains(changes.added, s.Name()):
+			err = e.lifecycle.Add(s)
+		case strslice.Contains(changes.restarted, s.Name()):
+			err = e.lifecycle.Replace(s)
+		default:
+			continue
+		}
+		if err != nil {
+			logthis.Error(err, logthis.NORMAL)
+			failed = append(failed, s.Name())
+		} else {
+			logthis.Info("Applied new configuration to "+s.Name()+".", logthis.NORMAL)
+		}
+	}
+	for _, name := range changes.removed {
+		if err := e.lifecycle.Remove(name); err != nil {
+			logthis.Error(err, logthis.NORMAL)
+			failed = append(failed, name)
+		} else {
+			logthis.Info("Stopped "+name+", it is no longer configured.", logthis.NORMAL)
+		}
+	}
+	if len(failed) != 0 {
+		return errors.New("Configuration reloaded, but could not apply it to: " + strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// swapConfiguration replaces the configuration in use, and returns the previous one.
+func (e *Environment) swapConfiguration(newConf *Config) *Config {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	// keeping the autosnatching state
+	for _, as := range newConf.Autosnatch {
+		if previous := e.config.autosnatchFor(as.Tracker); previous != nil {
+			as.disabledAutosnatching = previous.disabledAutosnatching
+		}
+	}
+	oldConf := e.config
+	e.config = newConf
+	setCurrentConfig(newConf)
+	return oldConf
+}
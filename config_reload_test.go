@@ -0,0 +1,68 @@
+package varroa
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigReload(t *testing.T) {
+	fmt.Println("+ Testing Config/reload...")
+	check := assert.New(t)
+
+	check.Nil(os.Mkdir("library", 0777))
+	defer os.Remove("library")
+
+	current := &Config{}
+	check.Nil(current.Load("test/test_complete.yaml"))
+	load := func() *Config {
+		c := &Config{}
+		check.Nil(c.Load("test/test_complete.yaml"))
+		return c
+	}
+
+	// nothing changed
+	check.Equal(subsystemChanges{}, compareSubsystems(current, load()))
+
+	// filters and notifications other than IRC do not require restarts
+	modified := load()
+	modified.Filters = modified.Filters[:1]
+	modified.Notifications.Pushover.User = "someone else"
+	check.Equal(subsystemChanges{}, compareSubsystems(current, modified))
+
+	// stats
+	modified = load()
+	modified.Stats[0].UpdatePeriodH = 2
+	check.Equal(subsystemChanges{restarted: []string{subsystemStats}}, compareSubsystems(current, modified))
+
+	// IRC notifications are sent from the IRC connection of their tracker
+	modified = load()
+	modified.Notifications.Irc.User = "other_irc_name"
+	check.Equal(subsystemChanges{restarted: []string{subsystemIRCPrefix + "blue"}}, compareSubsystems(current, modified))
+
+	// autosnatching
+	modified = load()
+	modified.Autosnatch = modified.Autosnatch[:1]
+	modified.Autosnatch[0].BotName = "other_bot"
+	check.Equal(subsystemChanges{removed: []string{subsystemIRCPrefix + "purple"}, restarted: []string{subsystemIRCPrefix + "blue"}}, compareSubsystems(current, modified))
+	check.Equal(subsystemChanges{added: []string{subsystemIRCPrefix + "purple"}, restarted: []string{subsystemIRCPrefix + "blue"}}, compareSubsystems(modified, current))
+
+	// web server and scheduler
+	modified = load()
+	modified.WebServer.ServeMetadata = false
+	modified.General.MonitorSnatchedPeriodHour = 12
+	check.Equal(subsystemChanges{restarted: []string{subsystemWebServer, subsystemScheduler}}, compareSubsystems(current, modified))
+	modified.webserverConfigured = false
+	check.Equal(subsystemChanges{removed: []string{subsystemWebServer}, restarted: []string{subsystemScheduler}}, compareSubsystems(current, modified))
+
+	// an invalid configuration is not applied
+	e := NewEnvironment()
+	e.config = current
+	err := ReloadConfiguration(e)
+	check.NotNil(err)
+	check.True(strings.HasPrefix(err.Error(), errorReloadingConfig))
+	check.Equal(current, e.config)
+}
@@ -3,8 +3,11 @@ package varroa
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -31,6 +34,7 @@ type ConfigGeneral struct {
 	AutomaticMetadataRetrieval bool   `yaml:"automatic_metadata_retrieval"`
 	FullMetadataRetrieval      bool   `yaml:"full_metadata_retrieval"`
 	TimestampedLogs            bool   `yaml:"timestamped_logs"`
+	MonitorSnatchedPeriodHour  int    `yaml:"monitor_snatched_period_hour"`
 }
 
 func (cg *ConfigGeneral) check() error {
@@ -46,6 +50,12 @@ func (cg *ConfigGeneral) check() error {
 	if (cg.AutomaticMetadataRetrieval || cg.FullMetadataRetrieval) && cg.DownloadDir == "" {
 		return errors.New("downloads directory must be defined to allow metadata retrieval")
 	}
+	if cg.MonitorSnatchedPeriodHour < 0 {
+		return errors.New("period for monitoring snatched releases must be positive")
+	}
+	if cg.MonitorSnatchedPeriodHour != 0 && cg.DownloadDir == "" {
+		return errors.New("downloads directory must be defined to monitor snatched releases")
+	}
 	return nil
 }
 
@@ -58,6 +68,9 @@ func (cg *ConfigGeneral) String() string {
 	txt += "\tDownload directory: " + cg.DownloadDir + "\n"
 	txt += "\tDownload metadata automatically: " + fmt.Sprintf("%v", cg.AutomaticMetadataRetrieval) + "\n"
 	txt += "\tDownload all related metadata: " + fmt.Sprintf("%v", cg.FullMetadataRetrieval) + "\n"
+	if cg.MonitorSnatchedPeriodHour != 0 {
+		txt += "\tMonitor snatched releases every: " + strconv.Itoa(cg.MonitorSnatchedPeriodHour) + "h\n"
+	}
 	return txt
 }
 
@@ -175,12 +188,19 @@ type ConfigLibrary struct {
 	MoveSorted        bool                `yaml:"move_sorted"`
 	AutomaticMode     bool                `yaml:"automatic_mode"`
 	Template          string              `yaml:"folder_template"`
+	Templates         map[string]string   `yaml:"folder_templates"`
+	TrackTemplate     string              `yaml:"music_file_template"`
+	WriteTags         bool                `yaml:"write_tags"`
+	EmbedCover        bool                `yaml:"embed_cover"`
 	AdditionalSources []string            `yaml:"additional_source_directories"`
 	AliasesFile       string              `yaml:"aliases_file"`
 	Aliases           map[string][]string `yaml:"-"`
 	CategoriesFile    string              `yaml:"categories_file"`
 	Categories        map[string][]string `yaml:"-"`
 	PlaylistDirectory string              `yaml:"playlist_directory"`
+	ConflictStrategy  string              `yaml:"on_conflict"`
+	TrashDirectory    string              `yaml:"trash_directory"`
+	SortRules         []*ConfigSortRule   `yaml:"sort_rules"`
 }
 
 func (cl *ConfigLibrary) check() error {
@@ -224,6 +244,39 @@ func (cl *ConfigLibrary) check() error {
 	if cl.UseHardLinks && cl.MoveSorted {
 		return errors.New("using hard links and moving sorted downloads are incompatible options")
 	}
+	if _, err := checkFolderTemplate(cl.Template); err != nil {
+		return errors.Wrap(err, "invalid folder template")
+	}
+	for key, t := range cl.Templates {
+		if _, err := checkFolderTemplate(t); err != nil {
+			return errors.Wrap(err, "invalid folder template for "+key)
+		}
+	}
+	if _, err := checkTrackTemplate(cl.TrackTemplate); err != nil {
+		return errors.Wrap(err, "invalid music file template")
+	}
+	if cl.EmbedCover && !cl.WriteTags {
+		return errors.New("embedding covers requires writing tags")
+	}
+	if cl.ConflictStrategy == "" {
+		cl.ConflictStrategy = conflictFail
+	}
+	if !strslice.Contains(conflictStrategies, cl.ConflictStrategy) {
+		return errors.New("unknown conflict strategy, must be among: " + strings.Join(conflictStrategies, ", "))
+	}
+	if cl.TrashDirectory == "" {
+		cl.TrashDirectory = filepath.Join(cl.Directory, libraryTrashDir)
+	}
+	var ruleNames []string
+	for _, r := range cl.SortRules {
+		if err := r.check(); err != nil {
+			return errors.Wrap(err, "invalid sort rule")
+		}
+		if strslice.Contains(ruleNames, r.Name) {
+			return errors.New("sort rule names must be unique: " + r.Name)
+		}
+		ruleNames = append(ruleNames, r.Name)
+	}
 	return nil
 }
 
@@ -241,13 +294,52 @@ func (cl *ConfigLibrary) loadMap(path string) (*map[string][]string, error) {
 	return &m, nil
 }
 
+// folderTemplate for a release, depending on its category or release type.
+func (cl *ConfigLibrary) folderTemplate(info *TrackerMetadata) string {
+	if t, ok := cl.Templates[info.Category]; ok {
+		return t
+	}
+	if t, ok := cl.Templates[info.ReleaseType]; ok {
+		return t
+	}
+	return cl.Template
+}
+
+// templateExample with sample metadata, for checking templates.
+func templateExample(userTemplate string, check func(string) (string, error)) string {
+	if userTemplate == "" {
+		return ""
+	}
+	example, err := check(userTemplate)
+	if err != nil {
+		return userTemplate + " (" + err.Error() + ")"
+	}
+	return userTemplate + " (example: " + example + ")"
+}
+
 func (cl *ConfigLibrary) String() string {
 	txt := "Library configuration:\n"
 	txt += "\tDirectory: " + cl.Directory + "\n"
 	txt += "\tUse hard links: " + fmt.Sprintf("%v", cl.UseHardLinks) + "\n"
 	txt += "\tMove sorted downloads: " + fmt.Sprintf("%v", cl.MoveSorted) + "\n"
 	txt += "\tAutomatic (non-interactive) mode: " + fmt.Sprintf("%v", cl.AutomaticMode) + "\n"
-	txt += "\tTemplate: " + cl.Template + "\n"
+	txt += "\tTemplate: " + templateExample(cl.Template, checkFolderTemplate) + "\n"
+	var keys []string
+	for key := range cl.Templates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		txt += "\tTemplate for " + key + ": " + templateExample(cl.Templates[key], checkFolderTemplate) + "\n"
+	}
+	txt += "\tMusic file template: " + templateExample(cl.TrackTemplate, checkTrackTemplate) + "\n"
+	txt += "\tWrite tags: " + fmt.Sprintf("%v", cl.WriteTags) + "\n"
+	txt += "\tEmbed cover: " + fmt.Sprintf("%v", cl.EmbedCover) + "\n"
+	txt += "\tOn conflict: " + cl.ConflictStrategy + "\n"
+	txt += "\tTrash directory: " + cl.TrashDirectory + "\n"
+	for _, r := range cl.SortRules {
+		txt += r.String()
+	}
 	if len(cl.AdditionalSources) != 0 {
 		txt += "\tAdditional sources: " + strings.Join(cl.AdditionalSources, ",") + "\n"
 	}
@@ -262,6 +354,95 @@ func (cl *ConfigLibrary) String() string {
 	return txt
 }
 
+// ConfigSortRule decides how downloads matching all of its criteria are sorted, instead of asking.
+type ConfigSortRule struct {
+	Name       string   `yaml:"name"`
+	Filter     []string `yaml:"filter"`
+	Tags       []string `yaml:"tags"`
+	Artist     []string `yaml:"artist"`
+	Format     []string `yaml:"format"`
+	Quality    []string `yaml:"quality"`
+	Source     []string `yaml:"source"`
+	MinSizeMB  int      `yaml:"min_size_mb"`
+	MaxSizeMB  int      `yaml:"max_size_mb"`
+	Decision   string   `yaml:"decision"`
+	MainArtist string   `yaml:"main_artist"`
+	Alias      string   `yaml:"alias"`
+	Category   string   `yaml:"category"`
+}
+
+func (cr *ConfigSortRule) check() error {
+	if cr.Name == "" {
+		return errors.New("missing sort rule name")
+	}
+	if !strslice.Contains(sortRuleDecisions, cr.Decision) {
+		return errors.New("unknown decision for sort rule " + cr.Name + ", must be among: " + strings.Join(sortRuleDecisions, ", "))
+	}
+	if cr.Decision != sortRuleAccept && (cr.MainArtist != "" || cr.Alias != "" || cr.Category != "") {
+		return errors.New("main artist, alias and category are only relevant for accepted downloads, in sort rule " + cr.Name)
+	}
+	if cr.MaxSizeMB < 0 || cr.MinSizeMB < 0 {
+		return errors.New("minimum and maximum sizes must not be negative, in sort rule " + cr.Name)
+	}
+	if cr.MaxSizeMB > 0 && cr.MinSizeMB >= cr.MaxSizeMB {
+		return errors.New("minimum release size must be lower than maximum release size, in sort rule " + cr.Name)
+	}
+	for _, r := range cr.Format {
+		if !strslice.Contains(tracker.KnownFormats, r) {
+			return errors.New("unknown format " + r + ", acceptable values: " + strings.Join(tracker.KnownFormats, ", "))
+		}
+	}
+	for _, r := range cr.Source {
+		if !strslice.Contains(tracker.KnownSources, r) {
+			return errors.New("unknown source " + r + ", acceptable values: " + strings.Join(tracker.KnownSources, ", "))
+		}
+	}
+	for _, r := range cr.Quality {
+		if !strslice.Contains(tracker.KnownQualities, r) {
+			return errors.New("unknown quality " + r + ", acceptable values: " + strings.Join(tracker.KnownQualities, ", "))
+		}
+	}
+	return nil
+}
+
+func (cr *ConfigSortRule) String() string {
+	txt := "\tSort rule " + cr.Name + ": " + cr.Decision + "\n"
+	if len(cr.Filter) != 0 {
+		txt += "\t - Filter(s): " + strings.Join(cr.Filter, ", ") + "\n"
+	}
+	if len(cr.Tags) != 0 {
+		txt += "\t - Tag(s): " + strings.Join(cr.Tags, ", ") + "\n"
+	}
+	if len(cr.Artist) != 0 {
+		txt += "\t - Artist(s): " + strings.Join(cr.Artist, ", ") + "\n"
+	}
+	if len(cr.Format) != 0 {
+		txt += "\t - Format(s): " + strings.Join(cr.Format, ", ") + "\n"
+	}
+	if len(cr.Quality) != 0 {
+		txt += "\t - Quality: " + strings.Join(cr.Quality, ", ") + "\n"
+	}
+	if len(cr.Source) != 0 {
+		txt += "\t - Source(s): " + strings.Join(cr.Source, ", ") + "\n"
+	}
+	if cr.MinSizeMB != 0 {
+		txt += "\t - Minimum Size: " + strconv.Itoa(cr.MinSizeMB) + "\n"
+	}
+	if cr.MaxSizeMB != 0 {
+		txt += "\t - Maximum Size: " + strconv.Itoa(cr.MaxSizeMB) + "\n"
+	}
+	if cr.MainArtist != "" {
+		txt += "\t - Main artist: " + cr.MainArtist + "\n"
+	}
+	if cr.Alias != "" {
+		txt += "\t - Main artist alias: " + cr.Alias + "\n"
+	}
+	if cr.Category != "" {
+		txt += "\t - Category: " + cr.Category + "\n"
+	}
+	return txt
+}
+
 type ConfigStats struct {
 	Tracker             string
 	UpdatePeriodH       int     `yaml:"update_period_hour"`
@@ -315,24 +496,40 @@ type ConfigWebServer struct {
 	PortHTTP       int    `yaml:"http_port"`
 	PortHTTPS      int    `yaml:"https_port"`
 	Hostname       string `yaml:"https_hostname"`
+	CertFile       string `yaml:"cert_file"`
+	KeyFile        string `yaml:"key_file"`
+	ClientCAFile   string `yaml:"client_ca_file"`
+	// brute-force protection
+	RateLimit       int                    `yaml:"rate_limit_per_minute"`
+	MaxFailedAuth   int                    `yaml:"max_failed_auth"`
+	AllowedNetworks *ConfigAllowedNetworks `yaml:"allowed_networks"`
 }
 
 func (cw *ConfigWebServer) check() error {
 	if !cw.ServeStats && !cw.AllowDownloads && !cw.ServeMetadata {
 		return errors.New("Webserver configured, but not serving stats or allowing remote downloads")
 	}
-	if cw.AllowDownloads && cw.Token == "" {
-		return errors.New("A user-defined token must be configured to allow remove downloads")
-	}
+	// without a user-defined token, remote downloads require tokens created with 'varroa token create'
 	if cw.PortHTTP == 0 && cw.PortHTTPS == 0 {
 		return errors.New("HTTP and/or HTTPS port(s) must be configured")
 	}
 	if cw.PortHTTPS == cw.PortHTTP {
 		return errors.New("HTTP and/or HTTPS port(s) must be different")
 	}
-	// TODO NOT TRUE if the user provides the certificates...
-	if cw.PortHTTPS != 0 && cw.Hostname == "" {
-		return errors.New("HTTPS server requires a hostname")
+	if cw.CertFile != "" && cw.KeyFile == "" || cw.CertFile == "" && cw.KeyFile != "" {
+		return errors.New("If providing a certificate, both certificate & key files must be provided")
+	}
+	for _, file := range []string{cw.CertFile, cw.KeyFile, cw.ClientCAFile} {
+		if file != "" && !fs.FileExists(file) {
+			return errors.New("File " + file + " does not exist")
+		}
+	}
+	// the hostname is only used to generate a self-signed certificate
+	if cw.PortHTTPS != 0 && cw.CertFile == "" && cw.Hostname == "" {
+		return errors.New("HTTPS server requires a hostname, or a certificate")
+	}
+	if cw.ClientCAFile != "" && cw.PortHTTPS == 0 {
+		return errors.New("Checking client certificates requires an HTTPS port")
 	}
 	if cw.Password != "" && cw.User == "" || cw.Password == "" && cw.User != "" {
 		return errors.New("If password-protecting the stats webserver, both user & password must be provided")
@@ -343,6 +540,16 @@ func (cw *ConfigWebServer) check() error {
 	if !strslice.Contains(knownThemeNames, cw.Theme) {
 		return errors.New("Unknown theme name")
 	}
+	// negative values disable rate limiting or lockouts
+	if cw.RateLimit == 0 {
+		cw.RateLimit = defaultRateLimitPerMinute
+	}
+	if cw.MaxFailedAuth == 0 {
+		cw.MaxFailedAuth = defaultMaxFailedAuth
+	}
+	if cw.AllowedNetworks != nil {
+		return cw.AllowedNetworks.check()
+	}
 	return nil
 }
 
@@ -358,6 +565,61 @@ func (cw *ConfigWebServer) String() string {
 	txt += "\tHTTP port: " + strconv.Itoa(cw.PortHTTP) + "\n"
 	txt += "\tHTTPS port: " + strconv.Itoa(cw.PortHTTPS) + "\n"
 	txt += "\tHostname: " + cw.Hostname + "\n"
+	txt += "\tCertificate file: " + cw.CertFile + "\n"
+	txt += "\tKey file: " + cw.KeyFile + "\n"
+	txt += "\tClient CA file: " + cw.ClientCAFile + "\n"
+	txt += "\tRate limit (requests/minute): " + strconv.Itoa(cw.RateLimit) + "\n"
+	txt += "\tFailed authentications before lockout: " + strconv.Itoa(cw.MaxFailedAuth) + "\n"
+	if cw.AllowedNetworks != nil {
+		txt += cw.AllowedNetworks.String()
+	}
+	return txt
+}
+
+// ConfigAllowedNetworks lists the CIDR ranges allowed to reach each group of endpoints. Empty lists allow everyone.
+type ConfigAllowedNetworks struct {
+	Downloads []string
+	API       []string
+	Pages     []string
+	downloads []*net.IPNet
+	api       []*net.IPNet
+	pages     []*net.IPNet
+}
+
+func (can *ConfigAllowedNetworks) check() error {
+	parse := func(ranges []string) ([]*net.IPNet, error) {
+		var networks []*net.IPNet
+		for _, r := range ranges {
+			_, network, err := net.ParseCIDR(r)
+			if err != nil {
+				return nil, errors.New("Invalid CIDR range " + r)
+			}
+			networks = append(networks, network)
+		}
+		return networks, nil
+	}
+	var err error
+	if can.downloads, err = parse(can.Downloads); err != nil {
+		return err
+	}
+	if can.api, err = parse(can.API); err != nil {
+		return err
+	}
+	can.pages, err = parse(can.Pages)
+	return err
+}
+
+func (can *ConfigAllowedNetworks) String() string {
+	allowed := func(ranges []string) string {
+		if len(ranges) == 0 {
+			return "all"
+		}
+		return strings.Join(ranges, ", ")
+	}
+	txt := "\tAllowed networks:\n"
+	txt += "\t\tDownloads: " + allowed(can.Downloads) + "\n"
+	txt += "\t\tAPI: " + allowed(can.API) + "\n"
+	txt += "\t\tPages: " + allowed(can.Pages) + "\n"
 	return txt
 }
 
@@ -365,6 +627,7 @@ type ConfigNotifications struct {
 	Pushover *ConfigPushover
 	WebHooks *WebHooksConfig
 	Irc      *ConfigIRC
+	Desktop  *ConfigDesktop
 }
 
 type ConfigPushover struct {
@@ -391,43 +654,155 @@ func (cp *ConfigPushover) String() string {
 	return txt
 }
 
-type WebHooksConfig struct {
+type ConfigDesktop struct {
+	ExpireSeconds int  `yaml:"expire_seconds"`
+	ShowCovers    bool `yaml:"show_covers"`
+}
+
+func (cd *ConfigDesktop) check() error {
+	if cd.ExpireSeconds < 0 {
+		return errors.New("Desktop notifications expiration must be positive")
+	}
+	return nil
+}
+
+func (cd *ConfigDesktop) String() string {
+	txt := "Desktop notifications configuration:\n"
+	txt += "\tExpire after (s): " + strconv.Itoa(cd.ExpireSeconds) + "\n"
+	txt += "\tShow covers: " + fmt.Sprintf("%v", cd.ShowCovers) + "\n"
+	return txt
+}
+
+type ConfigWebHook struct {
+	Name     string
 	Address  string
 	Token    string
+	Secret   string
 	Trackers []string
+	Events   []string
 }
 
-func (whc *WebHooksConfig) check() error {
+func (cwh *ConfigWebHook) check() error {
 	// TODO check address format!
-	if whc.Address == "" {
+	if cwh.Address == "" {
 		return errors.New("Webhook configuration must provide remote server address")
 	}
-	if whc.Token == "" {
-		return errors.New("Webhook configuration must provide a token for the remote server")
+	if cwh.Token == "" && cwh.Secret == "" {
+		return errors.New("Webhook configuration must provide a token or a signing secret for the remote server")
 	}
-	if len(whc.Trackers) == 0 {
+	if len(cwh.Trackers) == 0 {
 		return errors.New("Webhook configuration must provide the list of relevant trackers")
 	}
+	for _, ev := range cwh.Events {
+		if !strslice.Contains(knownNotificationEvents, ev) {
+			return errors.New("unknown webhook event " + ev + ", acceptable values: " + strings.Join(knownNotificationEvents, ", "))
+		}
+	}
 	return nil
 }
 
+// signingKey used for the HMAC signature of the payload, the shared token is used if no secret was defined.
+func (cwh *ConfigWebHook) signingKey() string {
+	if cwh.Secret != "" {
+		return cwh.Secret
+	}
+	return cwh.Token
+}
+
+// accepts an event for a given tracker if it is relevant to this endpoint.
+func (cwh *ConfigWebHook) accepts(tracker, event string) bool {
+	if !strslice.Contains(cwh.Trackers, tracker) {
+		return false
+	}
+	return len(cwh.Events) == 0 || strslice.Contains(cwh.Events, event)
+}
+
+func (cwh *ConfigWebHook) String() string {
+	txt := "\tAddress: " + cwh.Address + "\n"
+	txt += "\tToken: " + cwh.Token + "\n"
+	txt += "\tSecret: " + cwh.Secret + "\n"
+	txt += "\tTrackers: " + strings.Join(cwh.Trackers, ", ") + "\n"
+	if len(cwh.Events) != 0 {
+		txt += "\tEvents: " + strings.Join(cwh.Events, ", ") + "\n"
+	} else {
+		txt += "\tEvents: All\n"
+	}
+	return txt
+}
+
+type WebHooksConfig struct {
+	ConfigWebHook `yaml:",inline"`
+	Endpoints     []*ConfigWebHook
+}
+
+func (whc *WebHooksConfig) check() error {
+	if whc.Address == "" && len(whc.Endpoints) == 0 {
+		return errors.New("Webhook configuration must provide remote server address")
+	}
+	if whc.Address != "" {
+		if err := whc.ConfigWebHook.check(); err != nil {
+			return err
+		}
+		if whc.Name == "" {
+			whc.Name = defaultWebHookName
+		}
+	}
+	var names []string
+	for _, ep := range whc.Endpoints {
+		if ep.Name == "" {
+			return errors.New("Webhook endpoints must be named")
+		}
+		if err := ep.check(); err != nil {
+			return errors.Wrap(err, "Error with webhook endpoint "+ep.Name)
+		}
+		names = append(names, ep.Name)
+	}
+	if whc.Address != "" {
+		names = append(names, whc.Name)
+	}
+	if strslice.HasDuplicates(names) {
+		return errors.New("Webhook endpoints names must be unique")
+	}
+	return nil
+}
+
+// all endpoints, including the one defined at the top level of the webhooks configuration.
+func (whc *WebHooksConfig) all() []*ConfigWebHook {
+	var endpoints []*ConfigWebHook
+	if whc.Address != "" {
+		endpoints = append(endpoints, &whc.ConfigWebHook)
+	}
+	return append(endpoints, whc.Endpoints...)
+}
+
 func (whc *WebHooksConfig) String() string {
 	txt := "WebHook configuration:\n"
-	txt += "\tAddress: " + whc.Address + "\n"
-	txt += "\tToken: " + whc.Token + "\n"
-	txt += "\tTrackers: " + strings.Join(whc.Trackers, ", ") + "\n"
+	for _, ep := range whc.all() {
+		txt += "  Endpoint " + ep.Name + ":\n"
+		txt += ep.String()
+	}
 	return txt
 }
 
 type ConfigIRC struct {
-	Tracker string
-	User    string
+	Tracker         string
+	User            string
+	AllowCommands   bool   `yaml:"allow_commands"`
+	NickServAccount string `yaml:"nickserv_account"`
+	CommandSecret   string `yaml:"command_secret"`
 }
 
 func (ci *ConfigIRC) check() error {
 	if ci.User == "" || ci.Tracker == "" {
 		return errors.New("IRC notifications require both a tracker name & IRC username")
 	}
+	if !ci.AllowCommands && (ci.NickServAccount != "" || ci.CommandSecret != "") {
+		return errors.New("IRC NickServ account or command secret are only relevant if commands are allowed")
+	}
+	if ci.AllowCommands && ci.CommandSecret == "" && ci.NickServAccount == "" {
+		// by default, the user must be identified with the NickServ account of the same name
+		ci.NickServAccount = ci.User
+	}
 	return nil
 }
 
@@ -435,6 +810,14 @@ func (ci *ConfigIRC) String() string {
 	txt := "IRC notification configuration:\n"
 	txt += "\tIRC server for tracker: " + ci.Tracker + "\n"
 	txt += "\tUser: " + ci.User + "\n"
+	txt += "\tAllow commands: " + fmt.Sprintf("%v", ci.AllowCommands) + "\n"
+	if ci.AllowCommands {
+		if ci.CommandSecret != "" {
+			txt += "\tCommand secret: " + ci.CommandSecret + "\n"
+		} else {
+			txt += "\tNickServ account: " + ci.NickServAccount + "\n"
+		}
+	}
 	return txt
 }
 
@@ -3,6 +3,7 @@ package varroa
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -30,6 +31,7 @@ func TestConfig(t *testing.T) {
 	check.True(c.General.AutomaticMetadataRetrieval)
 	check.True(c.General.FullMetadataRetrieval)
 	check.True(c.General.TimestampedLogs)
+	check.Equal(24, c.General.MonitorSnatchedPeriodHour)
 
 	// trackers
 	fmt.Println("Checking trackers")
@@ -108,6 +110,11 @@ func TestConfig(t *testing.T) {
 	check.Equal("server.that.is.mine.com", c.WebServer.Hostname)
 	check.Equal(1234, c.WebServer.PortHTTP)
 	check.Equal(1235, c.WebServer.PortHTTPS)
+	check.Equal(defaultRateLimitPerMinute, c.WebServer.RateLimit)
+	check.Equal(3, c.WebServer.MaxFailedAuth)
+	check.Equal([]string{"10.0.0.0/8", "192.168.1.0/24"}, c.WebServer.AllowedNetworks.API)
+	check.Equal(2, len(c.WebServer.AllowedNetworks.api))
+	check.Nil(c.WebServer.AllowedNetworks.Downloads)
 	// pushover notifications
 	fmt.Println("Checking pushover notifications")
 	check.Equal("tokenpushovertoken", c.Notifications.Pushover.Token)
@@ -117,11 +124,32 @@ func TestConfig(t *testing.T) {
 	fmt.Println("Checking IRC notifications")
 	check.Equal("blue", c.Notifications.Irc.Tracker)
 	check.Equal("irc_name", c.Notifications.Irc.User)
+	check.True(c.Notifications.Irc.AllowCommands)
+	check.Equal("ircsecret", c.Notifications.Irc.CommandSecret)
+	check.Equal("", c.Notifications.Irc.NickServAccount)
+	check.Equal(10, c.Notifications.Desktop.ExpireSeconds)
+	check.True(c.Notifications.Desktop.ShowCovers)
 	// webhooks
 	fmt.Println("Checking webhooks")
 	check.Equal("http://some.thing", c.Notifications.WebHooks.Address)
 	check.Equal("tokenwebhooktoken", c.Notifications.WebHooks.Token)
 	check.Equal([]string{"blue"}, c.Notifications.WebHooks.Trackers)
+	check.Equal(defaultWebHookName, c.Notifications.WebHooks.Name)
+	check.Equal(1, len(c.Notifications.WebHooks.Endpoints))
+	check.Equal(2, len(c.Notifications.WebHooks.all()))
+	wh := c.Notifications.WebHooks.Endpoints[0]
+	check.Equal("signed", wh.Name)
+	check.Equal("https://other.thing/hook", wh.Address)
+	check.Equal("", wh.Token)
+	check.Equal("signingsecret", wh.Secret)
+	check.Equal("signingsecret", wh.signingKey())
+	check.Equal([]string{"blue", "purple"}, wh.Trackers)
+	check.Equal([]string{"snatch", "stats"}, wh.Events)
+	check.True(wh.accepts("purple", notificationEventSnatch))
+	check.False(wh.accepts("purple", notificationEventGeneral))
+	check.False(wh.accepts("magenta", notificationEventSnatch))
+	check.True(c.Notifications.WebHooks.accepts("blue", notificationEventGeneral))
+	check.Equal("tokenwebhooktoken", c.Notifications.WebHooks.signingKey())
 	// library
 	fmt.Println("Checking library")
 	check.Equal("test", c.Library.Directory)
@@ -129,6 +157,19 @@ func TestConfig(t *testing.T) {
 	check.False(c.Library.MoveSorted)
 	check.True(c.Library.AutomaticMode)
 	check.Equal("$a/$a ($y) $t [$f $q] [$s] [$l $n $e]", c.Library.Template)
+	check.Equal(map[string]string{"Compilation": "VA/$t ($y) [$f $s]", "jazz": "{{initial $a}}/$a/$a ($y) $t{{if $e}} [$e]{{end}}"}, c.Library.Templates)
+	check.Equal("$dn.$tn. $ta - $tt", c.Library.TrackTemplate)
+	check.Contains(c.Library.String(), "Template for Compilation: VA/$t ($y) [$f $s] (example: VA/The Title (1975) [FLAC CD])")
+	check.Contains(c.Library.String(), "(example: 1.01. The Artist - The Track)")
+	check.True(c.Library.WriteTags)
+	check.True(c.Library.EmbedCover)
+	check.Equal(3, len(c.Library.SortRules))
+	check.Equal(ConfigSortRule{Name: "jazz", Filter: []string{"perfect"}, Tags: []string{"jazz"}, Format: []string{"FLAC"}, Decision: sortRuleAccept, MainArtist: mainArtistFirst, Category: "Jazz"}, *c.Library.SortRules[0])
+	check.Equal(2000, c.Library.SortRules[1].MinSizeMB)
+	check.Equal([]string{tracker.QualityV0, tracker.Quality320}, c.Library.SortRules[2].Quality)
+	check.Contains(c.Library.String(), "Sort rule lossy: reject")
+	check.Equal(conflictDisambiguate, c.Library.ConflictStrategy)
+	check.Equal(filepath.Join("test", libraryTrashDir), c.Library.TrashDirectory)
 	check.Equal([]string{"../varroa/test", "../varroa/cmd"}, c.Library.AdditionalSources)
 	check.Equal("test/aliases.yaml", c.Library.AliasesFile)
 	check.Equal(14, len(c.Library.Aliases["MF DOOM"]))
@@ -244,6 +285,7 @@ func TestConfig(t *testing.T) {
 	check.True(c.DownloadFolderConfigured)
 	check.True(c.webserverHTTP)
 	check.True(c.webserverHTTPS)
+	check.True(c.webserverSorting)
 	check.True(c.LibraryConfigured)
 	check.True(c.playlistDirectoryConfigured)
 	check.True(c.metadataConfigured)
@@ -274,6 +316,7 @@ func TestConfig(t *testing.T) {
 	check.False(c.webserverHTTP)
 	check.True(c.webserverHTTPS)
 	check.False(c.LibraryConfigured)
+	check.False(c.webserverSorting)
 
 	c = &Config{}
 	err = c.Load("test/test_nostatsnoweb.yaml")
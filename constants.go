@@ -14,39 +14,44 @@ const (
 	envPassphrase  = "_VARROA_PASSPHRASE"
 
 	// directories & files
-	DefaultConfigurationFile   = "config.yaml"
-	daemonSocket               = "varroa.sock"
-	StatsDir                   = "stats"
-	MetadataDir                = "TrackerMetadata"
-	downloadsCleanDir          = "VarroaClean"
-	userMetadataJSONFile       = "user_metadata.json"
-	OriginJSONFile             = "origin.json"
-	trackerMetadataFile        = "Release.json"
-	trackerTGroupMetadataFile  = "Group.json"
-	trackerCollageMetadataFile = "%s collage #%d.json"
-	trackerCoverFile           = "Cover"
-	perDay                     = "per_day_"
-	uploadStatsFile            = "up"
-	downloadStatsFile          = "down"
-	ratioStatsFile             = "ratio"
-	bufferStatsFile            = "buffer"
-	warningBufferStatsFile     = "warningbuffer"
-	overallStatsFile           = "stats"
-	numberSnatchedPerDayFile   = "snatches_per_day"
-	sizeSnatchedPerDayFile     = "size_snatched_per_day"
-	totalSnatchesByFilterFile  = "total_snatched_by_filter"
-	toptagsFile                = "top_tags"
-	gitlabCIYamlFile           = ".gitlab-ci.yml"
-	htmlIndexFile              = "index.html"
-	defaultFolderTemplate      = "$a ($y) $t {$id} [$f $s]"
-	DefaultHistoryDB           = "history.db"
-	DefaultDownloadsDB         = "downloads.db"
-	DefaultLibraryDB           = "library.db"
-	manualSnatchFilterName     = "remote"
-	overallPrefix              = "overall"
-	lastWeekPrefix             = "lastweek"
-	lastMonthPrefix            = "lastmonth"
-	statsNotificationPrefix    = "stats: "
+	DefaultConfigurationFile          = "config.yaml"
+	daemonSocket                      = "varroa.sock"
+	StatsDir                          = "stats"
+	MetadataDir                       = "TrackerMetadata"
+	downloadsCleanDir                 = "VarroaClean"
+	userMetadataJSONFile              = "user_metadata.json"
+	OriginJSONFile                    = "origin.json"
+	trackerMetadataFile               = "Release.json"
+	trackerTGroupMetadataFile         = "Group.json"
+	trackerCollageMetadataFile        = "%s collage #%d.json"
+	trackerCoverFile                  = "Cover"
+	perDay                            = "per_day_"
+	uploadStatsFile                   = "up"
+	downloadStatsFile                 = "down"
+	ratioStatsFile                    = "ratio"
+	bufferStatsFile                   = "buffer"
+	warningBufferStatsFile            = "warningbuffer"
+	overallStatsFile                  = "stats"
+	numberSnatchedPerDayFile          = "snatches_per_day"
+	sizeSnatchedPerDayFile            = "size_snatched_per_day"
+	totalSnatchesByFilterFile         = "total_snatched_by_filter"
+	toptagsFile                       = "top_tags"
+	gitlabCIYamlFile                  = ".gitlab-ci.yml"
+	htmlIndexFile                     = "index.html"
+	defaultFolderTemplate             = "$a ($y) $t {$id} [$f $s]"
+	DefaultHistoryDB                  = "history.db"
+	DefaultDownloadsDB                = "downloads.db"
+	DefaultLibraryDB                  = "library.db"
+	DefaultLibraryFuseDB              = "library_fuse.db"
+	DefaultLibraryJournal             = "library_journal.jsonl"
+	DefaultTokensDB                   = "tokens.db"
+	manualSnatchFilterName            = "remote"
+	overallPrefix                     = "overall"
+	lastWeekPrefix                    = "lastweek"
+	lastMonthPrefix                   = "lastmonth"
+	statsNotificationPrefix           = "stats: "
+	releaseReadyNotification          = "Ready to sort: %s [download #%d]"
+	snatchedReleaseUpdateNotification = "Tracker update for %s: %s"
 
 	// Notable ratios & constants
 	defaultTargetRatio = 1.0
@@ -132,6 +137,7 @@ const (
 	errorOutgoingWebSocketJSON   = "Error writing to websocket"
 	errorIncorrectWebServerToken = "Error validating token for web server, ignoring."
 	errorCreatingWebSocket       = "Error creating websocket"
+	errorManagingTokens          = "Error managing API tokens"
 	// certificates errors
 	errorOpenSSL               = "openssl is not available on this system. "
 	errorGeneratingCertificate = "Error generating self-signed certificate"
@@ -162,9 +168,10 @@ const (
 	errorAddingToHistory        = "Error adding release to history"
 	announcerBadCredentials     = "Bad credentials."
 	// notifications errors
-	errorNotification  = "Error while sending pushover notification"
-	errorWebhook       = "Error pushing webhook POST"
-	errorNotifications = "Error while sending notifications"
+	errorNotification        = "Error while sending pushover notification"
+	errorWebhook             = "Error pushing webhook POST"
+	errorDesktopNotification = "Error sending desktop notification"
+	errorNotifications       = "Error while sending notifications"
 	// release metadata errors
 	errorWritingJSONMetadata        = "Error writing metadata file"
 	errorDownloadingTrackerCover    = "Error downloading tracker cover"
@@ -177,13 +184,17 @@ const (
 	ErrorFindingMusicAndMetadata    = "directory %s does not contain music files and tracker metadata"
 	couldNotFindMetadataAge         = "No information about metadata age found."
 	// stats errors
-	errorGettingStats      = "Error getting stats"
-	ErrorGeneratingGraphs  = "Error generating graphs (may require more data, 24h worth for daily graphs)"
-	errorBufferDrop        = "Buffer drop too important, stopping autosnatching. Restart to start again."
-	errorBelowWarningRatio = "Ratio below warning level, stopping autosnatching."
+	errorGettingStats        = "Error getting stats"
+	errorGettingLastSnatches = "Error getting last snatched releases"
+	ErrorGeneratingGraphs    = "Error generating graphs (may require more data, 24h worth for daily graphs)"
+	errorBufferDrop          = "Buffer drop too important, stopping autosnatching. Restart to start again."
+	errorBelowWarningRatio   = "Ratio below warning level, stopping autosnatching."
 
 	// downloads db errors
-	errorCleaningDownloads = "Error cleaning up download: "
+	errorCleaningDownloads    = "Error cleaning up download: "
+	errorWaitingForDownload   = "Error waiting for download to complete"
+	errorAddingDownloadsEntry = "Error adding release to the downloads database"
+	errorMonitoringSnatched   = "Error checking snatched releases on the trackers"
 	// disk space usage
 	currentUsage     = "Current disk usage: %.2f%% used, remaining: %s"
 	lowDiskSpace     = "Warning: low disk space available (<5%)"
@@ -83,32 +83,94 @@ func (d *DownloadsDB) String() string {
 	return txt
 }
 
-func (d *DownloadsDB) Scan() error {
-	defer TimeTrack(time.Now(), "Scan Downloads")
+// roots of the downloads: the download directory and the additional sources.
+func (d *DownloadsDB) roots() []string {
+	return append([]string{d.root}, d.additionalSources...)
+}
 
-	if d.db.DB == nil {
-		return errors.New("Error db not open")
+// metadataStamp of a download folder: the last modification time of its JSON metadata files, or 0 if there are none.
+func metadataStamp(folder string) int64 {
+	files, err := ioutil.ReadDir(filepath.Join(folder, MetadataDir))
+	if err != nil {
+		return 0
 	}
+	var stamp int64
+	for _, f := range files {
+		if !f.IsDir() && strings.ToLower(filepath.Ext(f.Name())) == ".json" && f.ModTime().UnixNano() > stamp {
+			stamp = f.ModTime().UnixNano()
+		}
+	}
+	return stamp
+}
 
-	// don't walk, we only want the top-level directories here
-	entries, readErr := ioutil.ReadDir(d.root)
-	if readErr != nil {
-		return errors.Wrap(readErr, "Error reading downloads directory "+d.root)
+// refresh the entry of a folder found in root, only loading its metadata again if it has been modified since the
+// previous entry was saved. previous has no ID if the folder is not in the database yet.
+// It returns false if the folder is not a download with metadata.
+func (d *DownloadsDB) refresh(node storm.Node, root, folderName string, previous DownloadEntry) (bool, error) {
+	folder := filepath.Join(root, folderName)
+	if !fs.DirExists(folder) {
+		return false, nil
+	}
+	stamp := metadataStamp(folder)
+	if previous.ID != 0 && previous.SchemaVersion == currentDownloadsDBSchemaVersion && stamp != 0 && previous.MetadataStamp == stamp {
+		return true, nil
+	}
+	// detect if sound files are present, leave otherwise
+	if !music.ContainsMusic(folder) {
+		logthis.Info("Error: no music found in "+folderName, logthis.VERBOSEST)
+		return false, nil
+	}
+	dl := previous
+	dl.FolderName = folderName
+	// read information from metadata
+	if err := dl.Load(root); err != nil {
+		return false, errors.Wrap(err, "Error: could not load metadata for "+folderName)
+	}
+	// saving the whole entry, storm does not update zero values
+	if err := node.Save(&dl); err != nil {
+		return false, errors.Wrap(err, "Error: could not save to db "+folderName)
+	}
+	if previous.ID == 0 {
+		logthis.Info("New Downloads entry: "+folderName, logthis.VERBOSESTEST)
+	} else {
+		logthis.Info("Updated Downloads entry: "+folderName, logthis.VERBOSESTEST)
 	}
+	return true, nil
+}
 
-	// same from additional sources
-	for _, s := range d.additionalSources {
-		se, err := ioutil.ReadDir(s)
-		if err != nil {
-			return errors.Wrap(readErr, "Error reading downloads directory "+s)
+// RefreshFolder entry after it has changed on disk, adding, updating or removing it.
+func (d *DownloadsDB) RefreshFolder(folderName string) error {
+	previous, err := d.FindByFolderName(folderName)
+	if err != nil && err != storm.ErrNotFound {
+		return errors.Wrap(err, fmt.Sprintf("error looking for entry %s", folderName))
+	}
+	for _, root := range d.roots() {
+		if fs.DirExists(filepath.Join(root, folderName)) {
+			found, err := d.refresh(d.db.DB, root, folderName, previous)
+			if found || err != nil {
+				return err
+			}
+			break
 		}
-		entries = append(entries, se...)
 	}
+	if previous.ID == 0 {
+		return nil
+	}
+	// no longer a download
+	if err := d.db.DB.DeleteStruct(&previous); err != nil {
+		return err
+	}
+	logthis.Info("Removed Download entry: "+folderName, logthis.VERBOSESTEST)
+	return nil
+}
 
-	s := spinner.New([]string{"    ", ".   ", "..  ", "... "}, 150*time.Millisecond)
-	s.Prefix = scanningFiles
-	if !daemon.WasReborn() {
-		s.Start()
+// Scan the download directories, adding new downloads, updating those whose metadata was modified, and removing
+// entries for folders that have disappeared.
+func (d *DownloadsDB) Scan() error {
+	defer TimeTrack(time.Now(), "Scan Downloads")
+
+	if d.db.DB == nil {
+		return errors.New("Error db not open")
 	}
 
 	// get old entries
@@ -116,6 +178,17 @@ func (d *DownloadsDB) Scan() error {
 	if err := d.db.DB.All(&previous); err != nil {
 		return errors.New("Cannot load previous entries")
 	}
+	previousEntries := make(map[string]DownloadEntry, len(previous))
+	for _, p := range previous {
+		previousEntries[p.FolderName] = p
+	}
+
+	s := spinner.New([]string{"    ", ".   ", "..  ", "... "}, 150*time.Millisecond)
+	s.Prefix = scanningFiles
+	if !daemon.WasReborn() {
+		s.Start()
+		defer s.Stop()
+	}
 
 	tx, err := d.db.DB.Begin(true)
 	if err != nil {
@@ -123,55 +196,31 @@ func (d *DownloadsDB) Scan() error {
 	}
 	defer tx.Rollback()
 
-	var currentFolderNames []string
-	for _, entry := range entries {
-		if entry.IsDir() {
-			// detect if sound files are present, leave otherwise
-			if !music.ContainsMusic(filepath.Join(d.root, entry.Name())) {
-				logthis.Info("Error: no music found in "+entry.Name(), logthis.VERBOSEST)
+	currentFolderNames := make(map[string]bool)
+	for _, root := range d.roots() {
+		// don't walk, we only want the top-level directories here
+		entries, err := ioutil.ReadDir(root)
+		if err != nil {
+			return errors.Wrap(err, "Error reading downloads directory "+root)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() || currentFolderNames[entry.Name()] {
 				continue
 			}
-			// try to find entry
-			var downloadEntry DownloadEntry
-			if dbErr := d.db.DB.One("FolderName", entry.Name(), &downloadEntry); dbErr != nil {
-				if dbErr == storm.ErrNotFound {
-					// not found, create new entry
-					downloadEntry.FolderName = entry.Name()
-					// read information from metadata
-					if err := downloadEntry.Load(d.root); err != nil {
-						logthis.Error(errors.Wrap(err, "Error: could not load metadata for "+entry.Name()), logthis.VERBOSEST)
-						continue
-					}
-					if err := tx.Save(&downloadEntry); err != nil {
-						logthis.Info("Error: could not save to db "+entry.Name(), logthis.VERBOSEST)
-						continue
-					}
-					logthis.Info("New Downloads entry: "+entry.Name(), logthis.VERBOSESTEST)
-				} else {
-					logthis.Error(dbErr, logthis.VERBOSEST)
-					continue
-				}
-			} else {
-				// found entry, update it
-				// TODO for existing entries, maybe only reload if the metadata has been modified?
-				// read information from metadata
-				if err := downloadEntry.Load(d.root); err != nil {
-					logthis.Info("Error: could not load metadata for "+entry.Name(), logthis.VERBOSEST)
-					continue
-				}
-				if err := tx.Update(&downloadEntry); err != nil {
-					logthis.Info("Error: could not save to db "+entry.Name(), logthis.VERBOSEST)
-					continue
-				}
-				logthis.Info("Updated Downloads entry: "+entry.Name(), logthis.VERBOSESTEST)
+			found, err := d.refresh(tx, root, entry.Name(), previousEntries[entry.Name()])
+			if err != nil {
+				logthis.Error(err, logthis.VERBOSEST)
+				continue
+			}
+			if found {
+				currentFolderNames[entry.Name()] = true
 			}
-			currentFolderNames = append(currentFolderNames, entry.Name())
 		}
 	}
 
 	// remove entries no longer associated with actual files
 	for _, p := range previous {
-		if !strslice.Contains(currentFolderNames, p.FolderName) {
+		if !currentFolderNames[p.FolderName] {
 			if err := tx.DeleteStruct(&p); err != nil {
 				logthis.Error(err, logthis.VERBOSEST)
 			}
@@ -180,14 +229,7 @@ func (d *DownloadsDB) Scan() error {
 	}
 
 	defer TimeTrack(time.Now(), "Committing changes to DB")
-	if err := tx.Commit(); err != nil {
-		return err
-	}
-
-	if !daemon.WasReborn() {
-		s.Stop()
-	}
-	return nil
+	return tx.Commit()
 }
 
 func (d *DownloadsDB) RescanIDs(IDs []int) error {
@@ -331,6 +373,48 @@ func (d *DownloadsDB) RescanPath(folderName string) error {
 	return errors.New(folderName + " could not be found")
 }
 
+// AddFolder from the download directory to the database, or update its entry if it already exists.
+func (d *DownloadsDB) AddFolder(folderName string) (DownloadEntry, error) {
+	dl, err := d.FindByFolderName(folderName)
+	if err != nil {
+		if err != storm.ErrNotFound {
+			return DownloadEntry{}, errors.Wrap(err, fmt.Sprintf("error looking for entry %s", folderName))
+		}
+		dl.FolderName = folderName
+	}
+	if err := dl.Load(d.root); err != nil {
+		return DownloadEntry{}, errors.Wrap(err, "error: could not load metadata for "+folderName)
+	}
+	if dl.ID == 0 {
+		err = d.db.DB.Save(&dl)
+	} else {
+		err = d.db.DB.Update(&dl)
+	}
+	if err != nil {
+		return DownloadEntry{}, errors.Wrap(err, "error: could not save to db "+folderName)
+	}
+	return dl, nil
+}
+
+// SetState of a download entry.
+func (d *DownloadsDB) SetState(id int, state int) (DownloadEntry, error) {
+	dl, err := d.FindByID(id)
+	if err != nil {
+		return DownloadEntry{}, err
+	}
+	dl.State = state
+	if err := d.db.DB.Update(&dl); err != nil {
+		return DownloadEntry{}, errors.Wrap(err, "error: could not save to db "+dl.FolderName)
+	}
+	// storm does not update zero values
+	if state == stateUnsorted {
+		if err := d.db.DB.UpdateField(&dl, "State", state); err != nil {
+			return DownloadEntry{}, errors.Wrap(err, "error: could not save to db "+dl.FolderName)
+		}
+	}
+	return dl, nil
+}
+
 func (d *DownloadsDB) FindByID(id int) (DownloadEntry, error) {
 	var downloadEntry DownloadEntry
 	if err := d.db.DB.One("ID", id, &downloadEntry); err != nil {
@@ -347,6 +431,22 @@ func (d *DownloadsDB) FindByFolderName(folderName string) (DownloadEntry, error)
 	return downloadEntry, nil
 }
 
+// FindByTrackerID returns the download of a torrent from a tracker.
+func (d *DownloadsDB) FindByTrackerID(trackerLabel string, id int) (DownloadEntry, error) {
+	var downloadEntries []DownloadEntry
+	if err := d.db.DB.Select(InSlice("Tracker", trackerLabel)).Find(&downloadEntries); err != nil {
+		return DownloadEntry{}, err
+	}
+	for _, dl := range downloadEntries {
+		for i, label := range dl.Tracker {
+			if label == trackerLabel && i < len(dl.TrackerID) && dl.TrackerID[i] == id {
+				return dl, nil
+			}
+		}
+	}
+	return DownloadEntry{}, storm.ErrNotFound
+}
+
 func (d *DownloadsDB) Sort(e *Environment) error {
 	var downloadEntries []DownloadEntry
 	query := d.db.DB.Select(q.Or(q.Eq("State", stateUnsorted), q.Eq("State", stateAccepted))).OrderBy("FolderName")
@@ -357,15 +457,47 @@ func (d *DownloadsDB) Sort(e *Environment) error {
 		}
 		return err
 	}
+	rules := e.config.Library.SortRules
+	// the snatch history is only needed to know which filter snatched a download
+	var stats *StatsDB
+	for _, r := range rules {
+		if len(r.Filter) != 0 {
+			var err error
+			if stats, err = NewStatsDB(filepath.Join(StatsDir, DefaultHistoryDB)); err != nil {
+				logthis.Error(errors.Wrap(err, "could not open the snatch history, sort rules about filters will not match"), logthis.NORMAL)
+			}
+			break
+		}
+	}
+	var report sortReport
+	defer func() {
+		if len(report) != 0 {
+			ui.Title("Sorting report")
+			fmt.Print(report.String())
+		}
+	}()
 	for _, dl := range downloadEntries {
+		var rule *ConfigSortRule
+		var sortedBy string
 		if dl.State == stateUnsorted {
-			if e.config.Library.AutomaticMode || ui.Accept(fmt.Sprintf("Sorting download #%d (%s), continue ", dl.ID, dl.FolderName)) {
+			sortedBy = sortedManually
+			if e.config.Library.AutomaticMode {
+				sortedBy = sortedAutomatically
+			}
+			// rules decide without asking, and export accepted downloads right away
+			if rule = matchSortRule(rules, &dl, snatchFilters(stats, &dl)); rule != nil {
+				sortedBy = rule.Name
+				logthis.Info(fmt.Sprintf("Download #%d (%s) matches sort rule %s: %s", dl.ID, dl.FolderName, rule.Name, rule.Decision), logthis.NORMAL)
+				if err := dl.applySortRule(d.root, e.config, rule); err != nil {
+					return errors.Wrap(err, "Error sorting download "+strconv.Itoa(dl.ID))
+				}
+			} else if e.config.Library.AutomaticMode || ui.Accept(fmt.Sprintf("Sorting download #%d (%s), continue ", dl.ID, dl.FolderName)) {
 				if err := dl.Sort(e, d.root); err != nil {
 					return errors.Wrap(err, "Error sorting download "+strconv.Itoa(dl.ID))
 				}
 			}
 		}
-		if dl.State == stateAccepted {
+		if dl.State == stateAccepted && rule == nil {
 			if e.config.Library.AutomaticMode || ui.Accept(fmt.Sprintf("Do you want to export already accepted release #%d (%s) ", dl.ID, dl.FolderName)) {
 				if err := dl.export(d.root, e.config); err != nil {
 					return errors.Wrap(err, "Error exporting download "+strconv.Itoa(dl.ID))
@@ -374,6 +506,9 @@ func (d *DownloadsDB) Sort(e *Environment) error {
 				fmt.Println("The release was not exported. It can be exported later by sorting again.")
 			}
 		}
+		if sortedBy != "" {
+			report = append(report, sortReportEntry{id: dl.ID, folder: dl.FolderName, rule: sortedBy, state: dl.State})
+		}
 		if err := d.db.DB.Update(&dl); err != nil {
 			return errors.Wrap(err, "Error saving new state for download "+dl.FolderName)
 		}
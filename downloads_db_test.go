@@ -0,0 +1,302 @@
+package varroa
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/passelecasque/obstruction/tracker"
+)
+
+// writeFakeDownload with a track and the metadata of a torrent from one tracker.
+func writeFakeDownload(root, folderName string, id int, artist string) error {
+	folder := filepath.Join(root, folderName)
+	if err := os.MkdirAll(filepath.Join(folder, MetadataDir), 0777); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(folder, "01 - Track.flac"), []byte("not really flac"), 0777); err != nil {
+		return err
+	}
+	return writeFakeMetadata(folder, id, artist)
+}
+
+func writeFakeMetadata(folder string, id int, artist string) error {
+	origin := TrackerOriginJSON{Origins: map[string]*OriginJSON{"blue": {Tracker: "https://blue.ch", ID: id, GroupID: id, LastUpdatedMetadata: time.Now().Unix()}}}
+	originJSON, err := json.Marshal(origin)
+	if err != nil {
+		return err
+	}
+	gt := tracker.GazelleTorrent{}
+	gt.Group.Name = "Release " + folder
+	gt.Group.MusicInfo.Artists = []tracker.Artist{{ID: 1, Name: artist}}
+	gt.Torrent.ID = id
+	gt.Torrent.FilePath = filepath.Base(folder)
+	gt.Torrent.FileList = "01 - Track.flac{{{15}}}"
+	gt.Group.Tags = []string{"jazz"}
+	gt.Group.Year = 1975
+	gt.Torrent.Format = "FLAC"
+	gt.Torrent.Encoding = "Lossless"
+	gt.Torrent.Media = "CD"
+	gt.Torrent.Size = 15
+	releaseJSON, err := json.Marshal(gt)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(folder, MetadataDir, OriginJSONFile), originJSON, 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(folder, MetadataDir, releaseMetadataFile("blue")), releaseJSON, 0777)
+}
+
+// newTestDownloadsDB in a temporary directory, with a download directory and an additional source.
+func newTestDownloadsDB(tb testing.TB) (*DownloadsDB, func()) {
+	dir, err := ioutil.TempDir("", "varroa-downloads")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	root, source := filepath.Join(dir, "downloads"), filepath.Join(dir, "source")
+	for _, d := range []string{root, source} {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	db, err := NewDatabase(filepath.Join(dir, DefaultDownloadsDB))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	downloads := &DownloadsDB{db: db, root: root, additionalSources: []string{source}}
+	if err := downloads.init(); err != nil {
+		tb.Fatal(err)
+	}
+	return downloads, func() {
+		downloads.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDownloadsScan(t *testing.T) {
+	fmt.Println("+ Testing Downloads/scan...")
+	check := assert.New(t)
+	_, err := NewConfig("test/test_complete.yaml")
+	check.Nil(err)
+
+	downloads, cleanup := newTestDownloadsDB(t)
+	defer cleanup()
+	root, source := downloads.root, downloads.additionalSources[0]
+	for i := 1; i <= 3; i++ {
+		check.Nil(writeFakeDownload(root, fmt.Sprintf("Release %d", i), i, "Artist"))
+	}
+	check.Nil(writeFakeDownload(source, "Other Release", 4, "Other Artist"))
+	// no metadata, or no music
+	check.Nil(os.MkdirAll(filepath.Join(root, "No Metadata"), 0777))
+	check.Nil(ioutil.WriteFile(filepath.Join(root, "No Metadata", "01.flac"), []byte("not really flac"), 0777))
+	check.Nil(os.MkdirAll(filepath.Join(root, "No Music", MetadataDir), 0777))
+	check.Nil(writeFakeMetadata(filepath.Join(root, "No Music"), 5, "Artist"))
+
+	check.Nil(downloads.Scan())
+	var entries []DownloadEntry
+	check.Nil(downloads.db.DB.All(&entries))
+	check.Equal(4, len(entries))
+	// downloads from additional sources are loaded from the right directory
+	other, err := downloads.FindByFolderName("Other Release")
+	check.Nil(err)
+	check.Equal([]string{"Other Artist"}, other.Artists)
+	check.Equal([]int{4}, other.TrackerID)
+	check.NotZero(other.MetadataStamp)
+	check.Equal(currentDownloadsDBSchemaVersion, other.SchemaVersion)
+
+	// unchanged metadata is not loaded again
+	release1 := filepath.Join(root, "Release 1")
+	releaseJSON := filepath.Join(release1, MetadataDir, releaseMetadataFile("blue"))
+	info, err := os.Stat(releaseJSON)
+	check.Nil(err)
+	check.Nil(writeFakeMetadata(release1, 1, "New Artist"))
+	check.Nil(os.Chtimes(releaseJSON, info.ModTime(), info.ModTime()))
+	check.Nil(os.Chtimes(filepath.Join(release1, MetadataDir, OriginJSONFile), info.ModTime(), info.ModTime()))
+	check.Nil(downloads.Scan())
+	dl, err := downloads.FindByFolderName("Release 1")
+	check.Nil(err)
+	check.Equal([]string{"Artist"}, dl.Artists)
+	// modified metadata is, keeping the state
+	_, err = downloads.SetState(dl.ID, stateAccepted)
+	check.Nil(err)
+	check.Nil(os.Chtimes(releaseJSON, time.Now(), info.ModTime().Add(time.Minute)))
+	check.Nil(downloads.Scan())
+	dl, err = downloads.FindByFolderName("Release 1")
+	check.Nil(err)
+	check.Equal([]string{"New Artist"}, dl.Artists)
+	check.Equal(stateAccepted, dl.State)
+	// entries from older versions are loaded again
+	dl.SchemaVersion = 1
+	dl.Artists = []string{"Old"}
+	check.Nil(downloads.db.DB.Save(&dl))
+	check.Nil(downloads.Scan())
+	dl, err = downloads.FindByFolderName("Release 1")
+	check.Nil(err)
+	check.Equal([]string{"New Artist"}, dl.Artists)
+
+	// removed folders
+	check.Nil(os.RemoveAll(filepath.Join(source, "Other Release")))
+	check.Nil(downloads.Scan())
+	_, err = downloads.FindByFolderName("Other Release")
+	check.Equal(storm.ErrNotFound, err)
+}
+
+func TestDownloadsLoadSeveralTrackers(t *testing.T) {
+	fmt.Println("+ Testing Downloads/load with several trackers...")
+	check := assert.New(t)
+	_, err := NewConfig("test/test_complete.yaml")
+	check.Nil(err)
+
+	dir, err := ioutil.TempDir("", "varroa-downloads")
+	check.Nil(err)
+	defer os.RemoveAll(dir)
+	folder := filepath.Join(dir, "Release")
+	check.Nil(writeFakeDownload(dir, "Release", 1, "Blue Artist"))
+	// the same release on another tracker, with different metadata
+	origin := TrackerOriginJSON{Origins: map[string]*OriginJSON{
+		"purple": {Tracker: "https://purple.com", ID: 2, GroupID: 2},
+		"blue":   {Tracker: "https://blue.ch", ID: 1, GroupID: 1},
+	}}
+	originJSON, err := json.Marshal(origin)
+	check.Nil(err)
+	check.Nil(ioutil.WriteFile(filepath.Join(folder, MetadataDir, OriginJSONFile), originJSON, 0777))
+	gt := tracker.GazelleTorrent{}
+	gt.Group.Name = "Purple Title"
+	gt.Group.MusicInfo.Artists = []tracker.Artist{{ID: 2, Name: "Purple Artist"}}
+	gt.Torrent.ID = 2
+	releaseJSON, err := json.Marshal(gt)
+	check.Nil(err)
+	check.Nil(ioutil.WriteFile(filepath.Join(folder, MetadataDir, releaseMetadataFile("purple")), releaseJSON, 0777))
+
+	// whatever the order of the origins, the searchable fields come from the first tracker by name
+	for i := 0; i < 10; i++ {
+		dl := DownloadEntry{FolderName: "Release"}
+		check.Nil(dl.Load(dir))
+		check.Equal([]string{"blue", "purple"}, dl.Tracker)
+		check.Equal([]int{1, 2}, dl.TrackerID)
+		check.Equal("Release "+folder, dl.Title)
+		check.Equal([]string{"Blue Artist", "Purple Artist"}, dl.Artists)
+	}
+}
+
+func TestDownloadsWatcher(t *testing.T) {
+	fmt.Println("+ Testing Downloads/watcher...")
+	check := assert.New(t)
+	_, err := NewConfig("test/test_complete.yaml")
+	check.Nil(err)
+
+	downloads, cleanup := newTestDownloadsDB(t)
+	defer cleanup()
+	root, source := downloads.root, downloads.additionalSources[0]
+	check.Nil(writeFakeDownload(root, "Existing", 1, "Artist"))
+	check.Nil(downloads.Scan())
+
+	watcher, err := newDownloadsWatcher(downloads, 50*time.Millisecond)
+	check.Nil(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watcher.run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	// waiting until the database has caught up
+	eventually := func(condition func() bool) bool {
+		for i := 0; i < 100; i++ {
+			if condition() {
+				return true
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return false
+	}
+
+	// new folders, in any of the directories
+	check.Nil(writeFakeDownload(root, "New", 2, "New Artist"))
+	check.Nil(writeFakeDownload(source, "Elsewhere", 3, "Other Artist"))
+	check.True(eventually(func() bool {
+		_, err1 := downloads.FindByFolderName("New")
+		_, err2 := downloads.FindByFolderName("Elsewhere")
+		return err1 == nil && err2 == nil
+	}))
+	// modified metadata
+	check.Nil(writeFakeMetadata(filepath.Join(root, "Existing"), 1, "Modified Artist"))
+	check.True(eventually(func() bool {
+		dl, err := downloads.FindByFolderName("Existing")
+		return err == nil && len(dl.Artists) == 1 && dl.Artists[0] == "Modified Artist"
+	}))
+	// metadata added later to a new folder
+	check.Nil(os.MkdirAll(filepath.Join(root, "Later"), 0777))
+	check.Nil(ioutil.WriteFile(filepath.Join(root, "Later", "01.flac"), []byte("not really flac"), 0777))
+	time.Sleep(200 * time.Millisecond)
+	check.Nil(os.MkdirAll(filepath.Join(root, "Later", MetadataDir), 0777))
+	time.Sleep(100 * time.Millisecond)
+	check.Nil(writeFakeMetadata(filepath.Join(root, "Later"), 4, "Late Artist"))
+	check.True(eventually(func() bool {
+		_, err := downloads.FindByFolderName("Later")
+		return err == nil
+	}))
+	// folders changing constantly are still updated
+	check.Nil(writeFakeDownload(root, "Busy", 5, "Busy Artist"))
+	found := false
+	for i := 0; i < 100 && !found; i++ {
+		check.Nil(ioutil.WriteFile(filepath.Join(root, "Busy", "02.flac"), []byte(fmt.Sprintf("not really flac %d", i)), 0777))
+		time.Sleep(20 * time.Millisecond)
+		_, err := downloads.FindByFolderName("Busy")
+		found = err == nil
+	}
+	check.True(found)
+	// removed folders
+	check.Nil(os.RemoveAll(filepath.Join(root, "New")))
+	check.True(eventually(func() bool {
+		_, err := downloads.FindByFolderName("New")
+		return err == storm.ErrNotFound
+	}))
+}
+
+func BenchmarkDownloadsScan(b *testing.B) {
+	if _, err := NewConfig("test/test_complete.yaml"); err != nil {
+		b.Fatal(err)
+	}
+	downloads, cleanup := newTestDownloadsDB(b)
+	defer cleanup()
+	for i := 0; i < 2000; i++ {
+		if err := writeFakeDownload(downloads.root, fmt.Sprintf("Artist %d - Release %d", i%100, i), i, fmt.Sprintf("Artist %d", i%100)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("full", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			if err := downloads.db.DB.Drop(&DownloadEntry{}); err != nil {
+				b.Fatal(err)
+			}
+			if err := downloads.init(); err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+			if err := downloads.Scan(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("unchanged", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := downloads.Scan(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
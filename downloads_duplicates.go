@@ -0,0 +1,225 @@
+package varroa
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/logthis"
+	"gitlab.com/passelecasque/obstruction/tracker"
+)
+
+const (
+	duplicateKeep       = "keep"
+	duplicateReseedOnly = "reseed-only"
+	duplicateReject     = "reject"
+
+	// ranks of lossless downloads, lossy downloads being ranked by bitrate below them
+	rank24bitLossless   = 40
+	rankPerfectLossless = 30
+	rankWEBLossless     = 20
+	rankLossless        = 10
+)
+
+// lossyQualities from the best to the worst.
+var lossyQualities = []string{tracker.Quality320, tracker.QualityV0, tracker.QualityAPX, tracker.Quality256, tracker.QualityV1, tracker.QualityAPS, tracker.QualityV2, tracker.Quality192}
+
+// QualityRank of a download, higher is better: 24bit lossless, lossless with a perfect log, lossless from the web,
+// other lossless, then lossy by bitrate. Downloads of unknown quality are ranked 0.
+func (d *DownloadEntry) QualityRank() int {
+	switch d.Quality {
+	case tracker.Quality24bitLossless:
+		return rank24bitLossless
+	case tracker.QualityLossless:
+		if d.Source == tracker.SourceCD && d.HasLog && d.LogScore == 100 {
+			return rankPerfectLossless
+		}
+		if d.Source == tracker.SourceWEB {
+			return rankWEBLossless
+		}
+		return rankLossless
+	}
+	for i, q := range lossyQualities {
+		if d.Quality == q {
+			return rankLossless - 1 - i
+		}
+	}
+	return 0
+}
+
+// QualityString describes the format of a download.
+func (d *DownloadEntry) QualityString() string {
+	description := strings.TrimSpace(strings.Join([]string{d.Format, d.Quality, d.Source}, " "))
+	if d.HasLog {
+		description += fmt.Sprintf(" log %d", d.LogScore)
+	}
+	return description
+}
+
+// DuplicateDownload in a group of downloads of the same release, with what should be done with it.
+type DuplicateDownload struct {
+	DownloadEntry
+	Rank       int
+	Suggestion string
+}
+
+// DuplicateGroup of downloads of the same release, the best one first.
+type DuplicateGroup struct {
+	Release   string
+	Downloads []DuplicateDownload
+}
+
+// UpgradedFrom returns the download already in the library that the suggested one is better than, if any.
+func (g DuplicateGroup) UpgradedFrom() (DuplicateDownload, bool) {
+	if g.Downloads[0].State == stateAccepted {
+		return DuplicateDownload{}, false
+	}
+	for _, dl := range g.Downloads[1:] {
+		if dl.State == stateAccepted && dl.Rank < g.Downloads[0].Rank {
+			return dl, true
+		}
+	}
+	return DuplicateDownload{}, false
+}
+
+func (g DuplicateGroup) String() string {
+	var b bytes.Buffer
+	b.WriteString(g.Release + "\n")
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	for _, dl := range g.Downloads {
+		fmt.Fprintf(w, "\t%s\t#%d\t%s\t%s\t%s\n", dl.Suggestion, dl.ID, DownloadFolderStates[dl.State], dl.QualityString(), dl.FolderName)
+	}
+	w.Flush()
+	if previous, ok := g.UpgradedFrom(); ok {
+		b.WriteString(fmt.Sprintf("\tUpgrade available: #%d is better than #%d, already in the library.\n", g.Downloads[0].ID, previous.ID))
+	}
+	return b.String()
+}
+
+// normalizeForDuplicates ignores case, punctuation and spacing.
+func normalizeForDuplicates(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}), " ")
+}
+
+// duplicateKeys of a download: its tracker groups, and its normalized artists, title and year.
+func duplicateKeys(dl DownloadEntry) []string {
+	var keys []string
+	for i, t := range dl.Tracker {
+		if i < len(dl.GroupID) && dl.GroupID[i] != 0 {
+			keys = append(keys, "group|"+t+"|"+strconv.Itoa(dl.GroupID[i]))
+		}
+	}
+	if dl.Title != "" && len(dl.Artists) != 0 {
+		artists := make([]string, len(dl.Artists))
+		for i, a := range dl.Artists {
+			artists[i] = normalizeForDuplicates(a)
+		}
+		sort.Strings(artists)
+		keys = append(keys, "release|"+strings.Join(artists, ",")+"|"+normalizeForDuplicates(dl.Title)+"|"+strconv.Itoa(dl.Year))
+	}
+	return keys
+}
+
+// findDuplicates among downloads: downloads are in the same group if they share a tracker group or the same
+// artists, title and year, directly or through other downloads.
+func findDuplicates(entries []DownloadEntry) []DuplicateGroup {
+	// union-find of the downloads sharing a key
+	parent := make([]int, len(entries))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	firstWithKey := make(map[string]int)
+	for i, dl := range entries {
+		for _, key := range duplicateKeys(dl) {
+			if j, ok := firstWithKey[key]; ok {
+				parent[find(i)] = find(j)
+			} else {
+				firstWithKey[key] = i
+			}
+		}
+	}
+	members := make(map[int][]DuplicateDownload)
+	for i, dl := range entries {
+		root := find(i)
+		members[root] = append(members[root], DuplicateDownload{DownloadEntry: dl, Rank: dl.QualityRank()})
+	}
+
+	var groups []DuplicateGroup
+	for _, downloads := range members {
+		if len(downloads) < 2 {
+			continue
+		}
+		sort.SliceStable(downloads, func(i, j int) bool {
+			if downloads[i].Rank != downloads[j].Rank {
+				return downloads[i].Rank > downloads[j].Rank
+			}
+			return downloads[i].ID < downloads[j].ID
+		})
+		best := downloads[0]
+		for i := range downloads {
+			switch {
+			case i == 0:
+				downloads[i].Suggestion = duplicateKeep
+			case best.Rank >= rankLossless && downloads[i].Rank < rankLossless:
+				// lossy copies are not worth keeping once a lossless version is available
+				downloads[i].Suggestion = duplicateReject
+			default:
+				downloads[i].Suggestion = duplicateReseedOnly
+			}
+		}
+		release := best.FolderName
+		if best.Title != "" {
+			release = strings.Join(best.Artists, ", ") + " - " + best.Title
+			if best.Year != 0 {
+				release += " (" + strconv.Itoa(best.Year) + ")"
+			}
+		}
+		groups = append(groups, DuplicateGroup{Release: release, Downloads: downloads})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Release < groups[j].Release })
+	return groups
+}
+
+// Duplicates among all downloads, with suggestions about which to keep.
+func (d *DownloadsDB) Duplicates() ([]DuplicateGroup, error) {
+	var entries []DownloadEntry
+	if err := d.db.DB.All(&entries); err != nil {
+		return nil, errors.Wrap(err, "Could not load downloads")
+	}
+	return findDuplicates(entries), nil
+}
+
+// ApplyDuplicates suggestions to the sort decisions: unsorted downloads that are not worth keeping are rejected, so
+// that they will not be exported to the library. Downloads already accepted or rejected are left alone.
+func (d *DownloadsDB) ApplyDuplicates(e *Environment, groups []DuplicateGroup) ([]DownloadEntry, error) {
+	var rejected []DownloadEntry
+	for _, g := range groups {
+		for _, dl := range g.Downloads {
+			if dl.Suggestion == duplicateKeep || dl.State != stateUnsorted {
+				continue
+			}
+			updated, err := d.SetState(dl.ID, stateRejected)
+			if err != nil {
+				return rejected, err
+			}
+			e.events.PublishDownloadState(updated)
+			logthis.Info(fmt.Sprintf("Download #%d (%s) rejected: %s", updated.ID, updated.FolderName, dl.Suggestion), logthis.VERBOSE)
+			rejected = append(rejected, updated)
+		}
+	}
+	return rejected, nil
+}
@@ -0,0 +1,70 @@
+package varroa
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadsDuplicates(t *testing.T) {
+	fmt.Println("+ Testing Downloads/duplicates...")
+	check := assert.New(t)
+
+	// ranking
+	check.True((&DownloadEntry{Quality: "24bit Lossless", Source: "Vinyl"}).QualityRank() > (&DownloadEntry{Quality: "Lossless", Source: "CD", HasLog: true, LogScore: 100}).QualityRank())
+	check.True((&DownloadEntry{Quality: "Lossless", Source: "CD", HasLog: true, LogScore: 100}).QualityRank() > (&DownloadEntry{Quality: "Lossless", Source: "WEB"}).QualityRank())
+	check.True((&DownloadEntry{Quality: "Lossless", Source: "WEB"}).QualityRank() > (&DownloadEntry{Quality: "Lossless", Source: "CD", HasLog: true, LogScore: 85}).QualityRank())
+	check.True((&DownloadEntry{Quality: "Lossless", Source: "CD"}).QualityRank() > (&DownloadEntry{Quality: "320", Source: "WEB"}).QualityRank())
+	check.True((&DownloadEntry{Quality: "320"}).QualityRank() > (&DownloadEntry{Quality: "V0 (VBR)"}).QualityRank())
+	check.True((&DownloadEntry{Quality: "192"}).QualityRank() > (&DownloadEntry{Quality: "Unknown"}).QualityRank())
+	check.Equal("miles davis kind of blue", normalizeForDuplicates("Miles  Davis: Kind-of-Blue!"))
+
+	downloads, cleanup := newTestDownloadsDB(t)
+	defer cleanup()
+	for _, dl := range []DownloadEntry{
+		// same tracker group
+		{FolderName: "Kind of Blue [V0]", Artists: []string{"Miles Davis"}, Title: "Kind of Blue", Year: 1959, Tracker: []string{"blue"}, GroupID: []int{10}, Format: "MP3", Quality: "V0 (VBR)", Source: "CD"},
+		{FolderName: "Kind of Blue [FLAC]", Artists: []string{"Miles Davis"}, Title: "Kind of Blue", Year: 1959, Tracker: []string{"blue"}, GroupID: []int{10}, Format: "FLAC", Quality: "Lossless", Source: "CD", HasLog: true, LogScore: 100, State: stateAccepted},
+		// same release on another tracker, found by artist, title and year
+		{FolderName: "Kind of Blue [24]", Artists: []string{"Miles DAVIS"}, Title: "Kind Of Blue", Year: 1959, Tracker: []string{"purple"}, GroupID: []int{99}, Format: "FLAC", Quality: "24bit Lossless", Source: "Vinyl"},
+		// different years are different releases
+		{FolderName: "Kind of Blue (Live)", Artists: []string{"Miles Davis"}, Title: "Kind of Blue", Year: 1960, Tracker: []string{"purple"}, GroupID: []int{100}, Format: "FLAC", Quality: "Lossless", Source: "WEB"},
+		// lossy duplicates only
+		{FolderName: "Other [320]", Artists: []string{"Someone"}, Title: "Other", Year: 2000, Tracker: []string{"blue"}, GroupID: []int{20}, Format: "MP3", Quality: "320", Source: "WEB"},
+		{FolderName: "Other [V0]", Artists: []string{"Someone"}, Title: "Other", Year: 2000, Tracker: []string{"blue"}, GroupID: []int{20}, Format: "MP3", Quality: "V0 (VBR)", Source: "WEB", State: stateRejected},
+	} {
+		dl := dl
+		check.Nil(downloads.db.DB.Save(&dl))
+	}
+	groups, err := downloads.Duplicates()
+	check.Nil(err)
+	check.Equal(2, len(groups))
+	check.Equal("Miles DAVIS - Kind Of Blue (1959)", groups[0].Release)
+	suggestions := func(g DuplicateGroup) map[int]string {
+		s := make(map[int]string)
+		for _, dl := range g.Downloads {
+			s[dl.ID] = dl.Suggestion
+		}
+		return s
+	}
+	check.Equal(map[int]string{3: duplicateKeep, 2: duplicateReseedOnly, 1: duplicateReject}, suggestions(groups[0]))
+	check.Equal(map[int]string{5: duplicateKeep, 6: duplicateReseedOnly}, suggestions(groups[1]))
+	previous, ok := groups[0].UpgradedFrom()
+	check.True(ok)
+	check.Equal(2, previous.ID)
+	_, ok = groups[1].UpgradedFrom()
+	check.False(ok)
+	check.Contains(groups[0].String(), "Upgrade available: #3 is better than #2, already in the library.")
+
+	// only unsorted downloads are rejected
+	rejected, err := downloads.ApplyDuplicates(NewEnvironment(), groups)
+	check.Nil(err)
+	check.Equal(1, len(rejected))
+	check.Equal(1, rejected[0].ID)
+	for id, state := range map[int]int{1: stateRejected, 2: stateAccepted, 3: stateUnsorted, 6: stateRejected} {
+		dl, err := downloads.FindByID(id)
+		check.Nil(err)
+		check.Equal(state, dl.State)
+	}
+}
@@ -2,8 +2,8 @@ package varroa
 
 import (
 	"fmt"
-	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -12,7 +12,6 @@ import (
 	"gitlab.com/catastrophic/assistance/logthis"
 	"gitlab.com/catastrophic/assistance/strslice"
 	"gitlab.com/catastrophic/assistance/ui"
-	"gitlab.com/passelecasque/obstruction/tracker"
 )
 
 const (
@@ -21,7 +20,9 @@ const (
 	stateAccepted // has metadata and has been accepted and exported to library
 	stateRejected // has metadata and is not to be exported to library
 
-	currentDownloadsDBSchemaVersion = 1
+	// version 2 added the metadata stamp, version 3 the release information used by searches, version 4 what is
+	// needed to find duplicates. Older entries are loaded again during the next scan.
+	currentDownloadsDBSchemaVersion = 4
 )
 
 var DownloadFolderStates = []string{"unsorted", "UNUSED", "accepted", "rejected"}
@@ -62,9 +63,25 @@ type DownloadEntry struct {
 	State              int      `storm:"index"`
 	Tracker            []string `storm:"index"`
 	TrackerID          []int    `storm:"index"`
+	GroupID            []int
 	Artists            []string `storm:"index"`
 	HasTrackerMetadata bool     `storm:"index"`
 	SchemaVersion      int
+	// release information, from the metadata of the first tracker
+	Title         string
+	Tags          []string `storm:"index"`
+	RecordLabel   string
+	CatalogNumber string
+	Year          int `storm:"index"`
+	Format        string
+	Quality       string
+	Source        string
+	HasLog        bool
+	LogScore      int
+	Size          uint64
+	TimeSnatched  int64
+	// MetadataStamp is the last modification time of the metadata when it was loaded, to skip unchanged folders.
+	MetadataStamp int64
 }
 
 func (d *DownloadEntry) ShortState() string {
@@ -108,9 +125,6 @@ func (d *DownloadEntry) Load(root string) error {
 		if err := origin.Load(); err != nil {
 			return errors.Wrap(err, "Error reading origin.json")
 		}
-		// TODO: check last update timestamp, compare with value in db
-		// TODO: if was not updated, skip.
-
 		// TODO: remove duplicate if there are actually several origins
 
 		// state: should be set to unsorted by default,
@@ -119,17 +133,29 @@ func (d *DownloadEntry) Load(root string) error {
 		// resetting the other fields
 		d.Tracker = []string{}
 		d.TrackerID = []int{}
+		d.GroupID = []int{}
 		d.Artists = []string{}
 		d.HasTrackerMetadata = false
+		d.Title, d.RecordLabel, d.CatalogNumber, d.Format, d.Quality, d.Source = "", "", "", "", "", ""
+		d.Tags = []string{}
+		d.Year, d.Size, d.TimeSnatched = 0, 0, 0
+		d.HasLog, d.LogScore = false, 0
 		// if d.SchemaVersion != currentDownloadsDBSchemaVersion {
 		//  migration if useful
 		// }
 		d.SchemaVersion = currentDownloadsDBSchemaVersion
 
-		// load useful things from JSON
-		for tracker, info := range origin.Origins {
+		// load useful things from JSON, in tracker order so that the searchable fields always come from the same tracker
+		var trackers []string
+		for tracker := range origin.Origins {
+			trackers = append(trackers, tracker)
+		}
+		sort.Strings(trackers)
+		for _, tracker := range trackers {
+			info := origin.Origins[tracker]
 			d.Tracker = append(d.Tracker, tracker)
 			d.TrackerID = append(d.TrackerID, info.ID)
+			d.GroupID = append(d.GroupID, info.GroupID)
 
 			// getting release info from json
 			infoJSON, err := getReleaseJSONFile(filepath.Join(root, d.FolderName, MetadataDir), tracker)
@@ -146,10 +172,33 @@ func (d *DownloadEntry) Load(root string) error {
 			for _, a := range md.Artists {
 				d.Artists = append(d.Artists, a.Name)
 			}
+			for _, t := range md.Tags {
+				if !strslice.Contains(d.Tags, t) {
+					d.Tags = append(d.Tags, t)
+				}
+			}
+			if d.Title == "" {
+				d.Title = md.Title
+				d.RecordLabel = md.RecordLabel
+				d.CatalogNumber = md.CatalogNumber
+				d.Year = md.OriginalYear
+				if d.Year == 0 {
+					d.Year = md.EditionYear
+				}
+				d.Format = md.Format
+				d.Quality = md.Quality
+				d.Source = md.Source
+				d.HasLog = md.HasLog
+				d.LogScore = md.LogScore
+				d.Size = md.Size
+				d.TimeSnatched = md.TimeSnatched
+			}
 		}
 	} else {
 		return errors.New("Error, no metadata found")
 	}
+	// after loading, user metadata may have been updated from the configuration
+	d.MetadataStamp = metadataStamp(filepath.Join(root, d.FolderName))
 	return nil
 }
 
@@ -259,10 +308,10 @@ func (d *DownloadEntry) Sort(e *Environment, root string) error {
 				d.State = stateUnsorted
 				validChoice = true
 			case strings.ToUpper(choice) == "A":
+				// export sets the new state, the release may not be exported after all
 				if err := d.export(root, e.config); err != nil {
 					return err
 				}
-				d.State = stateAccepted
 				validChoice = true
 			}
 
@@ -279,129 +328,89 @@ func (d *DownloadEntry) Sort(e *Environment, root string) error {
 }
 
 func (d *DownloadEntry) export(root string, config *Config) error {
-	// getting candidates for new folder name
-	var newName string
-	if d.HasTrackerMetadata {
-		for _, t := range d.Tracker {
-			info, err := d.getMetadata(root, t)
-			if err != nil {
-				logthis.Info("Could not find metadata for tracker "+t, logthis.NORMAL)
-				continue
-			}
-
-			// questions about how to file this release
-			var artists []string
-			for _, a := range info.Artists {
-				// not taking feat. artists
-				if a.Role == "Main" || a.Role == "Composer" {
-					artists = append(artists, a.Name)
-				}
-			}
-
-			// if only one artist, select them by default
-			mainArtist := artists[0]
-			if len(artists) > 1 {
-				mainArtistCandidates := []string{strings.Join(artists, ", ")}
-				mainArtistCandidates = append(mainArtistCandidates, artists...)
-				if len(artists) > 3 {
-					mainArtistCandidates = append([]string{tracker.VariousArtists}, mainArtistCandidates...)
-				}
-
-				//  selecting first main artist if in automatic mode
-				if config.Library.AutomaticMode {
-					mainArtist = mainArtistCandidates[0]
-				} else {
-					mainArtist, err = ui.SelectValue("Defining main artist", "If several artists are listed, this will help organize your files.", mainArtistCandidates)
-					if err != nil {
-						return err
-					}
-				}
-			}
-			info.MainArtist = mainArtist
-
-			// retrieving main artist alias from the configuration
-			if err = info.checkAliasAndCategory(filepath.Join(root, d.FolderName, MetadataDir)); err != nil {
-				return err
-			}
-			// main artist alias
-			aliasCandidates := []string{info.MainArtistAlias}
-			if info.MainArtistAlias != info.MainArtist {
-				aliasCandidates = append([]string{info.MainArtist}, aliasCandidates...)
-			}
-			// selecting first main artist alias if in automatic mode
-			if config.Library.AutomaticMode {
-				info.MainArtistAlias = aliasCandidates[0]
-			} else {
-				mainArtistAlias, err2 := ui.SelectValue("Defining main artist alias", "Change this value to regroup releases from different artist aliases in the library.", aliasCandidates)
-				if err2 != nil {
-					return err2
-				}
-				// retrieving category from the configuration
-				info.MainArtistAlias = mainArtistAlias
-			}
-
-			// category
-			if err = info.checkAliasAndCategory(filepath.Join(root, d.FolderName, MetadataDir)); err != nil {
-				return err
-			}
-			categoryCandidates := info.Tags
-			if !strslice.Contains(info.Tags, info.Category) {
-				categoryCandidates = append([]string{info.Category}, info.Tags...)
-			}
-
-			// selecting first tag if in automatic mode
-			if config.Library.AutomaticMode {
-				info.Category = categoryCandidates[0]
-			} else {
-				category, err2 := ui.SelectValue("Defining user category", "Allows custom library organization.", categoryCandidates)
-				if err2 != nil {
-					return err2
-				}
-				// saving value
-				info.Category = category
-			}
-			// write to original user_metadata.json
-			if err = info.UpdateUserJSON(filepath.Join(root, d.FolderName, MetadataDir), info.MainArtist, info.MainArtistAlias, info.Category); err != nil {
-				logthis.Error(errors.Wrap(err, "could not update user metadata with main artist, main artists alias, or category"), logthis.NORMAL)
-				return err
-			}
-			// generating new folder name using template from config
-			newName = info.GeneratePath(config.Library.Template, filepath.Join(root, d.FolderName))
+	decision := SortDecision{State: stateAccepted, AddToPlaylists: true}
+	if d.HasTrackerMetadata && !config.Library.AutomaticMode {
+		var err error
+		if decision, err = d.selectSortDecision(root, config); err != nil {
+			return err
 		}
 	}
-	if fs.DirExists(filepath.Join(config.Library.Directory, newName)) {
-		return errors.New("destination already exists")
+	return d.exportWithDecision(root, config, decision, !config.Library.AutomaticMode)
+}
+
+// exportWithDecision already made, only asking for confirmation if interactive.
+func (d *DownloadEntry) exportWithDecision(root string, config *Config, decision SortDecision, interactive bool) error {
+	newName, err := d.applySortDecision(root, config, decision)
+	if err != nil {
+		logthis.Error(err, logthis.NORMAL)
+		return err
 	}
 	// export
 	ui.Title("Exporting release")
-	if config.Library.AutomaticMode || ui.Accept("Export as "+newName) {
-		fmt.Println("Exporting files to the library...")
-		if err := fs.CopyDir(filepath.Join(root, d.FolderName), filepath.Join(config.Library.Directory, newName), config.Library.UseHardLinks); err != nil {
-			return errors.Wrap(err, "Error exporting download "+d.FolderName)
-		}
-		// if moving downloads, removing source
-		if config.Library.MoveSorted {
-			if err := os.RemoveAll(filepath.Join(root, d.FolderName)); err != nil {
-				return errors.Wrap(err, "Error moving download "+d.FolderName)
-			}
-		} else {
-			fmt.Println(ui.Green("This release has been exported to your library. The original files have not been removed, but will be ignored in later sorts."))
-		}
-		// if exported, write playlists
-		if config.playlistDirectoryConfigured {
-			ui.Title("Updating playlists")
-			if config.Library.AutomaticMode || ui.Accept("Add release to daily/monthly playlists") {
-				if err := addReleaseToCurrentPlaylists(config.Library.PlaylistDirectory, config.Library.Directory, newName); err != nil {
-					return err
-				}
-				fmt.Println(ui.Green("Playlists generated or updated.\n"))
-			} else {
-				fmt.Println(ui.Red("Playlists were not updated to include this release.\n"))
-			}
-		}
-	} else {
+	if interactive && !ui.Accept("Export as "+newName) {
+		fmt.Println(ui.Red("The release was not exported. It can be exported later by sorting this ID again. Until then, it will be marked as unsorted again.\n"))
+		d.State = stateUnsorted
+		return nil
+	}
+	if config.playlistDirectoryConfigured && interactive {
+		ui.Title("Updating playlists")
+		decision.AddToPlaylists = ui.Accept("Add release to daily/monthly playlists")
+	}
+	var ask func(string) string
+	if interactive {
+		ask = askConflictStrategy
+	}
+	fmt.Println("Exporting files to the library...")
+	exportedAs, err := d.exportToLibrary(root, newName, config, decision.AddToPlaylists, ask)
+	if err == errConflictSkipped {
 		fmt.Println(ui.Red("The release was not exported. It can be exported later by sorting this ID again. Until then, it will be marked as unsorted again.\n"))
 		d.State = stateUnsorted
+		return nil
 	}
+	if err != nil {
+		return err
+	}
+	if exportedAs != newName {
+		fmt.Println(ui.Green("This release has been exported as " + exportedAs + "."))
+	}
+	if !config.Library.MoveSorted {
+		fmt.Println(ui.Green("This release has been exported to your library. The original files have not been removed, but will be ignored in later sorts."))
+	}
+	if config.playlistDirectoryConfigured {
+		if decision.AddToPlaylists {
+			fmt.Println(ui.Green("Playlists generated or updated.\n"))
+		} else {
+			fmt.Println(ui.Red("Playlists were not updated to include this release.\n"))
+		}
+	}
+	d.State = stateAccepted
 	return nil
 }
+
+// selectSortDecision in the terminal, among the options given by the decision engine.
+func (d *DownloadEntry) selectSortDecision(root string, config *Config) (SortDecision, error) {
+	decision := SortDecision{State: stateAccepted, AddToPlaylists: true}
+	options, err := d.SortOptions(root, config, decision)
+	if err != nil {
+		return decision, err
+	}
+	// if only one artist, select them by default
+	if len(options.MainArtists) > 1 {
+		if decision.MainArtist, err = ui.SelectValue("Defining main artist", "If several artists are listed, this will help organize your files.", options.MainArtists); err != nil {
+			return decision, err
+		}
+		if options, err = d.SortOptions(root, config, decision); err != nil {
+			return decision, err
+		}
+	}
+	if decision.MainArtistAlias, err = ui.SelectValue("Defining main artist alias", "Change this value to regroup releases from different artist aliases in the library.", options.MainArtistAliases); err != nil {
+		return decision, err
+	}
+	if options, err = d.SortOptions(root, config, decision); err != nil {
+		return decision, err
+	}
+	if decision.Category, err = ui.SelectValue("Defining user category", "Allows custom library organization.", options.Categories); err != nil {
+		return decision, err
+	}
+	return decision, nil
+}
@@ -0,0 +1,352 @@
+package varroa
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+)
+
+const (
+	errorInvalidQuery   = "invalid query"
+	errorUnknownField   = "unknown field"
+	errorInvalidSort    = "invalid sort field, must be among: "
+	downloadsQueryRange = ".."
+)
+
+// downloadsQueryFields that can be searched, and the DownloadEntry field they match.
+var downloadsQueryFields = map[string]string{
+	"artist":   "Artists",
+	"title":    "Title",
+	"tag":      "Tags",
+	"label":    "RecordLabel",
+	"catnum":   "CatalogNumber",
+	"year":     "Year",
+	"format":   "Format",
+	"quality":  "Quality",
+	"source":   "Source",
+	"tracker":  "Tracker",
+	"state":    "State",
+	"size":     "Size",
+	"snatched": "TimeSnatched",
+	"folder":   "FolderName",
+}
+
+// downloadsSortFields that can be used to order search results.
+var downloadsSortFields = map[string]string{
+	"id":       "ID",
+	"folder":   "FolderName",
+	"title":    "Title",
+	"label":    "RecordLabel",
+	"year":     "Year",
+	"size":     "Size",
+	"snatched": "TimeSnatched",
+	"state":    "State",
+}
+
+// textMatcher matches string or []string fields, ignoring case.
+// Partial matches are allowed unless exact is set.
+type textMatcher struct {
+	value string
+	exact bool
+}
+
+func (c *textMatcher) matches(s string) bool {
+	if c.exact {
+		return strings.EqualFold(s, c.value)
+	}
+	return strings.Contains(strings.ToLower(s), c.value)
+}
+
+func (c *textMatcher) MatchField(v interface{}) (bool, error) {
+	switch value := v.(type) {
+	case string:
+		return c.matches(value), nil
+	case []string:
+		for _, s := range value {
+			if c.matches(s) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// MatchesText matches if a string field, or one of the elements of a []string field, contains the argument, ignoring
+// case.
+func MatchesText(field, v string) q.Matcher {
+	return q.NewFieldMatcher(field, &textMatcher{value: strings.ToLower(v)})
+}
+
+// EqualsText matches if a string field, or one of the elements of a []string field, is equal to the argument,
+// ignoring case.
+func EqualsText(field, v string) q.Matcher {
+	return q.NewFieldMatcher(field, &textMatcher{value: v, exact: true})
+}
+
+// queryTerm of a downloads query, such as -artist:"Someone".
+type queryTerm struct {
+	field   string
+	value   string
+	negated bool
+}
+
+// splitDownloadsQuery into terms separated by spaces, values with spaces being quoted.
+func splitDownloadsQuery(query string) ([]queryTerm, error) {
+	var terms []queryTerm
+	var current queryTerm
+	var value strings.Builder
+	var inQuotes, inTerm, quoted bool
+	endTerm := func() {
+		if inTerm {
+			current.value = value.String()
+			terms = append(terms, current)
+		}
+		current = queryTerm{}
+		value.Reset()
+		inTerm, quoted = false, false
+	}
+	for _, r := range query {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			inTerm, quoted = true, true
+		case inQuotes:
+			value.WriteRune(r)
+		case unicode.IsSpace(r):
+			endTerm()
+		case r == '-' && !inTerm:
+			current.negated = true
+			inTerm = true
+		case r == ':' && current.field == "" && !quoted && value.Len() != 0:
+			current.field = strings.ToLower(value.String())
+			value.Reset()
+		default:
+			value.WriteRune(r)
+			inTerm = true
+		}
+	}
+	if inQuotes {
+		return nil, errors.New(errorInvalidQuery + ": unterminated quote")
+	}
+	endTerm()
+	return terms, nil
+}
+
+// splitRange of values, such as 1970..1979, either bound being optional. A single value is both bounds.
+func splitRange(value string) (string, string) {
+	parts := strings.SplitN(value, downloadsQueryRange, 2)
+	if len(parts) != 2 {
+		return value, value
+	}
+	return parts[0], parts[1]
+}
+
+// intRangeMatcher for a field, from a single value or an inclusive range.
+func intRangeMatcher(field, value string, parse func(string) (int64, int64, error)) (q.Matcher, error) {
+	lower, upper := splitRange(value)
+	var matchers []q.Matcher
+	if lower != "" {
+		min, _, err := parse(lower)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, q.Gte(field, min))
+	}
+	if upper != "" {
+		_, max, err := parse(upper)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, q.Lte(field, max))
+	}
+	if len(matchers) == 0 {
+		return nil, errors.New(errorInvalidQuery + ": empty range")
+	}
+	return q.And(matchers...), nil
+}
+
+// parseYear as a range containing only that year.
+func parseYear(value string) (int64, int64, error) {
+	year, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, 0, errors.New(errorInvalidQuery + ": invalid year " + value)
+	}
+	return year, year, nil
+}
+
+// parseSize such as 500MB, a single size being both bounds.
+func parseSize(value string) (int64, int64, error) {
+	size, err := humanize.ParseBytes(value)
+	if err != nil {
+		return 0, 0, errors.New(errorInvalidQuery + ": invalid size " + value)
+	}
+	return int64(size), int64(size), nil
+}
+
+// parseDate such as 2020, 2020-05 or 2020-05-17, as the range of unix timestamps it covers.
+func parseDate(value string) (int64, int64, error) {
+	layouts := []struct {
+		layout string
+		next   func(time.Time) time.Time
+	}{
+		{"2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }},
+		{"2006-01", func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+		{"2006", func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+	}
+	for _, l := range layouts {
+		if start, err := time.ParseInLocation(l.layout, value, time.Local); err == nil {
+			return start.Unix(), l.next(start).Unix() - 1, nil
+		}
+	}
+	return 0, 0, errors.New(errorInvalidQuery + ": invalid date " + value)
+}
+
+// termMatcher for a single query term, among fields that can be searched.
+func termMatcher(term queryTerm, fields map[string]string) (q.Matcher, error) {
+	if term.value == "" {
+		return nil, errors.New(errorInvalidQuery + ": empty value for " + term.field)
+	}
+	if term.field == "" {
+		// bare terms can be found in artists, titles, or folder names
+		return q.Or(MatchesText("Artists", term.value), MatchesText("Title", term.value), MatchesText("FolderName", term.value)), nil
+	}
+	field, ok := fields[term.field]
+	if !ok {
+		return nil, errors.New(errorUnknownField + ": " + term.field)
+	}
+	switch term.field {
+	case "year":
+		return intRangeMatcher(field, term.value, parseYear)
+	case "size":
+		return intRangeMatcher(field, term.value, parseSize)
+	case "snatched":
+		return intRangeMatcher(field, term.value, parseDate)
+	case "state":
+		state := DownloadState(strings.ToLower(term.value))
+		if state == -1 {
+			return nil, errors.New(errorInvalidQuery + ": invalid state " + term.value)
+		}
+		return q.Eq(field, state), nil
+	case "tag", "format", "quality", "source", "tracker":
+		return EqualsText(field, term.value), nil
+	}
+	return MatchesText(field, term.value), nil
+}
+
+// ParseDownloadsQuery into a matcher for the downloads database.
+// Queries are made of terms such as: artist:"Miles Davis" tag:jazz year:1970..1979 -state:rejected
+func ParseDownloadsQuery(query string) (q.Matcher, error) {
+	return parseQuery(query, downloadsQueryFields)
+}
+
+// parseQuery into a matcher, for a database where fields can be searched.
+func parseQuery(query string, fields map[string]string) (q.Matcher, error) {
+	terms, err := splitDownloadsQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(terms) == 0 {
+		return q.True(), nil
+	}
+	matchers := make([]q.Matcher, len(terms))
+	for i, term := range terms {
+		m, err := termMatcher(term, fields)
+		if err != nil {
+			return nil, err
+		}
+		if term.negated {
+			m = q.Not(m)
+		}
+		matchers[i] = m
+	}
+	return q.And(matchers...), nil
+}
+
+// DownloadsQueryFromArgs rebuilds a query from command line arguments, quoting values that contain spaces.
+func DownloadsQueryFromArgs(args []string) string {
+	terms := make([]string, len(args))
+	for i, arg := range args {
+		if !strings.ContainsAny(arg, " \t") || strings.Contains(arg, `"`) {
+			terms[i] = arg
+			continue
+		}
+		prefix := ""
+		if strings.HasPrefix(arg, "-") {
+			prefix, arg = "-", arg[1:]
+		}
+		if parts := strings.SplitN(arg, ":", 2); len(parts) == 2 && !strings.ContainsAny(parts[0], " \t") {
+			prefix, arg = prefix+parts[0]+":", parts[1]
+		}
+		terms[i] = prefix + `"` + arg + `"`
+	}
+	return strings.Join(terms, " ")
+}
+
+// sortField of a database from the name given by the user, in reverse order if it starts with "-".
+func sortField(sortBy string, fields map[string]string) (string, bool, error) {
+	reverse := strings.HasPrefix(sortBy, "-")
+	sortBy = strings.TrimPrefix(sortBy, "-")
+	if sortBy == "" {
+		sortBy = "id"
+	}
+	field, ok := fields[strings.ToLower(sortBy)]
+	if !ok {
+		var names []string
+		for f := range fields {
+			names = append(names, f)
+		}
+		sort.Strings(names)
+		return "", false, errors.New(errorInvalidSort + strings.Join(names, ", "))
+	}
+	return field, reverse, nil
+}
+
+// Search the downloads with a query, sorting the results by a field, in reverse order if it starts with "-".
+func (d *DownloadsDB) Search(query, sortBy string) ([]DownloadEntry, error) {
+	matcher, err := ParseDownloadsQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	field, reverse, err := sortField(sortBy, downloadsSortFields)
+	if err != nil {
+		return nil, err
+	}
+	selection := d.db.DB.Select(matcher).OrderBy(field)
+	if reverse {
+		selection = selection.Reverse()
+	}
+	var hits []DownloadEntry
+	if err := selection.Find(&hits); err != nil && err != storm.ErrNotFound {
+		return nil, errors.Wrap(err, "Could not search downloads database")
+	}
+	return hits, nil
+}
+
+// DownloadsTable of search results.
+func DownloadsTable(entries []DownloadEntry) string {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tYEAR\tARTISTS\tTITLE\tFORMAT\tSOURCE\tSIZE\tTRACKERS")
+	for _, dl := range entries {
+		var year, size string
+		if dl.Year != 0 {
+			year = strconv.Itoa(dl.Year)
+		}
+		if dl.Size != 0 {
+			size = humanize.IBytes(dl.Size)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", dl.ID, DownloadFolderStates[dl.State], year, strings.Join(dl.Artists, ", "), dl.Title, strings.TrimSpace(dl.Format+" "+dl.Quality), dl.Source, size, strings.Join(dl.Tracker, ", "))
+	}
+	w.Flush()
+	return b.String()
+}
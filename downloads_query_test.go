@@ -0,0 +1,97 @@
+package varroa
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadsQuery(t *testing.T) {
+	fmt.Println("+ Testing Downloads/query...")
+	check := assert.New(t)
+	_, err := NewConfig("test/test_complete.yaml")
+	check.Nil(err)
+
+	// parsing
+	terms, err := splitDownloadsQuery(`artist:"Miles Davis" tag:jazz  year:1970..1979 -state:rejected "Kind of Blue" title:a:b`)
+	check.Nil(err)
+	check.Equal([]queryTerm{
+		{field: "artist", value: "Miles Davis"},
+		{field: "tag", value: "jazz"},
+		{field: "year", value: "1970..1979"},
+		{field: "state", value: "rejected", negated: true},
+		{value: "Kind of Blue"},
+		{field: "title", value: "a:b"},
+	}, terms)
+	_, err = splitDownloadsQuery(`artist:"Miles`)
+	check.NotNil(err)
+	for _, invalid := range []string{"unknown:x", "year:nineteen", "year:..", "size:big", "state:lost", "snatched:yesterday", "artist:"} {
+		_, err = ParseDownloadsQuery(invalid)
+		check.NotNil(err, invalid)
+	}
+	check.Equal(`artist:"Miles Davis" -tag:"free jazz" year:1970 "Kind of Blue" title:"already quoted"`, DownloadsQueryFromArgs([]string{"artist:Miles Davis", "-tag:free jazz", "year:1970", "Kind of Blue", `title:"already quoted"`}))
+	start, end, err := parseDate("2020-02")
+	check.Nil(err)
+	check.Equal(time.Date(2020, 2, 1, 0, 0, 0, 0, time.Local).Unix(), start)
+	check.Equal(time.Date(2020, 3, 1, 0, 0, 0, 0, time.Local).Unix()-1, end)
+
+	// searching
+	downloads, cleanup := newTestDownloadsDB(t)
+	defer cleanup()
+	snatched := time.Date(2020, 5, 17, 12, 0, 0, 0, time.Local).Unix()
+	for _, dl := range []DownloadEntry{
+		{FolderName: "Miles Davis - Kind of Blue", Artists: []string{"Miles Davis"}, Title: "Kind of Blue", Tags: []string{"jazz", "modal.jazz"}, Year: 1959, Format: "FLAC", Quality: "Lossless", Source: "CD", Tracker: []string{"blue"}, Size: 300000000, TimeSnatched: snatched, RecordLabel: "Columbia", CatalogNumber: "CL 1355"},
+		{FolderName: "Miles Davis - Bitches Brew", Artists: []string{"Miles Davis"}, Title: "Bitches Brew", Tags: []string{"jazz", "fusion"}, Year: 1970, Format: "FLAC", Quality: "24bit Lossless", Source: "Vinyl", Tracker: []string{"blue", "purple"}, Size: 1500000000, TimeSnatched: snatched + 86400*30, State: stateRejected},
+		{FolderName: "Herbie Hancock - Head Hunters", Artists: []string{"Herbie Hancock"}, Title: "Head Hunters", Tags: []string{"jazz", "funk"}, Year: 1973, Format: "MP3", Quality: "320", Source: "WEB", Tracker: []string{"purple"}, Size: 100000000, TimeSnatched: snatched, State: stateAccepted},
+		{FolderName: "Some Band - Some Album", Artists: []string{"Some Band"}, Title: "Some Album", Tags: []string{"rock"}, Year: 1999, Format: "FLAC", Quality: "Lossless", Source: "CD", Tracker: []string{"blue"}},
+	} {
+		dl := dl
+		check.Nil(downloads.db.DB.Save(&dl))
+	}
+	search := func(query, sortBy string) []string {
+		hits, err := downloads.Search(query, sortBy)
+		check.Nil(err, query)
+		var titles []string
+		for _, dl := range hits {
+			titles = append(titles, dl.Title)
+		}
+		return titles
+	}
+	check.Equal([]string{"Kind of Blue", "Bitches Brew", "Head Hunters", "Some Album"}, search("", ""))
+	check.Equal([]string{"Kind of Blue", "Bitches Brew"}, search(`artist:"miles davis"`, ""))
+	check.Equal([]string{"Kind of Blue", "Bitches Brew"}, search(`miles`, ""))
+	check.Equal([]string{"Bitches Brew", "Head Hunters"}, search("tag:jazz year:1970..1979", ""))
+	check.Equal([]string{"Head Hunters"}, search("tag:jazz year:1970..1979 -state:rejected", ""))
+	check.Equal([]string{"Kind of Blue", "Some Album"}, search("year:..1999 -year:1970..1998", ""))
+	check.Equal([]string{"Head Hunters", "Bitches Brew", "Kind of Blue"}, search("tag:jazz", "-year"))
+	check.Nil(search("tag:modal", ""))
+	check.Equal([]string{"Bitches Brew"}, search("size:1GB.. tracker:PURPLE", ""))
+	check.Equal([]string{"Head Hunters", "Kind of Blue"}, search("snatched:2020-05", "title"))
+	check.Equal([]string{"Bitches Brew"}, search("snatched:2020-06..2020", ""))
+	check.Equal([]string{"Kind of Blue"}, search(`label:columbia catnum:"CL 1355" format:flac quality:lossless source:cd`, ""))
+	check.Equal([]string{"Head Hunters"}, search("state:accepted folder:hancock", ""))
+	_, err = downloads.Search("", "artist")
+	check.NotNil(err)
+
+	// output
+	hits, err := downloads.Search("title:head", "")
+	check.Nil(err)
+	table := DownloadsTable(hits)
+	check.Contains(table, "Herbie Hancock")
+	check.Contains(table, "MP3 320")
+
+	// searchable information is loaded from the metadata
+	check.Nil(writeFakeDownload(downloads.root, "Loaded", 12, "Loaded Artist"))
+	dl := DownloadEntry{FolderName: "Loaded"}
+	check.Nil(dl.Load(downloads.root))
+	check.Equal("Release "+filepath.Join(downloads.root, "Loaded"), dl.Title)
+	check.Equal([]string{"jazz"}, dl.Tags)
+	check.Equal(1975, dl.Year)
+	check.Equal("FLAC", dl.Format)
+	check.Equal("Lossless", dl.Quality)
+	check.Equal("CD", dl.Source)
+	check.Equal(uint64(15), dl.Size)
+}
@@ -0,0 +1,133 @@
+package varroa
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/fs"
+	"gitlab.com/catastrophic/assistance/logthis"
+	"gitlab.com/passelecasque/obstruction/tracker"
+)
+
+const (
+	downloadReadyCheckPeriod = 1 * time.Minute
+	downloadReadyQuietPeriod = 2 * time.Minute
+	downloadReadyTimeout     = 48 * time.Hour
+)
+
+// partial file extensions used by common torrent clients while downloading.
+var partialDownloadExtensions = []string{".part", ".!qb", ".!ut", ".crdownload"}
+
+// saveMetadataAndNotifyWhenReady saves the tracker metadata of a snatched release, waits for its download to complete,
+// and sends a notification so that it can be sorted right away.
+func saveMetadataAndNotifyWhenReady(e *Environment, t *tracker.Gazelle, info *TrackerMetadata) {
+	conf := currentConfig()
+	folder := filepath.Join(conf.General.DownloadDir, info.FolderName)
+	if err := info.SaveFromTracker(folder, t); err != nil {
+		logthis.Error(err, logthis.NORMAL)
+		return
+	}
+	if err := waitForDownload(e.lifecycle.Context(), folder, info.Size); err != nil {
+		logthis.Error(errors.Wrap(err, errorWaitingForDownload), logthis.NORMAL)
+		return
+	}
+	// the cover may not have been saved if the download folder was not created yet
+	if err := info.SaveCover(folder); err != nil {
+		logthis.Error(errors.Wrap(err, errorDownloadingTrackerCover), logthis.VERBOSE)
+	}
+
+	// adding to the downloads database to get its ID
+	var additionalSources []string
+	if conf.LibraryConfigured {
+		additionalSources = conf.Library.AdditionalSources
+	}
+	downloads, err := NewDownloadsDB(DefaultDownloadsDB, conf.General.DownloadDir, additionalSources)
+	if err != nil {
+		logthis.Error(errors.Wrap(err, errorAddingDownloadsEntry), logthis.NORMAL)
+		return
+	}
+	dl, err := downloads.AddFolder(info.FolderName)
+	if err != nil {
+		logthis.Error(errors.Wrap(err, errorAddingDownloadsEntry), logthis.NORMAL)
+		return
+	}
+
+	release := info.Release()
+	title := info.FolderName
+	if release != nil {
+		title = release.ShortString()
+	}
+	msg := fmt.Sprintf(releaseReadyNotification, title, dl.ID) + "\n" + info.TextDescription(false)
+	data := &NotificationData{Event: notificationEventReady, Release: release, Metadata: info, DownloadID: dl.ID}
+	if cover := info.coverPath(folder); fs.FileExists(cover) {
+		data.Attachment = cover
+	}
+	if err := NotifyWithData(msg, t.Name, "info", data, e); err != nil {
+		logthis.Error(err, logthis.NORMAL)
+	}
+}
+
+// waitForDownload to be complete, checking periodically, until the daemon stops.
+func waitForDownload(ctx context.Context, folder string, expectedSize uint64) error {
+	timeout := time.After(downloadReadyTimeout)
+	ticker := time.NewTicker(downloadReadyCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			complete, err := downloadIsComplete(folder, expectedSize, downloadReadyQuietPeriod)
+			if err != nil {
+				logthis.Error(err, logthis.VERBOSEST)
+				continue
+			}
+			if complete {
+				return nil
+			}
+		case <-timeout:
+			return errors.New("download did not complete in time: " + folder)
+		case <-ctx.Done():
+			return errors.New("stopped waiting for download: " + folder)
+		}
+	}
+}
+
+// downloadIsComplete if its files, excluding metadata, have the expected size, are not partial,
+// and have not been modified recently.
+func downloadIsComplete(folder string, expectedSize uint64, quietPeriod time.Duration) (bool, error) {
+	if !fs.DirExists(folder) {
+		return false, nil
+	}
+	var totalSize uint64
+	var lastModified time.Time
+	partial := false
+	err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == MetadataDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		for _, ext := range partialDownloadExtensions {
+			if strings.ToLower(filepath.Ext(path)) == ext {
+				partial = true
+			}
+		}
+		totalSize += uint64(info.Size())
+		if info.ModTime().After(lastModified) {
+			lastModified = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return !partial && totalSize != 0 && totalSize >= expectedSize && time.Since(lastModified) >= quietPeriod, nil
+}
@@ -0,0 +1,49 @@
+package varroa
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadIsComplete(t *testing.T) {
+	fmt.Println("+ Testing download completion...")
+	check := assert.New(t)
+
+	fakeDownload := "test/fake_download"
+	check.Nil(os.MkdirAll(filepath.Join(fakeDownload, MetadataDir), 0777))
+	defer os.RemoveAll(fakeDownload)
+
+	// not created yet
+	complete, err := downloadIsComplete("test/does_not_exist", 10, 0)
+	check.Nil(err)
+	check.False(complete)
+	// metadata only
+	check.Nil(ioutil.WriteFile(filepath.Join(fakeDownload, MetadataDir, "origin.json"), []byte("0123456789"), 0777))
+	complete, err = downloadIsComplete(fakeDownload, 10, 0)
+	check.Nil(err)
+	check.False(complete)
+	// partial file
+	check.Nil(ioutil.WriteFile(filepath.Join(fakeDownload, "01.flac.part"), []byte("0123456789"), 0777))
+	complete, err = downloadIsComplete(fakeDownload, 10, 0)
+	check.Nil(err)
+	check.False(complete)
+	// complete, but too recent
+	check.Nil(os.Rename(filepath.Join(fakeDownload, "01.flac.part"), filepath.Join(fakeDownload, "01.flac")))
+	complete, err = downloadIsComplete(fakeDownload, 10, time.Hour)
+	check.Nil(err)
+	check.False(complete)
+	// complete
+	complete, err = downloadIsComplete(fakeDownload, 10, 0)
+	check.Nil(err)
+	check.True(complete)
+	// too small
+	complete, err = downloadIsComplete(fakeDownload, 11, 0)
+	check.Nil(err)
+	check.False(complete)
+}
@@ -0,0 +1,303 @@
+package varroa
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/fs"
+	"gitlab.com/catastrophic/assistance/logthis"
+	"gitlab.com/catastrophic/assistance/strslice"
+	"gitlab.com/passelecasque/obstruction/tracker"
+)
+
+// SortDecision about a download, made from the terminal or from the web interface.
+// Empty values are replaced by the first candidate offered for them.
+type SortDecision struct {
+	State           int
+	MainArtist      string
+	MainArtistAlias string
+	Category        string
+	AddToPlaylists  bool
+}
+
+// SortOptions offered to the user to file a download in the library, default values first.
+type SortOptions struct {
+	MainArtists       []string
+	MainArtistAliases []string
+	Categories        []string
+	Decision          SortDecision
+	Path              string
+	PathExists        bool
+}
+
+// mainArtists of a release, not taking featured artists into account.
+func mainArtists(info *TrackerMetadata) []string {
+	var artists []string
+	for _, a := range info.Artists {
+		if a.Role == "Main" || a.Role == "Composer" {
+			artists = append(artists, a.Name)
+		}
+	}
+	return artists
+}
+
+// mainArtistCandidates for filing a release.
+func mainArtistCandidates(info *TrackerMetadata) []string {
+	artists := mainArtists(info)
+	switch {
+	case len(artists) == 0:
+		return []string{info.MainArtist}
+	case len(artists) == 1:
+		return artists
+	}
+	candidates := []string{}
+	if len(artists) > 3 {
+		candidates = append(candidates, tracker.VariousArtists)
+	}
+	candidates = append(candidates, strings.Join(artists, ", "))
+	return append(candidates, artists...)
+}
+
+// libraryAlias for an artist, from the configuration.
+func libraryAlias(library *ConfigLibrary, artist, title string) (string, bool) {
+	for alias, aliasArtists := range library.Aliases {
+		if artistInSlice(artist, title, aliasArtists) {
+			return alias, true
+		}
+	}
+	return "", false
+}
+
+// libraryCategory for an artist alias, from the configuration.
+func libraryCategory(library *ConfigLibrary, alias, title string) (string, bool) {
+	for category, categoryArtists := range library.Categories {
+		if artistInSlice(alias, title, categoryArtists) {
+			return category, true
+		}
+	}
+	return "", false
+}
+
+// chooseValue among candidates, the first one being the default.
+func chooseValue(value string, candidates []string) string {
+	if value == "" {
+		return candidates[0]
+	}
+	return value
+}
+
+// resolveSortOptions for a release, given the choices already made. Only modifies info.
+func resolveSortOptions(info *TrackerMetadata, library *ConfigLibrary, decision SortDecision, releaseFolder string) (SortOptions, error) {
+	options := SortOptions{Decision: decision}
+	// main artist
+	options.MainArtists = mainArtistCandidates(info)
+	loadedAlias := info.MainArtistAlias
+	info.MainArtist = chooseValue(decision.MainArtist, options.MainArtists)
+	// main artist alias, preferring the one from the configuration
+	if alias, ok := libraryAlias(library, info.MainArtist, info.Title); ok {
+		options.MainArtistAliases = append(options.MainArtistAliases, alias)
+	}
+	options.MainArtistAliases = append(options.MainArtistAliases, info.MainArtist, loadedAlias)
+	strslice.RemoveDuplicates(&options.MainArtistAliases)
+	info.MainArtistAlias = chooseValue(decision.MainArtistAlias, options.MainArtistAliases)
+	// category, preferring the one from the configuration
+	if category, ok := libraryCategory(library, info.MainArtistAlias, info.Title); ok {
+		options.Categories = append(options.Categories, category)
+	}
+	options.Categories = append(options.Categories, info.Category)
+	options.Categories = append(options.Categories, info.Tags...)
+	strslice.RemoveDuplicates(&options.Categories)
+	info.Category = chooseValue(decision.Category, options.Categories)
+
+	options.Decision.MainArtist = info.MainArtist
+	options.Decision.MainArtistAlias = info.MainArtistAlias
+	options.Decision.Category = info.Category
+	path, err := info.GeneratePath(library.folderTemplate(info), releaseFolder)
+	if err != nil {
+		return options, errors.Wrap(err, "could not generate a library folder name")
+	}
+	options.Path = path
+	options.PathExists = fs.DirExists(filepath.Join(library.Directory, options.Path))
+	return options, nil
+}
+
+// SortOptions for a download, merging the candidates from all trackers.
+func (d *DownloadEntry) SortOptions(root string, config *Config, decision SortDecision) (SortOptions, error) {
+	var options SortOptions
+	if !d.HasTrackerMetadata {
+		return options, errors.New("no tracker metadata found for " + d.FolderName)
+	}
+	var found bool
+	for _, t := range d.Tracker {
+		info, err := d.getMetadata(root, t)
+		if err != nil {
+			logthis.Info("Could not find metadata for tracker "+t, logthis.NORMAL)
+			continue
+		}
+		trackerOptions, err := resolveSortOptions(&info, config.Library, decision, filepath.Join(root, d.FolderName))
+		if err != nil {
+			return options, err
+		}
+		// the path is generated from the last tracker, as when exporting
+		trackerOptions.MainArtists = append(options.MainArtists, trackerOptions.MainArtists...)
+		trackerOptions.MainArtistAliases = append(options.MainArtistAliases, trackerOptions.MainArtistAliases...)
+		trackerOptions.Categories = append(options.Categories, trackerOptions.Categories...)
+		options = trackerOptions
+		found = true
+	}
+	if !found {
+		return options, errors.New("could not load tracker metadata for " + d.FolderName)
+	}
+	strslice.RemoveDuplicates(&options.MainArtists)
+	strslice.RemoveDuplicates(&options.MainArtistAliases)
+	strslice.RemoveDuplicates(&options.Categories)
+	return options, nil
+}
+
+// applySortDecision to the user metadata of all trackers, returns the folder name in the library.
+func (d *DownloadEntry) applySortDecision(root string, config *Config, decision SortDecision) (string, error) {
+	var newName string
+	if !d.HasTrackerMetadata {
+		return newName, nil
+	}
+	for _, t := range d.Tracker {
+		info, err := d.getMetadata(root, t)
+		if err != nil {
+			logthis.Info("Could not find metadata for tracker "+t, logthis.NORMAL)
+			continue
+		}
+		options, err := resolveSortOptions(&info, config.Library, decision, filepath.Join(root, d.FolderName))
+		if err != nil {
+			return newName, err
+		}
+		// write to original user_metadata.json
+		if err := info.UpdateUserJSON(filepath.Join(root, d.FolderName, MetadataDir), info.MainArtist, info.MainArtistAlias, info.Category); err != nil {
+			return newName, errors.Wrap(err, "could not update user metadata with main artist, main artists alias, or category")
+		}
+		newName = options.Path
+	}
+	return newName, nil
+}
+
+// exportToLibrary under a new name, adding it to the current playlists if required.
+// If the destination already exists, the configured conflict strategy decides where the release goes, using ask if it
+// is configured to ask and asking is possible. It returns where the release was exported, relative to the library.
+func (d *DownloadEntry) exportToLibrary(root, newName string, config *Config, addToPlaylists bool, ask func(string) string) (string, error) {
+	if newName == "" {
+		return "", errors.New("could not generate a library folder name for " + d.FolderName)
+	}
+	journal := newLibraryJournal(DefaultLibraryJournal, "export "+d.FolderName, false)
+	release := libraryRelease{folder: filepath.Join(root, d.FolderName)}
+	if len(d.Tracker) != 0 {
+		if info, err := d.getMetadata(root, d.Tracker[0]); err == nil {
+			release.info = info
+		}
+	}
+	placement, err := placeInLibrary(journal, config.Library, release, newName, ask)
+	if err != nil {
+		return "", err
+	}
+	movedExisting := false
+	err = placement.makeRoom(journal, config.Library, func(oldPath, newPath string) error {
+		movedExisting = true
+		if config.playlistDirectoryConfigured {
+			updatePlaylists(journal, loadPlaylists(config.Library.PlaylistDirectory), oldPath, newPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "Error making room for download "+d.FolderName)
+	}
+	newName = placement.destination
+	// if moving downloads, removing source
+	if config.Library.MoveSorted {
+		err = errors.Wrap(journal.moveDirAcross(release.folder, filepath.Join(config.Library.Directory, newName), config.Library.UseHardLinks), "Error moving download "+d.FolderName)
+	} else {
+		err = errors.Wrap(journal.copyDir(release.folder, filepath.Join(config.Library.Directory, newName), config.Library.UseHardLinks), "Error exporting download "+d.FolderName)
+	}
+	if err != nil {
+		// the release that was replaced must not be lost
+		if restoreErr := placement.restore(journal, config.Library); restoreErr != nil {
+			logthis.Error(errors.Wrap(restoreErr, "Error restoring "+newName+" from the trash"), logthis.NORMAL)
+		}
+		return "", err
+	}
+	// hard links are shared with the downloads, which must not be modified
+	if config.Library.TrackTemplate != "" && !config.Library.UseHardLinks {
+		if err := release.info.renameTracks(journal, filepath.Join(config.Library.Directory, newName), config.Library.TrackTemplate); err != nil {
+			logthis.Error(errors.Wrap(err, "Error renaming tracks of "+newName), logthis.NORMAL)
+		}
+	}
+	if config.Library.WriteTags && !config.Library.UseHardLinks {
+		changes, err := release.info.writeTags(filepath.Join(config.Library.Directory, newName), config.Library.EmbedCover, false)
+		if err != nil {
+			logthis.Error(errors.Wrap(err, "Error writing tags of "+newName), logthis.NORMAL)
+		}
+		for _, c := range changes {
+			logthis.Info("Tagged "+c.String(), logthis.VERBOSEST)
+		}
+	}
+	updateLibraryDB(config.Library, func(l *LibraryDB) error {
+		// the release that was already there has been moved or trashed
+		if movedExisting || placement.trash != "" {
+			if err := l.Scan(); err != nil {
+				return err
+			}
+		}
+		_, err := l.Add(newName, d.ID)
+		return err
+	})
+	if config.playlistDirectoryConfigured && addToPlaylists {
+		if err := addReleaseToCurrentPlaylists(journal, config.Library.PlaylistDirectory, config.Library.Directory, newName); err != nil {
+			return newName, err
+		}
+	}
+	return newName, nil
+}
+
+// Decide what to do with a download, exporting it to the library if it is accepted.
+func (d *DownloadsDB) Decide(e *Environment, id int, decision SortDecision) (DownloadEntry, error) {
+	dl, err := d.FindByID(id)
+	if err != nil {
+		return dl, errors.Wrap(err, "Error finding such an ID in the downloads database")
+	}
+	if err := dl.Load(d.root); err != nil {
+		return dl, err
+	}
+	switch decision.State {
+	case stateAccepted:
+		conf := currentConfig()
+		if !conf.LibraryConfigured {
+			return dl, errors.New("Cannot export download, library is not configured")
+		}
+		if dl.State == stateAccepted {
+			return dl, errors.New("Download " + dl.FolderName + " has already been accepted")
+		}
+		newName, err := dl.applySortDecision(d.root, conf, decision)
+		if err != nil {
+			return dl, err
+		}
+		// there is no one to ask
+		if newName, err = dl.exportToLibrary(d.root, newName, conf, decision.AddToPlaylists, nil); err != nil {
+			return dl, err
+		}
+		logthis.Info(fmt.Sprintf("Download #%d exported to the library as %s.", dl.ID, newName), logthis.NORMAL)
+	case stateRejected, stateUnsorted:
+	default:
+		return dl, errors.New("invalid download state")
+	}
+	dl.State = decision.State
+	if err := d.db.DB.Update(&dl); err != nil {
+		return dl, errors.Wrap(err, "Error saving new state for download "+dl.FolderName)
+	}
+	// storm does not update zero values
+	if dl.State == stateUnsorted {
+		if err := d.db.DB.UpdateField(&dl, "State", dl.State); err != nil {
+			return dl, errors.Wrap(err, "Error saving new state for download "+dl.FolderName)
+		}
+	}
+	e.events.PublishDownloadState(dl)
+	return dl, nil
+}
@@ -0,0 +1,174 @@
+package varroa
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/logthis"
+	"gitlab.com/passelecasque/obstruction/tracker"
+)
+
+const (
+	// what sort rules do with the downloads they match
+	sortRuleAccept = "accept"
+	sortRuleReject = "reject"
+	sortRuleDefer  = "defer"
+
+	// main artist policies of sort rules, other values are used as the main artist
+	mainArtistFirst   = "first"
+	mainArtistAll     = "all"
+	mainArtistVarious = "various"
+
+	// shown instead of a rule name when sorting is not decided by a rule
+	sortedManually      = "(manual)"
+	sortedAutomatically = "(automatic)"
+)
+
+var sortRuleDecisions = []string{sortRuleAccept, sortRuleReject, sortRuleDefer}
+
+// containsAnyFold returns true if one of the values is in the list, ignoring case.
+func containsAnyFold(list []string, values ...string) bool {
+	for _, l := range list {
+		for _, v := range values {
+			if strings.EqualFold(l, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matches returns true if the download satisfies all the criteria of the rule.
+// filters are the names of the autosnatch filters that snatched it.
+func (cr *ConfigSortRule) matches(dl *DownloadEntry, filters []string) bool {
+	if len(cr.Filter) != 0 && !containsAnyFold(cr.Filter, filters...) {
+		return false
+	}
+	if len(cr.Tags) != 0 && !containsAnyFold(cr.Tags, dl.Tags...) {
+		return false
+	}
+	if len(cr.Artist) != 0 && !containsAnyFold(cr.Artist, dl.Artists...) {
+		return false
+	}
+	if len(cr.Format) != 0 && !containsAnyFold(cr.Format, dl.Format) {
+		return false
+	}
+	if len(cr.Quality) != 0 && !containsAnyFold(cr.Quality, dl.Quality) {
+		return false
+	}
+	if len(cr.Source) != 0 && !containsAnyFold(cr.Source, dl.Source) {
+		return false
+	}
+	if cr.MaxSizeMB != 0 && uint64(cr.MaxSizeMB) < dl.Size/(1024*1024) {
+		return false
+	}
+	if cr.MinSizeMB != 0 && uint64(cr.MinSizeMB) > dl.Size/(1024*1024) {
+		return false
+	}
+	return true
+}
+
+// matchSortRule returns the first rule matching the download, or nil.
+func matchSortRule(rules []*ConfigSortRule, dl *DownloadEntry, filters []string) *ConfigSortRule {
+	for _, r := range rules {
+		if r.matches(dl, filters) {
+			return r
+		}
+	}
+	return nil
+}
+
+// ruleMainArtist for a release, from the main artist policy of a rule.
+func ruleMainArtist(policy string, info *TrackerMetadata) string {
+	artists := mainArtists(info)
+	switch policy {
+	case mainArtistFirst, mainArtistAll:
+		if len(artists) == 0 {
+			return info.MainArtist
+		}
+		if policy == mainArtistFirst {
+			return artists[0]
+		}
+		return strings.Join(artists, ", ")
+	case mainArtistVarious:
+		return tracker.VariousArtists
+	}
+	return policy
+}
+
+// sortDecision for a download accepted by the rule.
+func (cr *ConfigSortRule) sortDecision(root string, dl *DownloadEntry) (SortDecision, error) {
+	decision := SortDecision{State: stateAccepted, MainArtistAlias: cr.Alias, Category: cr.Category, AddToPlaylists: true}
+	if cr.MainArtist != "" && dl.HasTrackerMetadata {
+		info, err := dl.getMetadata(root, dl.Tracker[0])
+		if err != nil {
+			return decision, err
+		}
+		decision.MainArtist = ruleMainArtist(cr.MainArtist, &info)
+	}
+	return decision, nil
+}
+
+// applySortRule to a download, without asking anything.
+func (d *DownloadEntry) applySortRule(root string, config *Config, rule *ConfigSortRule) error {
+	if err := d.Load(root); err != nil {
+		return err
+	}
+	switch rule.Decision {
+	case sortRuleReject:
+		d.State = stateRejected
+	case sortRuleDefer:
+		d.State = stateUnsorted
+	case sortRuleAccept:
+		decision, err := rule.sortDecision(root, d)
+		if err != nil {
+			return errors.Wrap(err, "could not apply sort rule "+rule.Name)
+		}
+		return d.exportWithDecision(root, config, decision, false)
+	}
+	return nil
+}
+
+// snatchFilters that snatched a download, from the snatch history.
+func snatchFilters(stats *StatsDB, dl *DownloadEntry) []string {
+	var filters []string
+	if stats == nil {
+		return filters
+	}
+	for i, t := range dl.Tracker {
+		if i < len(dl.TrackerID) {
+			if f := stats.SnatchFilter(t, strconv.Itoa(dl.TrackerID[i])); f != "" {
+				filters = append(filters, f)
+			}
+		}
+	}
+	return filters
+}
+
+// sortReportEntry about how a download was sorted.
+type sortReportEntry struct {
+	id     int
+	folder string
+	rule   string
+	state  int
+}
+
+// sortReport of a batch of downloads, showing which rule decided each one.
+type sortReport []sortReportEntry
+
+func (r sortReport) String() string {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tFolder\tRule\tState")
+	for _, e := range r {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", e.id, e.folder, e.rule, DownloadFolderStates[e.state])
+	}
+	if err := w.Flush(); err != nil {
+		logthis.Error(err, logthis.VERBOSE)
+	}
+	return b.String()
+}
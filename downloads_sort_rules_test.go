@@ -0,0 +1,70 @@
+package varroa
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/passelecasque/obstruction/tracker"
+)
+
+func TestSortRules(t *testing.T) {
+	fmt.Println("+ Testing Downloads/sort rules...")
+	check := assert.New(t)
+	c, err := NewConfig("test/test_complete.yaml")
+	check.Nil(err)
+	rules := c.Library.SortRules
+
+	// matching
+	dl := &DownloadEntry{ID: 1, FolderName: "Release", Artists: []string{"Artist"}, Tags: []string{"free.jazz", "Jazz"}, Format: tracker.FormatFLAC, Quality: tracker.QualityLossless, Size: 500 * 1024 * 1024}
+	check.Equal("jazz", matchSortRule(rules, dl, []string{"other", "perfect"}).Name)
+	check.Nil(matchSortRule(rules, dl, nil))
+	dl.Size = 3000 * 1024 * 1024
+	check.Equal("big", matchSortRule(rules, dl, nil).Name)
+	dl.Size = 0
+	dl.Quality = tracker.Quality320
+	check.Equal("lossy", matchSortRule(rules, dl, nil).Name)
+	rule := &ConfigSortRule{Name: "artist", Artist: []string{"artist"}, Source: []string{tracker.SourceWEB}, MaxSizeMB: 10, Decision: sortRuleReject}
+	check.False(rule.matches(dl, nil))
+	dl.Source = tracker.SourceWEB
+	check.True(rule.matches(dl, nil))
+	dl.Size = 20 * 1024 * 1024
+	check.False(rule.matches(dl, nil))
+
+	// checking rules
+	check.NotNil((&ConfigSortRule{Name: "r", Decision: "maybe"}).check())
+	check.NotNil((&ConfigSortRule{Name: "r", Decision: sortRuleReject, Category: "Jazz"}).check())
+	check.NotNil((&ConfigSortRule{Name: "r", Decision: sortRuleAccept, Format: []string{"OGG"}}).check())
+	check.NotNil((&ConfigSortRule{Name: "r", Decision: sortRuleAccept, MinSizeMB: 10, MaxSizeMB: 5}).check())
+	check.Nil((&ConfigSortRule{Name: "r", Decision: sortRuleAccept, MainArtist: "Someone"}).check())
+
+	// main artist policies
+	info := &TrackerMetadata{MainArtist: "A, B", Artists: []TrackerMetadataArtist{{Name: "A", Role: "Main"}, {Name: "C", Role: "Guest"}, {Name: "B", Role: "Composer"}}}
+	check.Equal("A", ruleMainArtist(mainArtistFirst, info))
+	check.Equal("A, B", ruleMainArtist(mainArtistAll, info))
+	check.Equal(tracker.VariousArtists, ruleMainArtist(mainArtistVarious, info))
+	check.Equal("Someone", ruleMainArtist("Someone", info))
+	info.Artists = nil
+	check.Equal("A, B", ruleMainArtist(mainArtistFirst, info))
+
+	// applying rules
+	root, err := ioutil.TempDir("", "varroa-downloads")
+	check.Nil(err)
+	defer os.RemoveAll(root)
+	check.Nil(writeFakeDownload(root, "Release", 12, "Artist"))
+	dl = &DownloadEntry{ID: 1, FolderName: "Release"}
+	check.Nil(dl.applySortRule(root, c, rules[2]))
+	check.Equal(stateRejected, dl.State)
+	check.Nil(dl.applySortRule(root, c, rules[1]))
+	check.Equal(stateUnsorted, dl.State)
+	decision, err := rules[0].sortDecision(root, dl)
+	check.Nil(err)
+	check.Equal(SortDecision{State: stateAccepted, MainArtist: "Artist", Category: "Jazz", AddToPlaylists: true}, decision)
+
+	// reporting
+	report := sortReport{{id: 1, folder: "Release", rule: "lossy", state: stateRejected}, {id: 2, folder: "Other", rule: sortedManually, state: stateAccepted}}
+	check.Contains(report.String(), "Release  lossy     rejected")
+	check.Contains(report.String(), "Other    (manual)  accepted")
+}
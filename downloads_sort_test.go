@@ -0,0 +1,100 @@
+package varroa
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/passelecasque/obstruction/tracker"
+)
+
+func TestSortOptions(t *testing.T) {
+	fmt.Println("+ Testing Downloads/sort options...")
+	check := assert.New(t)
+
+	library := &ConfigLibrary{
+		Directory:  "test",
+		Template:   "$c/$ma/$a - $t",
+		Templates:  map[string]string{"Category": "$c/{{$ma | the | initial}}/$ma/$t"},
+		Aliases:    map[string][]string{"The Alias": {"Artist B"}},
+		Categories: map[string][]string{"Category": {"The Alias"}},
+	}
+	newInfo := func() *TrackerMetadata {
+		return &TrackerMetadata{
+			Title:           "Title",
+			Artists:         []TrackerMetadataArtist{{Name: "Artist A", Role: "Main"}, {Name: "Artist B", Role: "Main"}, {Name: "Artist C", Role: "Guest"}},
+			Tags:            []string{"tag1", "tag2"},
+			MainArtist:      "Artist A, Artist B",
+			MainArtistAlias: "Artist A, Artist B",
+			Category:        "tag1",
+		}
+	}
+
+	// main artist candidates
+	check.Equal([]string{"Artist A, Artist B", "Artist A", "Artist B"}, mainArtistCandidates(newInfo()))
+	info := newInfo()
+	info.Artists = append(info.Artists, TrackerMetadataArtist{Name: "Artist D", Role: "Composer"}, TrackerMetadataArtist{Name: "Artist E", Role: "Main"})
+	check.Equal(tracker.VariousArtists, mainArtistCandidates(info)[0])
+	info.Artists = []TrackerMetadataArtist{{Name: "Artist C", Role: "Guest"}}
+	check.Equal([]string{"Artist A, Artist B"}, mainArtistCandidates(info))
+
+	// defaults
+	info = newInfo()
+	options, err := resolveSortOptions(info, library, SortDecision{}, "")
+	check.Nil(err)
+	check.Equal([]string{"Artist A, Artist B", "Artist A", "Artist B"}, options.MainArtists)
+	check.Equal([]string{"Artist A, Artist B"}, options.MainArtistAliases)
+	check.Equal([]string{"tag1", "tag2"}, options.Categories)
+	check.Equal(SortDecision{MainArtist: "Artist A, Artist B", MainArtistAlias: "Artist A, Artist B", Category: "tag1"}, options.Decision)
+	check.Equal("tag1/Artist A, Artist B/Artist A, Artist B - Title", options.Path)
+	check.False(options.PathExists)
+
+	// choosing a main artist with an alias and a category in the configuration
+	info = newInfo()
+	options, err = resolveSortOptions(info, library, SortDecision{MainArtist: "Artist B", AddToPlaylists: true}, "")
+	check.Nil(err)
+	check.Equal([]string{"The Alias", "Artist B", "Artist A, Artist B"}, options.MainArtistAliases)
+	check.Equal([]string{"Category", "tag1", "tag2"}, options.Categories)
+	check.Equal(SortDecision{MainArtist: "Artist B", MainArtistAlias: "The Alias", Category: "Category", AddToPlaylists: true}, options.Decision)
+	check.Equal("Category/A/The Alias/Title", options.Path)
+	check.Equal("The Alias", info.MainArtistAlias)
+
+	// choosing values that were not offered
+	info = newInfo()
+	options, err = resolveSortOptions(info, library, SortDecision{MainArtist: "Artist B", MainArtistAlias: "Someone", Category: "Other"}, "")
+	check.Nil(err)
+	check.Equal([]string{"tag1", "tag2"}, options.Categories)
+	check.Equal("Other/Someone/Artist B - Title", options.Path)
+
+	// invalid templates
+	library.Template = "$c/{{if $a}}$a"
+	_, err = resolveSortOptions(newInfo(), library, SortDecision{}, "")
+	check.NotNil(err)
+}
+
+func TestDownloadsDecide(t *testing.T) {
+	fmt.Println("+ Testing Downloads/decide...")
+	check := assert.New(t)
+	c, err := NewConfig("test/test_complete.yaml")
+	check.Nil(err)
+
+	downloads, cleanup := newTestDownloadsDB(t)
+	defer cleanup()
+	e := NewEnvironment()
+	e.SetConfig(c)
+	check.Nil(writeFakeDownload(downloads.root, "Release", 12, "Artist"))
+	dl := DownloadEntry{FolderName: "Release", State: stateRejected}
+	check.Nil(downloads.db.DB.Save(&dl))
+
+	// deferring brings the download back to unsorted
+	_, err = downloads.Decide(e, dl.ID, SortDecision{State: stateUnsorted})
+	check.Nil(err)
+	dl, err = downloads.FindByID(dl.ID)
+	check.Nil(err)
+	check.Equal(stateUnsorted, dl.State)
+
+	// accepted downloads are not exported again
+	check.Nil(downloads.db.DB.UpdateField(&dl, "State", stateAccepted))
+	_, err = downloads.Decide(e, dl.ID, SortDecision{State: stateAccepted})
+	check.NotNil(err)
+}
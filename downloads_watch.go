@@ -0,0 +1,214 @@
+package varroa
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/fs"
+	"gitlab.com/catastrophic/assistance/logthis"
+)
+
+const (
+	// changes are only taken into account once the download folders have been quiet for a while, or once the
+	// oldest pending change has waited downloadsWatchMaxDelayFactor times as long, so that constant activity
+	// does not postpone updates forever
+	downloadsWatchDelay          = 5 * time.Second
+	downloadsWatchMaxDelayFactor = 6
+
+	errorWatchingDownloads = "Error watching the download directories"
+)
+
+// downloadsWatcher updates the downloads database when folders appear, change, or disappear in the download
+// directories. It watches the directories themselves, every download folder, and their metadata directories.
+type downloadsWatcher struct {
+	downloads *DownloadsDB
+	watcher   *fsnotify.Watcher
+	delay     time.Duration
+	maxDelay  time.Duration
+	pending   map[string]bool
+	// when the oldest pending change happened
+	pendingSince time.Time
+	// only the first watch that could not be added is logged, watch limits are usually reached all at once
+	watchErrors int
+}
+
+func newDownloadsWatcher(downloads *DownloadsDB, delay time.Duration) (*downloadsWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, errorWatchingDownloads)
+	}
+	dw := &downloadsWatcher{downloads: downloads, watcher: watcher, delay: delay, maxDelay: downloadsWatchMaxDelayFactor * delay, pending: make(map[string]bool)}
+	for _, root := range downloads.roots() {
+		if err := watcher.Add(root); err != nil {
+			watcher.Close()
+			return nil, errors.Wrap(err, errorWatchingDownloads+": "+root)
+		}
+		folders, err := filepath.Glob(filepath.Join(root, "*"))
+		if err != nil {
+			watcher.Close()
+			return nil, errors.Wrap(err, errorWatchingDownloads+": "+root)
+		}
+		for _, folder := range folders {
+			dw.watchFolder(folder)
+		}
+	}
+	if dw.watchErrors != 0 {
+		logthis.Info(fmt.Sprintf("Could not watch %d folder(s), their changes will only be found by scanning the downloads", dw.watchErrors), logthis.NORMAL)
+	}
+	return dw, nil
+}
+
+// watchFolder of a download and its metadata directory, if they exist.
+func (dw *downloadsWatcher) watchFolder(folder string) {
+	for _, dir := range []string{folder, filepath.Join(folder, MetadataDir)} {
+		if !fs.DirExists(dir) {
+			return
+		}
+		if err := dw.watcher.Add(dir); err != nil {
+			if dw.watchErrors == 0 {
+				logthis.Error(errors.Wrap(err, errorWatchingDownloads+": "+dir), logthis.NORMAL)
+			}
+			dw.watchErrors++
+			return
+		}
+	}
+}
+
+// folderOf a path inside the download directories: the root it was found in and the name of the download folder.
+func (dw *downloadsWatcher) folderOf(path string) (string, string, bool) {
+	for _, root := range dw.downloads.roots() {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return root, strings.Split(rel, string(filepath.Separator))[0], true
+	}
+	return "", "", false
+}
+
+// handle a file system event, remembering which download folder changed.
+func (dw *downloadsWatcher) handle(event fsnotify.Event) {
+	root, folderName, ok := dw.folderOf(filepath.Clean(event.Name))
+	if !ok {
+		return
+	}
+	// new download folders, and the metadata directories created inside them, are watched too
+	if event.Op&fsnotify.Create != 0 {
+		folder := filepath.Join(root, folderName)
+		if filepath.Clean(event.Name) == folder {
+			dw.watchFolder(folder)
+		} else if filepath.Clean(event.Name) == filepath.Join(folder, MetadataDir) && fs.DirExists(event.Name) {
+			if err := dw.watcher.Add(event.Name); err != nil {
+				logthis.Error(errors.Wrap(err, errorWatchingDownloads+": "+event.Name), logthis.VERBOSE)
+			}
+		}
+	}
+	dw.pending[folderName] = true
+}
+
+// refreshPending folders in the database.
+func (dw *downloadsWatcher) refreshPending() {
+	for folderName := range dw.pending {
+		if err := dw.downloads.RefreshFolder(folderName); err != nil {
+			logthis.Error(errors.Wrap(err, "Error updating download entry for "+folderName), logthis.VERBOSE)
+		}
+	}
+	dw.pending = make(map[string]bool)
+}
+
+// run until ctx is cancelled.
+func (dw *downloadsWatcher) run(ctx context.Context) {
+	defer dw.watcher.Close()
+	timer := time.NewTimer(dw.delay)
+	timer.Stop()
+	for {
+		select {
+		case event, ok := <-dw.watcher.Events:
+			if !ok {
+				return
+			}
+			if len(dw.pending) == 0 {
+				dw.pendingSince = time.Now()
+			}
+			dw.handle(event)
+			wait := dw.delay
+			if remaining := dw.maxDelay - time.Since(dw.pendingSince); remaining < wait {
+				wait = remaining
+			}
+			timer.Reset(wait)
+		case <-timer.C:
+			dw.refreshPending()
+		case err, ok := <-dw.watcher.Errors:
+			if !ok {
+				return
+			}
+			logthis.Error(errors.Wrap(err, errorWatchingDownloads), logthis.NORMAL)
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// downloadsSubsystem scans the download directories on startup, and then keeps the downloads database up to date
+// by watching them.
+type downloadsSubsystem struct {
+	e      *Environment
+	done   chan struct{}
+	cancel context.CancelFunc
+}
+
+func (ds *downloadsSubsystem) Name() string {
+	return subsystemDownloads
+}
+
+func (ds *downloadsSubsystem) Start(ctx context.Context) error {
+	var additionalSources []string
+	if ds.e.config.LibraryConfigured {
+		additionalSources = ds.e.config.Library.AdditionalSources
+	}
+	downloads, err := NewDownloadsDB(DefaultDownloadsDB, ds.e.config.General.DownloadDir, additionalSources)
+	if err != nil {
+		return errors.Wrap(err, "Error loading downloads database")
+	}
+	// watching first so that nothing is missed while scanning
+	watcher, err := newDownloadsWatcher(downloads, downloadsWatchDelay)
+	if err != nil {
+		return err
+	}
+	ctx, ds.cancel = context.WithCancel(ctx)
+	ds.done = make(chan struct{})
+	go func() {
+		defer close(ds.done)
+		if err := downloads.Scan(); err != nil {
+			logthis.Error(errors.Wrap(err, "Error scanning downloads"), logthis.NORMAL)
+		}
+		watcher.run(ctx)
+	}()
+	return nil
+}
+
+// Stop watching, once the current scan is over.
+func (ds *downloadsSubsystem) Stop(ctx context.Context) error {
+	ds.cancel()
+	select {
+	case <-ds.done:
+		return nil
+	case <-ctx.Done():
+		return errors.New("timeout waiting for downloads scan")
+	}
+}
+
+func (ds *downloadsSubsystem) Health() error {
+	select {
+	case <-ds.done:
+		return errors.New("not watching downloads")
+	default:
+		return nil
+	}
+}
@@ -47,6 +47,8 @@ type Environment struct {
 	daemonUnixSocket *ipc.UnixSocket
 	startTime        time.Time
 	ircClient        *irc.Connection
+	events           *EventHub
+	lifecycle        *Lifecycle
 }
 
 // NewEnvironment prepares a new Environment.
@@ -57,6 +59,8 @@ func NewEnvironment() *Environment {
 	// make maps
 	e.Trackers = make(map[string]*tracker.Gazelle)
 	e.daemonUnixSocket = ipc.NewUnixSocketServer(daemonSocket)
+	e.events = NewEventHub(eventsBufferSize)
+	e.lifecycle = NewLifecycle()
 	// irc
 	e.ircClient = nil
 	return e
@@ -73,7 +77,12 @@ func (e *Environment) LoadConfiguration() error {
 	if err != nil {
 		return err
 	}
+	return e.applyConfiguration()
+}
 
+// applyConfiguration to the theme and git repository.
+func (e *Environment) applyConfiguration() error {
+	var err error
 	// get theme for stats & webserver
 	if e.config.statsConfigured {
 		theme := knownThemes[darkOrange]
@@ -203,23 +212,44 @@ func (e *Environment) DeployToGitlabPages() error {
 	return nil
 }
 
-func GoGoRoutines(e *Environment, noDaemon bool) {
-	//  tracker-dependent goroutines
-	for _, t := range e.Trackers {
-		if e.config.autosnatchConfigured {
-			go ircHandler(e, t)
+// configuredSubsystems for the current configuration, in starting order.
+func (e *Environment) configuredSubsystems() []Subsystem {
+	var subsystems []Subsystem
+	//  tracker-dependent subsystems
+	for _, as := range e.config.Autosnatch {
+		if t, ok := e.Trackers[as.Tracker]; ok {
+			subsystems = append(subsystems, newIRCSubsystem(e, t))
 		}
 	}
-	// general goroutines
+	// general subsystems
 	if e.config.statsConfigured {
-		go monitorAllStats(e)
+		subsystems = append(subsystems, &statsSubsystem{e: e})
 	}
 	if e.config.webserverConfigured {
-		go webServer(e)
+		subsystems = append(subsystems, &webServerSubsystem{e: e})
 	}
-	// background goroutines
-	go automatedTasks(e)
+	if e.config.webserverMetadata {
+		subsystems = append(subsystems, &downloadsSubsystem{e: e})
+	}
+	// background subsystems
+	return append(subsystems, &schedulerSubsystem{e: e})
+}
+
+// GoGoRoutines registers and starts the subsystems of the daemon.
+func GoGoRoutines(e *Environment, noDaemon bool) {
+	for _, s := range e.configuredSubsystems() {
+		e.lifecycle.Register(s)
+	}
+	e.lifecycle.StartAll()
 	if !noDaemon {
 		go awaitOrders(e)
 	}
 }
+
+// StopGoRoutines cleanly, waiting for snatches and metadata saves in progress.
+func StopGoRoutines(e *Environment) {
+	logthis.Info("Stopping subsystems...", logthis.NORMAL)
+	if err := e.lifecycle.Shutdown(shutdownTimeout); err != nil {
+		logthis.Error(err, logthis.NORMAL)
+	}
+}
@@ -0,0 +1,178 @@
+package varroa
+
+import (
+	"sync"
+	"time"
+
+	"gitlab.com/catastrophic/assistance/strslice"
+)
+
+const (
+	eventAnnounce      = "announce"
+	eventFilterMatch   = "filter-match"
+	eventFilterReject  = "filter-reject"
+	eventSnatch        = "snatch"
+	eventStats         = "stats"
+	eventDownloadState = "download-state"
+	eventNotification  = "notification"
+	eventAuthFailure   = "auth-failure"
+
+	// eventsBufferSize is the number of past events kept for clients resuming a stream.
+	eventsBufferSize = 500
+	// eventsSubscriberBuffer is the number of events waiting for a slow client before it is dropped.
+	eventsSubscriberBuffer = 64
+)
+
+// KnownEventTypes that can be streamed.
+var KnownEventTypes = []string{eventAnnounce, eventFilterMatch, eventFilterReject, eventSnatch, eventStats, eventDownloadState, eventNotification, eventAuthFailure}
+
+// Event describes something that happened in the daemon.
+type Event struct {
+	ID      uint64      `json:"id"`
+	Type    string      `json:"type"`
+	Tracker string      `json:"tracker,omitempty"`
+	Time    time.Time   `json:"time"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// EventAuthFailureData describes a failed authentication on the web server, and the lockout it caused if any.
+type EventAuthFailureData struct {
+	Address string `json:"address"`
+	Path    string `json:"path"`
+	Reason  string `json:"reason"`
+	Lockout string `json:"lockout,omitempty"`
+}
+
+// EventFilterData describes why a filter matched or rejected an announce.
+type EventFilterData struct {
+	Filter    string `json:"filter"`
+	TorrentID string `json:"torrent_id"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// EventDownloadData describes a download state change.
+type EventDownloadData struct {
+	ID         int    `json:"id"`
+	FolderName string `json:"folder_name"`
+	State      string `json:"state"`
+}
+
+// EventNotificationData describes a notification that was sent.
+type EventNotificationData struct {
+	Level string `json:"level"`
+	Event string `json:"event"`
+}
+
+// EventSubscription receives events matching its types and trackers.
+type EventSubscription struct {
+	Events   chan Event
+	types    []string
+	trackers []string
+	// restricted to some trackers, events not related to a tracker are not accepted
+	restricted bool
+}
+
+// accepts an event if it has one of the types and one of the trackers, if any are set.
+// Events not related to a tracker are only accepted if the subscription is not restricted.
+func (s *EventSubscription) accepts(event Event) bool {
+	if len(s.types) != 0 && !strslice.Contains(s.types, event.Type) {
+		return false
+	}
+	if event.Tracker == "" {
+		return !s.restricted
+	}
+	return len(s.trackers) == 0 || strslice.Contains(s.trackers, event.Tracker)
+}
+
+// EventHub keeps the last events in a ring buffer and dispatches new events to subscribers.
+type EventHub struct {
+	sync.Mutex
+	buffer      []Event
+	next        int
+	lastID      uint64
+	subscribers map[*EventSubscription]struct{}
+}
+
+// NewEventHub keeping up to size past events.
+func NewEventHub(size int) *EventHub {
+	return &EventHub{buffer: make([]Event, 0, size), subscribers: make(map[*EventSubscription]struct{})}
+}
+
+// Publish a new event. Never blocks: subscribers that cannot keep up are dropped.
+func (h *EventHub) Publish(eventType, tracker, message string, data interface{}) {
+	if h == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	h.lastID++
+	event := Event{ID: h.lastID, Type: eventType, Tracker: tracker, Time: time.Now(), Message: message, Data: data}
+	if len(h.buffer) < cap(h.buffer) {
+		h.buffer = append(h.buffer, event)
+	} else if cap(h.buffer) != 0 {
+		h.buffer[h.next] = event
+		h.next = (h.next + 1) % cap(h.buffer)
+	}
+	for s := range h.subscribers {
+		if !s.accepts(event) {
+			continue
+		}
+		select {
+		case s.Events <- event:
+		default:
+			delete(h.subscribers, s)
+			close(s.Events)
+		}
+	}
+}
+
+// PublishDownloadState after a download was accepted, rejected or sent back to be sorted.
+func (h *EventHub) PublishDownloadState(dl DownloadEntry) {
+	state := DownloadFolderStates[dl.State]
+	var trackerLabel string
+	if len(dl.Tracker) != 0 {
+		trackerLabel = dl.Tracker[0]
+	}
+	h.Publish(eventDownloadState, trackerLabel, dl.FolderName+" is now "+state, EventDownloadData{ID: dl.ID, FolderName: dl.FolderName, State: state})
+}
+
+// since returns the buffered events after an ID, oldest first. Must be called with the lock.
+func (h *EventHub) since(lastID uint64) []Event {
+	var events []Event
+	for i := 0; i < len(h.buffer); i++ {
+		event := h.buffer[(h.next+i)%len(h.buffer)]
+		if event.ID > lastID {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// Subscribe to events of some types and trackers (all if empty), returning the buffered events after lastID.
+// Subscribers restricted to some trackers do not get the events unrelated to a tracker.
+func (h *EventHub) Subscribe(types, trackers []string, restricted bool, lastID uint64) (*EventSubscription, []Event) {
+	s := &EventSubscription{Events: make(chan Event, eventsSubscriberBuffer), types: types, trackers: trackers, restricted: restricted}
+	h.Lock()
+	defer h.Unlock()
+	var missed []Event
+	if lastID != 0 {
+		for _, event := range h.since(lastID) {
+			if s.accepts(event) {
+				missed = append(missed, event)
+			}
+		}
+	}
+	h.subscribers[s] = struct{}{}
+	return s, missed
+}
+
+// Unsubscribe from events, if the subscription was not already dropped.
+func (h *EventHub) Unsubscribe(s *EventSubscription) {
+	h.Lock()
+	defer h.Unlock()
+	if _, ok := h.subscribers[s]; ok {
+		delete(h.subscribers, s)
+		close(s.Events)
+	}
+}
@@ -0,0 +1,121 @@
+package varroa
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventHub(t *testing.T) {
+	fmt.Println("+ Testing Events...")
+	check := assert.New(t)
+
+	// publishing without a hub does nothing
+	var noHub *EventHub
+	noHub.Publish(eventAnnounce, "blue", "nothing", nil)
+
+	// ring buffer
+	hub := NewEventHub(3)
+	for i := 1; i <= 5; i++ {
+		hub.Publish(eventAnnounce, "blue", fmt.Sprintf("announce %d", i), nil)
+	}
+	check.Equal(uint64(5), hub.lastID)
+	check.Equal(3, len(hub.buffer))
+	events := hub.since(0)
+	check.Equal(3, len(events))
+	check.Equal(uint64(3), events[0].ID)
+	check.Equal(uint64(5), events[2].ID)
+	check.Equal(1, len(hub.since(4)))
+	check.Equal(0, len(hub.since(5)))
+
+	// resuming, filtering by type and tracker
+	hub.Publish(eventSnatch, "purple", "snatch", nil)
+	hub.Publish(eventDownloadState, "", "state", nil)
+	s, missed := hub.Subscribe(nil, nil, false, 4)
+	check.Equal(3, len(missed))
+	check.Equal(uint64(5), missed[0].ID)
+	hub.Unsubscribe(s)
+	s, missed = hub.Subscribe([]string{eventSnatch, eventDownloadState}, []string{"blue"}, false, 1)
+	check.Equal(1, len(missed))
+	check.Equal(eventDownloadState, missed[0].Type)
+	// restricted subscribers do not get events unrelated to a tracker
+	s3, missed := hub.Subscribe(nil, []string{"purple"}, true, 1)
+	check.Equal(1, len(missed))
+	check.Equal(eventSnatch, missed[0].Type)
+	hub.Unsubscribe(s3)
+	s2, missed := hub.Subscribe(nil, nil, false, 0)
+	check.Equal(0, len(missed))
+
+	hub.Publish(eventSnatch, "blue", "snatch", nil)
+	hub.Publish(eventSnatch, "purple", "snatch", nil)
+	hub.Publish(eventStats, "blue", "stats", nil)
+	check.Equal(1, len(s.Events))
+	check.Equal(uint64(8), (<-s.Events).ID)
+	check.Equal(3, len(s2.Events))
+	hub.Unsubscribe(s)
+	_, ok := <-s.Events
+	check.False(ok)
+
+	// slow subscribers are dropped
+	for i := 0; i < eventsSubscriberBuffer; i++ {
+		hub.Publish(eventAnnounce, "blue", "announce", nil)
+	}
+	check.Equal(0, len(hub.subscribers))
+	hub.Unsubscribe(s2)
+}
+
+func TestAPIEvents(t *testing.T) {
+	fmt.Println("+ Testing API events...")
+	check := assert.New(t)
+
+	c, err := NewConfig("test/test_complete.yaml")
+	check.Nil(err)
+	e := NewEnvironment()
+	e.SetConfig(c)
+	rtr := mux.NewRouter()
+	registerAPIv1(rtr, e, nil, nil)
+
+	e.events.Publish(eventAnnounce, "blue", "announce", nil)
+	e.events.Publish(eventFilterReject, "blue", "test: Wrong year", EventFilterData{Filter: "test", TorrentID: "1234", Reason: "Wrong year"})
+	e.events.Publish(eventSnatch, "purple", "snatch", nil)
+
+	request := func(path, lastID string) *httptest.ResponseRecorder {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		r := httptest.NewRequest("GET", path, nil).WithContext(ctx)
+		r.Header.Set(apiTokenHeader, "thisisatoken")
+		if lastID != "" {
+			r.Header.Set("Last-Event-ID", lastID)
+		}
+		w := httptest.NewRecorder()
+		rtr.ServeHTTP(w, r)
+		return w
+	}
+
+	check.Equal(http.StatusBadRequest, request("/api/v1/events?type=nothing", "").Code)
+	check.Equal(http.StatusBadRequest, request("/api/v1/events", "last").Code)
+
+	// new events only
+	w := request("/api/v1/events", "")
+	check.Equal(http.StatusOK, w.Code)
+	check.Equal(apiEventStreamType, w.Header().Get("Content-Type"))
+	check.Equal("", w.Body.String())
+
+	// resuming
+	w = request("/api/v1/events", "1")
+	check.Equal(http.StatusOK, w.Code)
+	check.Equal(2, strings.Count(w.Body.String(), "id: "))
+	check.True(strings.HasPrefix(w.Body.String(), "id: 2\nevent: filter-reject\ndata: {\"id\":2,\"type\":\"filter-reject\",\"tracker\":\"blue\""))
+	check.Contains(w.Body.String(), `"reason":"Wrong year"`)
+	w = request("/api/v1/events?tracker=purple&type=snatch,announce", "1")
+	check.Equal(http.StatusOK, w.Code)
+	check.True(strings.HasPrefix(w.Body.String(), "id: 3\nevent: snatch\n"))
+	check.Equal(1, strings.Count(w.Body.String(), "id: "))
+}
@@ -14,7 +14,10 @@ require (
 	github.com/fatih/color v1.7.0 // indirect
 	github.com/fhs/gompd v2.0.0+incompatible
 	github.com/frankban/quicktest v1.9.0 // indirect
-	github.com/goji/httpauth v0.0.0-20160601135302-2da839ab0f4d
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/go-flac/flacpicture v0.2.0
+	github.com/go-flac/go-flac v0.3.1
+	github.com/godbus/dbus/v5 v5.1.0
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
 	github.com/golang/protobuf v1.3.5 // indirect
 	github.com/gorilla/mux v1.6.2
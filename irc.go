@@ -1,6 +1,7 @@
 package varroa
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"path/filepath"
@@ -20,7 +21,8 @@ const (
 	alternativeAnnouncePattern = `(.*?) - (.*) \[([\d]{4})\] \[(Album|Soundtrack|Compilation|Anthology|EP|Single|Live album|Remix|Bootleg|Interview|Mixtape|Demo|Concert Recording|DJ Mix|Unknown)\] - (FLAC|MP3|AAC) / (Lossless|24bit Lossless|V0 \(VBR\)|V2 \(VBR\)|320|256) /( (Log.*?) /)?( (-*\d+)\% /)?( (Cue) /)? (CD|DVD|Vinyl|Soundboard|SACD|DAT|Cassette|WEB|Blu-Ray) (/ (Scene) )?- ([\w\., ]*) - (http[s]?://[\w\./:]*torrents\.php\?id=[\d]*) / (http[s]?://[\w\./:]*torrents\.php\?action=download&id=[\d]*)`
 )
 
-func analyzeAnnounce(announced string, e *Environment, t *tracker.Gazelle, autosnatchConfig *ConfigAutosnatch) error {
+// analyzeAnnounce and snatch the release if it triggers a filter, using the configuration it was announced with.
+func analyzeAnnounce(announced string, e *Environment, t *tracker.Gazelle, conf *Config, autosnatchConfig *ConfigAutosnatch) error {
 	stats, err := NewStatsDB(filepath.Join(StatsDir, DefaultHistoryDB))
 	if err != nil {
 		return errors.Wrap(err, "could not access the stats database")
@@ -42,20 +44,28 @@ func analyzeAnnounce(announced string, e *Environment, t *tracker.Gazelle, autos
 			return err
 		}
 		logthis.Info(release.String(), logthis.VERBOSEST)
+		e.events.Publish(eventAnnounce, t.Name, release.ShortString(), *release)
+		// logging and publishing why a filter was not triggered
+		reject := func(filter *ConfigFilter, reason string) {
+			logthis.Info(filter.Name+": "+reason, logthis.VERBOSE)
+			e.events.Publish(eventFilterReject, t.Name, filter.Name+": "+reason, EventFilterData{Filter: filter.Name, TorrentID: release.TorrentID, Reason: reason})
+		}
 
 		// if satisfies a filter, download
 		var downloadedInfo bool
 		var downloadedTorrent bool
 		info := &TrackerMetadata{}
 		var torrentGroupInfo *tracker.GazelleTorrentGroup
-		for _, filter := range e.config.Filters {
+		for _, filter := range conf.Filters {
 			// checking if filter is specifically set for this tracker (if nothing is indicated, all trackers match)
 			if len(filter.Tracker) != 0 && !strslice.Contains(filter.Tracker, t.Name) {
 				logthis.Info(fmt.Sprintf(infoFilterIgnoredForTracker, filter.Name, t.Name), logthis.VERBOSE)
 				continue
 			}
 			// checking if a filter is triggered
-			if release.Satisfies(filter) {
+			if ok, reason := release.satisfies(filter); !ok {
+				reject(filter, reason)
+			} else {
 				// getting torrent info
 				if !downloadedInfo {
 					if err := info.LoadFromID(t, release.TorrentID); err != nil {
@@ -65,19 +75,21 @@ func analyzeAnnounce(announced string, e *Environment, t *tracker.Gazelle, autos
 					logthis.Info(info.TextDescription(false), logthis.VERBOSE)
 				}
 				// else check other criteria
-				if release.HasCompatibleTrackerInfo(filter, autosnatchConfig.BlacklistedUploaders, info) {
+				if ok, reason := release.hasCompatibleTrackerInfo(filter, autosnatchConfig.BlacklistedUploaders, info); !ok {
+					reject(filter, reason)
+				} else {
 					release.Filter = filter.Name
 
 					// checking if duplicate
 					if !filter.AllowDuplicates && stats.AlreadySnatchedDuplicate(release) {
-						logthis.Info(filter.Name+": "+infoNotSnatchingDuplicate, logthis.VERBOSE)
+						reject(filter, infoNotSnatchingDuplicate)
 						continue
 					}
 					// checking if a torrent from the same group has already been downloaded
 					if filter.UniqueInGroup {
 						// if varroa knows about the group, rejecting
 						if stats.AlreadySnatchedFromGroup(release) {
-							logthis.Info(filter.Name+": "+infoNotSnatchingUniqueInGroup, logthis.VERBOSE)
+							reject(filter, infoNotSnatchingUniqueInGroup)
 							continue
 						}
 						// else, getting the torrentgroup to check if the site itself know about past snatches
@@ -87,15 +99,16 @@ func analyzeAnnounce(announced string, e *Environment, t *tracker.Gazelle, autos
 								logthis.Error(errors.Wrap(err, "error retrieving torrent group info"), logthis.NORMAL)
 							} else {
 								if torrentGroupInfo.AlreadySnatched() {
-									logthis.Info(filter.Name+": "+infoNotSnatchingUniqueInGroup, logthis.VERBOSE)
+									reject(filter, infoNotSnatchingUniqueInGroup)
 									continue
 								}
 							}
 						}
 					}
 					logthis.Info(" -> "+release.ShortString()+" triggered filter "+filter.Name+", snatching.", logthis.NORMAL)
+					e.events.Publish(eventFilterMatch, t.Name, filter.Name+": "+release.ShortString(), EventFilterData{Filter: filter.Name, TorrentID: release.TorrentID})
 					// move to relevant watch directory
-					destination := e.config.General.WatchDir
+					destination := conf.General.WatchDir
 					if filter.WatchDir != "" {
 						destination = filter.WatchDir
 					}
@@ -103,17 +116,18 @@ func analyzeAnnounce(announced string, e *Environment, t *tracker.Gazelle, autos
 						return errors.Wrap(err, errorDownloadingTorrent)
 					}
 					downloadedTorrent = true
+					e.events.Publish(eventSnatch, t.Name, filter.Name+": Snatched "+release.ShortString(), *release)
 					// adding to history
 					if err := stats.AddSnatch(*release); err != nil {
 						logthis.Error(errors.Wrap(err, errorAddingToHistory), logthis.NORMAL)
 					}
 					// send notification
-					if err := Notify(filter.Name+": Snatched "+release.ShortString(), t.Name, "info", e); err != nil {
+					if err := NotifyWithData(filter.Name+": Snatched "+release.ShortString(), t.Name, "info", &NotificationData{Event: notificationEventSnatch, Release: release, Metadata: info}, e); err != nil {
 						logthis.Error(err, logthis.NORMAL)
 					}
-					// save metadata once the download folder is created
-					if e.config.General.AutomaticMetadataRetrieval {
-						go info.SaveFromTracker(filepath.Join(e.config.General.DownloadDir, info.FolderName), t)
+					// save metadata, and notify once the download is complete
+					if conf.General.AutomaticMetadataRetrieval {
+						e.lifecycle.Go(func() { saveMetadataAndNotifyWhenReady(e, t, info) })
 					}
 					// no need to consider other filters
 					break
@@ -129,14 +143,70 @@ func analyzeAnnounce(announced string, e *Environment, t *tracker.Gazelle, autos
 	return nil
 }
 
-func ircHandler(e *Environment, t *tracker.Gazelle) {
+// ircSubsystem connects to the announce channel of a tracker.
+type ircSubsystem struct {
+	e      *Environment
+	t      *tracker.Gazelle
+	client *irc.Connection
+	done   chan struct{}
+}
+
+func newIRCSubsystem(e *Environment, t *tracker.Gazelle) *ircSubsystem {
+	return &ircSubsystem{e: e, t: t}
+}
+
+func (is *ircSubsystem) Name() string {
+	return subsystemIRCPrefix + is.t.Name
+}
+
+// Start connecting to IRC.
+func (is *ircSubsystem) Start(ctx context.Context) error {
+	client, err := newIRCClient(ctx, is.e, is.t)
+	if err != nil {
+		return err
+	}
+	is.client = client
+	is.done = make(chan struct{})
+	go func() {
+		client.Loop()
+		close(is.done)
+	}()
+	return nil
+}
+
+// Stop saying QUIT, then disconnecting if the server does not close the connection in time.
+func (is *ircSubsystem) Stop(ctx context.Context) error {
+	is.e.mutex.Lock()
+	if is.e.ircClient == is.client {
+		is.e.ircClient = nil
+	}
+	is.e.mutex.Unlock()
+	is.client.Quit()
+	select {
+	case <-is.done:
+		return nil
+	case <-ctx.Done():
+		is.client.Disconnect()
+		return errors.New("timeout waiting for the IRC server to close the connection")
+	}
+}
+
+func (is *ircSubsystem) Health() error {
+	if !is.client.Connected() {
+		return errors.New("disconnected from " + is.client.Server)
+	}
+	return nil
+}
+
+// newIRCClient connected to the announce channel of a tracker, until ctx is cancelled.
+func newIRCClient(ctx context.Context, e *Environment, t *tracker.Gazelle) (*irc.Connection, error) {
 	// general replacer to remove color codes and other useless things from announces.
 	r := strings.NewReplacer("\x02TORRENT:\x02 ", "", "\x0303", "", "\x0304", "", "\x0310", "", "\x0312", "", "\x03", "")
 
-	autosnatchConfig, err := e.config.GetAutosnatch(t.Name)
+	conf := currentConfig()
+	autosnatchConfig, err := conf.GetAutosnatch(t.Name)
 	if err != nil {
-		logthis.Info("Cannot find autosnatch configuration for tracker "+t.Name, logthis.NORMAL)
-		return
+		return nil, errors.New("Cannot find autosnatch configuration for tracker " + t.Name)
 	}
 	IRCClient := irc.IRC(autosnatchConfig.BotName, t.User)
 	if autosnatchConfig.LocalAddress != "" {
@@ -147,8 +217,8 @@ func ircHandler(e *Environment, t *tracker.Gazelle) {
 	IRCClient.AddCallback("001", func(_ *irc.Event) {
 		IRCClient.Privmsg("NickServ", "IDENTIFY "+autosnatchConfig.NickservPassword)
 		IRCClient.Privmsg(autosnatchConfig.Announcer, fmt.Sprintf("enter %s %s %s", autosnatchConfig.AnnounceChannel, t.User, autosnatchConfig.IRCKey))
-		if e.config.ircNotifsConfigured {
-			IRCClient.Privmsg(e.config.Notifications.Irc.User, "varroa bot, connected.")
+		if current := currentConfig(); current.ircNotifsConfigured {
+			IRCClient.Privmsg(current.Notifications.Irc.User, "varroa bot, connected.")
 		}
 	})
 	IRCClient.AddCallback("PRIVMSG", func(ev *irc.Event) {
@@ -169,26 +239,39 @@ func ircHandler(e *Environment, t *tracker.Gazelle) {
 			IRCClient.Join(autosnatchConfig.AnnounceChannel)
 		case strings.ToLower(autosnatchConfig.AnnounceChannel):
 			// if sent to the announce channel, it's a new release
+			// autosnatching can be paused, or the configuration reloaded, while connected
 			e.mutex.RLock()
-			canSnatch := !autosnatchConfig.disabledAutosnatching
+			current := e.config
+			currentAutosnatch, err := current.GetAutosnatch(t.Name)
+			canSnatch := err == nil && !currentAutosnatch.disabledAutosnatching
 			e.mutex.RUnlock()
 			if canSnatch {
+				// the snatch must complete before shutting down
+				done, ok := e.lifecycle.Track()
+				if !ok {
+					return
+				}
+				defer done()
 				announced := r.Replace(ev.Message())
 				logthis.Info("++ Announced on "+t.Name+": "+announced, logthis.VERBOSE)
-				if err = analyzeAnnounce(announced, e, t, autosnatchConfig); err != nil {
+				if err := analyzeAnnounce(announced, e, t, current, currentAutosnatch); err != nil {
 					logthis.Error(errors.Wrap(err, errorDealingWithAnnounce), logthis.VERBOSE)
 					return
 				}
 			}
 		}
 	})
-	err = IRCClient.Connect(autosnatchConfig.IRCServer)
-	if err != nil {
-		logthis.Error(errors.Wrap(err, errorConnectingToIRC), logthis.NORMAL)
-		return
+	// the configured user can send commands by private message
+	if conf.ircNotifsConfigured && conf.Notifications.Irc.Tracker == autosnatchConfig.Tracker && conf.Notifications.Irc.AllowCommands {
+		newIRCController(e, IRCClient, conf.Notifications.Irc).register(ctx)
+	}
+	if err := IRCClient.Connect(autosnatchConfig.IRCServer); err != nil {
+		return nil, errors.Wrap(err, errorConnectingToIRC)
 	}
-	if e.config.ircNotifsConfigured && e.config.Notifications.Irc.Tracker == autosnatchConfig.Tracker {
+	if conf.ircNotifsConfigured && conf.Notifications.Irc.Tracker == autosnatchConfig.Tracker {
+		e.mutex.Lock()
 		e.ircClient = IRCClient
+		e.mutex.Unlock()
 	}
-	IRCClient.Loop()
+	return IRCClient, nil
 }
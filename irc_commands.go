@@ -0,0 +1,242 @@
+package varroa
+
+import (
+	"context"
+	"crypto/subtle"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/logthis"
+	"gitlab.com/catastrophic/assistance/strslice"
+	"gitlab.com/catastrophic/assistance/ui"
+	irc "gitlab.com/catastrophic/go-ircevent"
+)
+
+const (
+	ircReplyInterval         = 700 * time.Millisecond
+	ircReplyQueueSize        = 30
+	ircReplyMaxLength        = 400
+	ircPendingCommandsSize   = 5
+	ircAuthenticationTimeout = 30 * time.Minute
+
+	ircRplWhoisAccount = "330"
+	ircRplEndOfWhois   = "318"
+
+	ircCommandsHelp = "Commands: status, stats, snatch [tracker] <id>..., info [tracker] <id>..., pause [tracker], resume [tracker], last."
+)
+
+// ircController lets the configured user send commands to the daemon by private message.
+type ircController struct {
+	e        *Environment
+	client   *irc.Connection
+	config   *ConfigIRC
+	replies  chan string
+	mutex    sync.Mutex
+	running  sync.Mutex
+	authedAt time.Time
+	pending  []string
+}
+
+func newIRCController(e *Environment, client *irc.Connection, config *ConfigIRC) *ircController {
+	return &ircController{e: e, client: client, config: config, replies: make(chan string, ircReplyQueueSize)}
+}
+
+// register the callbacks on the IRC connection, before it connects. Replies are sent until ctx is cancelled.
+func (ic *ircController) register(ctx context.Context) {
+	ic.client.AddCallback("PRIVMSG", func(ev *irc.Event) {
+		// only private messages from the configured user
+		if len(ev.Arguments) == 0 || !strings.EqualFold(ev.Nick, ic.config.User) || !strings.EqualFold(ev.Arguments[0], ic.client.GetNick()) {
+			return
+		}
+		ic.received(ev.Message())
+	})
+	ic.client.AddCallback(ircRplWhoisAccount, func(ev *irc.Event) {
+		// arguments: our nick, the nick being checked, the account it is identified with
+		if len(ev.Arguments) < 3 || !strings.EqualFold(ev.Arguments[1], ic.config.User) {
+			return
+		}
+		if strings.EqualFold(ev.Arguments[2], ic.config.NickServAccount) {
+			ic.mutex.Lock()
+			ic.authedAt = time.Now()
+			ic.mutex.Unlock()
+		}
+	})
+	ic.client.AddCallback(ircRplEndOfWhois, func(ev *irc.Event) {
+		if len(ev.Arguments) < 2 || !strings.EqualFold(ev.Arguments[1], ic.config.User) {
+			return
+		}
+		ic.mutex.Lock()
+		pending := ic.pending
+		ic.pending = []string{}
+		authenticated := ic.isAuthenticated()
+		ic.mutex.Unlock()
+		if !authenticated {
+			logthis.Info("IRC commands rejected: "+ic.config.User+" is not identified as "+ic.config.NickServAccount, logthis.NORMAL)
+			ic.reply("You must be identified with NickServ as " + ic.config.NickServAccount + " to send commands.")
+			return
+		}
+		for _, p := range pending {
+			go ic.run(p)
+		}
+	})
+	go ic.sendReplies(ctx)
+}
+
+// isAuthenticated must be called with the mutex held.
+func (ic *ircController) isAuthenticated() bool {
+	return !ic.authedAt.IsZero() && time.Since(ic.authedAt) < ircAuthenticationTimeout
+}
+
+// received a private message from the configured user.
+func (ic *ircController) received(msg string) {
+	msg = strings.TrimSpace(msg)
+	if ic.config.CommandSecret != "" {
+		command, ok := stripIRCCommandSecret(msg, ic.config.CommandSecret)
+		if !ok {
+			logthis.Info("IRC command rejected: wrong or missing secret.", logthis.VERBOSE)
+			return
+		}
+		go ic.run(command)
+		return
+	}
+	// checking the user is identified with NickServ
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	if ic.isAuthenticated() {
+		go ic.run(msg)
+		return
+	}
+	if len(ic.pending) == ircPendingCommandsSize {
+		logthis.Info("Too many IRC commands waiting for NickServ identification, dropping: "+msg, logthis.VERBOSE)
+		return
+	}
+	ic.pending = append(ic.pending, msg)
+	if len(ic.pending) == 1 {
+		ic.client.Whois(ic.config.User)
+	}
+}
+
+// run a command and send its output back to the user.
+func (ic *ircController) run(msg string) {
+	orders, err := parseIRCCommand(msg, ic.config.Tracker, currentConfig().TrackerLabels())
+	if err != nil {
+		ic.reply(err.Error())
+		return
+	}
+	if orders == nil {
+		ic.reply(ircCommandsHelp)
+		return
+	}
+	// one command at a time, so that their outputs do not get mixed up
+	ic.running.Lock()
+	defer ic.running.Unlock()
+
+	logthis.Info("Running IRC command from "+ic.config.User+": "+orders.Command+" "+strings.Join(orders.Args, " "), logthis.VERBOSE)
+	executeOrders(ic.e, *orders, ic)
+}
+
+// Info sends the messages of a command back to the user.
+func (ic *ircController) Info(msg string) {
+	ic.reply(msg)
+}
+
+// Error sends the errors of a command back to the user.
+func (ic *ircController) Error(err error) {
+	ic.reply(err.Error())
+}
+
+// reply to the user, dropping lines if too many are already waiting to be sent.
+func (ic *ircController) reply(msg string) {
+	for _, line := range strings.Split(ui.RemoveColor(msg), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if len(line) > ircReplyMaxLength {
+			line = line[:ircReplyMaxLength] + "..."
+		}
+		select {
+		case ic.replies <- line:
+		default:
+			logthis.Info("Too many IRC replies queued, dropping: "+line, logthis.VERBOSEST)
+		}
+	}
+}
+
+// sendReplies at a limited rate to avoid being kicked for flooding, until ctx is cancelled.
+func (ic *ircController) sendReplies(ctx context.Context) {
+	ticker := time.NewTicker(ircReplyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case line := <-ic.replies:
+			ic.client.Privmsg(ic.config.User, line)
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// stripIRCCommandSecret from the start of a message, returning the command if the secret was correct.
+func stripIRCCommandSecret(msg, secret string) (string, bool) {
+	parts := strings.SplitN(strings.TrimSpace(msg), " ", 2)
+	if len(parts) != 2 || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(secret)) != 1 {
+		return "", false
+	}
+	return strings.TrimSpace(parts[1]), true
+}
+
+// parseIRCCommand into orders for the daemon, returns nil orders if help must be displayed.
+func parseIRCCommand(msg, defaultTracker string, trackers []string) (*IncomingJSON, error) {
+	fields := strings.Fields(msg)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	command := strings.ToLower(fields[0])
+	args := fields[1:]
+	// an optional tracker label can follow the command
+	var site string
+	if len(args) != 0 {
+		for _, t := range trackers {
+			if strings.EqualFold(t, args[0]) {
+				site = t
+				args = args[1:]
+				break
+			}
+		}
+	}
+
+	switch command {
+	case "status", "stats", "last":
+		if len(args) != 0 || site != "" {
+			return nil, errors.New(command + " does not take any argument")
+		}
+		return &IncomingJSON{Command: command}, nil
+	case "pause", "resume":
+		if len(args) != 0 {
+			return nil, errors.New(command + " only takes an optional tracker name")
+		}
+		return &IncomingJSON{Command: command, Site: site}, nil
+	case "snatch", "info":
+		if len(args) == 0 {
+			return nil, errors.New(command + " requires at least one torrent ID")
+		}
+		if _, err := strslice.ToIntSlice(args); err != nil {
+			return nil, errors.New("invalid torrent IDs: " + strings.Join(args, " "))
+		}
+		if site == "" {
+			site = defaultTracker
+		}
+		return &IncomingJSON{Command: command, Site: site, Args: args}, nil
+	case "help":
+		return nil, nil
+	}
+	return nil, errors.New("unknown command " + command + ". " + ircCommandsHelp)
+}
@@ -1,11 +1,14 @@
 package varroa
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	irc "gitlab.com/catastrophic/go-ircevent"
 )
 
 var (
@@ -192,3 +195,63 @@ func TestRegexp(t *testing.T) {
 		}
 	}
 }
+
+func TestIRCCommands(t *testing.T) {
+	fmt.Println("+ Testing IRC commands parsing...")
+	verify := assert.New(t)
+	trackers := []string{"blue", "purple"}
+
+	// secret
+	cmd, ok := stripIRCCommandSecret("s3cr3t snatch 1234", "s3cr3t")
+	verify.True(ok)
+	verify.Equal("snatch 1234", cmd)
+	_, ok = stripIRCCommandSecret("wrong snatch 1234", "s3cr3t")
+	verify.False(ok)
+	_, ok = stripIRCCommandSecret("s3cr3t", "s3cr3t")
+	verify.False(ok)
+
+	// valid commands
+	orders, err := parseIRCCommand("status", "blue", trackers)
+	verify.Nil(err)
+	verify.Equal(&IncomingJSON{Command: "status"}, orders)
+	orders, err = parseIRCCommand("Snatch 1234 5678", "blue", trackers)
+	verify.Nil(err)
+	verify.Equal(&IncomingJSON{Command: "snatch", Site: "blue", Args: []string{"1234", "5678"}}, orders)
+	orders, err = parseIRCCommand("info PURPLE 1234", "blue", trackers)
+	verify.Nil(err)
+	verify.Equal(&IncomingJSON{Command: "info", Site: "purple", Args: []string{"1234"}}, orders)
+	orders, err = parseIRCCommand("pause", "blue", trackers)
+	verify.Nil(err)
+	verify.Equal(&IncomingJSON{Command: "pause"}, orders)
+	orders, err = parseIRCCommand("resume purple", "blue", trackers)
+	verify.Nil(err)
+	verify.Equal(&IncomingJSON{Command: "resume", Site: "purple"}, orders)
+	orders, err = parseIRCCommand("help", "blue", trackers)
+	verify.Nil(err)
+	verify.Nil(orders)
+
+	// invalid commands
+	for _, c := range []string{"snatch", "snatch abc", "info blue", "last 3", "pause green", "stop", "refresh-metadata-by-id 1234"} {
+		_, err = parseIRCCommand(c, "blue", trackers)
+		verify.NotNil(err, c)
+	}
+}
+
+func TestIRCRepliesStop(t *testing.T) {
+	fmt.Println("+ Testing IRC replies stop with their connection...")
+	verify := assert.New(t)
+
+	ic := newIRCController(NewEnvironment(), irc.IRC("bot", "user"), &ConfigIRC{User: "someone"})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ic.sendReplies(ctx)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		verify.Fail("replies still being sent after the connection was stopped")
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"github.com/briandowns/spinner"
 	"github.com/pkg/errors"
 	daemon "github.com/sevlyar/go-daemon"
-	"gitlab.com/catastrophic/assistance/fs"
 	"gitlab.com/catastrophic/assistance/logthis"
 	"gitlab.com/catastrophic/assistance/m3u"
 )
@@ -37,41 +36,50 @@ func ReorganizeLibrary(doNothing, interactive bool) error {
 		s.Start()
 	}
 
-	movedAlbums := 0
-	template := defaultFolderTemplate
-	if c.Library.Template != "" {
-		template = c.Library.Template
-	}
-
+	journal := newLibraryJournal(DefaultLibraryJournal, "reorganize", doNothing)
 	var playlists []m3u.Playlist
 	if c.playlistDirectoryConfigured {
-		// load all playlists
-		e = filepath.Walk(c.Library.PlaylistDirectory, func(path string, fileInfo os.FileInfo, walkError error) error {
-			if os.IsNotExist(walkError) {
-				return nil
-			}
-			// load all found playlists
-			if filepath.Ext(path) == m3uExt {
-				p, err := m3u.New(path)
-				if err != nil {
-					logthis.Error(err, logthis.VERBOSE)
-				} else {
-					playlists = append(playlists, *p)
-				}
-			}
-			return nil
-		})
-		if e != nil {
-			logthis.Error(e, logthis.NORMAL)
-		}
+		playlists = loadPlaylists(c.Library.PlaylistDirectory)
+	}
+	var ask func(string) string
+	if interactive {
+		ask = askConflictStrategy
+	}
+	movedAlbums, walkErr := reorganizeLibrary(journal, c.Library, playlists, ask, interactive)
+	if walkErr != nil {
+		logthis.Error(walkErr, logthis.NORMAL)
 	}
 
-	walkErr := filepath.Walk(c.Library.Directory, func(path string, fileInfo os.FileInfo, walkError error) error {
+	if !interactive && !daemon.WasReborn() {
+		s.Stop()
+	}
+	err := deleteEmptyLibraryFolders(journal)
+	if !doNothing {
+		updateLibraryDB(c.Library, func(l *LibraryDB) error { return l.Scan() })
+	}
+	// simulations and actual runs are displayed the same way
+	fmt.Print(journal.String())
+	logthis.Info(fmt.Sprintf("Moved %d release(s).", movedAlbums), logthis.NORMAL)
+	return err
+}
+
+// reorganizeLibrary by moving every release to the path generated by the folder template, resolving conflicts with
+// the releases already there with the configured strategy. It returns the number of releases moved.
+func reorganizeLibrary(journal *LibraryJournal, library *ConfigLibrary, playlists []m3u.Playlist, ask func(string) string, interactive bool) (int, error) {
+	movedAlbums := 0
+	moved := func(oldPath, newPath string) error {
+		updatePlaylists(journal, playlists, oldPath, newPath)
+		return nil
+	}
+	walkErr := filepath.Walk(library.Directory, func(path string, fileInfo os.FileInfo, walkError error) error {
 		// when an album has just been moved, Walk goes through it a second
 		// time with an "file does not exist" error
 		if os.IsNotExist(walkError) {
 			return nil
 		}
+		if path == library.TrashDirectory {
+			return filepath.SkipDir
+		}
 
 		if fileInfo.IsDir() && DirectoryContainsMusicAndMetadata(path) {
 			var libraryEntry DownloadEntry
@@ -82,13 +90,24 @@ func ReorganizeLibrary(doNothing, interactive bool) error {
 				return err
 			}
 			var newName string
+			var info TrackerMetadata
 			for _, t := range libraryEntry.Tracker {
-				info, err := libraryEntry.getMetadata(filepath.Dir(path), t)
+				var err error
+				info, err = libraryEntry.getMetadata(filepath.Dir(path), t)
 				if err != nil {
 					logthis.Info("Could not find metadata for tracker "+t, logthis.NORMAL)
 					continue
 				}
-				newName = info.GeneratePath(template, path)
+				template := library.folderTemplate(&info)
+				if template == "" {
+					template = defaultFolderTemplate
+				}
+				newName, err = info.GeneratePath(template, path)
+				if err != nil {
+					// only this release is not moved
+					logthis.Error(errors.Wrap(err, "Not moving "+path), logthis.NORMAL)
+					return nil
+				}
 				break // stop once we have a name.
 			}
 
@@ -96,47 +115,41 @@ func ReorganizeLibrary(doNothing, interactive bool) error {
 				return errors.New("could not generate path for " + fileInfo.Name())
 			}
 
-			hasMoved, err := fs.MoveDir(path, filepath.Join(c.Library.Directory, newName), doNothing, interactive)
+			// conflicts only prevent this release from being moved
+			placement, err := placeInLibrary(journal, library, libraryRelease{folder: path, info: info}, newName, ask)
 			if err != nil {
+				logthis.Error(errors.Wrap(err, "Not moving "+path), logthis.NORMAL)
+				return nil
+			}
+			if err := placement.makeRoom(journal, library, moved); err != nil {
+				return err
+			}
+			hasMoved, err := journal.moveDir(path, filepath.Join(library.Directory, placement.destination), interactive)
+			if err != nil {
+				// the release that was replaced must not be lost
+				if restoreErr := placement.restore(journal, library); restoreErr != nil {
+					logthis.Error(errors.Wrap(restoreErr, "Error restoring "+placement.destination+" from the trash"), logthis.NORMAL)
+				}
 				return err
 			}
 			if hasMoved {
 				movedAlbums++
-				logthis.Info("Moved "+path+" -> "+newName, logthis.VERBOSE)
-				if !doNothing && c.playlistDirectoryConfigured {
-					relativePath, err := filepath.Rel(c.Library.Directory, path)
-					if err != nil {
-						return err
-					}
-					// find all playlists mentioning the release that was moved, update the path
-					for _, p := range playlists {
-						if p.Contains(relativePath) {
-							// update the playlist
-							p.Update(relativePath, newName)
-							// save the new playlist
-							if err := p.Save(); err != nil {
-								logthis.Error(err, logthis.VERBOSE)
-							}
-						}
-					}
+				logthis.Info("Moved "+path+" -> "+placement.destination, logthis.VERBOSE)
+				relativePath, err := filepath.Rel(library.Directory, path)
+				if err != nil {
+					return err
 				}
+				// find all playlists mentioning the release that was moved, update the path
+				updatePlaylists(journal, playlists, relativePath, placement.destination)
 			}
 		}
 		return nil
 	})
-	if walkErr != nil {
-		logthis.Error(walkErr, logthis.NORMAL)
-	}
-
-	if !interactive && !daemon.WasReborn() {
-		s.Stop()
-	}
-	logthis.Info(fmt.Sprintf("Moved %d release(s).", movedAlbums), logthis.NORMAL)
-	return deleteEmptyLibraryFolders()
+	return movedAlbums, walkErr
 }
 
-// DeleteEmptyLibraryFolders deletes empty folders that may appear after sorting albums.
-func deleteEmptyLibraryFolders() error {
+// deleteEmptyLibraryFolders deletes empty folders that may appear after sorting albums.
+func deleteEmptyLibraryFolders(journal *LibraryJournal) error {
 	c, err := NewConfig(DefaultConfigurationFile)
 	if err != nil {
 		return err
@@ -145,5 +158,5 @@ func deleteEmptyLibraryFolders() error {
 		return errors.New("library section of the configuration file not found")
 	}
 	// preserving .stfolder for syncthing compatibility
-	return fs.DeleteEmptyDirs(c.Library.Directory, []string{filepath.Join(c.Library.Directory, ".stfolder")})
+	return journal.deleteEmptyDirs(c.Library.Directory, []string{filepath.Join(c.Library.Directory, ".stfolder")})
 }
@@ -0,0 +1,306 @@
+package varroa
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/fs"
+	"gitlab.com/catastrophic/assistance/logthis"
+	"gitlab.com/catastrophic/assistance/ui"
+	"gitlab.com/passelecasque/obstruction/tracker"
+)
+
+const (
+	// what to do when a release is exported or moved to a library folder that already exists
+	conflictFail         = "fail"
+	conflictDisambiguate = "disambiguate"
+	conflictReplace      = "replace"
+	conflictMerge        = "merge"
+	conflictAsk          = "ask"
+	// only possible when asking
+	conflictSkip = "skip"
+
+	libraryTrashDir  = "VarroaTrash"
+	discFolderFormat = "Disc %d"
+
+	errorDestinationExists = "destination already exists"
+)
+
+var conflictStrategies = []string{conflictFail, conflictDisambiguate, conflictReplace, conflictMerge, conflictAsk}
+
+// errConflictSkipped when the user chose to leave a release where it is.
+var errConflictSkipped = errors.New("release skipped, its destination already exists")
+
+var (
+	discNumberRegexp = regexp.MustCompile(`(?i)\b(?:cd|dis[ck])\s*(\d+)\b`)
+	discFolderRegexp = regexp.MustCompile(`^Disc \d+$`)
+)
+
+// discNumber of a release that is part of a multi-disc set, found in its original folder name, edition or title.
+// It returns 0 if it cannot be found.
+func discNumber(info TrackerMetadata) int {
+	for _, s := range []string{info.FolderName, info.EditionName, info.Title} {
+		if m := discNumberRegexp.FindStringSubmatch(s); m != nil {
+			if n, err := strconv.Atoi(m[1]); err == nil && n != 0 {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// isMergedDisc returns true if the folder is a disc of a merged multi-disc set.
+func isMergedDisc(folder string) bool {
+	return discFolderRegexp.MatchString(filepath.Base(folder))
+}
+
+// isMergedSet returns true if the folder contains the discs of a merged multi-disc set.
+func isMergedSet(folder string) bool {
+	// not using Glob, folder names can contain its special characters
+	entries, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && discFolderRegexp.MatchString(entry.Name()) {
+			return true
+		}
+	}
+	return false
+}
+
+// qualityRank of a release, as for duplicate downloads.
+func qualityRank(info TrackerMetadata) int {
+	dl := DownloadEntry{Quality: info.Quality, Source: info.Source, HasLog: info.HasLog, LogScore: info.LogScore}
+	return dl.QualityRank()
+}
+
+// libraryReleaseMetadata of a release in the library, from its first tracker.
+func libraryReleaseMetadata(folder string) (TrackerMetadata, error) {
+	dl := DownloadEntry{FolderName: filepath.Base(folder)}
+	if err := dl.Load(filepath.Dir(folder)); err != nil {
+		return TrackerMetadata{}, err
+	}
+	if len(dl.Tracker) == 0 {
+		return TrackerMetadata{}, errors.New("no tracker metadata for " + folder)
+	}
+	return dl.getMetadata(filepath.Dir(folder), dl.Tracker[0])
+}
+
+// libraryRelease being exported or moved in the library.
+type libraryRelease struct {
+	// folder where it currently is
+	folder string
+	info   TrackerMetadata
+}
+
+// libraryPlacement of a release: where it goes, relative to the library directory, and what happens to the release
+// that was already there.
+type libraryPlacement struct {
+	destination string
+	// full path of the trash folder where the existing release goes when replacing it
+	trash string
+	// where the existing release goes, relative to the library directory, when merging
+	existingTo string
+}
+
+// disambiguated path for a release, from its edition, catalog number, or tracker ID, whichever makes it unique.
+func disambiguated(journal *LibraryJournal, library *ConfigLibrary, release libraryRelease, destination string) string {
+	var suffixes []string
+	var edition []string
+	if release.info.EditionYear != 0 && release.info.EditionYear != release.info.OriginalYear {
+		edition = append(edition, strconv.Itoa(release.info.EditionYear))
+	}
+	if e := tracker.ShortEdition(release.info.EditionName); e != "" {
+		edition = append(edition, e)
+	}
+	if len(edition) != 0 {
+		suffixes = append(suffixes, " ["+strings.Join(edition, " ")+"]")
+	}
+	if release.info.CatalogNumber != "" {
+		suffixes = append(suffixes, " ["+release.info.CatalogNumber+"]")
+	}
+	if release.info.Tracker != "" && release.info.ID != 0 {
+		suffixes = append(suffixes, fmt.Sprintf(" {%s %d}", release.info.Tracker, release.info.ID))
+	}
+	for _, suffix := range suffixes {
+		candidate := destination + fs.SanitizePath(suffix)
+		full := filepath.Join(library.Directory, candidate)
+		if full == release.folder || !journal.exists(full) {
+			return candidate
+		}
+	}
+	// last resort, numbering
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)", destination, i)
+		full := filepath.Join(library.Directory, candidate)
+		if full == release.folder || !journal.exists(full) {
+			return candidate
+		}
+	}
+}
+
+// replaced placement, if the release is of higher quality than the one already in the library.
+func replaced(journal *LibraryJournal, library *ConfigLibrary, release libraryRelease, destination string) (libraryPlacement, error) {
+	full := filepath.Join(library.Directory, destination)
+	existingRank := 0
+	if existing, err := libraryReleaseMetadata(full); err == nil {
+		existingRank = qualityRank(existing)
+	} else {
+		logthis.Info("Could not read metadata of "+full+", it is considered of unknown quality", logthis.VERBOSE)
+	}
+	if qualityRank(release.info) <= existingRank {
+		return libraryPlacement{}, errors.New(errorDestinationExists + ", and is of the same or better quality: " + destination)
+	}
+	trash := filepath.Join(library.TrashDirectory, destination)
+	for i := 2; journal.exists(trash); i++ {
+		trash = fmt.Sprintf("%s (%d)", filepath.Join(library.TrashDirectory, destination), i)
+	}
+	return libraryPlacement{destination: destination, trash: trash}, nil
+}
+
+// merged placement of a disc of a multi-disc set, in a folder for each disc.
+func merged(journal *LibraryJournal, library *ConfigLibrary, release libraryRelease, destination string) (libraryPlacement, error) {
+	full := filepath.Join(library.Directory, destination)
+	disc := discNumber(release.info)
+	if isMergedSet(full) {
+		if disc == 0 {
+			return libraryPlacement{}, errors.New("could not find the disc number of " + release.folder)
+		}
+		discFolder := filepath.Join(destination, fmt.Sprintf(discFolderFormat, disc))
+		if journal.exists(filepath.Join(library.Directory, discFolder)) {
+			return libraryPlacement{}, errors.New(errorDestinationExists + ": " + discFolder)
+		}
+		return libraryPlacement{destination: discFolder}, nil
+	}
+	if !DirectoryContainsMusicAndMetadata(full) {
+		return libraryPlacement{}, errors.New(errorDestinationExists + ", and is not a release that can be merged with: " + destination)
+	}
+	existing, err := libraryReleaseMetadata(full)
+	if err != nil {
+		return libraryPlacement{}, errors.Wrap(err, "could not read metadata of "+destination)
+	}
+	existingDisc := discNumber(existing)
+	// if only one disc number is known, the other release is assumed to be the first disc
+	switch {
+	case disc == 0 && existingDisc == 0:
+		return libraryPlacement{}, errors.New("could not find disc numbers to merge " + release.folder + " with " + destination)
+	case disc == 0:
+		disc = 1
+	case existingDisc == 0:
+		existingDisc = 1
+	}
+	if disc == existingDisc {
+		return libraryPlacement{}, errors.New(fmt.Sprintf("cannot merge, both releases are disc %d: %s", disc, destination))
+	}
+	return libraryPlacement{destination: filepath.Join(destination, fmt.Sprintf(discFolderFormat, disc)), existingTo: filepath.Join(destination, fmt.Sprintf(discFolderFormat, existingDisc))}, nil
+}
+
+// placeInLibrary finds where a release should go in the library, using the configured strategy if its destination is
+// already taken. ask is used to choose a strategy, if it is configured so and if it is possible.
+func placeInLibrary(journal *LibraryJournal, library *ConfigLibrary, release libraryRelease, destination string, ask func(string) string) (libraryPlacement, error) {
+	full := filepath.Join(library.Directory, destination)
+	// discs of a merged set are already where they should be
+	if full == release.folder || filepath.Dir(release.folder) == full && isMergedDisc(release.folder) {
+		rel, err := filepath.Rel(library.Directory, release.folder)
+		return libraryPlacement{destination: rel}, err
+	}
+	if !journal.exists(full) {
+		return libraryPlacement{destination: destination}, nil
+	}
+	strategy := library.ConflictStrategy
+	if strategy == conflictAsk {
+		strategy = conflictFail
+		if ask != nil {
+			strategy = ask(destination)
+		}
+	}
+	logthis.Info(fmt.Sprintf("Library folder %s already exists, strategy: %s", destination, strategy), logthis.VERBOSE)
+	switch strategy {
+	case conflictDisambiguate:
+		return libraryPlacement{destination: disambiguated(journal, library, release, destination)}, nil
+	case conflictReplace:
+		return replaced(journal, library, release, destination)
+	case conflictMerge:
+		return merged(journal, library, release, destination)
+	case conflictSkip:
+		return libraryPlacement{}, errConflictSkipped
+	}
+	return libraryPlacement{}, errors.New(errorDestinationExists + ": " + destination)
+}
+
+// makeRoom for a release in the library, by moving the release already at its destination to the trash, or to its own
+// disc folder. moved is called when a release is moved elsewhere in the library.
+func (p libraryPlacement) makeRoom(journal *LibraryJournal, library *ConfigLibrary, moved func(string, string) error) error {
+	switch {
+	case p.trash != "":
+		return journal.moveDirAcross(filepath.Join(library.Directory, p.destination), p.trash, false)
+	case p.existingTo != "":
+		// the set folder is where the existing release is, it is moved aside first
+		set := filepath.Join(library.Directory, filepath.Dir(p.existingTo))
+		aside := set + ".merging"
+		if err := journal.moveDirAcross(set, aside, false); err != nil {
+			return err
+		}
+		// recorded so that undoing the merge removes it before moving the existing release back
+		if err := journal.mkdir(set); err != nil {
+			return err
+		}
+		if err := journal.moveDirAcross(aside, filepath.Join(library.Directory, p.existingTo), false); err != nil {
+			return err
+		}
+		if moved != nil {
+			return moved(filepath.Dir(p.existingTo), p.existingTo)
+		}
+	}
+	return nil
+}
+
+// restore the release that was moved to the trash to make room, when the new release could not take its place.
+// Whatever the failed export left at the destination goes to the trash instead.
+func (p libraryPlacement) restore(journal *LibraryJournal, library *ConfigLibrary) error {
+	if p.trash == "" {
+		return nil
+	}
+	full := filepath.Join(library.Directory, p.destination)
+	if journal.exists(full) {
+		failed := p.trash + " (failed)"
+		for i := 2; journal.exists(failed); i++ {
+			failed = fmt.Sprintf("%s (failed %d)", p.trash, i)
+		}
+		if err := journal.moveDirAcross(full, failed, false); err != nil {
+			return err
+		}
+	}
+	return journal.moveDirAcross(p.trash, full, false)
+}
+
+// askConflictStrategy in the terminal, when a release cannot go where it should.
+func askConflictStrategy(destination string) string {
+	ui.Title("Library conflict")
+	ui.Usage(destination + " already exists in the library.")
+	for errs := 0; errs < 10; errs++ {
+		ui.UserChoice("[D]isambiguate with edition, catalog number or tracker ID, [R]eplace if of better quality, [M]erge as multi-disc set, or [S]kip")
+		choice, err := ui.GetInput(nil)
+		if err != nil {
+			return conflictSkip
+		}
+		switch strings.ToUpper(choice) {
+		case "D":
+			return conflictDisambiguate
+		case "R":
+			return conflictReplace
+		case "M":
+			return conflictMerge
+		case "S":
+			return conflictSkip
+		}
+		fmt.Println(ui.Red("Invalid choice."))
+	}
+	return conflictSkip
+}
@@ -0,0 +1,239 @@
+package varroa
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/catastrophic/assistance/fs"
+	"gitlab.com/catastrophic/assistance/m3u"
+	"gitlab.com/passelecasque/obstruction/tracker"
+)
+
+// writeFakeRelease with modified tracker metadata.
+func writeFakeRelease(folder string, id int, edit func(gt *tracker.GazelleTorrent)) (libraryRelease, error) {
+	release := libraryRelease{folder: folder}
+	if err := writeFakeDownload(filepath.Dir(folder), filepath.Base(folder), id, "Artist"); err != nil {
+		return release, err
+	}
+	metadataFile := filepath.Join(folder, MetadataDir, releaseMetadataFile("blue"))
+	data, err := ioutil.ReadFile(metadataFile)
+	if err != nil {
+		return release, err
+	}
+	var gt tracker.GazelleTorrent
+	if err := json.Unmarshal(data, &gt); err != nil {
+		return release, err
+	}
+	edit(&gt)
+	if data, err = json.Marshal(gt); err != nil {
+		return release, err
+	}
+	if err := ioutil.WriteFile(metadataFile, data, 0777); err != nil {
+		return release, err
+	}
+	release.info, err = libraryReleaseMetadata(folder)
+	return release, err
+}
+
+func TestLibraryConflicts(t *testing.T) {
+	fmt.Println("+ Testing Library/conflicts...")
+	check := assert.New(t)
+	_, err := NewConfig("test/test_complete.yaml")
+	check.Nil(err)
+
+	dir, err := ioutil.TempDir("", "varroa-library")
+	check.Nil(err)
+	defer os.RemoveAll(dir)
+	root, downloads := filepath.Join(dir, "library"), filepath.Join(dir, "downloads")
+	library := &ConfigLibrary{Directory: root, TrashDirectory: filepath.Join(root, libraryTrashDir), Template: "$a/$t"}
+	journalFile := filepath.Join(dir, DefaultLibraryJournal)
+	journal := newLibraryJournal(journalFile, "test", false)
+
+	_, err = writeFakeRelease(filepath.Join(root, "Artist", "Album"), 1, func(gt *tracker.GazelleTorrent) {
+		gt.Group.Name = "Album"
+	})
+	check.Nil(err)
+	incoming, err := writeFakeRelease(filepath.Join(downloads, "Album"), 2, func(gt *tracker.GazelleTorrent) {
+		gt.Group.Name = "Album"
+		gt.Torrent.Remastered = true
+		gt.Torrent.RemasterCatalogueNumber = "CAT-2"
+		gt.Torrent.Encoding = tracker.Quality24bitLossless
+	})
+	check.Nil(err)
+	destination := filepath.Join("Artist", "Album")
+
+	// no conflict
+	placement, err := placeInLibrary(journal, library, incoming, filepath.Join("Artist", "Other"), nil)
+	check.Nil(err)
+	check.Equal(libraryPlacement{destination: filepath.Join("Artist", "Other")}, placement)
+
+	// failing
+	library.ConflictStrategy = conflictFail
+	_, err = placeInLibrary(journal, library, incoming, destination, nil)
+	check.NotNil(err)
+	check.Contains(err.Error(), errorDestinationExists)
+
+	// asking, only if possible
+	library.ConflictStrategy = conflictAsk
+	_, err = placeInLibrary(journal, library, incoming, destination, nil)
+	check.NotNil(err)
+	_, err = placeInLibrary(journal, library, incoming, destination, func(string) string { return conflictSkip })
+	check.Equal(errConflictSkipped, err)
+	placement, err = placeInLibrary(journal, library, incoming, destination, func(string) string { return conflictDisambiguate })
+	check.Nil(err)
+	check.Equal(destination+" [CAT-2]", placement.destination)
+
+	// disambiguating, with the catalog number then the tracker ID
+	library.ConflictStrategy = conflictDisambiguate
+	check.Nil(os.MkdirAll(filepath.Join(root, destination+" [CAT-2]"), 0777))
+	placement, err = placeInLibrary(journal, library, incoming, destination, nil)
+	check.Nil(err)
+	check.Equal(destination+" {blue 2}", placement.destination)
+	check.Nil(os.MkdirAll(filepath.Join(root, destination+" {blue 2}"), 0777))
+	placement, err = placeInLibrary(journal, library, incoming, destination, nil)
+	check.Nil(err)
+	check.Equal(destination+" (2)", placement.destination)
+
+	// replacing only with a release of higher quality, moving the existing one to the trash, or pretending to
+	library.ConflictStrategy = conflictReplace
+	worse := incoming
+	worse.info.Quality = tracker.Quality320
+	_, err = placeInLibrary(journal, library, worse, destination, nil)
+	check.NotNil(err)
+	placement, err = placeInLibrary(journal, library, incoming, destination, nil)
+	check.Nil(err)
+	check.Equal(libraryPlacement{destination: destination, trash: filepath.Join(library.TrashDirectory, destination)}, placement)
+	simulation := newLibraryJournal(journalFile, "test", true)
+	check.Nil(placement.makeRoom(simulation, library, nil))
+	check.True(fs.DirExists(filepath.Join(root, destination)))
+	check.False(simulation.exists(filepath.Join(root, destination)))
+	check.True(simulation.exists(placement.trash))
+	check.Nil(placement.makeRoom(journal, library, nil))
+	check.False(fs.DirExists(filepath.Join(root, destination)))
+	check.True(DirectoryContainsMusicAndMetadata(placement.trash))
+	// if the new release could not be exported, the existing one is restored
+	check.Nil(os.MkdirAll(filepath.Join(root, destination), 0777))
+	check.Nil(ioutil.WriteFile(filepath.Join(root, destination, "01.flac"), []byte("partial"), 0777))
+	check.Nil(placement.restore(journal, library))
+	check.True(DirectoryContainsMusicAndMetadata(filepath.Join(root, destination)))
+	check.False(fs.DirExists(placement.trash))
+	check.True(fs.FileExists(filepath.Join(placement.trash+" (failed)", "01.flac")))
+	check.Nil(placement.makeRoom(journal, library, nil))
+	// the trash is never overwritten
+	check.Nil(os.MkdirAll(filepath.Join(root, destination), 0777))
+	placement, err = placeInLibrary(journal, library, incoming, destination, nil)
+	check.Nil(err)
+	check.Equal(filepath.Join(library.TrashDirectory, destination)+" (2)", placement.trash)
+
+	// merging discs of a set
+	library.ConflictStrategy = conflictMerge
+	// with characters that have a special meaning for filepath.Glob
+	set := filepath.Join("Artist", "Set [Deluxe]")
+	_, err = writeFakeRelease(filepath.Join(root, set), 3, func(gt *tracker.GazelleTorrent) {
+		gt.Torrent.FilePath = "Set CD1"
+	})
+	check.Nil(err)
+	discs := make(map[int]libraryRelease)
+	for i := 1; i <= 3; i++ {
+		discs[i], err = writeFakeRelease(filepath.Join(downloads, fmt.Sprintf("Set CD%d", i)), 3+i, func(gt *tracker.GazelleTorrent) {
+			gt.Torrent.FilePath = fmt.Sprintf("Set CD%d", i)
+		})
+		check.Nil(err)
+	}
+	_, err = placeInLibrary(journal, library, discs[1], set, nil)
+	check.NotNil(err)
+	_, err = placeInLibrary(journal, library, incoming, set, nil)
+	check.NotNil(err)
+	placement, err = placeInLibrary(journal, library, discs[2], set, nil)
+	check.Nil(err)
+	check.Equal(libraryPlacement{destination: filepath.Join(set, "Disc 2"), existingTo: filepath.Join(set, "Disc 1")}, placement)
+	merging := newLibraryJournal(journalFile, "merge", false)
+	var moved []string
+	check.Nil(placement.makeRoom(merging, library, func(oldPath, newPath string) error {
+		moved = append(moved, oldPath, newPath)
+		return nil
+	}))
+	check.Equal([]string{set, filepath.Join(set, "Disc 1")}, moved)
+	check.True(DirectoryContainsMusicAndMetadata(filepath.Join(root, set, "Disc 1")))
+	check.Nil(merging.copyDir(discs[2].folder, filepath.Join(root, placement.destination), false))
+	// adding to the set
+	placement, err = placeInLibrary(journal, library, discs[3], set, nil)
+	check.Nil(err)
+	check.Equal(libraryPlacement{destination: filepath.Join(set, "Disc 3")}, placement)
+	_, err = placeInLibrary(journal, library, discs[2], set, nil)
+	check.NotNil(err)
+	// discs of the set are where they should be
+	placement, err = placeInLibrary(journal, library, libraryRelease{folder: filepath.Join(root, set, "Disc 2"), info: discs[2].info}, set, nil)
+	check.Nil(err)
+	check.Equal(filepath.Join(set, "Disc 2"), placement.destination)
+
+	// undoing the merge
+	_, err = undoLibraryRun(journalFile, merging.run.ID)
+	check.Nil(err)
+	check.True(DirectoryContainsMusicAndMetadata(filepath.Join(root, set)))
+	check.False(fs.DirExists(filepath.Join(root, set, "Disc 1")))
+	check.False(fs.DirExists(filepath.Join(root, set, "Disc 2")))
+	check.False(fs.DirExists(filepath.Join(root, set) + ".merging"))
+}
+
+func TestLibraryConflictsReorganize(t *testing.T) {
+	fmt.Println("+ Testing Library/conflicts when reorganizing...")
+	check := assert.New(t)
+	_, err := NewConfig("test/test_complete.yaml")
+	check.Nil(err)
+
+	dir, err := ioutil.TempDir("", "varroa-library")
+	check.Nil(err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "library")
+	library := &ConfigLibrary{Directory: root, TrashDirectory: filepath.Join(root, libraryTrashDir), Template: "$a/$t", ConflictStrategy: conflictDisambiguate}
+	journalFile := filepath.Join(dir, DefaultLibraryJournal)
+	for i, folder := range []string{"a", "b"} {
+		_, err := writeFakeRelease(filepath.Join(root, folder), i+1, func(gt *tracker.GazelleTorrent) {
+			gt.Group.Name = "Album"
+			gt.Group.CatalogueNumber = fmt.Sprintf("CAT-%d", i+1)
+			// the fake tracks are not read to find the format of lossy releases
+			gt.Torrent.Encoding = tracker.Quality320
+		})
+		check.Nil(err)
+	}
+	// releases for which no path can be generated are left alone
+	broken, err := writeFakeRelease(filepath.Join(root, "d"), 4, func(gt *tracker.GazelleTorrent) {
+		gt.Group.ReleaseType = 5
+	})
+	check.Nil(err)
+	library.Templates = map[string]string{broken.info.ReleaseType: "$a//$t"}
+	// releases in the trash are left alone
+	_, err = writeFakeRelease(filepath.Join(library.TrashDirectory, "c"), 3, func(gt *tracker.GazelleTorrent) {
+		gt.Group.Name = "Album"
+	})
+	check.Nil(err)
+	playlistFile := filepath.Join(dir, "list.m3u")
+	check.Nil(ioutil.WriteFile(playlistFile, []byte("b/01 - Track.flac"), 0777))
+
+	reorganize := func(simulate bool) *LibraryJournal {
+		journal := newLibraryJournal(journalFile, "reorganize", simulate)
+		p, err := m3u.New(playlistFile)
+		check.Nil(err)
+		moved, err := reorganizeLibrary(journal, library, []m3u.Playlist{*p}, nil, false)
+		check.Nil(err)
+		check.Equal(2, moved)
+		return journal
+	}
+	simulation := reorganize(true)
+	check.True(fs.DirExists(filepath.Join(root, "a")))
+	run := reorganize(false)
+	check.Equal(len(simulation.run.Entries), len(run.run.Entries))
+	check.True(DirectoryContainsMusicAndMetadata(filepath.Join(root, "Artist", "Album")))
+	check.True(DirectoryContainsMusicAndMetadata(filepath.Join(root, "Artist", "Album [CAT-2]")))
+	check.True(DirectoryContainsMusicAndMetadata(filepath.Join(library.TrashDirectory, "c")))
+	check.True(DirectoryContainsMusicAndMetadata(filepath.Join(root, "d")))
+	content, err := ioutil.ReadFile(playlistFile)
+	check.Nil(err)
+	check.Equal("Artist/Album [CAT-2]/01 - Track.flac", string(content))
+}
@@ -0,0 +1,379 @@
+package varroa
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/logthis"
+)
+
+const (
+	libraryStatsTop = 10
+
+	errorOpeningLibraryDB = "Error opening library database"
+)
+
+// libraryQueryFields that can be searched, and the LibraryEntry field they match.
+var libraryQueryFields = map[string]string{
+	"artist":   "Artists",
+	"title":    "Title",
+	"tag":      "Tags",
+	"label":    "RecordLabel",
+	"catnum":   "CatalogNumber",
+	"year":     "Year",
+	"format":   "Format",
+	"quality":  "Quality",
+	"source":   "Source",
+	"tracker":  "Tracker",
+	"size":     "Size",
+	"exported": "TimeExported",
+	"folder":   "FolderName",
+}
+
+// librarySortFields that can be used to order search results.
+var librarySortFields = map[string]string{
+	"id":       "ID",
+	"folder":   "FolderName",
+	"title":    "Title",
+	"label":    "RecordLabel",
+	"year":     "Year",
+	"size":     "Size",
+	"exported": "TimeExported",
+}
+
+// LibraryEntry is a release in the library, with its tracker metadata.
+// FolderName is relative to the library directory, and may include parent folders.
+type LibraryEntry struct {
+	ID            int      `storm:"id,increment"`
+	FolderName    string   `storm:"unique"`
+	DownloadID    int      `storm:"index"`
+	Tracker       []string `storm:"index"`
+	TrackerID     []int    `storm:"index"`
+	Artists       []string `storm:"index"`
+	Title         string
+	Tags          []string `storm:"index"`
+	RecordLabel   string   `storm:"index"`
+	CatalogNumber string
+	Year          int `storm:"index"`
+	Format        string
+	Quality       string
+	Source        string
+	Size          uint64
+	TimeExported  int64
+	MetadataStamp int64
+}
+
+// trackerKeys identifying the release on each tracker.
+func (l *LibraryEntry) trackerKeys() []string {
+	var keys []string
+	for i, t := range l.Tracker {
+		if i < len(l.TrackerID) {
+			keys = append(keys, t+"|"+strconv.Itoa(l.TrackerID[i]))
+		}
+	}
+	return keys
+}
+
+// LibraryDB indexes the releases in the library.
+// It is opened for each command, so that the daemon and the command line can both use it.
+type LibraryDB struct {
+	root string
+	// releases in the trash are not part of the library
+	trash string
+	db    *Database
+}
+
+func OpenLibraryDB(path string, library *ConfigLibrary) (*LibraryDB, error) {
+	db, err := NewDatabase(path)
+	if err != nil {
+		return nil, errors.Wrap(err, errorOpeningLibraryDB)
+	}
+	l := &LibraryDB{db: db, root: library.Directory, trash: library.TrashDirectory}
+	if err := l.db.DB.Init(&LibraryEntry{}); err != nil {
+		l.Close()
+		return nil, errors.Wrap(err, "Could not prepare database for indexing library entries")
+	}
+	return l, nil
+}
+
+func (l *LibraryDB) Close() error {
+	return l.db.Close()
+}
+
+// load the metadata of a release in the library into its entry, keeping what cannot be found in the metadata.
+func (l *LibraryDB) load(folderName string, entry LibraryEntry) (LibraryEntry, error) {
+	// metadata is loaded as if the parent folder were a download directory
+	dl := DownloadEntry{FolderName: filepath.Base(folderName)}
+	if err := dl.Load(filepath.Join(l.root, filepath.Dir(folderName))); err != nil {
+		return entry, errors.Wrap(err, "Error: could not load metadata for "+folderName)
+	}
+	entry.FolderName = folderName
+	entry.Tracker, entry.TrackerID, entry.Artists, entry.Tags = dl.Tracker, dl.TrackerID, dl.Artists, dl.Tags
+	entry.Title, entry.RecordLabel, entry.CatalogNumber, entry.Year = dl.Title, dl.RecordLabel, dl.CatalogNumber, dl.Year
+	entry.Format, entry.Quality, entry.Source, entry.Size = dl.Format, dl.Quality, dl.Source, dl.Size
+	entry.MetadataStamp = dl.MetadataStamp
+	if entry.TimeExported == 0 {
+		entry.TimeExported = time.Now().Unix()
+	}
+	return entry, nil
+}
+
+// Add a release exported to the library from a download.
+func (l *LibraryDB) Add(folderName string, downloadID int) (LibraryEntry, error) {
+	var entry LibraryEntry
+	if err := l.db.DB.One("FolderName", folderName, &entry); err != nil && err != storm.ErrNotFound {
+		return entry, errors.Wrap(err, "Error looking for library entry "+folderName)
+	}
+	entry, err := l.load(folderName, LibraryEntry{ID: entry.ID, DownloadID: downloadID, TimeExported: time.Now().Unix()})
+	if err != nil {
+		return entry, err
+	}
+	// saving the whole entry, storm does not update zero values
+	if err := l.db.DB.Save(&entry); err != nil {
+		return entry, errors.Wrap(err, "Error: could not save to db "+folderName)
+	}
+	logthis.Info("New Library entry: "+folderName, logthis.VERBOSESTEST)
+	return entry, nil
+}
+
+// Scan the library, adding new releases, updating those that were moved or whose metadata was modified, and removing
+// entries for releases that have disappeared. Moved releases are found by their tracker IDs, and keep the download
+// they were exported from.
+func (l *LibraryDB) Scan() error {
+	defer TimeTrack(time.Now(), "Scan Library")
+
+	var previous []LibraryEntry
+	if err := l.db.DB.All(&previous); err != nil {
+		return errors.Wrap(err, "Cannot load previous entries")
+	}
+	byFolderName := make(map[string]LibraryEntry, len(previous))
+	byTrackerKey := make(map[string]LibraryEntry)
+	for _, p := range previous {
+		byFolderName[p.FolderName] = p
+		for _, k := range p.trackerKeys() {
+			byTrackerKey[k] = p
+		}
+	}
+	var found []string
+	walkErr := filepath.Walk(l.root, func(path string, fileInfo os.FileInfo, walkError error) error {
+		if os.IsNotExist(walkError) {
+			return nil
+		}
+		if walkError != nil {
+			return walkError
+		}
+		if path == l.trash {
+			return filepath.SkipDir
+		}
+		if !fileInfo.IsDir() || fileInfo.Name() == MetadataDir || !DirectoryContainsMusicAndMetadata(path) {
+			return nil
+		}
+		folderName, err := filepath.Rel(l.root, path)
+		if err != nil {
+			return err
+		}
+		found = append(found, folderName)
+		// releases are not nested
+		return filepath.SkipDir
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+
+	tx, err := l.db.DB.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	current := make(map[int]bool)
+	for _, folderName := range found {
+		entry, ok := byFolderName[folderName]
+		if ok && entry.MetadataStamp != 0 && entry.MetadataStamp == metadataStamp(filepath.Join(l.root, folderName)) {
+			current[entry.ID] = true
+			continue
+		}
+		entry, err = l.load(folderName, entry)
+		if err != nil {
+			logthis.Error(err, logthis.VERBOSE)
+			continue
+		}
+		if !ok {
+			// a release that was moved keeps its ID, download and export time
+			for _, k := range entry.trackerKeys() {
+				if moved, ok := byTrackerKey[k]; ok && !current[moved.ID] {
+					entry.ID, entry.DownloadID, entry.TimeExported = moved.ID, moved.DownloadID, moved.TimeExported
+					break
+				}
+			}
+		}
+		if err := tx.Save(&entry); err != nil {
+			return errors.Wrap(err, "Error: could not save to db "+folderName)
+		}
+		current[entry.ID] = true
+	}
+	for _, p := range previous {
+		if !current[p.ID] {
+			if err := tx.DeleteStruct(&p); err != nil {
+				return err
+			}
+			logthis.Info("Removed Library entry: "+p.FolderName, logthis.VERBOSESTEST)
+		}
+	}
+	return tx.Commit()
+}
+
+// Count of library entries.
+func (l *LibraryDB) Count() (int, error) {
+	return l.db.DB.Count(&LibraryEntry{})
+}
+
+// Search the library with a query, sorting the results by a field, in reverse order if it starts with "-".
+// Queries are the same as for downloads, except that releases are found by the date they were exported.
+func (l *LibraryDB) Search(query, sortBy string) ([]LibraryEntry, error) {
+	matcher, err := parseQuery(query, libraryQueryFields)
+	if err != nil {
+		return nil, err
+	}
+	field, reverse, err := sortField(sortBy, librarySortFields)
+	if err != nil {
+		return nil, err
+	}
+	selection := l.db.DB.Select(matcher).OrderBy(field)
+	if reverse {
+		selection = selection.Reverse()
+	}
+	var hits []LibraryEntry
+	if err := selection.Find(&hits); err != nil && err != storm.ErrNotFound {
+		return nil, errors.Wrap(err, "Could not search library database")
+	}
+	return hits, nil
+}
+
+// LibraryTable of search results.
+func LibraryTable(entries []LibraryEntry) string {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tYEAR\tARTISTS\tTITLE\tFORMAT\tSOURCE\tSIZE\tFOLDER")
+	for _, e := range entries {
+		var year, size string
+		if e.Year != 0 {
+			year = strconv.Itoa(e.Year)
+		}
+		if e.Size != 0 {
+			size = humanize.IBytes(e.Size)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.ID, year, strings.Join(e.Artists, ", "), e.Title, strings.TrimSpace(e.Format+" "+e.Quality), e.Source, size, e.FolderName)
+	}
+	w.Flush()
+	return b.String()
+}
+
+// LibraryCount of releases sharing a value.
+type LibraryCount struct {
+	Value    string
+	Releases int
+}
+
+// LibraryStats of the releases in the library.
+type LibraryStats struct {
+	Releases int
+	Size     uint64
+	Artists  []LibraryCount
+	Labels   []LibraryCount
+	Years    []LibraryCount
+	Formats  []LibraryCount
+}
+
+// sortedCounts, the most common first.
+func sortedCounts(counts map[string]int) []LibraryCount {
+	var sorted []LibraryCount
+	for v, c := range counts {
+		sorted = append(sorted, LibraryCount{Value: v, Releases: c})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Releases != sorted[j].Releases {
+			return sorted[i].Releases > sorted[j].Releases
+		}
+		return sorted[i].Value < sorted[j].Value
+	})
+	return sorted
+}
+
+// Stats of the library: number of releases by artist, label, year and format, and total size.
+func (l *LibraryDB) Stats() (LibraryStats, error) {
+	var stats LibraryStats
+	var entries []LibraryEntry
+	if err := l.db.DB.All(&entries); err != nil {
+		return stats, errors.Wrap(err, "Could not load library entries")
+	}
+	artists, labels, years, formats := make(map[string]int), make(map[string]int), make(map[string]int), make(map[string]int)
+	for _, e := range entries {
+		stats.Releases++
+		stats.Size += e.Size
+		for _, a := range e.Artists {
+			artists[a]++
+		}
+		if e.RecordLabel != "" {
+			labels[e.RecordLabel]++
+		}
+		if e.Year != 0 {
+			years[strconv.Itoa(e.Year)]++
+		}
+		if format := strings.TrimSpace(e.Format + " " + e.Quality); format != "" {
+			formats[format]++
+		}
+	}
+	stats.Artists, stats.Labels, stats.Years, stats.Formats = sortedCounts(artists), sortedCounts(labels), sortedCounts(years), sortedCounts(formats)
+	return stats, nil
+}
+
+func (ls LibraryStats) String() string {
+	var b bytes.Buffer
+	b.WriteString(fmt.Sprintf("Releases: %d, total size: %s\n", ls.Releases, humanize.IBytes(ls.Size)))
+	for _, section := range []struct {
+		title  string
+		counts []LibraryCount
+	}{
+		{"Top artists", ls.Artists},
+		{"Top labels", ls.Labels},
+		{"Top years", ls.Years},
+		{"Formats", ls.Formats},
+	} {
+		if len(section.counts) == 0 {
+			continue
+		}
+		b.WriteString("\n" + section.title + ":\n")
+		w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+		for i, c := range section.counts {
+			if i == libraryStatsTop {
+				break
+			}
+			fmt.Fprintf(w, "\t%s\t%d\n", c.Value, c.Releases)
+		}
+		w.Flush()
+	}
+	return b.String()
+}
+
+// updateLibraryDB after the library has changed, logging errors: the database can always be scanned again.
+func updateLibraryDB(library *ConfigLibrary, update func(l *LibraryDB) error) {
+	l, err := OpenLibraryDB(DefaultLibraryDB, library)
+	if err != nil {
+		logthis.Error(err, logthis.NORMAL)
+		return
+	}
+	defer l.Close()
+	if err := update(l); err != nil {
+		logthis.Error(errors.Wrap(err, "Error updating library database"), logthis.NORMAL)
+	}
+}
@@ -0,0 +1,79 @@
+package varroa
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLibraryDB(t *testing.T) {
+	fmt.Println("+ Testing Library/database...")
+	check := assert.New(t)
+	_, err := NewConfig("test/test_complete.yaml")
+	check.Nil(err)
+
+	dir, err := ioutil.TempDir("", "varroa-library")
+	check.Nil(err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "library")
+	check.Nil(os.MkdirAll(filepath.Join(root, "Artist"), 0777))
+	library, err := OpenLibraryDB(filepath.Join(dir, DefaultLibraryDB), &ConfigLibrary{Directory: root, TrashDirectory: filepath.Join(root, libraryTrashDir)})
+	check.Nil(err)
+	defer library.Close()
+
+	// exported releases
+	check.Nil(writeFakeDownload(filepath.Join(root, "Artist"), "Exported", 1, "Artist"))
+	exported, err := library.Add(filepath.Join("Artist", "Exported"), 12)
+	check.Nil(err)
+	check.Equal(12, exported.DownloadID)
+	check.Equal([]string{"blue"}, exported.Tracker)
+	check.Equal([]int{1}, exported.TrackerID)
+	check.Equal(1975, exported.Year)
+	check.NotZero(exported.TimeExported)
+
+	// releases already in the library, moved releases and removed releases are found by scanning, trashed releases are not
+	check.Nil(writeFakeDownload(root, "Other", 2, "Other Artist"))
+	check.Nil(writeFakeDownload(root, "Removed", 3, "Removed Artist"))
+	check.Nil(writeFakeDownload(filepath.Join(root, libraryTrashDir), "Trashed", 4, "Trashed Artist"))
+	check.Nil(library.Scan())
+	count, err := library.Count()
+	check.Nil(err)
+	check.Equal(3, count)
+	check.Nil(os.RemoveAll(filepath.Join(root, "Removed")))
+	check.Nil(os.Rename(filepath.Join(root, "Artist", "Exported"), filepath.Join(root, "Moved")))
+	check.Nil(library.Scan())
+	hits, err := library.Search("", "folder")
+	check.Nil(err)
+	check.Equal(2, len(hits))
+	check.Equal("Moved", hits[0].FolderName)
+	check.Equal(exported.ID, hits[0].ID)
+	check.Equal(12, hits[0].DownloadID)
+	check.Equal(exported.TimeExported, hits[0].TimeExported)
+	check.Equal("Other", hits[1].FolderName)
+	check.Zero(hits[1].DownloadID)
+
+	// searching
+	hits, err = library.Search(`artist:"other artist" year:1970..1979 format:flac`, "")
+	check.Nil(err)
+	check.Equal(1, len(hits))
+	check.Equal("Other", hits[0].FolderName)
+	_, err = library.Search("state:accepted", "")
+	check.NotNil(err)
+	_, err = library.Search("", "snatched")
+	check.NotNil(err)
+	check.Contains(LibraryTable(hits), "Other Artist")
+
+	// stats
+	stats, err := library.Stats()
+	check.Nil(err)
+	check.Equal(2, stats.Releases)
+	check.Equal(uint64(30), stats.Size)
+	check.Equal([]LibraryCount{{"Artist", 1}, {"Other Artist", 1}}, stats.Artists)
+	check.Equal([]LibraryCount{{"1975", 2}}, stats.Years)
+	check.Equal([]LibraryCount{{"FLAC Lossless", 2}}, stats.Formats)
+	check.Contains(stats.String(), "Releases: 2, total size: 30 B")
+}
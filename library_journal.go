@@ -0,0 +1,519 @@
+package varroa
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/fs"
+	"gitlab.com/catastrophic/assistance/logthis"
+	"gitlab.com/catastrophic/assistance/m3u"
+	"gitlab.com/catastrophic/assistance/strslice"
+)
+
+const (
+	journalMove     = "move"
+	journalCopy     = "copy"
+	journalRemove   = "remove"
+	journalPlaylist = "playlist"
+	journalRmdir    = "rmdir"
+	journalMkdir    = "mkdir"
+	journalRename   = "rename"
+
+	journalRunIDFormat = "20060102-150405.000"
+
+	errorWritingJournal = "Error writing to the library journal"
+	errorReadingJournal = "Error reading the library journal"
+	errorUndoingRun     = "Error undoing library run "
+)
+
+// JournalEntry is a single change made to the library, as written in the journal.
+// Entries of the same run share its ID, command and time.
+type JournalEntry struct {
+	Run         string   `json:"run"`
+	Command     string   `json:"command"`
+	Time        int64    `json:"time"`
+	Undoes      string   `json:"undoes,omitempty"`
+	Operation   string   `json:"op"`
+	Source      string   `json:"source,omitempty"`
+	Destination string   `json:"destination,omitempty"`
+	Before      []string `json:"before,omitempty"`
+	After       []string `json:"after,omitempty"`
+	// Created playlists did not exist before the run.
+	Created bool `json:"created,omitempty"`
+}
+
+func (je JournalEntry) String() string {
+	switch je.Operation {
+	case journalMove, journalCopy, journalRename:
+		return fmt.Sprintf("%s\t%s -> %s", je.Operation, je.Source, je.Destination)
+	case journalPlaylist:
+		description := fmt.Sprintf("%s\t%s (%d -> %d tracks)", je.Operation, je.Destination, len(je.Before), len(je.After))
+		if je.Created {
+			description += ", created"
+		}
+		return description
+	default:
+		return fmt.Sprintf("%s\t%s", je.Operation, je.Source)
+	}
+}
+
+// LibraryRun is a group of changes made to the library by a command, such as reorganize or export.
+type LibraryRun struct {
+	ID      string
+	Command string
+	Time    int64
+	Undoes  string
+	Entries []JournalEntry
+	// UndoneBy the runs that reverted this one, and how many of its entries they reverted.
+	UndoneBy []string
+	Undone   int
+}
+
+func (lr LibraryRun) String() string {
+	var b bytes.Buffer
+	b.WriteString(fmt.Sprintf("Run %s (%s): %d operation(s)\n", lr.ID, lr.Command, len(lr.Entries)))
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	for _, e := range lr.Entries {
+		fmt.Fprintf(w, "\t%s\n", e.String())
+	}
+	w.Flush()
+	return b.String()
+}
+
+// Status of the run: whether it was undone, completely or not.
+func (lr LibraryRun) Status() string {
+	switch {
+	case lr.Undoes != "":
+		return "undoes " + lr.Undoes
+	case len(lr.UndoneBy) == 0:
+		return ""
+	case lr.Undone < len(lr.Entries):
+		return fmt.Sprintf("partially undone by %s (%d/%d)", strings.Join(lr.UndoneBy, ", "), lr.Undone, len(lr.Entries))
+	default:
+		return "undone by " + strings.Join(lr.UndoneBy, ", ")
+	}
+}
+
+// LibraryJournal records the changes made to the library during a run, appending them to the journal file as they
+// happen. In simulation mode, nothing is changed or written, but the run is recorded all the same.
+type LibraryJournal struct {
+	filename string
+	simulate bool
+	run      LibraryRun
+	// in simulation mode, folders that would have been moved away, or created
+	moved   map[string]bool
+	created map[string]bool
+}
+
+var (
+	lastRunTime  time.Time
+	runTimeMutex sync.Mutex
+)
+
+// newRunTime with a different run ID than the previous one.
+func newRunTime() time.Time {
+	runTimeMutex.Lock()
+	defer runTimeMutex.Unlock()
+	now := time.Now().Truncate(time.Millisecond)
+	if !now.After(lastRunTime) {
+		now = lastRunTime.Add(time.Millisecond)
+	}
+	lastRunTime = now
+	return now
+}
+
+func newLibraryJournal(filename, command string, simulate bool) *LibraryJournal {
+	now := newRunTime()
+	return &LibraryJournal{filename: filename, simulate: simulate, run: LibraryRun{ID: now.Format(journalRunIDFormat), Command: command, Time: now.Unix()}, moved: make(map[string]bool), created: make(map[string]bool)}
+}
+
+func (j *LibraryJournal) String() string {
+	return j.run.String()
+}
+
+// exists returns true if a folder exists, or would exist in simulation mode.
+func (j *LibraryJournal) exists(path string) bool {
+	return j.created[path] || fs.DirExists(path) && !j.moved[path]
+}
+
+// simulated move of a folder, so that later changes in the same run can take it into account.
+func (j *LibraryJournal) simulated(src, dst string) {
+	if j.simulate {
+		if src != "" {
+			j.moved[src], j.created[src] = true, false
+		}
+		j.created[dst], j.moved[dst] = true, false
+	}
+}
+
+// record a change that was made, or would have been made in simulation mode.
+func (j *LibraryJournal) record(entry JournalEntry) error {
+	entry.Run, entry.Command, entry.Time, entry.Undoes = j.run.ID, j.run.Command, j.run.Time, j.run.Undoes
+	j.run.Entries = append(j.run.Entries, entry)
+	logthis.Info(entry.String(), logthis.VERBOSE)
+	if j.simulate {
+		return nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, errorWritingJournal)
+	}
+	f, err := os.OpenFile(j.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, errorWritingJournal)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return errors.Wrap(err, errorWritingJournal)
+	}
+	return nil
+}
+
+// moveDir to a new path in the library, returns true if it was moved.
+func (j *LibraryJournal) moveDir(current, new string, interactive bool) (bool, error) {
+	hasMoved, err := fs.MoveDir(current, new, j.simulate, interactive)
+	if err != nil || !hasMoved {
+		return hasMoved, err
+	}
+	j.simulated(current, new)
+	return true, j.record(JournalEntry{Operation: journalMove, Source: current, Destination: new})
+}
+
+// copyDir to the library.
+func (j *LibraryJournal) copyDir(src, dst string, useHardLinks bool) error {
+	if !j.simulate {
+		if err := fs.CopyDir(src, dst, useHardLinks); err != nil {
+			return err
+		}
+	}
+	j.simulated("", dst)
+	return j.record(JournalEntry{Operation: journalCopy, Source: src, Destination: dst})
+}
+
+// moveDirAcross file systems: renaming if possible, or copying and then removing the source.
+func (j *LibraryJournal) moveDirAcross(src, dst string, useHardLinks bool) error {
+	if !j.simulate {
+		if err := moveDirAcross(src, dst, useHardLinks); err != nil {
+			return err
+		}
+	}
+	j.simulated(src, dst)
+	return j.record(JournalEntry{Operation: journalMove, Source: src, Destination: dst})
+}
+
+// mkdir creates a folder in the library, with its parents.
+func (j *LibraryJournal) mkdir(path string) error {
+	if !j.simulate {
+		if err := os.MkdirAll(path, 0777); err != nil {
+			return err
+		}
+	}
+	j.simulated("", path)
+	return j.record(JournalEntry{Operation: journalMkdir, Source: path})
+}
+
+// rename a file or folder inside a release.
+func (j *LibraryJournal) rename(src, dst string) error {
+	if !j.simulate {
+		if err := os.Rename(src, dst); err != nil {
+			return err
+		}
+	}
+	return j.record(JournalEntry{Operation: journalRename, Source: src, Destination: dst})
+}
+
+// savePlaylist after it has been edited, with its contents before the edit.
+func (j *LibraryJournal) savePlaylist(p *m3u.Playlist, before []string, created bool) error {
+	if !j.simulate {
+		if err := p.Save(); err != nil {
+			return err
+		}
+	}
+	return j.record(JournalEntry{Operation: journalPlaylist, Destination: p.Filename, Before: before, After: append([]string{}, p.Contents...), Created: created})
+}
+
+// deleteEmptyDirs in root, except those in the whitelist, deepest directories first.
+// In simulation mode, folders that would have been moved are considered gone.
+func (j *LibraryJournal) deleteEmptyDirs(root string, whitelist []string) error {
+	var dirs []string
+	walkErr := filepath.Walk(root, func(path string, fileInfo os.FileInfo, walkError error) error {
+		if os.IsNotExist(walkError) {
+			return nil
+		}
+		if walkError != nil {
+			return walkError
+		}
+		if j.moved[path] {
+			return filepath.SkipDir
+		}
+		// do not delete root, even if empty
+		if fileInfo.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+	removed := make(map[string]bool)
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if strslice.Contains(whitelist, dirs[i]) {
+			continue
+		}
+		contents, err := ioutil.ReadDir(dirs[i])
+		if err != nil {
+			continue
+		}
+		isEmpty := true
+		for _, c := range contents {
+			if path := filepath.Join(dirs[i], c.Name()); !removed[path] && !j.moved[path] {
+				isEmpty = false
+				break
+			}
+		}
+		if !isEmpty {
+			continue
+		}
+		if !j.simulate {
+			if err := os.Remove(dirs[i]); err != nil {
+				logthis.Error(err, logthis.VERBOSE)
+				continue
+			}
+		}
+		removed[dirs[i]] = true
+		if err := j.record(JournalEntry{Operation: journalRmdir, Source: dirs[i]}); err != nil {
+			return err
+		}
+	}
+	logthis.Info(fmt.Sprintf("Removed %d empty directories.", len(removed)), logthis.VERBOSE)
+	return nil
+}
+
+// moveDirAcross file systems: renaming if possible, or copying and then removing the source.
+func moveDirAcross(src, dst string, useHardLinks bool) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := fs.CopyDir(src, dst, useHardLinks); err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// readLibraryRuns from the journal, in chronological order.
+func readLibraryRuns(filename string) ([]LibraryRun, error) {
+	if !fs.FileExists(filename) {
+		return nil, nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, errorReadingJournal)
+	}
+	defer f.Close()
+
+	var runs []LibraryRun
+	index := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, errors.Wrap(err, errorReadingJournal)
+		}
+		i, ok := index[entry.Run]
+		if !ok {
+			i = len(runs)
+			index[entry.Run] = i
+			runs = append(runs, LibraryRun{ID: entry.Run, Command: entry.Command, Time: entry.Time, Undoes: entry.Undoes})
+		}
+		runs[i].Entries = append(runs[i].Entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, errorReadingJournal)
+	}
+	for _, r := range runs {
+		if i, ok := index[r.Undoes]; ok {
+			runs[i].UndoneBy = append(runs[i].UndoneBy, r.ID)
+			runs[i].Undone += len(r.Entries)
+		}
+	}
+	return runs, nil
+}
+
+// libraryHistory lists the runs in the journal, the most recent first.
+func libraryHistory(filename string) (string, error) {
+	runs, err := readLibraryRuns(filename)
+	if err != nil {
+		return "", err
+	}
+	if len(runs) == 0 {
+		return "The library journal is empty.\n", nil
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].Time > runs[j].Time })
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RUN\tDATE\tCOMMAND\tOPERATIONS\tSTATUS")
+	for _, r := range runs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", r.ID, time.Unix(r.Time, 0).Format("2006-01-02 15:04:05"), r.Command, len(r.Entries), r.Status())
+	}
+	w.Flush()
+	return b.String(), nil
+}
+
+// LibraryHistory lists the runs that changed the library, the most recent first.
+func LibraryHistory() (string, error) {
+	return libraryHistory(DefaultLibraryJournal)
+}
+
+// undoEntry reverts a single change, recording it in the journal of the undo run.
+func (j *LibraryJournal) undoEntry(entry JournalEntry) error {
+	switch entry.Operation {
+	case journalMove:
+		if !fs.DirExists(entry.Destination) {
+			return errors.New(entry.Destination + " does not exist anymore")
+		}
+		if fs.DirExists(entry.Source) {
+			return errors.New(entry.Source + " already exists")
+		}
+		return j.moveDirAcross(entry.Destination, entry.Source, false)
+	case journalCopy:
+		if !fs.DirExists(entry.Destination) {
+			return errors.New(entry.Destination + " does not exist anymore")
+		}
+		if !j.simulate {
+			if err := os.RemoveAll(entry.Destination); err != nil {
+				return err
+			}
+		}
+		return j.record(JournalEntry{Operation: journalRemove, Source: entry.Destination})
+	case journalPlaylist:
+		p := &m3u.Playlist{Filename: entry.Destination}
+		if fs.FileExists(entry.Destination) {
+			current, err := m3u.New(entry.Destination)
+			if err != nil {
+				return err
+			}
+			p.Contents = current.Contents
+		}
+		// playlists edited since the run cannot be restored safely
+		if strings.Join(p.Contents, "\n") != strings.Join(entry.After, "\n") {
+			return errors.New("playlist " + entry.Destination + " has been modified since")
+		}
+		if entry.Created {
+			if !j.simulate {
+				if err := os.Remove(entry.Destination); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			return j.record(JournalEntry{Operation: journalRemove, Source: entry.Destination})
+		}
+		p.Contents = append([]string{}, entry.Before...)
+		return j.savePlaylist(p, entry.After, false)
+	case journalRename:
+		if _, err := os.Stat(entry.Destination); err != nil {
+			return errors.New(entry.Destination + " does not exist anymore")
+		}
+		if _, err := os.Stat(entry.Source); err == nil {
+			return errors.New(entry.Source + " already exists")
+		}
+		return j.rename(entry.Destination, entry.Source)
+	case journalRmdir:
+		if !j.simulate {
+			if err := os.MkdirAll(entry.Source, 0777); err != nil {
+				return err
+			}
+		}
+		return j.record(JournalEntry{Operation: journalMkdir, Source: entry.Source})
+	case journalMkdir:
+		if !j.simulate {
+			// only removing the folder if nothing was added to it since
+			if err := os.Remove(entry.Source); err != nil && !os.IsNotExist(err) {
+				return errors.New(entry.Source + " is not empty anymore")
+			}
+		}
+		return j.record(JournalEntry{Operation: journalRmdir, Source: entry.Source})
+	}
+	return errors.New("operation " + entry.Operation + " cannot be undone")
+}
+
+// undoLibraryRun reverts the changes of a run, the last one first. Without a run ID, the most recent run that has not
+// been undone is chosen. If a previous undo was interrupted, it resumes where it stopped.
+func undoLibraryRun(filename, runID string) (*LibraryJournal, error) {
+	runs, err := readLibraryRuns(filename)
+	if err != nil {
+		return nil, err
+	}
+	var target *LibraryRun
+	for i := len(runs) - 1; i >= 0; i-- {
+		if runID == "" && runs[i].Undoes == "" && runs[i].Undone < len(runs[i].Entries) || runID != "" && runs[i].ID == runID {
+			target = &runs[i]
+			break
+		}
+	}
+	switch {
+	case target == nil && runID == "":
+		return nil, errors.New("nothing to undo")
+	case target == nil:
+		return nil, errors.New("unknown library run " + runID)
+	case target.Undoes != "":
+		return nil, errors.New(errorUndoingRun + target.ID + ": it is already an undo run")
+	case target.Undone >= len(target.Entries):
+		return nil, errors.New(errorUndoingRun + target.ID + ": it has already been undone")
+	}
+
+	journal := newLibraryJournal(filename, "undo "+target.ID, false)
+	journal.run.Undoes = target.ID
+	for i := len(target.Entries) - 1 - target.Undone; i >= 0; i-- {
+		if err := journal.undoEntry(target.Entries[i]); err != nil {
+			return journal, errors.Wrap(err, errorUndoingRun+target.ID+", it was only partially undone")
+		}
+	}
+	return journal, nil
+}
+
+// UndoLibraryRun reverts the changes made to the library by a run, or by the most recent one.
+// Folders left empty by moving releases back are then deleted, in a run of their own.
+func UndoLibraryRun(runID string) (*LibraryJournal, *LibraryJournal, error) {
+	c, err := NewConfig(DefaultConfigurationFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !c.LibraryConfigured {
+		return nil, nil, errors.New("library section of the configuration file not found")
+	}
+	journal, err := undoLibraryRun(DefaultLibraryJournal, runID)
+	if journal == nil || len(journal.run.Entries) == 0 {
+		return journal, nil, err
+	}
+	// even partial undos change the library
+	defer updateLibraryDB(c.Library, func(l *LibraryDB) error { return l.Scan() })
+	if err != nil {
+		return journal, nil, err
+	}
+	movedBack := false
+	for _, e := range journal.run.Entries {
+		movedBack = movedBack || e.Operation == journalMove
+	}
+	if !movedBack {
+		return journal, nil, nil
+	}
+	clean := newLibraryJournal(DefaultLibraryJournal, "clean", false)
+	return journal, clean, deleteEmptyLibraryFolders(clean)
+}
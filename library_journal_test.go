@@ -0,0 +1,113 @@
+package varroa
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/catastrophic/assistance/fs"
+	"gitlab.com/catastrophic/assistance/m3u"
+)
+
+func TestLibraryJournal(t *testing.T) {
+	fmt.Println("+ Testing Library/journal...")
+	check := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "varroa-library")
+	check.Nil(err)
+	defer os.RemoveAll(dir)
+	library, downloads := filepath.Join(dir, "library"), filepath.Join(dir, "downloads")
+	journalFile := filepath.Join(dir, DefaultLibraryJournal)
+	for _, d := range []string{filepath.Join(library, "Old Artist", "Release"), filepath.Join(library, "Empty"), filepath.Join(downloads, "Download")} {
+		check.Nil(os.MkdirAll(d, 0777))
+	}
+	check.Nil(ioutil.WriteFile(filepath.Join(library, "Old Artist", "Release", "01.flac"), []byte("not really flac"), 0777))
+	check.Nil(ioutil.WriteFile(filepath.Join(downloads, "Download", "01.flac"), []byte("not really flac"), 0777))
+	playlistFile := filepath.Join(dir, "list.m3u")
+	check.Nil(ioutil.WriteFile(playlistFile, []byte("Old Artist/Release/01.flac"), 0777))
+
+	// a simulation changes nothing and writes nothing, but looks like an actual run
+	reorganize := func(simulate bool) *LibraryJournal {
+		journal := newLibraryJournal(journalFile, "reorganize", simulate)
+		moved, err := journal.moveDir(filepath.Join(library, "Old Artist", "Release"), filepath.Join(library, "New Artist", "Release"), false)
+		check.Nil(err)
+		check.True(moved)
+		p, err := m3u.New(playlistFile)
+		check.Nil(err)
+		before := append([]string{}, p.Contents...)
+		p.Update("Old Artist/Release", "New Artist/Release")
+		check.Nil(journal.savePlaylist(p, before, false))
+		check.Nil(journal.deleteEmptyDirs(library, nil))
+		return journal
+	}
+	simulation := reorganize(true)
+	check.False(fs.FileExists(journalFile))
+	check.True(fs.DirExists(filepath.Join(library, "Old Artist", "Release")))
+	check.True(fs.DirExists(filepath.Join(library, "Empty")))
+	run := reorganize(false)
+	// only the run IDs differ
+	check.Equal(strings.Replace(simulation.String(), simulation.run.ID, run.run.ID, 1), run.String())
+	check.Contains(run.String(), "playlist  "+playlistFile+" (1 -> 1 tracks)")
+	check.False(fs.DirExists(filepath.Join(library, "Old Artist")))
+	check.False(fs.DirExists(filepath.Join(library, "Empty")))
+	content, err := ioutil.ReadFile(playlistFile)
+	check.Nil(err)
+	check.Equal("New Artist/Release/01.flac", string(content))
+
+	// exporting to a new playlist
+	export := newLibraryJournal(journalFile, "export Download", false)
+	check.Nil(export.copyDir(filepath.Join(downloads, "Download"), filepath.Join(library, "Downloaded"), false))
+	newPlaylist := &m3u.Playlist{Filename: filepath.Join(dir, "new.m3u")}
+	check.Nil(newPlaylist.AddRelease(library, "Downloaded"))
+	check.Nil(export.savePlaylist(newPlaylist, nil, true))
+
+	runs, err := readLibraryRuns(journalFile)
+	check.Nil(err)
+	check.Equal(2, len(runs))
+	check.Equal(run.run.Entries, runs[0].Entries)
+	check.Equal(4, len(runs[0].Entries))
+	history, err := libraryHistory(journalFile)
+	check.Nil(err)
+	check.Contains(history, "export Download")
+
+	// undoing the most recent run first
+	undo, err := undoLibraryRun(journalFile, "")
+	check.Nil(err)
+	check.Equal(export.run.ID, undo.run.Undoes)
+	check.False(fs.DirExists(filepath.Join(library, "Downloaded")))
+	check.True(fs.DirExists(filepath.Join(downloads, "Download")))
+	check.False(fs.FileExists(newPlaylist.Filename))
+	_, err = undoLibraryRun(journalFile, export.run.ID)
+	check.NotNil(err)
+	_, err = undoLibraryRun(journalFile, undo.run.ID)
+	check.NotNil(err)
+	_, err = undoLibraryRun(journalFile, "unknown")
+	check.NotNil(err)
+
+	// playlists edited since the run are not overwritten
+	check.Nil(ioutil.WriteFile(playlistFile, []byte("Something Else/01.flac"), 0777))
+	_, err = undoLibraryRun(journalFile, "")
+	check.NotNil(err)
+	runs, err = readLibraryRuns(journalFile)
+	check.Nil(err)
+	check.Equal("partially undone by "+runs[3].ID+" (2/4)", runs[0].Status())
+	// resuming
+	check.Nil(ioutil.WriteFile(playlistFile, []byte("New Artist/Release/01.flac"), 0777))
+	_, err = undoLibraryRun(journalFile, "")
+	check.Nil(err)
+	check.True(fs.DirExists(filepath.Join(library, "Old Artist", "Release")))
+	check.True(fs.DirExists(filepath.Join(library, "Empty")))
+	check.False(fs.DirExists(filepath.Join(library, "New Artist", "Release")))
+	content, err = ioutil.ReadFile(playlistFile)
+	check.Nil(err)
+	check.Equal("Old Artist/Release/01.flac", string(content))
+	runs, err = readLibraryRuns(journalFile)
+	check.Nil(err)
+	check.Equal("undone by "+runs[3].ID+", "+runs[4].ID, runs[0].Status())
+	_, err = undoLibraryRun(journalFile, "")
+	check.NotNil(err)
+}
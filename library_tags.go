@@ -0,0 +1,334 @@
+package varroa
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-flac/flacpicture"
+	goflac "github.com/go-flac/go-flac"
+	"github.com/mewkiz/flac/meta"
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/flac"
+	"gitlab.com/catastrophic/assistance/fs"
+	"gitlab.com/catastrophic/assistance/logthis"
+	"gitlab.com/catastrophic/assistance/music"
+	"gitlab.com/catastrophic/assistance/ui"
+)
+
+const (
+	tagCatalogNumber = "CATALOGNUMBER"
+	tagReleaseType   = "RELEASETYPE"
+	// followed by the tracker name
+	tagTorrentIDSuffix = "_TORRENTID"
+	tagGroupIDSuffix   = "_GROUPID"
+	// shown in the differences when embedding the cover
+	tagPicture = "PICTURE"
+)
+
+// tagChange of a music file in the library.
+type tagChange struct {
+	file   string
+	field  string
+	before []string
+	after  []string
+}
+
+func (c tagChange) String() string {
+	before := strings.Join(c.before, ", ")
+	if len(c.before) == 0 {
+		before = "(none)"
+	}
+	return fmt.Sprintf("%s: %s: %s -> %s", c.file, c.field, before, strings.Join(c.after, ", "))
+}
+
+// readFLACComment of a FLAC file: its vendor, and its tags with upper case names.
+func readFLACComment(path string) (string, map[string][]string, error) {
+	stream, err := parseFLAC(path)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "could not read tags of "+path)
+	}
+	var vendor string
+	tags := make(map[string][]string)
+	for _, block := range stream.Blocks {
+		if comment, ok := block.Body.(*meta.VorbisComment); ok {
+			vendor = comment.Vendor
+			for _, tag := range comment.Tags {
+				name := strings.ToUpper(tag[0])
+				tags[name] = append(tags[name], strings.TrimSpace(tag[1]))
+			}
+		}
+	}
+	return vendor, tags, nil
+}
+
+// trackerTagName for the tags of tracker IDs, which can only contain some ASCII characters.
+func trackerTagName(tracker, suffix string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7d || r == '=' {
+			return '_'
+		}
+		return r
+	}, strings.ToUpper(tracker)) + suffix
+}
+
+// libraryTags for all the tracks of a release, from its tracker metadata. Empty values are not written.
+func (tm *TrackerMetadata) libraryTags() map[string][]string {
+	tags := make(map[string][]string)
+	set := func(field string, values ...string) {
+		for _, v := range values {
+			if v != "" {
+				tags[field] = append(tags[field], v)
+			}
+		}
+	}
+	set(flac.TagAlbumArtist, tm.MainArtist)
+	set(flac.TagRecordLabel, tm.RecordLabel)
+	set(flac.TagRecordLabel2, tm.RecordLabel)
+	set(tagCatalogNumber, tm.CatalogNumber)
+	set(tagReleaseType, tm.ReleaseType)
+	set(flac.TagGenre, tm.Tags...)
+	if tm.Tracker != "" {
+		if tm.ID != 0 {
+			set(trackerTagName(tm.Tracker, tagTorrentIDSuffix), strconv.Itoa(tm.ID))
+		}
+		if tm.GroupID != 0 {
+			set(trackerTagName(tm.Tracker, tagGroupIDSuffix), strconv.Itoa(tm.GroupID))
+		}
+	}
+	return tags
+}
+
+// isHardLinked returns true if the file shares its contents with another, such as a download.
+func isHardLinked(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Nlink > 1, nil
+	}
+	return false, nil
+}
+
+// coverPicture block from the cover saved with the tracker metadata.
+func coverPicture(cover string) (*goflac.MetaDataBlock, error) {
+	data, err := ioutil.ReadFile(cover)
+	if err != nil {
+		return nil, err
+	}
+	mime := http.DetectContentType(data)
+	if mime != "image/jpeg" && mime != "image/png" {
+		return nil, errors.New("unsupported cover format " + mime + ": " + cover)
+	}
+	picture, err := flacpicture.NewFromImageData(flacpicture.PictureTypeFrontCover, "cover", data, mime)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read cover "+cover)
+	}
+	block := picture.Marshal()
+	return &block, nil
+}
+
+// parseFLACFile to modify its metadata blocks, without panicking on invalid files.
+func parseFLACFile(path string) (f *goflac.File, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid FLAC file %s: %v", path, r)
+		}
+	}()
+	return goflac.ParseFile(path)
+}
+
+// writeFLACTags of a FLAC file, and add the picture if it has none. It returns what was, or would be, modified.
+func writeFLACTags(path string, tags map[string][]string, picture *goflac.MetaDataBlock, simulate bool) ([]tagChange, error) {
+	vendor, current, err := readFLACComment(path)
+	if err != nil {
+		return nil, err
+	}
+	var fields []string
+	for field := range tags {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	var changes []tagChange
+	for _, field := range fields {
+		if strings.Join(current[field], "\x00") != strings.Join(tags[field], "\x00") {
+			changes = append(changes, tagChange{file: path, field: field, before: current[field], after: tags[field]})
+			current[field] = tags[field]
+		}
+	}
+	f, err := parseFLACFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse "+path)
+	}
+	commentIndex := -1
+	var hasPicture bool
+	for i, block := range f.Meta {
+		switch block.Type {
+		case goflac.VorbisComment:
+			commentIndex = i
+		case goflac.Picture:
+			hasPicture = true
+		}
+	}
+	if picture != nil && !hasPicture {
+		changes = append(changes, tagChange{file: path, field: tagPicture, after: []string{"front cover"}})
+	} else {
+		picture = nil
+	}
+	if simulate || len(changes) == 0 {
+		return changes, nil
+	}
+
+	comment := flac.NewTags(vendor)
+	for field, values := range current {
+		if err := comment.Set(field, values); err != nil {
+			return nil, errors.Wrap(err, "invalid tag "+field+" in "+path)
+		}
+	}
+	block, err := comment.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if commentIndex == -1 {
+		f.Meta = append(f.Meta, &block)
+	} else {
+		f.Meta[commentIndex] = &block
+	}
+	if picture != nil {
+		f.Meta = append(f.Meta, picture)
+	}
+	return changes, saveFLACFile(f, path)
+}
+
+// saveFLACFile to a temporary file in the same folder, which then replaces the original, so that it is never left
+// half-written.
+func saveFLACFile(f *goflac.File, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return errors.Wrap(err, "could not create temporary file to tag "+path)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(f.Marshal()); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "could not write tags to "+path)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "could not write tags to "+path)
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// writeTags of the FLAC files of a release in the library, with its tracker metadata. Files that are hard links to
+// the downloads are left alone. It returns what was, or would be, modified.
+// Tags are not recorded in the library journal: undoing an export removes the copy anyway.
+func (tm *TrackerMetadata) writeTags(releaseFolder string, embedCover, simulate bool) ([]tagChange, error) {
+	tags := tm.libraryTags()
+	var picture *goflac.MetaDataBlock
+	if cover := tm.coverPath(releaseFolder); embedCover && fs.FileExists(cover) {
+		var err error
+		if picture, err = coverPicture(cover); err != nil {
+			logthis.Error(err, logthis.NORMAL)
+		}
+	}
+	var changes []tagChange
+	err := filepath.Walk(releaseFolder, func(path string, fileInfo os.FileInfo, walkError error) error {
+		if walkError != nil {
+			return walkError
+		}
+		if fileInfo.IsDir() && fileInfo.Name() == MetadataDir {
+			return filepath.SkipDir
+		}
+		if fileInfo.IsDir() || strings.ToLower(filepath.Ext(path)) != music.FlacExt {
+			return nil
+		}
+		linked, err := isHardLinked(path)
+		if err != nil {
+			return err
+		}
+		if linked {
+			logthis.Info("Not writing tags to hard link "+path, logthis.VERBOSE)
+			return nil
+		}
+		fileChanges, err := writeFLACTags(path, tags, picture, simulate)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, fileChanges...)
+		return nil
+	})
+	return changes, err
+}
+
+// tagLibrary by writing the tracker metadata of all releases to their FLAC files.
+// It returns the number of releases that were, or would be, modified.
+func tagLibrary(library *ConfigLibrary, simulate bool) (int, []tagChange, error) {
+	var tagged int
+	var changes []tagChange
+	err := filepath.Walk(library.Directory, func(path string, fileInfo os.FileInfo, walkError error) error {
+		if walkError != nil {
+			return walkError
+		}
+		if path == library.TrashDirectory {
+			return filepath.SkipDir
+		}
+		if !fileInfo.IsDir() || !DirectoryContainsMusicAndMetadata(path) {
+			return nil
+		}
+		info, err := libraryReleaseMetadata(path)
+		if err != nil {
+			logthis.Error(errors.Wrap(err, "Not tagging "+path), logthis.NORMAL)
+			return nil
+		}
+		releaseChanges, err := info.writeTags(path, library.EmbedCover, simulate)
+		if err != nil {
+			logthis.Error(errors.Wrap(err, "Error tagging "+path), logthis.NORMAL)
+		}
+		if len(releaseChanges) != 0 {
+			tagged++
+			changes = append(changes, releaseChanges...)
+		}
+		return nil
+	})
+	return tagged, changes, err
+}
+
+// TagLibrary writes tracker metadata into the tags of the FLAC files of all releases in the library.
+func TagLibrary(doNothing bool) error {
+	defer TimeTrack(time.Now(), "Tag Library")
+
+	c, err := NewConfig(DefaultConfigurationFile)
+	if err != nil {
+		return err
+	}
+	if !c.LibraryConfigured {
+		return errors.New("library section of the configuration file not found")
+	}
+	if doNothing {
+		logthis.Info("Simulating library tagging...", logthis.NORMAL)
+	}
+	tagged, changes, err := tagLibrary(c.Library, doNothing)
+	for _, change := range changes {
+		if doNothing {
+			fmt.Println(ui.Yellow(change.String()))
+		} else {
+			fmt.Println(change.String())
+		}
+	}
+	logthis.Info(fmt.Sprintf("Tagged %d release(s).", tagged), logthis.NORMAL)
+	return err
+}
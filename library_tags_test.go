@@ -0,0 +1,109 @@
+package varroa
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	goflac "github.com/go-flac/go-flac"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/passelecasque/obstruction/tracker"
+)
+
+func TestLibraryTags(t *testing.T) {
+	fmt.Println("+ Testing Library/tags...")
+	check := assert.New(t)
+	_, err := NewConfig("test/test_complete.yaml")
+	check.Nil(err)
+
+	dir, err := ioutil.TempDir("", "varroa-library")
+	check.Nil(err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "library")
+	library := &ConfigLibrary{Directory: root, TrashDirectory: filepath.Join(root, libraryTrashDir), EmbedCover: true}
+	release, err := writeFakeRelease(filepath.Join(root, "Release"), 12, func(gt *tracker.GazelleTorrent) {
+		gt.Group.ID = 34
+		gt.Group.RecordLabel = "Label"
+		gt.Group.CatalogueNumber = "CAT-1"
+		gt.Group.ReleaseType = 1
+		gt.Group.Tags = []string{"jazz", "free.jazz"}
+	})
+	check.Nil(err)
+	track := filepath.Join(release.folder, "01 - Track.flac")
+	check.Nil(writeFakeFLAC(track, "TITLE=Track", "GENRE=rock", "LABEL=Label"))
+	// hard links to the downloads are not modified
+	download := filepath.Join(dir, "download.flac")
+	check.Nil(writeFakeFLAC(download, "TITLE=Linked"))
+	check.Nil(os.Link(download, filepath.Join(release.folder, "02 - Linked.flac")))
+	original, err := ioutil.ReadFile(download)
+	check.Nil(err)
+	// cover
+	cover, err := os.Create(release.info.coverPath(release.folder))
+	check.Nil(err)
+	check.Nil(png.Encode(cover, image.NewRGBA(image.Rect(0, 0, 2, 2))))
+	check.Nil(cover.Close())
+
+	tags := release.info.libraryTags()
+	check.Equal([]string{"Artist"}, tags["ALBUMARTIST"])
+	check.Equal([]string{"Label"}, tags["ORGANIZATION"])
+	check.Equal([]string{"jazz", "free.jazz"}, tags["GENRE"])
+	check.Equal([]string{"12"}, tags["BLUE_TORRENTID"])
+	check.Equal([]string{"34"}, tags["BLUE_GROUPID"])
+	check.Equal("ABC_D_"+tagGroupIDSuffix, trackerTagName("abc=dé", tagGroupIDSuffix))
+
+	// simulating only shows what would change
+	tagged, changes, err := tagLibrary(library, true)
+	check.Nil(err)
+	check.Equal(1, tagged)
+	fields := make(map[string]tagChange)
+	for _, c := range changes {
+		check.Equal(track, c.file)
+		fields[c.field] = c
+	}
+	check.NotContains(fields, "LABEL")
+	check.Equal(tagChange{file: track, field: "GENRE", before: []string{"rock"}, after: []string{"jazz", "free.jazz"}}, fields["GENRE"])
+	check.Contains(fields["GENRE"].String(), "GENRE: rock -> jazz, free.jazz")
+	check.Contains(fields, tagCatalogNumber)
+	check.Contains(fields, tagPicture)
+	current, err := readFLACTags(track)
+	check.Nil(err)
+	check.Equal("rock", current["GENRE"])
+
+	// writing
+	tagged, changes, err = tagLibrary(library, false)
+	check.Nil(err)
+	check.Equal(1, tagged)
+	check.Equal(len(fields), len(changes))
+	_, current2, err := readFLACComment(track)
+	check.Nil(err)
+	check.Equal([]string{"Track"}, current2["TITLE"])
+	check.Equal([]string{"jazz", "free.jazz"}, current2["GENRE"])
+	check.Equal([]string{"CAT-1"}, current2[tagCatalogNumber])
+	check.Equal([]string{"12"}, current2["BLUE_TORRENTID"])
+	f, err := goflac.ParseFile(track)
+	check.Nil(err)
+	var pictures int
+	for _, block := range f.Meta {
+		if block.Type == goflac.Picture {
+			pictures++
+		}
+	}
+	check.Equal(1, pictures)
+	// the file is replaced, leaving no temporary file behind
+	leftovers, err := filepath.Glob(filepath.Join(release.folder, ".*.flac.*"))
+	check.Nil(err)
+	check.Empty(leftovers)
+	linked, err := ioutil.ReadFile(download)
+	check.Nil(err)
+	check.Equal(original, linked)
+
+	// nothing left to do
+	tagged, changes, err = tagLibrary(library, false)
+	check.Nil(err)
+	check.Equal(0, tagged)
+	check.Empty(changes)
+}
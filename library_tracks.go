@@ -0,0 +1,223 @@
+package varroa
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mewkiz/flac"
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/logthis"
+	"gitlab.com/catastrophic/assistance/music"
+	"gitlab.com/catastrophic/assistance/strslice"
+)
+
+// track number and title in file names such as "01 - Title.flac" or "1-01. Title.flac"
+var trackFilenameRegexp = regexp.MustCompile(`^(?:(\d+)[-.])?(\d+)(?:\s*[-._]\s*|\s+)(.+)$`)
+
+// parseFLAC metadata blocks.
+func parseFLAC(path string) (*flac.Stream, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return flac.Parse(f)
+}
+
+// readFLACTags of a FLAC file, with upper case names. Only the first value of each tag is kept.
+func readFLACTags(path string) (map[string]string, error) {
+	_, comment, err := readFLACComment(path)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string)
+	for name, values := range comment {
+		tags[name] = values[0]
+	}
+	return tags, nil
+}
+
+// tagNumber from tags such as TRACKNUMBER=3/12.
+func tagNumber(value string) string {
+	value = strings.TrimSpace(strings.Split(value, "/")[0])
+	if n, err := strconv.Atoi(value); err == nil {
+		return strconv.Itoa(n)
+	}
+	return ""
+}
+
+// isMusicFile returns true for the files that are renamed.
+func isMusicFile(path string) bool {
+	return strslice.Contains([]string{music.FlacExt, music.Mp3Ext}, strings.ToLower(filepath.Ext(path)))
+}
+
+// trackInfo of a music file of a release, from its tags, or else from the tracker metadata, or else from its path.
+// relativePath is relative to the release folder.
+func (tm *TrackerMetadata) trackInfo(releaseFolder, relativePath string) TrackerMetadataTrack {
+	var track TrackerMetadataTrack
+	if strings.ToLower(filepath.Ext(relativePath)) == music.FlacExt {
+		tags, err := readFLACTags(filepath.Join(releaseFolder, relativePath))
+		if err != nil {
+			logthis.Info(err.Error(), logthis.VERBOSE)
+		}
+		track = TrackerMetadataTrack{Disc: tagNumber(tags["DISCNUMBER"]), Number: tagNumber(tags["TRACKNUMBER"]), Artist: tags["ARTIST"], Title: tags["TITLE"]}
+	}
+	// the tracker file list only has file names, unless the user metadata describes the tracks
+	for _, t := range tm.Tracks {
+		if t.Title != relativePath && filepath.Base(t.Title) != filepath.Base(relativePath) {
+			continue
+		}
+		if track.Disc == "" {
+			track.Disc = tagNumber(t.Disc)
+		}
+		if track.Number == "" {
+			track.Number = tagNumber(t.Number)
+		}
+		if track.Artist == "" {
+			track.Artist = t.Artist
+		}
+		if track.Title == "" && !isMusicFile(t.Title) {
+			track.Title = t.Title
+		}
+		break
+	}
+	// parsing the file name
+	name := strings.TrimSuffix(filepath.Base(relativePath), filepath.Ext(relativePath))
+	if hits := trackFilenameRegexp.FindStringSubmatch(name); hits != nil {
+		if track.Disc == "" {
+			track.Disc = tagNumber(hits[1])
+		}
+		if track.Number == "" {
+			track.Number = tagNumber(hits[2])
+		}
+		if track.Title == "" {
+			track.Title = strings.TrimSpace(hits[3])
+		}
+	}
+	if track.Disc == "" {
+		if n := discNumber(TrackerMetadata{FolderName: filepath.Dir(relativePath)}); n != 0 {
+			track.Disc = strconv.Itoa(n)
+		}
+	}
+	if track.Disc == "" {
+		track.Disc = "1"
+	}
+	if track.Title == "" {
+		track.Title = name
+	}
+	return track
+}
+
+// normalizeDiscFolders of a release, so that CD1, cd 2, Disk3... become Disc 1, Disc 2, Disc 3.
+// Folders are left alone if the normalized name is already taken.
+func normalizeDiscFolders(journal *LibraryJournal, releaseFolder string) error {
+	contents, err := ioutil.ReadDir(releaseFolder)
+	if err != nil {
+		return err
+	}
+	for _, c := range contents {
+		if !c.IsDir() || c.Name() == MetadataDir {
+			continue
+		}
+		n := discNumber(TrackerMetadata{FolderName: c.Name()})
+		if n == 0 {
+			continue
+		}
+		normalized := fmt.Sprintf(discFolderFormat, n)
+		if normalized == c.Name() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(releaseFolder, normalized)); err == nil {
+			logthis.Info("Not renaming "+c.Name()+", "+normalized+" already exists", logthis.VERBOSE)
+			continue
+		}
+		if err := journal.rename(filepath.Join(releaseFolder, c.Name()), filepath.Join(releaseFolder, normalized)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameTracks of a release in the library with a template, after normalizing its disc folders.
+// Tracks are renamed only if all of them can be, without any two getting the same name.
+func (tm *TrackerMetadata) renameTracks(journal *LibraryJournal, releaseFolder, trackTemplate string) error {
+	if err := normalizeDiscFolders(journal, releaseFolder); err != nil {
+		return errors.Wrap(err, "could not normalize disc folders")
+	}
+	var tracks []string
+	err := filepath.Walk(releaseFolder, func(path string, fileInfo os.FileInfo, walkError error) error {
+		if walkError != nil {
+			return walkError
+		}
+		if fileInfo.IsDir() && fileInfo.Name() == MetadataDir {
+			return filepath.SkipDir
+		}
+		if !fileInfo.IsDir() && isMusicFile(path) {
+			relativePath, err := filepath.Rel(releaseFolder, path)
+			if err != nil {
+				return err
+			}
+			tracks = append(tracks, relativePath)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(tracks)
+
+	renamed := make(map[string]string)
+	newNames := make(map[string]bool)
+	for _, t := range tracks {
+		name, err := tm.GenerateTrackName(trackTemplate, tm.trackInfo(releaseFolder, t))
+		if err != nil {
+			return err
+		}
+		// templates creating folders are refused when loading the configuration
+		if strings.Contains(name, "/") {
+			return errors.New("music file names cannot contain folders: " + name)
+		}
+		newPath := filepath.Join(filepath.Dir(t), name+strings.ToLower(filepath.Ext(t)))
+		if newNames[newPath] {
+			return errors.New("several tracks would be renamed " + newPath)
+		}
+		newNames[newPath] = true
+		renamed[t] = newPath
+	}
+	// tracks taking the current name of another are first moved out of the way, so that swapped names lose nothing
+	current := make(map[string]string)
+	var swapping bool
+	for _, t := range tracks {
+		current[t] = filepath.Join(releaseFolder, t)
+		if newNames[t] && renamed[t] != t {
+			swapping = true
+		}
+	}
+	if swapping {
+		for i, t := range tracks {
+			if renamed[t] == t {
+				continue
+			}
+			temporary := filepath.Join(releaseFolder, filepath.Dir(t), fmt.Sprintf(".varroa-renaming-%d%s", i, filepath.Ext(t)))
+			if err := journal.rename(current[t], temporary); err != nil {
+				return err
+			}
+			current[t] = temporary
+		}
+	}
+	for _, t := range tracks {
+		if renamed[t] == t {
+			continue
+		}
+		if err := journal.rename(current[t], filepath.Join(releaseFolder, renamed[t])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
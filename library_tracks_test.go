@@ -0,0 +1,120 @@
+package varroa
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/catastrophic/assistance/fs"
+)
+
+// writeFakeFLAC with only a stream info block, tags, and the start of a frame, which is enough to read and write its
+// metadata.
+func writeFakeFLAC(path string, tags ...string) error {
+	var b bytes.Buffer
+	b.WriteString("fLaC")
+	// stream info: 44.1kHz, 2 channels, 16 bits
+	b.Write([]byte{0x00, 0x00, 0x00, 34})
+	b.Write([]byte{0x10, 0x00, 0x10, 0x00, 0, 0, 0, 0, 0, 0})
+	b.Write([]byte{0x0A, 0xC4, 0x42, 0xF0, 0, 0, 0, 0})
+	b.Write(make([]byte, 16))
+	// vorbis comment, last block
+	var comment bytes.Buffer
+	binary.Write(&comment, binary.LittleEndian, uint32(len("varroa")))
+	comment.WriteString("varroa")
+	binary.Write(&comment, binary.LittleEndian, uint32(len(tags)))
+	for _, t := range tags {
+		binary.Write(&comment, binary.LittleEndian, uint32(len(t)))
+		comment.WriteString(t)
+	}
+	size := comment.Len()
+	b.Write([]byte{0x80 | 0x04, byte(size >> 16), byte(size >> 8), byte(size)})
+	b.Write(comment.Bytes())
+	// frame sync code
+	b.Write([]byte{0xFF, 0xF8, 0x69, 0x18, 0, 0})
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b.Bytes(), 0777)
+}
+
+func TestLibraryTracks(t *testing.T) {
+	fmt.Println("+ Testing Library/tracks...")
+	check := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "varroa-library")
+	check.Nil(err)
+	defer os.RemoveAll(dir)
+	release := filepath.Join(dir, "library", "Release")
+	journalFile := filepath.Join(dir, DefaultLibraryJournal)
+	check.Nil(writeFakeFLAC(filepath.Join(release, "CD1", "01 - a.flac"), "TITLE=First", "ARTIST=Someone", "TRACKNUMBER=1/2", "DISCNUMBER=1/2"))
+	check.Nil(writeFakeFLAC(filepath.Join(release, "CD1", "02 - b.flac"), "TITLE=Second"))
+	check.Nil(writeFakeFLAC(filepath.Join(release, "cd 2", "track.flac")))
+	check.Nil(ioutil.WriteFile(filepath.Join(release, "cd 2", "2-03 Third.mp3"), []byte("not really mp3"), 0777))
+	check.Nil(ioutil.WriteFile(filepath.Join(release, "cd 2", "cover.jpg"), []byte("not really jpg"), 0777))
+	check.Nil(os.MkdirAll(filepath.Join(release, MetadataDir), 0777))
+	check.Nil(ioutil.WriteFile(filepath.Join(release, MetadataDir, "01 - a.flac"), []byte("not a track"), 0777))
+
+	tags, err := readFLACTags(filepath.Join(release, "CD1", "01 - a.flac"))
+	check.Nil(err)
+	check.Equal("Someone", tags["ARTIST"])
+	_, err = readFLACTags(filepath.Join(release, "cd 2", "2-03 Third.mp3"))
+	check.NotNil(err)
+
+	// tags first, then tracker metadata, then file names
+	info := &TrackerMetadata{MainArtist: "Artist", Tracks: []TrackerMetadataTrack{{Title: "cd 2/track.flac"}, {Number: "4", Title: "Fourth"}}}
+	check.Equal(TrackerMetadataTrack{Disc: "1", Number: "1", Artist: "Someone", Title: "First"}, info.trackInfo(release, filepath.Join("CD1", "01 - a.flac")))
+	check.Equal(TrackerMetadataTrack{Disc: "1", Number: "2", Title: "Second"}, info.trackInfo(release, filepath.Join("CD1", "02 - b.flac")))
+	check.Equal(TrackerMetadataTrack{Disc: "2", Number: "3", Title: "Third"}, info.trackInfo(release, filepath.Join("cd 2", "2-03 Third.mp3")))
+	check.Equal(TrackerMetadataTrack{Disc: "2", Title: "track"}, info.trackInfo(release, filepath.Join("cd 2", "track.flac")))
+	info.Tracks[0] = TrackerMetadataTrack{Number: "2", Title: "cd 2/track.flac"}
+	check.Equal(TrackerMetadataTrack{Disc: "2", Number: "2", Title: "track"}, info.trackInfo(release, filepath.Join("cd 2", "track.flac")))
+
+	// tracks that would get the same name are not renamed
+	journal := newLibraryJournal(journalFile, "export Release", false)
+	check.NotNil(info.renameTracks(journal, release, "$dn - $a"))
+	check.True(fs.DirExists(filepath.Join(release, "Disc 1")))
+	check.True(fs.FileExists(filepath.Join(release, "Disc 1", "01 - a.flac")))
+
+	journal = newLibraryJournal(journalFile, "export Release", false)
+	check.Nil(info.renameTracks(journal, release, "$dn.$tn. $ta - $tt"))
+	check.True(fs.FileExists(filepath.Join(release, "Disc 1", "1.01. Someone - First.flac")))
+	check.True(fs.FileExists(filepath.Join(release, "Disc 1", "1.02. Artist - Second.flac")))
+	check.True(fs.FileExists(filepath.Join(release, "Disc 2", "2.03. Artist - Third.mp3")))
+	check.True(fs.FileExists(filepath.Join(release, "Disc 2", "2.02. Artist - track.flac")))
+	check.True(fs.FileExists(filepath.Join(release, "Disc 2", "cover.jpg")))
+	check.True(fs.FileExists(filepath.Join(release, MetadataDir, "01 - a.flac")))
+
+	// renaming can be undone, including the disc folders normalized by the first attempt
+	for i := 0; i < 2; i++ {
+		_, err = undoLibraryRun(journalFile, "")
+		check.Nil(err)
+	}
+	check.True(fs.FileExists(filepath.Join(release, "CD1", "01 - a.flac")))
+	check.True(fs.FileExists(filepath.Join(release, "cd 2", "2-03 Third.mp3")))
+
+	// tracks whose tags disagree with their file names swap names without losing any
+	swapped := filepath.Join(dir, "library", "Swapped")
+	check.Nil(writeFakeFLAC(filepath.Join(swapped, "01.flac"), "TITLE=Second", "TRACKNUMBER=2"))
+	check.Nil(writeFakeFLAC(filepath.Join(swapped, "02.flac"), "TITLE=First", "TRACKNUMBER=1"))
+	journal = newLibraryJournal(journalFile, "export Swapped", false)
+	check.Nil(info.renameTracks(journal, swapped, "$tn"))
+	for file, title := range map[string]string{"01.flac": "First", "02.flac": "Second"} {
+		tags, err = readFLACTags(filepath.Join(swapped, file))
+		check.Nil(err)
+		check.Equal(title, tags["TITLE"])
+	}
+	leftovers, err := filepath.Glob(filepath.Join(swapped, ".*"))
+	check.Nil(err)
+	check.Empty(leftovers)
+	_, err = undoLibraryRun(journalFile, "")
+	check.Nil(err)
+	tags, err = readFLACTags(filepath.Join(swapped, "01.flac"))
+	check.Nil(err)
+	check.Equal("Second", tags["TITLE"])
+}
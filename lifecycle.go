@@ -0,0 +1,320 @@
+package varroa
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/logthis"
+)
+
+const (
+	shutdownTimeout = 30 * time.Second
+
+	subsystemWebServer = "webserver"
+	subsystemStats     = "stats"
+	subsystemScheduler = "scheduler"
+	subsystemDownloads = "downloads"
+	subsystemIRCPrefix = "irc-"
+
+	restartCommand = "restart"
+
+	healthOK      = "ok"
+	healthStopped = "stopped"
+
+	errorUnknownSubsystem = "unknown subsystem"
+	errorShuttingDown     = "the daemon is shutting down"
+)
+
+// Subsystem of the daemon that can be started, stopped and restarted on its own.
+type Subsystem interface {
+	Name() string
+	// Start the subsystem without blocking. It must stop when ctx is cancelled.
+	Start(ctx context.Context) error
+	// Stop the subsystem, giving up when ctx is done.
+	Stop(ctx context.Context) error
+	// Health returns an error if the running subsystem is not working as expected.
+	Health() error
+}
+
+// Lifecycle of the daemon subsystems and of the work in progress, such as snatches and metadata saves.
+type Lifecycle struct {
+	sync.Mutex
+	// control serializes starting and stopping, without blocking health checks
+	control    sync.Mutex
+	ctx        context.Context
+	cancel     context.CancelFunc
+	subsystems []Subsystem
+	running    map[string]context.CancelFunc
+	stopping   bool
+	// work in progress has its own lock, subsystems being stopped may still be tracking work
+	workMutex    sync.Mutex
+	workStopping bool
+	inFlight     sync.WaitGroup
+}
+
+// NewLifecycle with no subsystems.
+func NewLifecycle() *Lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Lifecycle{ctx: ctx, cancel: cancel, running: make(map[string]context.CancelFunc)}
+}
+
+// Context cancelled when the daemon shuts down.
+func (l *Lifecycle) Context() context.Context {
+	return l.ctx
+}
+
+// Register a subsystem, subsystems are stopped in the reverse order.
+func (l *Lifecycle) Register(s Subsystem) {
+	l.Lock()
+	defer l.Unlock()
+	l.subsystems = append(l.subsystems, s)
+}
+
+// registered subsystems, in order.
+func (l *Lifecycle) registered() []Subsystem {
+	l.Lock()
+	defer l.Unlock()
+	return append([]Subsystem{}, l.subsystems...)
+}
+
+// find a subsystem by name. Must be called with the lock.
+func (l *Lifecycle) find(name string) (Subsystem, error) {
+	for _, s := range l.subsystems {
+		if s.Name() == name {
+			return s, nil
+		}
+	}
+	return nil, errors.New(errorUnknownSubsystem + ": " + name)
+}
+
+// isRunning subsystem.
+func (l *Lifecycle) isRunning(name string) bool {
+	l.Lock()
+	defer l.Unlock()
+	_, ok := l.running[name]
+	return ok
+}
+
+// start a subsystem with its own context. Must be called with the control lock.
+func (l *Lifecycle) start(s Subsystem) error {
+	l.Lock()
+	stopping := l.stopping
+	l.Unlock()
+	if stopping {
+		return errors.New(errorShuttingDown)
+	}
+	if l.isRunning(s.Name()) {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(l.ctx)
+	if err := s.Start(ctx); err != nil {
+		cancel()
+		return errors.Wrap(err, "could not start "+s.Name())
+	}
+	l.Lock()
+	l.running[s.Name()] = cancel
+	l.Unlock()
+	logthis.Info("Started "+s.Name()+".", logthis.VERBOSE)
+	return nil
+}
+
+// stop a subsystem, waiting at most for the timeout. Must be called with the control lock.
+func (l *Lifecycle) stop(s Subsystem, timeout time.Duration) error {
+	l.Lock()
+	cancel, ok := l.running[s.Name()]
+	l.Unlock()
+	if !ok {
+		return nil
+	}
+	// signalling the subsystem goroutines before waiting for them
+	cancel()
+	ctx, cancelTimeout := context.WithTimeout(context.Background(), timeout)
+	defer cancelTimeout()
+	err := s.Stop(ctx)
+	l.Lock()
+	delete(l.running, s.Name())
+	l.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "could not stop "+s.Name()+" cleanly")
+	}
+	logthis.Info("Stopped "+s.Name()+".", logthis.VERBOSE)
+	return nil
+}
+
+// StartAll registered subsystems.
+func (l *Lifecycle) StartAll() {
+	l.control.Lock()
+	defer l.control.Unlock()
+	for _, s := range l.registered() {
+		if err := l.start(s); err != nil {
+			logthis.Error(err, logthis.NORMAL)
+		}
+	}
+}
+
+// Restart a subsystem by name.
+func (l *Lifecycle) Restart(name string) error {
+	l.control.Lock()
+	defer l.control.Unlock()
+	l.Lock()
+	s, err := l.find(name)
+	l.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := l.stop(s, shutdownTimeout); err != nil {
+		logthis.Error(err, logthis.NORMAL)
+	}
+	return l.start(s)
+}
+
+// Add a subsystem and start it.
+func (l *Lifecycle) Add(s Subsystem) error {
+	l.control.Lock()
+	defer l.control.Unlock()
+	l.Lock()
+	if _, err := l.find(s.Name()); err == nil {
+		l.Unlock()
+		return errors.New("subsystem " + s.Name() + " already exists")
+	}
+	l.subsystems = append(l.subsystems, s)
+	l.Unlock()
+	return l.start(s)
+}
+
+// Remove a subsystem, stopping it first.
+func (l *Lifecycle) Remove(name string) error {
+	l.control.Lock()
+	defer l.control.Unlock()
+	l.Lock()
+	s, err := l.find(name)
+	l.Unlock()
+	if err != nil {
+		return err
+	}
+	stopErr := l.stop(s, shutdownTimeout)
+	l.Lock()
+	for i, registered := range l.subsystems {
+		if registered == s {
+			l.subsystems = append(l.subsystems[:i], l.subsystems[i+1:]...)
+			break
+		}
+	}
+	l.Unlock()
+	return stopErr
+}
+
+// Replace a subsystem with a new one of the same name, stopping the old one and starting the new one.
+func (l *Lifecycle) Replace(s Subsystem) error {
+	l.control.Lock()
+	defer l.control.Unlock()
+	l.Lock()
+	old, err := l.find(s.Name())
+	l.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := l.stop(old, shutdownTimeout); err != nil {
+		logthis.Error(err, logthis.NORMAL)
+	}
+	l.Lock()
+	for i, registered := range l.subsystems {
+		if registered == old {
+			l.subsystems[i] = s
+			break
+		}
+	}
+	l.Unlock()
+	return l.start(s)
+}
+
+// Health of all subsystems.
+func (l *Lifecycle) Health() map[string]string {
+	health := make(map[string]string)
+	for _, s := range l.registered() {
+		if !l.isRunning(s.Name()) {
+			health[s.Name()] = healthStopped
+		} else if err := s.Health(); err != nil {
+			health[s.Name()] = err.Error()
+		} else {
+			health[s.Name()] = healthOK
+		}
+	}
+	return health
+}
+
+// Names of the registered subsystems.
+func (l *Lifecycle) Names() []string {
+	var names []string
+	for _, s := range l.registered() {
+		names = append(names, s.Name())
+	}
+	return names
+}
+
+// Track work in progress that must be completed before shutting down.
+// Returns false if the daemon is already shutting down, otherwise done must be called once the work is over.
+func (l *Lifecycle) Track() (done func(), ok bool) {
+	l.workMutex.Lock()
+	defer l.workMutex.Unlock()
+	if l.workStopping {
+		return nil, false
+	}
+	l.inFlight.Add(1)
+	return l.inFlight.Done, true
+}
+
+// Go runs f in a goroutine, as tracked work in progress.
+func (l *Lifecycle) Go(f func()) bool {
+	done, ok := l.Track()
+	if !ok {
+		logthis.Info(errorShuttingDown+", not starting new work.", logthis.NORMAL)
+		return false
+	}
+	go func() {
+		defer done()
+		f()
+	}()
+	return true
+}
+
+// Shutdown all subsystems in the reverse order, then wait for the work in progress, all within the timeout.
+func (l *Lifecycle) Shutdown(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	l.control.Lock()
+	defer l.control.Unlock()
+	l.Lock()
+	l.stopping = true
+	l.Unlock()
+	l.workMutex.Lock()
+	l.workStopping = true
+	l.workMutex.Unlock()
+	// background work waiting for something stops waiting
+	l.cancel()
+	var failed []string
+	subsystems := l.registered()
+	for i := len(subsystems) - 1; i >= 0; i-- {
+		if err := l.stop(subsystems[i], time.Until(deadline)); err != nil {
+			logthis.Error(err, logthis.NORMAL)
+			failed = append(failed, subsystems[i].Name())
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		l.inFlight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(time.Until(deadline)):
+		failed = append(failed, "work in progress")
+	}
+	if len(failed) != 0 {
+		return errors.New("could not stop cleanly: " + strings.Join(failed, ", "))
+	}
+	return nil
+}
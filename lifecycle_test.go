@@ -0,0 +1,132 @@
+package varroa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testSubsystem struct {
+	name      string
+	starts    int
+	stops     int
+	failStart bool
+	slowStop  bool
+	// like subsystems whose goroutines only return when their context is cancelled
+	waitsForContext bool
+	ctx             context.Context
+	health          error
+	stopOrder       *[]string
+}
+
+func (ts *testSubsystem) Name() string {
+	return ts.name
+}
+
+func (ts *testSubsystem) Start(ctx context.Context) error {
+	if ts.failStart {
+		return errors.New("nope")
+	}
+	ts.starts++
+	ts.ctx = ctx
+	return nil
+}
+
+func (ts *testSubsystem) Stop(ctx context.Context) error {
+	ts.stops++
+	*ts.stopOrder = append(*ts.stopOrder, ts.name)
+	if ts.slowStop {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if ts.waitsForContext {
+		select {
+		case <-ts.ctx.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (ts *testSubsystem) Health() error {
+	return ts.health
+}
+
+func TestLifecycle(t *testing.T) {
+	fmt.Println("+ Testing Lifecycle...")
+	check := assert.New(t)
+
+	var stopOrder []string
+	first := &testSubsystem{name: "first", stopOrder: &stopOrder}
+	second := &testSubsystem{name: "second", stopOrder: &stopOrder, health: errors.New("disconnected")}
+	broken := &testSubsystem{name: "broken", stopOrder: &stopOrder, failStart: true}
+	l := NewLifecycle()
+	l.Register(first)
+	l.Register(second)
+	l.Register(broken)
+	check.Equal([]string{"first", "second", "broken"}, l.Names())
+
+	// starting
+	l.StartAll()
+	check.Equal(1, first.starts)
+	check.Equal(1, second.starts)
+	check.Equal(map[string]string{"first": healthOK, "second": "disconnected", "broken": healthStopped}, l.Health())
+
+	// restarting
+	check.NotNil(l.Restart("unknown"))
+	firstCtx := first.ctx
+	check.Nil(l.Restart("first"))
+	check.Equal(2, first.starts)
+	check.Equal(1, first.stops)
+	check.NotNil(firstCtx.Err())
+	check.Nil(first.ctx.Err())
+	check.Nil(l.Restart("first"))
+	check.NotNil(l.Restart("broken"))
+	// the subsystem context is cancelled before waiting for it to stop
+	second.waitsForContext = true
+	restarting := time.Now()
+	check.Nil(l.Restart("second"))
+	check.True(time.Since(restarting) < time.Second)
+
+	// tracking work in progress
+	done, ok := l.Track()
+	check.True(ok)
+	finished := make(chan struct{})
+	check.True(l.Go(func() {
+		<-l.Context().Done()
+		close(finished)
+	}))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		done()
+	}()
+
+	// shutting down, in reverse order, waiting for the work in progress
+	check.Nil(l.Shutdown(time.Second))
+	<-finished
+	check.Equal([]string{"first", "first", "second", "second", "first"}, stopOrder)
+	check.NotNil(first.ctx.Err())
+	check.Equal(map[string]string{"first": healthStopped, "second": healthStopped, "broken": healthStopped}, l.Health())
+	_, ok = l.Track()
+	check.False(ok)
+	check.False(l.Go(func() {}))
+	check.NotNil(l.Restart("first"))
+
+	// timeouts
+	stopOrder = []string{}
+	slow := &testSubsystem{name: "slow", stopOrder: &stopOrder, slowStop: true}
+	l = NewLifecycle()
+	l.Register(slow)
+	l.StartAll()
+	done, ok = l.Track()
+	check.True(ok)
+	defer done()
+	err := l.Shutdown(50 * time.Millisecond)
+	check.NotNil(err)
+	check.Equal("could not stop cleanly: slow, work in progress", err.Error())
+}
@@ -2,6 +2,9 @@ package varroa
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"net/http"
 	"os"
@@ -15,11 +18,41 @@ import (
 	"github.com/pkg/errors"
 	"gitlab.com/catastrophic/assistance/daemon"
 	"gitlab.com/catastrophic/assistance/logthis"
-	"gitlab.com/catastrophic/assistance/strslice"
 )
 
+const (
+	notificationEventGeneral = "general"
+	notificationEventSnatch  = "snatch"
+	notificationEventStats   = "stats"
+	notificationEventReady   = "ready"
+	notificationEventUpdate  = "update"
+	// notificationEventAuthFailure is sent when an address is locked out of the web server
+	notificationEventAuthFailure = "auth_failure"
+
+	currentWebHookSchemaVersion = 2
+	defaultWebHookName          = "default"
+	webHookSignaturePrefix      = "sha256="
+)
+
+var knownNotificationEvents = []string{notificationEventGeneral, notificationEventSnatch, notificationEventStats, notificationEventReady, notificationEventUpdate, notificationEventAuthFailure}
+
+// NotificationData is the structured information attached to a notification, for backends that can use it.
+type NotificationData struct {
+	Event      string
+	Release    *Release
+	Metadata   *TrackerMetadata
+	Stats      *StatsEntry
+	DownloadID int
+	Attachment string // path to an image, for backends that support attachments
+}
+
 // Notify in a goroutine, or directly.
 func Notify(msg, tracker, msgType string, e *Environment) error {
+	return NotifyWithData(msg, tracker, msgType, &NotificationData{Event: notificationEventGeneral}, e)
+}
+
+// NotifyWithData in a goroutine, or directly, attaching structured data about the event.
+func NotifyWithData(msg, tracker, msgType string, data *NotificationData, e *Environment) error {
 	conf, err := NewConfig(DefaultConfigurationFile)
 	if err != nil {
 		return err
@@ -36,28 +69,56 @@ func Notify(msg, tracker, msgType string, e *Environment) error {
 		// pushover notifications
 		if conf.pushoverConfigured {
 			pushOver := &Notification{client: pushover.New(conf.Notifications.Pushover.Token), recipient: pushover.NewRecipient(conf.Notifications.Pushover.User)}
-			var pngLink string
+			var attachment string
 			if tracker != FullName && strings.HasPrefix(msg, statsNotificationPrefix) && conf.Notifications.Pushover.IncludeBufferGraph {
-				pngLink = filepath.Join(StatsDir, tracker+"_"+lastWeekPrefix+"_"+bufferStatsFile+pngExt)
+				attachment = filepath.Join(StatsDir, tracker+"_"+lastWeekPrefix+"_"+bufferStatsFile+pngExt)
+			} else if data != nil {
+				attachment = data.Attachment
 			}
-			if err := pushOver.Send(tracker+": "+msg, conf.gitlabPagesConfigured, link, pngLink); err != nil {
+			if err := pushOver.Send(tracker+": "+msg, conf.gitlabPagesConfigured, link, attachment); err != nil {
 				logthis.Error(errors.Wrap(err, errorNotification), logthis.VERBOSE)
 				atLeastOneError = true
 			}
 		}
 
 		// webhooks
-		if conf.webhooksConfigured && strslice.Contains(conf.Notifications.WebHooks.Trackers, tracker) {
-			// create json, POST it
-			whJSON := &WebHookJSON{Site: tracker, Message: msg, Link: link, Type: msgType}
-			if err := whJSON.Send(conf.Notifications.WebHooks.Address, conf.Notifications.WebHooks.Token); err != nil {
-				logthis.Error(errors.Wrap(err, errorWebhook), logthis.VERBOSE)
-				atLeastOneError = true
+		if conf.webhooksConfigured {
+			// create json, POST it to all interested endpoints
+			whJSON := NewWebHookJSON(tracker, msg, msgType, link, data)
+			for _, wh := range conf.Notifications.WebHooks.all() {
+				if !wh.accepts(tracker, whJSON.Event) {
+					continue
+				}
+				if err := whJSON.Send(wh.Address, wh.Token, wh.signingKey()); err != nil {
+					logthis.Error(errors.Wrap(err, errorWebhook+" to "+wh.Name), logthis.VERBOSE)
+					atLeastOneError = true
+				}
+			}
+		}
+
+		// desktop notifications, if a session bus is available
+		if conf.desktopNotifsConfigured {
+			desktop, err := NewDesktopNotification("")
+			if err != nil {
+				logthis.Error(errors.Wrap(err, errorDesktopNotification), logthis.VERBOSEST)
+			} else {
+				var icon string
+				if data != nil && conf.Notifications.Desktop.ShowCovers {
+					icon = data.Attachment
+				}
+				if _, err := desktop.Send(tracker, msg, icon, desktopUrgency(msgType, data), conf.Notifications.Desktop.ExpireSeconds); err != nil {
+					logthis.Error(errors.Wrap(err, errorDesktopNotification), logthis.VERBOSE)
+					atLeastOneError = true
+				}
+				desktop.Close()
 			}
 		}
 
 		// IRC notifications
-		if conf.ircNotifsConfigured && e.ircClient != nil {
+		e.mutex.RLock()
+		ircClient := e.ircClient
+		e.mutex.RUnlock()
+		if conf.ircNotifsConfigured && ircClient != nil {
 			r := regexp.MustCompile(regexpProgress)
 			if r.MatchString(msg) {
 				// colorize stats
@@ -84,8 +145,20 @@ func Notify(msg, tracker, msgType string, e *Environment) error {
 				}
 				msg = strings.Join(parts[2:], " ")
 			}
-			e.ircClient.Privmsg(conf.Notifications.Irc.User, msg)
+			// only the first line of multi-line messages
+			ircClient.Privmsg(conf.Notifications.Irc.User, strings.Split(msg, "\n")[0])
+		}
+
+		// event stream
+		eventData := EventNotificationData{Level: msgType}
+		if data != nil {
+			eventData.Event = data.Event
+		}
+		eventTracker := tracker
+		if tracker == FullName {
+			eventTracker = ""
 		}
+		e.events.Publish(eventNotification, eventTracker, msg, eventData)
 
 		if atLeastOneError {
 			return errors.New(errorNotifications)
@@ -100,7 +173,7 @@ type Notification struct {
 	recipient *pushover.Recipient
 }
 
-func (n *Notification) Send(message string, addLink bool, link, pngLink string) error {
+func (n *Notification) Send(message string, addLink bool, link, attachment string) error {
 	if n.client == nil || n.recipient == nil {
 		return errors.New("Could not send notification: " + message)
 	}
@@ -110,14 +183,14 @@ func (n *Notification) Send(message string, addLink bool, link, pngLink string)
 	} else {
 		pushoverMessage = pushover.NewMessageWithTitle(message, FullName)
 	}
-	if pngLink != "" {
-		file, err := os.Open(pngLink)
+	if attachment != "" {
+		file, err := os.Open(attachment)
 		if err != nil {
-			logthis.Error(errors.Wrap(err, "error adding png attachment to pushover notification"), logthis.VERBOSE)
+			logthis.Error(errors.Wrap(err, "error adding attachment to pushover notification"), logthis.VERBOSE)
 		} else {
 			defer file.Close()
 			if addErr := pushoverMessage.AddAttachment(file); addErr != nil {
-				logthis.Error(errors.Wrap(err, "error adding png attachment to pushover notification"), logthis.VERBOSE)
+				logthis.Error(errors.Wrap(addErr, "error adding attachment to pushover notification"), logthis.VERBOSE)
 			}
 		}
 	}
@@ -127,14 +200,36 @@ func (n *Notification) Send(message string, addLink bool, link, pngLink string)
 
 // -----------------------------------------------------------------------------
 
+// WebHookJSON is the payload POSTed to webhook endpoints.
 type WebHookJSON struct {
-	Site    string
-	Message string
-	Type    string // "error" "info"
-	Link    string
+	SchemaVersion int
+	Event         string
+	Timestamp     int64
+	Site          string
+	Message       string
+	Type          string // "error" "info"
+	Link          string
+	Release       *Release         `json:",omitempty"`
+	Metadata      *TrackerMetadata `json:",omitempty"`
+	Stats         *StatsEntry      `json:",omitempty"`
+	DownloadID    int              `json:",omitempty"`
 }
 
-func (whj *WebHookJSON) Send(address string, token string) error {
+func NewWebHookJSON(tracker, msg, msgType, link string, data *NotificationData) *WebHookJSON {
+	whj := &WebHookJSON{SchemaVersion: currentWebHookSchemaVersion, Event: notificationEventGeneral, Timestamp: time.Now().Unix(), Site: tracker, Message: msg, Type: msgType, Link: link}
+	if data != nil {
+		if data.Event != "" {
+			whj.Event = data.Event
+		}
+		whj.Release = data.Release
+		whj.Metadata = data.Metadata
+		whj.Stats = data.Stats
+		whj.DownloadID = data.DownloadID
+	}
+	return whj
+}
+
+func (whj *WebHookJSON) Send(address, token, secret string) error {
 	// TODO check address?
 
 	// create POST request
@@ -148,7 +243,14 @@ func (whj *WebHookJSON) Send(address string, token string) error {
 		return errors.Wrap(err, "Error preparing webhook request")
 	}
 	req.Header.Set("X-Varroa-Event", whj.Type)
-	req.Header.Set("X-Varroa-Token", token)
+	if token != "" {
+		req.Header.Set("X-Varroa-Token", token)
+	}
+	if secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Varroa-Timestamp", timestamp)
+		req.Header.Set("X-Varroa-Signature", signWebHook(secret, timestamp, hook))
+	}
 	req.Header.Set("Content-Type", "application/json")
 
 	client := &http.Client{Timeout: time.Second * 5}
@@ -163,3 +265,27 @@ func (whj *WebHookJSON) Send(address string, token string) error {
 	// not doing anything with body, really.
 	return nil
 }
+
+// signWebHook with HMAC-SHA256, over the timestamp and the body so that the timestamp cannot be tampered with.
+func signWebHook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return webHookSignaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebHookSignature of a received webhook, rejecting it if it is older than maxAge to prevent replays.
+func VerifyWebHookSignature(secret, timestamp, signature string, body []byte, maxAge time.Duration) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.Wrap(err, "invalid webhook timestamp")
+	}
+	age := time.Since(time.Unix(ts, 0))
+	if age > maxAge || age < -maxAge {
+		return errors.New("webhook timestamp is outside of the acceptable window")
+	}
+	if !hmac.Equal([]byte(signature), []byte(signWebHook(secret, timestamp, body))) {
+		return errors.New("invalid webhook signature")
+	}
+	return nil
+}
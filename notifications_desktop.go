@@ -0,0 +1,83 @@
+package varroa
+
+import (
+	"html"
+	"path/filepath"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/pkg/errors"
+)
+
+const (
+	dbusNotificationsName      = "org.freedesktop.Notifications"
+	dbusNotificationsPath      = "/org/freedesktop/Notifications"
+	dbusNotificationsInterface = "org.freedesktop.Notifications"
+
+	// urgency levels, as defined by the Desktop Notifications specification
+	desktopUrgencyLow      byte = 0
+	desktopUrgencyNormal   byte = 1
+	desktopUrgencyCritical byte = 2
+)
+
+// DesktopNotification is sent to the notification server of the current desktop session.
+type DesktopNotification struct {
+	conn *dbus.Conn
+}
+
+// NewDesktopNotification connects to the session bus, or to a specific bus address if one is given.
+func NewDesktopNotification(address string) (*DesktopNotification, error) {
+	var conn *dbus.Conn
+	var err error
+	if address == "" {
+		conn, err = dbus.ConnectSessionBus()
+	} else {
+		conn, err = dbus.Connect(address)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to the D-Bus session bus")
+	}
+	return &DesktopNotification{conn: conn}, nil
+}
+
+// Close the connection to the bus.
+func (dn *DesktopNotification) Close() error {
+	return dn.conn.Close()
+}
+
+// Send a notification, optionally with an image as icon, returns the notification ID.
+func (dn *DesktopNotification) Send(summary, body, icon string, urgency byte, expireSeconds int) (uint32, error) {
+	hints := map[string]dbus.Variant{"urgency": dbus.MakeVariant(urgency)}
+	if icon != "" {
+		absIcon, err := filepath.Abs(icon)
+		if err == nil {
+			icon = absIcon
+			hints["image-path"] = dbus.MakeVariant("file://" + absIcon)
+		}
+	}
+	// -1 lets the server decide when to expire the notification
+	expire := int32(-1)
+	if expireSeconds != 0 {
+		expire = int32(expireSeconds * 1000)
+	}
+	var id uint32
+	obj := dn.conn.Object(dbusNotificationsName, dbusNotificationsPath)
+	call := obj.Call(dbusNotificationsInterface+".Notify", 0, FullName, uint32(0), icon, summary, html.EscapeString(body), []string{}, hints, expire)
+	if call.Err != nil {
+		return 0, errors.Wrap(call.Err, "could not send desktop notification")
+	}
+	if err := call.Store(&id); err != nil {
+		return 0, errors.Wrap(err, "could not read desktop notification ID")
+	}
+	return id, nil
+}
+
+// desktopUrgency of a notification, depending on its type and event.
+func desktopUrgency(msgType string, data *NotificationData) byte {
+	if msgType == "error" {
+		return desktopUrgencyCritical
+	}
+	if data != nil && data.Event == notificationEventStats {
+		return desktopUrgencyLow
+	}
+	return desktopUrgencyNormal
+}
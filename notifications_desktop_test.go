@@ -0,0 +1,76 @@
+package varroa
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeNotificationServer records the notifications it receives, on the D-Bus goroutine.
+type fakeNotificationServer struct {
+	sync.Mutex
+	summaries []string
+	icons     []string
+	urgencies []byte
+}
+
+func (f *fakeNotificationServer) Notify(appName string, replacesID uint32, icon, summary, body string, actions []string, hints map[string]dbus.Variant, expire int32) (uint32, *dbus.Error) {
+	f.Lock()
+	defer f.Unlock()
+	f.summaries = append(f.summaries, summary)
+	f.icons = append(f.icons, icon)
+	f.urgencies = append(f.urgencies, hints["urgency"].Value().(byte))
+	return uint32(len(f.summaries)), nil
+}
+
+func TestDesktopNotification(t *testing.T) {
+	fmt.Println("+ Testing Desktop notifications...")
+	check := assert.New(t)
+
+	if _, err := exec.LookPath("dbus-daemon"); err != nil {
+		t.Skip("dbus-daemon not available")
+	}
+	// private session bus
+	cmd := exec.Command("dbus-daemon", "--session", "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	check.Nil(err)
+	check.Nil(cmd.Start())
+	defer cmd.Process.Kill()
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	check.Nil(err)
+	address = strings.TrimSpace(address)
+
+	// fake notification server
+	serverConn, err := dbus.Connect(address)
+	check.Nil(err)
+	defer serverConn.Close()
+	server := &fakeNotificationServer{}
+	check.Nil(serverConn.Export(server, dbusNotificationsPath, dbusNotificationsInterface))
+	reply, err := serverConn.RequestName(dbusNotificationsName, dbus.NameFlagDoNotQueue)
+	check.Nil(err)
+	check.Equal(dbus.RequestNameReplyPrimaryOwner, reply)
+
+	desktop, err := NewDesktopNotification(address)
+	check.Nil(err)
+	defer desktop.Close()
+
+	id, err := desktop.Send("blue", "snatched something", "", desktopUrgency("info", &NotificationData{Event: notificationEventSnatch}), 0)
+	check.Nil(err)
+	check.Equal(uint32(1), id)
+	id, err = desktop.Send("blue", "ratio too low", "test/cover.jpg", desktopUrgency("error", &NotificationData{Event: notificationEventStats}), 5)
+	check.Nil(err)
+	check.Equal(uint32(2), id)
+	server.Lock()
+	check.Equal([]string{"blue", "blue"}, server.summaries)
+	check.Equal("", server.icons[0])
+	check.True(strings.HasSuffix(server.icons[1], "test/cover.jpg"))
+	check.Equal([]byte{desktopUrgencyNormal, desktopUrgencyCritical}, server.urgencies)
+	server.Unlock()
+	check.Equal(desktopUrgencyLow, desktopUrgency("info", &NotificationData{Event: notificationEventStats}))
+}
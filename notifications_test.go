@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -25,16 +26,36 @@ func TestWebHooks(t *testing.T) {
 		body, err := ioutil.ReadAll(r.Body)
 		check.Nil(err)
 
+		// checking signature
+		timestamp := r.Header.Get("X-Varroa-Timestamp")
+		signature := r.Header.Get("X-Varroa-Signature")
+		check.Nil(VerifyWebHookSignature("secret", timestamp, signature, body, time.Minute))
+		check.NotNil(VerifyWebHookSignature("wrongsecret", timestamp, signature, body, time.Minute))
+		check.NotNil(VerifyWebHookSignature("secret", timestamp, signature, append(body, []byte("tampered")...), time.Minute))
+		check.NotNil(VerifyWebHookSignature("secret", "1500000000", signature, body, time.Minute))
+
 		var wbJSON WebHookJSON
 		check.Nil(json.Unmarshal(body, &wbJSON))
+		check.Equal(currentWebHookSchemaVersion, wbJSON.SchemaVersion)
+		check.Equal(notificationEventSnatch, wbJSON.Event)
 		check.Equal("site", wbJSON.Site)
 		check.Equal("msg", wbJSON.Message)
 		check.Equal("info", wbJSON.Type)
 		check.Equal("http://link.link", wbJSON.Link)
+		check.NotNil(wbJSON.Release)
+		check.Equal("1234", wbJSON.Release.TorrentID)
+		check.Equal([]string{"Artist"}, wbJSON.Release.Artists)
+		check.Equal("filter", wbJSON.Release.Filter)
+		check.NotNil(wbJSON.Metadata)
+		check.Equal(1234, wbJSON.Metadata.ID)
+		check.Equal([]string{"tag1", "tag2"}, wbJSON.Metadata.Tags)
+		check.Nil(wbJSON.Stats)
 	}))
 	defer ts.Close()
 
-	wh := &WebHookJSON{Site: "site", Message: "msg", Type: "info", Link: "http://link.link"}
-	err := wh.Send(ts.URL, "token")
+	release := &Release{TorrentID: "1234", Artists: []string{"Artist"}, Filter: "filter"}
+	info := &TrackerMetadata{ID: 1234, Tags: []string{"tag1", "tag2"}}
+	wh := NewWebHookJSON("site", "msg", "info", "http://link.link", &NotificationData{Event: notificationEventSnatch, Release: release, Metadata: info})
+	err := wh.Send(ts.URL, "token", "secret")
 	check.Nil(err)
 }
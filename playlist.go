@@ -1,11 +1,13 @@
 package varroa
 
 import (
+	"os"
 	"path/filepath"
 	"time"
 
 	"github.com/pkg/errors"
 	"gitlab.com/catastrophic/assistance/fs"
+	"gitlab.com/catastrophic/assistance/logthis"
 	"gitlab.com/catastrophic/assistance/m3u"
 )
 
@@ -51,25 +53,68 @@ func getCurrentPlaylists(root string) (*m3u.Playlist, *m3u.Playlist, error) {
 	return daily, monthly, nil
 }
 
-func addReleaseToCurrentPlaylists(playlistDirectory, libraryDirectory, release string) error {
+func addReleaseToCurrentPlaylists(journal *LibraryJournal, playlistDirectory, libraryDirectory, release string) error {
 	// daily playlist
 	dailyPlaylist, monthlyPlaylist, err := getCurrentPlaylists(playlistDirectory)
 	if err != nil {
 		return errors.Wrap(err, "error getting current playlists")
 	}
 
+	created := !fs.FileExists(dailyPlaylist.Filename)
+	before := append([]string{}, dailyPlaylist.Contents...)
 	if err = dailyPlaylist.AddRelease(libraryDirectory, release); err != nil {
 		return errors.Wrap(err, "error adding tracks to daily playlist")
 	}
-	if err = dailyPlaylist.Save(); err != nil {
+	if err = journal.savePlaylist(dailyPlaylist, before, created); err != nil {
 		return errors.Wrap(err, "error saving daily playlist")
 	}
 	// monthly playlist
+	created = !fs.FileExists(monthlyPlaylist.Filename)
+	before = append([]string{}, monthlyPlaylist.Contents...)
 	if err = monthlyPlaylist.AddRelease(libraryDirectory, release); err != nil {
-		return errors.Wrap(err, "error adding tracks to daily playlist")
+		return errors.Wrap(err, "error adding tracks to monthly playlist")
 	}
-	if err = monthlyPlaylist.Save(); err != nil {
-		return errors.Wrap(err, "error saving daily playlist")
+	if err = journal.savePlaylist(monthlyPlaylist, before, created); err != nil {
+		return errors.Wrap(err, "error saving monthly playlist")
 	}
 	return nil
 }
+
+// loadPlaylists found in a directory and its subdirectories.
+func loadPlaylists(directory string) []m3u.Playlist {
+	var playlists []m3u.Playlist
+	err := filepath.Walk(directory, func(path string, fileInfo os.FileInfo, walkError error) error {
+		if os.IsNotExist(walkError) {
+			return nil
+		}
+		// load all found playlists
+		if filepath.Ext(path) == m3uExt {
+			p, err := m3u.New(path)
+			if err != nil {
+				logthis.Error(err, logthis.VERBOSE)
+			} else {
+				playlists = append(playlists, *p)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logthis.Error(err, logthis.NORMAL)
+	}
+	return playlists
+}
+
+// updatePlaylists mentioning a release that was moved in the library, with paths relative to the library directory.
+func updatePlaylists(journal *LibraryJournal, playlists []m3u.Playlist, oldPath, newPath string) {
+	// only matching whole folder names
+	oldPath, newPath = oldPath+string(filepath.Separator), newPath+string(filepath.Separator)
+	for i := range playlists {
+		if playlists[i].Contains(oldPath) {
+			before := append([]string{}, playlists[i].Contents...)
+			playlists[i].Update(oldPath, newPath)
+			if err := journal.savePlaylist(&playlists[i], before, false); err != nil {
+				logthis.Error(err, logthis.VERBOSE)
+			}
+		}
+	}
+}
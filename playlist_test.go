@@ -45,7 +45,9 @@ func TestPlaylist(t *testing.T) {
 	defer os.RemoveAll(fakePlaylistPath)
 
 	// add release to playlists
-	check.Nil(addReleaseToCurrentPlaylists(fakePlaylistPath, fakeLibraryPath, fakeRelease))
+	journal := newLibraryJournal(filepath.Join(fakePlaylistPath, DefaultLibraryJournal), "export", false)
+	check.Nil(addReleaseToCurrentPlaylists(journal, fakePlaylistPath, fakeLibraryPath, fakeRelease))
+	check.Equal(2, len(journal.run.Entries))
 	check.True(fs.FileExists(filepath.Join(fakePlaylistPath, thisDay+m3uExt)))
 	check.True(fs.FileExists(filepath.Join(fakePlaylistPath, thisMonth+m3uExt)))
 
@@ -157,59 +157,56 @@ func (r *Release) TorrentFile() string {
 }
 
 func (r *Release) Satisfies(filter *ConfigFilter) bool {
+	ok, reason := r.satisfies(filter)
+	if !ok {
+		logthis.Info(filter.Name+": "+reason, logthis.VERBOSE)
+	}
+	return ok
+}
+
+// satisfies a filter with the information from the announce, or returns why not.
+func (r *Release) satisfies(filter *ConfigFilter) (bool, string) {
 	// no longer filtering on artists. If a filter has artists defined,
 	// varroa will now wait until it gets the TorrentInfo and all of the artists
 	// to make a call.
 	if len(filter.Year) != 0 && !intslice.Contains(filter.Year, r.Year) {
-		logthis.Info(filter.Name+": Wrong year", logthis.VERBOSE)
-		return false
+		return false, "Wrong year"
 	}
 	if len(filter.Format) != 0 && !strslice.Contains(filter.Format, r.Format) {
-		logthis.Info(filter.Name+": Wrong format", logthis.VERBOSE)
-		return false
+		return false, "Wrong format"
 	}
 	if len(filter.Source) != 0 && !strslice.Contains(filter.Source, r.Source) {
-		logthis.Info(filter.Name+": Wrong source", logthis.VERBOSE)
-		return false
+		return false, "Wrong source"
 	}
 	if len(filter.Quality) != 0 && !strslice.Contains(filter.Quality, r.Quality) {
-		logthis.Info(filter.Name+": Wrong quality", logthis.VERBOSE)
-		return false
+		return false, "Wrong quality"
 	}
 	if r.Source == tracker.SourceCD && r.Format == tracker.FormatFLAC && filter.HasLog && !r.HasLog {
-		logthis.Info(filter.Name+": Release has no log", logthis.VERBOSE)
-		return false
+		return false, "Release has no log"
 	}
 	// only compare logscores if the announce contained that information
 	if r.Source == tracker.SourceCD && r.Format == tracker.FormatFLAC && filter.LogScore != 0 && (!r.HasLog || (r.LogScore != logScoreNotInAnnounce && filter.LogScore > r.LogScore)) {
-		logthis.Info(filter.Name+": Incorrect log score", logthis.VERBOSE)
-		return false
+		return false, "Incorrect log score"
 	}
 	if r.Source == tracker.SourceCD && r.Format == tracker.FormatFLAC && filter.HasCue && !r.HasCue {
-		logthis.Info(filter.Name+": Release has no cue", logthis.VERBOSE)
-		return false
+		return false, "Release has no cue"
 	}
 	if !filter.AllowScene && r.IsScene {
-		logthis.Info(filter.Name+": Scene release not allowed", logthis.VERBOSE)
-		return false
+		return false, "Scene release not allowed"
 	}
 	if len(filter.ExcludedReleaseType) != 0 && strslice.Contains(filter.ExcludedReleaseType, r.ReleaseType) {
-		logthis.Info(filter.Name+": Excluded release type", logthis.VERBOSE)
-		return false
+		return false, "Excluded release type"
 	}
 	if len(filter.ReleaseType) != 0 && !strslice.Contains(filter.ReleaseType, r.ReleaseType) {
-		logthis.Info(filter.Name+": Wrong release type", logthis.VERBOSE)
-		return false
+		return false, "Wrong release type"
 	}
 	// checking tags
 	if len(filter.TagsRequired) != 0 && !MatchAllInSlice(filter.TagsRequired, r.Tags) {
-		logthis.Info(filter.Name+": Does not have all required tags", logthis.VERBOSE)
-		return false
+		return false, "Does not have all required tags"
 	}
 	for _, excluded := range filter.TagsExcluded {
 		if MatchInSlice(excluded, r.Tags) {
-			logthis.Info(filter.Name+": Has excluded tag", logthis.VERBOSE)
-			return false
+			return false, "Has excluded tag"
 		}
 	}
 	if len(filter.TagsIncluded) != 0 {
@@ -222,36 +219,39 @@ func (r *Release) Satisfies(filter *ConfigFilter) bool {
 			}
 		}
 		if !atLeastOneIncludedTag {
-			logthis.Info(filter.Name+": Does not have any wanted tag", logthis.VERBOSE)
-			return false
+			return false, "Does not have any wanted tag"
 		}
 	}
 	// taking the opportunity to retrieve and save some info
 	r.Filter = filter.Name
-	return true
+	return true, ""
 }
 
 func (r *Release) HasCompatibleTrackerInfo(filter *ConfigFilter, blacklistedUploaders []string, info *TrackerMetadata) bool {
+	ok, reason := r.hasCompatibleTrackerInfo(filter, blacklistedUploaders, info)
+	if !ok {
+		logthis.Info(filter.Name+": "+reason, logthis.VERBOSE)
+	}
+	return ok
+}
+
+// hasCompatibleTrackerInfo for a filter, or returns why not.
+func (r *Release) hasCompatibleTrackerInfo(filter *ConfigFilter, blacklistedUploaders []string, info *TrackerMetadata) (bool, string) {
 	// checks
 	if len(filter.EditionYear) != 0 && !intslice.Contains(filter.EditionYear, info.EditionYear) {
-		logthis.Info(filter.Name+": Wrong edition year", logthis.VERBOSE)
-		return false
+		return false, "Wrong edition year"
 	}
 	if filter.MaxSizeMB != 0 && uint64(filter.MaxSizeMB) < (info.Size/(1024*1024)) {
-		logthis.Info(filter.Name+": Release too big.", logthis.VERBOSE)
-		return false
+		return false, "Release too big."
 	}
 	if filter.MinSizeMB > 0 && uint64(filter.MinSizeMB) > (info.Size/(1024*1024)) {
-		logthis.Info(filter.Name+": Release too small.", logthis.VERBOSE)
-		return false
+		return false, "Release too small."
 	}
 	if r.Source == tracker.SourceCD && r.Format == tracker.FormatFLAC && r.HasLog && filter.LogScore != 0 && filter.LogScore > info.LogScore {
-		logthis.Info(filter.Name+": Incorrect log score", logthis.VERBOSE)
-		return false
+		return false, "Incorrect log score"
 	}
 	if len(filter.RecordLabel) != 0 && !MatchInSlice(info.RecordLabel, filter.RecordLabel) {
-		logthis.Info(filter.Name+": No match for record label", logthis.VERBOSE)
-		return false
+		return false, "No match for record label"
 	}
 	if len(filter.Artist) != 0 || len(filter.ExcludedArtist) != 0 {
 		var foundAtLeastOneArtist bool
@@ -260,22 +260,18 @@ func (r *Release) HasCompatibleTrackerInfo(filter *ConfigFilter, blacklistedUplo
 				foundAtLeastOneArtist = true
 			}
 			if MatchInSlice(iArtist.Name, filter.ExcludedArtist) {
-				logthis.Info(filter.Name+": Found excluded artist "+iArtist.Name, logthis.VERBOSE)
-				return false
+				return false, "Found excluded artist " + iArtist.Name
 			}
 		}
 		if !foundAtLeastOneArtist && len(filter.Artist) != 0 {
-			logthis.Info(filter.Name+": No match for artists", logthis.VERBOSE)
-			return false
+			return false, "No match for artists"
 		}
 	}
 	if strslice.Contains(blacklistedUploaders, info.Uploader) || strslice.Contains(filter.BlacklistedUploaders, info.Uploader) {
-		logthis.Info(filter.Name+": Uploader "+info.Uploader+" is blacklisted.", logthis.VERBOSE)
-		return false
+		return false, "Uploader " + info.Uploader + " is blacklisted."
 	}
 	if len(filter.Uploader) != 0 && !strslice.Contains(filter.Uploader, info.Uploader) {
-		logthis.Info(filter.Name+": No match for uploader", logthis.VERBOSE)
-		return false
+		return false, "No match for uploader"
 	}
 	if len(filter.Edition) != 0 {
 		found := false
@@ -283,8 +279,7 @@ func (r *Release) HasCompatibleTrackerInfo(filter *ConfigFilter, blacklistedUplo
 			found = true
 		}
 		if !found {
-			logthis.Info(filter.Name+": Edition name does not match any criteria.", logthis.VERBOSE)
-			return false
+			return false, "Edition name does not match any criteria."
 		}
 	}
 	if len(filter.Title) != 0 {
@@ -293,22 +288,19 @@ func (r *Release) HasCompatibleTrackerInfo(filter *ConfigFilter, blacklistedUplo
 			found = true
 		}
 		if !found {
-			logthis.Info(filter.Name+": Title does not match any criteria.", logthis.VERBOSE)
-			return false
+			return false, "Title does not match any criteria."
 		}
 	}
 	if filter.RejectUnknown && info.CatalogNumber == "" && info.RecordLabel == "" {
-		logthis.Info(filter.Name+": Release has neither a record label or catalog number, rejected.", logthis.VERBOSE)
-		return false
+		return false, "Release has neither a record label or catalog number, rejected."
 	}
 	if filter.RejectTrumpable && info.Trumpable {
-		logthis.Info(filter.Name+": Release is marked as trumpable, rejected.", logthis.VERBOSE)
-		return false
+		return false, "Release is marked as trumpable, rejected."
 	}
 	// taking the opportunity to retrieve and save some info
 	r.Size = info.Size
 	r.LogScore = info.LogScore
 	r.Folder = info.FolderName
 	r.GroupID = strconv.Itoa(info.GroupID)
-	return true
+	return true, ""
 }
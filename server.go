@@ -1,16 +1,17 @@
 package varroa
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"path/filepath"
 	"strings"
 	"sync"
 
-	"github.com/goji/httpauth"
 	"github.com/gorilla/mux"
-	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 	"github.com/sevlyar/go-daemon"
 	"gitlab.com/catastrophic/assistance/fs"
@@ -19,20 +20,7 @@ import (
 )
 
 const (
-	downloadCommand  = "get"
-	handshakeCommand = "hello"
-	statsCommand     = "stats"
-	autoCloseTab     = "<html><head><script>t = null;function moveMe(){t = setTimeout(\"self.close()\",5000);}</script></head><body onload=\"moveMe()\">Successfully downloaded torrent: %s</body></html>"
-)
-
-const (
-	responseInfo = iota
-	responseError
-)
-
-const (
-	notificationArea = iota
-	statsArea
+	autoCloseTab = "<html><head><script>t = null;function moveMe(){t = setTimeout(\"self.close()\",5000);}</script></head><body onload=\"moveMe()\">Successfully downloaded torrent: %s</body></html>"
 )
 
 // IncomingJSON from the websocket created by the GM script, also used with unix socket.
@@ -42,6 +30,10 @@ type IncomingJSON struct {
 	Args    []string
 	FLToken bool
 	Site    string
+	// protocol v2
+	Version   int    `json:",omitempty"`
+	RequestID string `json:",omitempty"`
+	Filters   bool   `json:",omitempty"`
 }
 
 // OutgoingJSON to the websocket created by the GM script.
@@ -49,10 +41,22 @@ type OutgoingJSON struct {
 	Status  int
 	Target  int
 	Message string
+	// protocol v2
+	Version   int                `json:",omitempty"`
+	RequestID string             `json:",omitempty"`
+	Command   string             `json:",omitempty"`
+	Torrents  []WebSocketTorrent `json:",omitempty"`
+	Daemon    *APIStatus         `json:",omitempty"`
 }
 
 // TODO: see if this could also be used by irc
 func manualSnatchFromID(e *Environment, t *tracker.Gazelle, id string, useFLToken bool) (*Release, error) {
+	// the snatch must complete before shutting down
+	done, ok := e.lifecycle.Track()
+	if !ok {
+		return nil, errors.New(errorShuttingDown)
+	}
+	defer done()
 	stats, err := NewStatsDB(filepath.Join(StatsDir, DefaultHistoryDB))
 	if err != nil {
 		return nil, errors.Wrap(err, "could not access the stats database")
@@ -74,7 +78,8 @@ func manualSnatchFromID(e *Environment, t *tracker.Gazelle, id string, useFLToke
 	} else {
 		logthis.Info("Downloading torrent "+release.ShortString(), logthis.NORMAL)
 	}
-	if err := t.Download(info.ID, useFLToken, e.config.General.WatchDir, ""); err != nil {
+	conf := currentConfig()
+	if err := t.Download(info.ID, useFLToken, conf.General.WatchDir, ""); err != nil {
 		logthis.Error(errors.Wrap(err, errorDownloadingTorrent+id), logthis.NORMAL)
 		return release, err
 	}
@@ -82,22 +87,23 @@ func manualSnatchFromID(e *Environment, t *tracker.Gazelle, id string, useFLToke
 	if release.IsMusicRelease() {
 		// add to history
 		release.Filter = manualSnatchFilterName
+		e.events.Publish(eventSnatch, t.Name, "Snatched "+release.ShortString(), *release)
 		if err := stats.AddSnatch(*release); err != nil {
 			logthis.Info(errorAddingToHistory, logthis.NORMAL)
 		}
 		// save metadata
-		if e.config.General.AutomaticMetadataRetrieval {
+		if conf.General.AutomaticMetadataRetrieval {
 			if daemon.WasReborn() {
-				go info.SaveFromTracker(filepath.Join(e.config.General.DownloadDir, info.FolderName), t)
+				e.lifecycle.Go(func() { saveMetadataAndNotifyWhenReady(e, t, info) })
 			} else {
-				info.SaveFromTracker(filepath.Join(e.config.General.DownloadDir, info.FolderName), t)
+				info.SaveFromTracker(filepath.Join(conf.General.DownloadDir, info.FolderName), t)
 			}
 		}
 	}
 	return release, nil
 }
 
-func validateGet(r *http.Request, config *Config) (string, string, bool, error) {
+func validateGet(r *http.Request, config *Config, tokens *TokensDB) (string, string, bool, error) {
 	queryParameters := r.URL.Query()
 	// get torrent ID
 	id, ok := mux.Vars(r)["id"]
@@ -120,16 +126,17 @@ func validateGet(r *http.Request, config *Config) (string, string, bool, error)
 		trackerLabel = queryTrackerLabel[0]
 	}
 	// checking token
-	token, ok := queryParameters["token"]
-	if !ok {
+	token := requestToken(r)
+	if token == "" {
 		// try to get token from "pass" parameter instead
-		token, ok = queryParameters["pass"]
-		if !ok {
-			return "", "", false, errors.New(errorNoToken)
-		}
+		token = queryParameters.Get("pass")
 	}
-	if token[0] != config.WebServer.Token {
-		return "", "", false, errors.New(errorWrongToken)
+	apiToken, err := tokens.Authenticate(token, config.WebServer.Token)
+	if err != nil {
+		return "", "", false, errors.Wrap(err, errorWrongToken)
+	}
+	if err := apiToken.Allows(scopeSnatch, trackerLabel); err != nil {
+		return "", "", false, err
 	}
 
 	// checking FL token use
@@ -142,40 +149,37 @@ func validateGet(r *http.Request, config *Config) (string, string, bool, error)
 	return trackerLabel, id, useFLToken, nil
 }
 
-func webServer(e *Environment) {
-	if !e.config.webserverConfigured {
-		logthis.Info(webServerNotConfigured, logthis.NORMAL)
-		return
+// webServerRouter with all the pages and APIs allowed by the configuration.
+func webServerRouter(e *Environment) (*mux.Router, error) {
+	conf := currentConfig()
+	if !conf.webserverConfigured {
+		return nil, errors.New(webServerNotConfigured)
 	}
 	var additionalSources []string
-	if e.config.LibraryConfigured {
-		additionalSources = e.config.Library.AdditionalSources
+	if conf.LibraryConfigured {
+		additionalSources = conf.Library.AdditionalSources
 	}
-	downloads, err := NewDownloadsDB(DefaultDownloadsDB, e.config.General.DownloadDir, additionalSources)
+	downloads, err := NewDownloadsDB(DefaultDownloadsDB, conf.General.DownloadDir, additionalSources)
 	if err != nil {
 		logthis.Error(errors.Wrap(err, "Error loading downloads database"), logthis.VERBOSE)
 	}
-	if e.config.WebServer.ServeMetadata {
-		// scan on startup in goroutine
-		go downloads.Scan()
+	tokens, err := NewTokensDB(DefaultTokensDB)
+	if err != nil {
+		logthis.Error(errors.Wrap(err, "Error loading tokens database, only the configured token can be used"), logthis.NORMAL)
+		tokens = nil
 	}
-
 	rtr := mux.NewRouter()
-	var mutex = &sync.Mutex{}
-	if e.config.WebServer.AllowDownloads {
+	rtr.Use(newWebServerGuard(e).protect)
+	if conf.WebServer.AllowDownloads {
 		getStats := func(w http.ResponseWriter, r *http.Request) {
 			// checking token
-			token, ok := r.URL.Query()["token"]
-			if !ok {
-				logthis.Info(errorNoToken, logthis.NORMAL)
-				w.WriteHeader(http.StatusNotFound)
-				return
-			}
-			if token[0] != e.config.WebServer.Token {
-				logthis.Info(errorWrongToken, logthis.NORMAL)
+			token, err := tokens.Authenticate(requestToken(r), currentConfig().WebServer.Token)
+			if err != nil {
+				authFailed(r, err.Error())
 				w.WriteHeader(http.StatusNotFound)
 				return
 			}
+			authSucceeded(r)
 			// get site
 			trackerLabel, ok := mux.Vars(r)["site"]
 			if !ok {
@@ -188,6 +192,11 @@ func webServer(e *Environment) {
 				}
 				trackerLabel = queryTrackerLabel[0]
 			}
+			if err := token.Allows(scopeReadStats, trackerLabel); err != nil {
+				logthis.Info(err.Error(), logthis.NORMAL)
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
 			// get filename
 			filename, ok := mux.Vars(r)["name"]
 			if !ok {
@@ -209,12 +218,13 @@ func webServer(e *Environment) {
 			w.Write(file)
 		}
 		getTorrent := func(w http.ResponseWriter, r *http.Request) {
-			trackerLabel, id, useFLToken, err := validateGet(r, e.config)
+			trackerLabel, id, useFLToken, err := validateGet(r, currentConfig(), tokens)
 			if err != nil {
-				logthis.Error(errors.Wrap(err, "Error parsing request"), logthis.NORMAL)
+				authFailed(r, err.Error())
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
+			authSucceeded(r)
 			// snatching
 			tracker, err := e.Tracker(trackerLabel)
 			if err != nil {
@@ -234,7 +244,7 @@ func webServer(e *Environment) {
 		}
 		getMetadata := func(w http.ResponseWriter, r *http.Request) {
 			// if not configured, return error
-			if !e.config.WebServer.ServeMetadata {
+			if !currentConfig().WebServer.ServeMetadata {
 				logthis.Error(errors.New("Error, not configured to serve metadata"), logthis.NORMAL)
 				w.WriteHeader(http.StatusUnauthorized)
 				return
@@ -263,122 +273,28 @@ func webServer(e *Environment) {
 			w.WriteHeader(http.StatusOK)
 			w.Write(response)
 		}
-		upgrader := websocket.Upgrader{
-			// allows connection to websocket from anywhere
-			CheckOrigin: func(r *http.Request) bool { return true },
-		}
-		socket := func(w http.ResponseWriter, r *http.Request) {
-			c, err := upgrader.Upgrade(w, r, nil)
-			if err != nil {
-				logthis.Error(errors.Wrap(err, errorCreatingWebSocket), logthis.NORMAL)
-				return
-			}
-			defer c.Close()
-			// channel to know when the connection with a specific instance is over
-			endThisConnection := make(chan struct{})
-
-			// this goroutine will send messages to the remote
-			websocketUp := true
-			go func() {
-				logOutput := logthis.Subscribe()
-				for {
-					select {
-					case messageToLog := <-logOutput:
-						mutex.Lock()
-						// TODO differentiate info / error
-						if err := c.WriteJSON(OutgoingJSON{Status: responseInfo, Message: messageToLog.(string), Target: notificationArea}); err != nil {
-							if !websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-								logthis.Error(errors.Wrap(err, errorOutgoingWebSocketJSON), logthis.VERBOSEST)
-							}
-							mutex.Lock()
-							logthis.Unsubscribe(logOutput)
-							websocketUp = false
-							mutex.Unlock()
-							return
-						}
-						mutex.Unlock()
-					case <-endThisConnection:
-						mutex.Lock()
-						logthis.Unsubscribe(logOutput)
-						websocketUp = false
-						mutex.Unlock()
-						return
-					}
-				}
-			}()
-
-			for {
-				if !websocketUp {
-					return
-				}
-				// TODO if server is shutting down, c.Close()
-				incoming := IncomingJSON{}
-				if err := c.ReadJSON(&incoming); err != nil {
-					if !websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-						logthis.Error(errors.Wrap(err, errorIncomingWebSocketJSON), logthis.VERBOSEST)
-					}
-					endThisConnection <- struct{}{}
-					break
-				}
-
-				var answer OutgoingJSON
-				if incoming.Token != e.config.WebServer.Token {
-					logthis.Info(errorIncorrectWebServerToken, logthis.NORMAL)
-					answer = OutgoingJSON{Status: responseError, Target: notificationArea, Message: "Bad token!"}
-				} else {
-					// dealing with command
-					switch incoming.Command {
-					case handshakeCommand:
-						// say hello right back
-						answer = OutgoingJSON{Status: responseInfo, Target: notificationArea, Message: handshakeCommand}
-					case downloadCommand:
-						tracker, err := e.Tracker(incoming.Site)
-						if err != nil {
-							logthis.Error(errors.Wrap(err, "Error identifying in configuration tracker "+incoming.Site), logthis.NORMAL)
-							answer = OutgoingJSON{Status: responseError, Target: notificationArea, Message: "Error snatching torrent."}
-						} else {
-							// snatching
-							for _, id := range incoming.Args {
-								release, err := manualSnatchFromID(e, tracker, id, incoming.FLToken)
-								if err != nil {
-									logthis.Info("Error snatching torrent: "+err.Error(), logthis.NORMAL)
-									answer = OutgoingJSON{Status: responseError, Target: notificationArea, Message: "Error snatching torrent."}
-								} else {
-									answer = OutgoingJSON{Status: responseInfo, Target: notificationArea, Message: "Successfully snatched torrent " + release.ShortString()}
-								}
-								// TODO send responses for all IDs (only 1 from GM Script for now anyway)
-							}
-						}
-					case statsCommand:
-						// TODO gather stats and send text (ie snatched today, this week, etc...)
-						answer = OutgoingJSON{Status: responseInfo, Target: statsArea, Message: statusString(e)}
-					default:
-						answer = OutgoingJSON{Status: responseError, Target: notificationArea, Message: errorUnknownCommand + incoming.Command}
-					}
-				}
-				// writing answer
-				mutex.Lock()
-				if err := c.WriteJSON(answer); err != nil {
-					if !websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-						logthis.Error(errors.Wrap(err, errorOutgoingWebSocketJSON+" (answer)"), logthis.VERBOSEST)
-					}
-					endThisConnection <- struct{}{}
-					break
-				}
-				mutex.Unlock()
-			}
-		}
 		// interface for remotely ordering downloads
 		rtr.HandleFunc("/get/{id:[0-9]+}", getTorrent).Methods("GET")
-		rtr.HandleFunc("/downloads", getMetadata).Methods("GET")
-		rtr.HandleFunc("/downloads/{id:[0-9]+}", getMetadata).Methods("GET")
+		rtr.Handle("/downloads", metadataAuth(e, getMetadata)).Methods("GET")
+		rtr.Handle("/downloads/{id:[0-9]+}", metadataAuth(e, getMetadata)).Methods("GET")
+		if downloads != nil {
+			registerFilePages(rtr, e, downloads)
+		}
+		if conf.webserverSorting && downloads != nil {
+			registerSortPages(rtr, e, downloads)
+		} else if conf.webserverMetadata && conf.LibraryConfigured {
+			logthis.Info("Sorting downloads from the web interface requires a user and password for the web server.", logthis.NORMAL)
+		}
 		rtr.HandleFunc("/getStats/{name:[\\w]+.svg}", getStats).Methods("GET")
 		rtr.HandleFunc("/getStats/{name:[\\w]+.png}", getStats).Methods("GET")
 		rtr.HandleFunc("/dl.pywa", getTorrent).Methods("GET")
-		rtr.HandleFunc("/ws", socket)
+		rtr.HandleFunc("/ws", websocketHandler(e, downloads, tokens))
 	}
 
-	if e.config.WebServer.ServeStats {
+	// JSON API
+	registerAPIv1(rtr, e, downloads, tokens)
+
+	if conf.WebServer.ServeStats {
 		getLocalStats := func(w http.ResponseWriter, r *http.Request) {
 			// get filename
 			filename, ok := mux.Vars(r)["name"]
@@ -400,53 +316,135 @@ func webServer(e *Environment) {
 			w.WriteHeader(http.StatusOK)
 			w.Write(response)
 		}
-		if e.config.WebServer.Password != "" {
-			rtr.Handle("/", httpauth.SimpleBasicAuth(e.config.WebServer.User, e.config.WebServer.Password)(http.HandlerFunc(getIndex)))
-			rtr.Handle("/{name:[\\w]+.svg}", httpauth.SimpleBasicAuth(e.config.WebServer.User, e.config.WebServer.Password)(http.HandlerFunc(getLocalStats)))
-			rtr.Handle("/{name:[\\w]+.png}", httpauth.SimpleBasicAuth(e.config.WebServer.User, e.config.WebServer.Password)(http.HandlerFunc(getLocalStats)))
+		if conf.WebServer.Password != "" {
+			rtr.Handle("/", basicAuth(e, http.HandlerFunc(getIndex)))
+			rtr.Handle("/{name:[\\w]+.svg}", basicAuth(e, http.HandlerFunc(getLocalStats)))
+			rtr.Handle("/{name:[\\w]+.png}", basicAuth(e, http.HandlerFunc(getLocalStats)))
 		} else {
 			rtr.HandleFunc("/", getIndex)
 			rtr.HandleFunc("/{name:[\\w]+.svg}", getLocalStats)
 			rtr.HandleFunc("/{name:[\\w]+.png}", getLocalStats)
 		}
 	}
-	// serve
-	if e.config.webserverHTTP {
-		go func() {
-			logthis.Info(webServerUpHTTP, logthis.NORMAL)
-			httpServer := &http.Server{Addr: fmt.Sprintf(":%d", e.config.WebServer.PortHTTP), Handler: rtr}
-			if err := httpServer.ListenAndServe(); err != nil {
-				if err == http.ErrServerClosed {
-					logthis.Info(webServerShutDown, logthis.NORMAL)
-				} else {
-					logthis.Error(errors.Wrap(err, errorServing), logthis.NORMAL)
-				}
-			}
-		}()
+	return rtr, nil
+}
+
+// webServerSubsystem serves the web interface over HTTP and/or HTTPS.
+type webServerSubsystem struct {
+	e       *Environment
+	mutex   sync.Mutex
+	servers []*http.Server
+	err     error
+}
+
+func (ws *webServerSubsystem) Name() string {
+	return subsystemWebServer
+}
+
+// serve in a goroutine, keeping track of unexpected errors.
+func (ws *webServerSubsystem) serve(server *http.Server, l net.Listener, useTLS bool) {
+	var err error
+	if useTLS {
+		err = server.ServeTLS(l, "", "")
+	} else {
+		err = server.Serve(l)
 	}
-	if e.config.webserverHTTPS {
-		// if not there yet, generate the self-signed certificate
-		if !fs.FileExists(filepath.Join(certificatesDir, certificateKey)) || !fs.FileExists(filepath.Join(certificatesDir, certificate)) {
-			if err := generateCertificates(e); err != nil {
-				logthis.Error(errors.Wrap(err, errorGeneratingCertificate+provideCertificate), logthis.NORMAL)
+	if err == http.ErrServerClosed {
+		logthis.Info(webServerShutDown, logthis.NORMAL)
+		return
+	}
+	logthis.Error(errors.Wrap(err, errorServing), logthis.NORMAL)
+	ws.mutex.Lock()
+	ws.err = err
+	ws.mutex.Unlock()
+}
+
+// Start listening, so that errors such as ports already in use are returned.
+// Nothing is served until both servers are ready, so that a failure does not leave one of them running.
+func (ws *webServerSubsystem) Start(ctx context.Context) error {
+	conf := currentConfig()
+	rtr, err := webServerRouter(ws.e)
+	if err != nil {
+		return err
+	}
+
+	var tlsConfig *tls.Config
+	if conf.webserverHTTPS {
+		// if not there yet and none is provided, generate the self-signed certificate
+		if conf.WebServer.CertFile == "" && (!fs.FileExists(filepath.Join(certificatesDir, certificateKey)) || !fs.FileExists(filepath.Join(certificatesDir, certificate))) {
+			if err := generateCertificates(ws.e); err != nil {
 				logthis.Info(infoBackupScript, logthis.NORMAL)
-				return
+				return errors.Wrap(err, errorGeneratingCertificate+provideCertificate)
 			}
 			// basic instruction for first connection.
 			logthis.Info(infoAddCertificates, logthis.NORMAL)
 		}
+		tlsConfig, err = webServerTLSConfig(ctx, conf.WebServer)
+		if err != nil {
+			return errors.Wrap(err, errorServing)
+		}
+	}
 
-		go func() {
-			logthis.Info(webServerUpHTTPS, logthis.NORMAL)
-			httpsServer := &http.Server{Addr: fmt.Sprintf(":%d", e.config.WebServer.PortHTTPS), Handler: rtr}
-			if err := httpsServer.ListenAndServeTLS(filepath.Join(certificatesDir, certificate), filepath.Join(certificatesDir, certificateKey)); err != nil {
-				if err == http.ErrServerClosed {
-					logthis.Info(webServerShutDown, logthis.NORMAL)
-				} else {
-					logthis.Error(errors.Wrap(err, errorServing), logthis.NORMAL)
-				}
+	var httpServer, httpsServer *http.Server
+	var httpListener, httpsListener net.Listener
+	if conf.webserverHTTP {
+		httpServer = &http.Server{Addr: fmt.Sprintf(":%d", conf.WebServer.PortHTTP), Handler: rtr}
+		httpListener, err = net.Listen("tcp", httpServer.Addr)
+		if err != nil {
+			return errors.Wrap(err, errorServing)
+		}
+	}
+	if conf.webserverHTTPS {
+		httpsServer = &http.Server{Addr: fmt.Sprintf(":%d", conf.WebServer.PortHTTPS), Handler: rtr, TLSConfig: tlsConfig}
+		httpsListener, err = net.Listen("tcp", httpsServer.Addr)
+		if err != nil {
+			if httpListener != nil {
+				httpListener.Close()
 			}
-		}()
+			return errors.Wrap(err, errorServing)
+		}
+	}
+
+	ws.mutex.Lock()
+	ws.servers = []*http.Server{}
+	ws.err = nil
+	if httpServer != nil {
+		ws.servers = append(ws.servers, httpServer)
+	}
+	if httpsServer != nil {
+		ws.servers = append(ws.servers, httpsServer)
+	}
+	ws.mutex.Unlock()
+
+	if httpServer != nil {
+		logthis.Info(webServerUpHTTP, logthis.NORMAL)
+		go ws.serve(httpServer, httpListener, false)
+	}
+	if httpsServer != nil {
+		logthis.Info(webServerUpHTTPS, logthis.NORMAL)
+		go ws.serve(httpsServer, httpsListener, true)
 	}
 	logthis.Info(webServersUp, logthis.NORMAL)
+	return nil
+}
+
+// Stop accepting connections, and wait for the current requests to be over.
+func (ws *webServerSubsystem) Stop(ctx context.Context) error {
+	ws.mutex.Lock()
+	servers := ws.servers
+	ws.mutex.Unlock()
+	var stopErr error
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			server.Close()
+			stopErr = err
+		}
+	}
+	return stopErr
+}
+
+func (ws *webServerSubsystem) Health() error {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	return ws.err
 }
@@ -0,0 +1,512 @@
+package varroa
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/logthis"
+	"gitlab.com/catastrophic/assistance/strslice"
+	"gitlab.com/passelecasque/obstruction/tracker"
+)
+
+const (
+	apiV1Prefix         = "/api/v1"
+	apiDefaultLimit     = 50
+	apiMaximumLimit     = 1000
+	apiTokenHeader      = "X-Varroa-Token"
+	apiBearerPrefix     = "Bearer "
+	apiJSONType         = "application/json"
+	errorAPINotFound    = "not found"
+	errorAPIBadLimit    = "invalid limit parameter"
+	errorAPIBadState    = "invalid download state"
+	errorAPIBadBody     = "invalid request body"
+	errorAPINoMetrics   = "stats are not configured for this tracker"
+	errorAPINoDownloads = "downloads database is not available"
+)
+
+// APIError is returned by all API endpoints when something goes wrong.
+type APIError struct {
+	Error APIErrorDetail `json:"error"`
+}
+
+// APIErrorDetail describes what went wrong.
+type APIErrorDetail struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// APIStatus of the daemon.
+type APIStatus struct {
+	Version    string             `json:"version"`
+	StartTime  time.Time          `json:"start_time"`
+	Uptime     string             `json:"uptime"`
+	Autosnatch []APIAutosnatching `json:"autosnatch"`
+	Subsystems map[string]string  `json:"subsystems"`
+}
+
+// APIAutosnatching state for a tracker.
+type APIAutosnatching struct {
+	Tracker string `json:"tracker"`
+	Enabled bool   `json:"enabled"`
+}
+
+// APITracker describes a configured tracker.
+type APITracker struct {
+	Name       string `json:"name"`
+	URL        string `json:"url"`
+	Autosnatch bool   `json:"autosnatch"`
+	Stats      bool   `json:"stats"`
+}
+
+// APIDownload is a download entry, with its tracker metadata when requested individually.
+type APIDownload struct {
+	DownloadEntry
+	StateName string            `json:"state"`
+	Metadata  []TrackerMetadata `json:"metadata,omitempty"`
+}
+
+// APIFilterResult tells if a torrent would be snatched by a filter, and why not.
+type APIFilterResult struct {
+	Filter  string `json:"filter"`
+	Matches bool   `json:"matches"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// APISnatchRequest is the body of a snatch request.
+type APISnatchRequest struct {
+	Tracker string `json:"tracker"`
+	ID      string `json:"id"`
+	FLToken bool   `json:"fltoken"`
+}
+
+// APIStateRequest is the body of a download state change.
+type APIStateRequest struct {
+	State string `json:"state"`
+}
+
+// apiTokenKey is the request context key for the authenticated token.
+type apiTokenKey struct{}
+
+type apiV1 struct {
+	e         *Environment
+	downloads *DownloadsDB
+	tokens    *TokensDB
+}
+
+// registerAPIv1 routes on the router.
+func registerAPIv1(rtr *mux.Router, e *Environment, downloads *DownloadsDB, tokens *TokensDB) {
+	api := &apiV1{e: e, downloads: downloads, tokens: tokens}
+	// the OpenAPI document is public
+	rtr.HandleFunc(apiV1Prefix+"/openapi.json", api.openAPI).Methods("GET")
+
+	sub := rtr.PathPrefix(apiV1Prefix).Subrouter()
+	sub.Use(api.authenticate)
+	sub.HandleFunc("/status", api.require(scopeReadStats, api.status)).Methods("GET")
+	sub.HandleFunc("/trackers", api.require(scopeReadStats, api.trackers)).Methods("GET")
+	sub.HandleFunc("/stats/{tracker}", api.require(scopeReadStats, api.stats)).Methods("GET")
+	sub.HandleFunc("/history", api.require(scopeReadStats, api.history)).Methods("GET")
+	sub.HandleFunc("/events", api.require(scopeReadStats, api.events)).Methods("GET")
+	sub.HandleFunc("/downloads", api.require(scopeReadDownloads, api.listDownloads)).Methods("GET")
+	sub.HandleFunc("/downloads/{id:[0-9]+}", api.require(scopeReadDownloads, api.showDownload)).Methods("GET")
+	sub.HandleFunc("/downloads/{id:[0-9]+}/state", api.require(scopeAdmin, api.setDownloadState)).Methods("PUT")
+	sub.HandleFunc("/filters", api.require(scopeAdmin, api.filters)).Methods("GET")
+	sub.HandleFunc("/filters/test/{tracker}/{id:[0-9]+}", api.require(scopeSnatch, api.testFilters)).Methods("GET")
+	sub.HandleFunc("/snatch", api.require(scopeSnatch, api.snatch)).Methods("POST")
+	sub.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, errorAPINotFound)
+	})
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", apiJSONType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logthis.Error(errors.Wrap(err, "Error writing API response"), logthis.VERBOSEST)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeAPIJSON(w, status, APIError{Error: APIErrorDetail{Status: status, Message: message}})
+}
+
+// requestToken from the Authorization or X-Varroa-Token headers, or from the query parameters.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, apiBearerPrefix) {
+		return strings.TrimPrefix(auth, apiBearerPrefix)
+	}
+	if token := r.Header.Get(apiTokenHeader); token != "" {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+func (api *apiV1) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := requestToken(r)
+		if token == "" {
+			writeAPIError(w, http.StatusUnauthorized, errorNoToken)
+			return
+		}
+		apiToken, err := api.tokens.Authenticate(token, currentConfig().WebServer.Token)
+		if err != nil {
+			authFailed(r, errorWrongToken+": "+err.Error())
+			writeAPIError(w, http.StatusForbidden, errorWrongToken)
+			return
+		}
+		authSucceeded(r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiTokenKey{}, apiToken)))
+	})
+}
+
+// require a scope from the authenticated token before handling the request.
+func (api *apiV1) require(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := requestAPIToken(r).Allows(scope, ""); err != nil {
+			writeAPIError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requestAPIToken that was authenticated for this request.
+func requestAPIToken(r *http.Request) *APIToken {
+	if token, ok := r.Context().Value(apiTokenKey{}).(*APIToken); ok {
+		return token
+	}
+	// should not happen behind authenticate, allowing nothing
+	return &APIToken{}
+}
+
+// allowsTracker checks the authenticated token can be used for a tracker, or writes the relevant error.
+func allowsTracker(w http.ResponseWriter, r *http.Request, scope, tracker string) bool {
+	if err := requestAPIToken(r).Allows(scope, tracker); err != nil {
+		writeAPIError(w, http.StatusForbidden, err.Error())
+		return false
+	}
+	return true
+}
+
+// limit from the query parameters.
+func apiLimit(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return apiDefaultLimit, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 || limit > apiMaximumLimit {
+		return 0, errors.New(errorAPIBadLimit)
+	}
+	return limit, nil
+}
+
+func (api *apiV1) openAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", apiJSONType)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(openAPIv1))
+}
+
+func (api *apiV1) status(w http.ResponseWriter, r *http.Request) {
+	writeAPIJSON(w, http.StatusOK, newAPIStatus(api.e))
+}
+
+// newAPIStatus of the daemon, also sent to the userscript.
+func newAPIStatus(e *Environment) APIStatus {
+	status := APIStatus{Version: Version, StartTime: e.startTime, Subsystems: e.lifecycle.Health()}
+	if !e.startTime.IsZero() {
+		status.Uptime = time.Since(e.startTime).String()
+	}
+	e.mutex.RLock()
+	for _, as := range e.config.Autosnatch {
+		status.Autosnatch = append(status.Autosnatch, APIAutosnatching{Tracker: as.Tracker, Enabled: !as.disabledAutosnatching})
+	}
+	e.mutex.RUnlock()
+	return status
+}
+
+func (api *apiV1) trackers(w http.ResponseWriter, r *http.Request) {
+	trackers := []APITracker{}
+	conf := currentConfig()
+	for _, t := range conf.Trackers {
+		if requestAPIToken(r).Allows(scopeReadStats, t.Name) != nil {
+			continue
+		}
+		_, autosnatchErr := conf.GetAutosnatch(t.Name)
+		_, statsErr := conf.GetStats(t.Name)
+		trackers = append(trackers, APITracker{Name: t.Name, URL: t.URL, Autosnatch: autosnatchErr == nil, Stats: statsErr == nil})
+	}
+	writeAPIJSON(w, http.StatusOK, trackers)
+}
+
+func (api *apiV1) stats(w http.ResponseWriter, r *http.Request) {
+	label := mux.Vars(r)["tracker"]
+	if !allowsTracker(w, r, scopeReadStats, label) {
+		return
+	}
+	if _, err := currentConfig().GetStats(label); err != nil {
+		writeAPIError(w, http.StatusNotFound, errorAPINoMetrics)
+		return
+	}
+	limit, err := apiLimit(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	stats, err := NewStatsDB(filepath.Join(StatsDir, DefaultHistoryDB))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, errorGettingStats)
+		return
+	}
+	entries, err := stats.GetLastCollected(label, limit)
+	if err != nil && err != storm.ErrNotFound {
+		writeAPIError(w, http.StatusInternalServerError, errorGettingStats)
+		return
+	}
+	if entries == nil {
+		entries = []StatsEntry{}
+	}
+	writeAPIJSON(w, http.StatusOK, entries)
+}
+
+func (api *apiV1) history(w http.ResponseWriter, r *http.Request) {
+	limit, err := apiLimit(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	stats, err := NewStatsDB(filepath.Join(StatsDir, DefaultHistoryDB))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, errorGettingStats)
+		return
+	}
+	query := stats.db.DB.Select()
+	if label := r.URL.Query().Get("tracker"); label != "" {
+		if !allowsTracker(w, r, scopeReadStats, label) {
+			return
+		}
+		query = stats.db.DB.Select(q.Eq("Tracker", label))
+	} else if trackers := requestAPIToken(r).Trackers; len(trackers) != 0 {
+		query = stats.db.DB.Select(q.In("Tracker", trackers))
+	}
+	var releases []Release
+	if err := query.OrderBy("ID").Reverse().Limit(limit).Find(&releases); err != nil && err != storm.ErrNotFound {
+		writeAPIError(w, http.StatusInternalServerError, errorGettingLastSnatches)
+		return
+	}
+	if releases == nil {
+		releases = []Release{}
+	}
+	writeAPIJSON(w, http.StatusOK, releases)
+}
+
+func (api *apiV1) listDownloads(w http.ResponseWriter, r *http.Request) {
+	if api.downloads == nil {
+		writeAPIError(w, http.StatusServiceUnavailable, errorAPINoDownloads)
+		return
+	}
+	state := r.URL.Query().Get("state")
+	if state != "" && !IsValidDownloadState(state) {
+		writeAPIError(w, http.StatusBadRequest, errorAPIBadState)
+		return
+	}
+	artist := r.URL.Query().Get("artist")
+	// state and artist are applied the same way, with or without a search query
+	entries, err := api.downloads.Search(r.URL.Query().Get("q"), r.URL.Query().Get("sort"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	list := []APIDownload{}
+	for _, dl := range entries {
+		if state != "" && dl.State != DownloadState(state) {
+			continue
+		}
+		if artist != "" && !strslice.ContainsCaseInsensitive(dl.Artists, artist) {
+			continue
+		}
+		list = append(list, APIDownload{DownloadEntry: dl, StateName: DownloadFolderStates[dl.State]})
+	}
+	writeAPIJSON(w, http.StatusOK, list)
+}
+
+// downloadFromRequest finds the download entry identified in the URL, or writes the relevant error.
+func (api *apiV1) downloadFromRequest(w http.ResponseWriter, r *http.Request) (DownloadEntry, bool) {
+	if api.downloads == nil {
+		writeAPIError(w, http.StatusServiceUnavailable, errorAPINoDownloads)
+		return DownloadEntry{}, false
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, errorNoID)
+		return DownloadEntry{}, false
+	}
+	dl, err := api.downloads.FindByID(id)
+	if err != nil {
+		if err == storm.ErrNotFound {
+			writeAPIError(w, http.StatusNotFound, errorAPINotFound)
+		} else {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+		}
+		return DownloadEntry{}, false
+	}
+	return dl, true
+}
+
+func (api *apiV1) showDownload(w http.ResponseWriter, r *http.Request) {
+	dl, ok := api.downloadFromRequest(w, r)
+	if !ok {
+		return
+	}
+	response := APIDownload{DownloadEntry: dl, StateName: DownloadFolderStates[dl.State]}
+	for _, t := range dl.Tracker {
+		md, err := dl.getMetadata(api.downloads.root, t)
+		if err != nil {
+			logthis.Error(errors.Wrap(err, "Error loading metadata for "+dl.FolderName), logthis.VERBOSE)
+			continue
+		}
+		response.Metadata = append(response.Metadata, md)
+	}
+	writeAPIJSON(w, http.StatusOK, response)
+}
+
+func (api *apiV1) setDownloadState(w http.ResponseWriter, r *http.Request) {
+	dl, ok := api.downloadFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var request APIStateRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeAPIError(w, http.StatusBadRequest, errorAPIBadBody)
+		return
+	}
+	if !IsValidDownloadState(request.State) {
+		writeAPIError(w, http.StatusBadRequest, errorAPIBadState)
+		return
+	}
+	updated, err := api.downloads.SetState(dl.ID, DownloadState(request.State))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	api.e.events.PublishDownloadState(updated)
+	writeAPIJSON(w, http.StatusOK, APIDownload{DownloadEntry: updated, StateName: DownloadFolderStates[updated.State]})
+}
+
+func (api *apiV1) filters(w http.ResponseWriter, r *http.Request) {
+	filters := currentConfig().Filters
+	if filters == nil {
+		filters = []*ConfigFilter{}
+	}
+	writeAPIJSON(w, http.StatusOK, filters)
+}
+
+func (api *apiV1) testFilters(w http.ResponseWriter, r *http.Request) {
+	if !allowsTracker(w, r, scopeSnatch, mux.Vars(r)["tracker"]) {
+		return
+	}
+	t, err := api.e.Tracker(mux.Vars(r)["tracker"])
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	info := &TrackerMetadata{}
+	if err := info.LoadFromID(t, mux.Vars(r)["id"]); err != nil {
+		writeAPIError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	stats, err := NewStatsDB(filepath.Join(StatsDir, DefaultHistoryDB))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, errorGettingStats)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, matchingFilters(api.e, t, info, stats))
+}
+
+// matchingFilters for a torrent, as if it had just been announced, checking the snatch history if stats is not nil.
+func matchingFilters(e *Environment, t *tracker.Gazelle, info *TrackerMetadata, stats *StatsDB) []APIFilterResult {
+	conf := currentConfig()
+	var blacklistedUploaders []string
+	if autosnatchConfig, err := conf.GetAutosnatch(t.Name); err == nil {
+		blacklistedUploaders = autosnatchConfig.BlacklistedUploaders
+	}
+	results := []APIFilterResult{}
+	release := info.Release()
+	var torrentGroupInfo *tracker.GazelleTorrentGroup
+	for _, filter := range conf.Filters {
+		result := APIFilterResult{Filter: filter.Name}
+		var ok bool
+		switch {
+		case release == nil:
+			result.Reason = errorCouldNotGetTorrentInfo
+		case len(filter.Tracker) != 0 && !strslice.ContainsCaseInsensitive(filter.Tracker, t.Name):
+			result.Reason = fmt.Sprintf(infoFilterIgnoredForTracker, filter.Name, t.Name)
+		default:
+			if ok, result.Reason = release.satisfies(filter); !ok {
+				break
+			}
+			if ok, result.Reason = release.hasCompatibleTrackerInfo(filter, blacklistedUploaders, info); !ok {
+				break
+			}
+			if stats != nil && !filter.AllowDuplicates && len(release.Artists) != 0 && stats.AlreadySnatchedDuplicate(release) {
+				result.Reason = infoNotSnatchingDuplicate
+				break
+			}
+			if filter.UniqueInGroup {
+				if stats != nil && stats.AlreadySnatchedFromGroup(release) {
+					result.Reason = infoNotSnatchingUniqueInGroup
+					break
+				}
+				// the site itself may know about past snatches
+				if torrentGroupInfo == nil {
+					var err error
+					if torrentGroupInfo, err = t.GetTorrentGroup(info.GroupID); err != nil {
+						logthis.Error(errors.Wrap(err, "error retrieving torrent group info"), logthis.NORMAL)
+					}
+				}
+				if torrentGroupInfo != nil && torrentGroupInfo.AlreadySnatched() {
+					result.Reason = infoNotSnatchingUniqueInGroup
+					break
+				}
+			}
+			result.Matches = true
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func (api *apiV1) snatch(w http.ResponseWriter, r *http.Request) {
+	var request APISnatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeAPIError(w, http.StatusBadRequest, errorAPIBadBody)
+		return
+	}
+	if _, err := strconv.Atoi(request.ID); err != nil {
+		writeAPIError(w, http.StatusBadRequest, errorNoID)
+		return
+	}
+	if !allowsTracker(w, r, scopeSnatch, request.Tracker) {
+		return
+	}
+	t, err := api.e.Tracker(request.Tracker)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	release, err := manualSnatchFromID(api.e, t, request.ID, request.FLToken)
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, errors.Wrap(err, ErrorSnatchingTorrent).Error())
+		return
+	}
+	writeAPIJSON(w, http.StatusCreated, release)
+}
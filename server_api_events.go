@@ -0,0 +1,125 @@
+package varroa
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/logthis"
+	"gitlab.com/catastrophic/assistance/strslice"
+)
+
+const (
+	apiEventStreamType      = "text/event-stream"
+	apiEventsKeepAlive      = 30 * time.Second
+	errorAPIBadEventType    = "invalid event type"
+	errorAPIBadLastEventID  = "invalid last event ID"
+	errorAPINoEventsSupport = "streaming is not supported"
+)
+
+// queryList of comma-separated values from the query parameters.
+func queryList(r *http.Request, key string) []string {
+	var values []string
+	for _, value := range strings.Split(r.URL.Query().Get(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// lastEventID from the Last-Event-ID header sent by reconnecting clients, or from the query parameters.
+func lastEventID(r *http.Request) (uint64, error) {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("last_event_id")
+	}
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// writeEvent in the server-sent events format.
+func writeEvent(w http.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+func (api *apiV1) events(w http.ResponseWriter, r *http.Request) {
+	types := queryList(r, "type")
+	for _, eventType := range types {
+		if !strslice.Contains(KnownEventTypes, eventType) {
+			writeAPIError(w, http.StatusBadRequest, errorAPIBadEventType)
+			return
+		}
+	}
+	// only streaming events from the trackers the token can read
+	trackers := queryList(r, "tracker")
+	for _, t := range trackers {
+		if !allowsTracker(w, r, scopeReadStats, t) {
+			return
+		}
+	}
+	restricted := len(requestAPIToken(r).Trackers) != 0
+	if len(trackers) == 0 {
+		trackers = requestAPIToken(r).Trackers
+	}
+	lastID, err := lastEventID(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, errorAPIBadLastEventID)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, errorAPINoEventsSupport)
+		return
+	}
+
+	subscription, missed := api.e.events.Subscribe(types, trackers, restricted, lastID)
+	defer api.e.events.Unsubscribe(subscription)
+
+	w.Header().Set("Content-Type", apiEventStreamType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	for _, event := range missed {
+		if err := writeEvent(w, event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(apiEventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event, ok := <-subscription.Events:
+			if !ok {
+				// the client could not keep up, it can reconnect and resume from the last event it received
+				logthis.Info("Closing event stream for a slow client.", logthis.VERBOSE)
+				return
+			}
+			if err := writeEvent(w, event); err != nil {
+				logthis.Error(errors.Wrap(err, "Error writing event"), logthis.VERBOSEST)
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
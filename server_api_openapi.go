@@ -0,0 +1,198 @@
+package varroa
+
+// openAPIv1 describes the /api/v1 endpoints.
+const openAPIv1 = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "varroa musica API",
+    "description": "Tokens are created with 'varroa token create' and have scopes: read-stats (status, trackers, stats, history, events), read-downloads (downloads), snatch (snatch, filter tests), admin (everything, including download state changes and filters). The token from the configuration file has all scopes.",
+    "version": "1"
+  },
+  "servers": [{"url": "/api/v1"}],
+  "security": [{"bearer": []}, {"header": []}],
+  "paths": {
+    "/status": {
+      "get": {
+        "summary": "Daemon status",
+        "responses": {
+          "200": {"description": "Daemon status", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Status"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/trackers": {
+      "get": {
+        "summary": "Configured trackers",
+        "responses": {
+          "200": {"description": "Trackers", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Tracker"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/stats/{tracker}": {
+      "get": {
+        "summary": "Last collected stats for a tracker, most recent first",
+        "parameters": [{"$ref": "#/components/parameters/Tracker"}, {"$ref": "#/components/parameters/Limit"}],
+        "responses": {
+          "200": {"description": "Stats series", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/StatsEntry"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/history": {
+      "get": {
+        "summary": "Snatch history, most recent first",
+        "parameters": [
+          {"name": "tracker", "in": "query", "schema": {"type": "string"}},
+          {"$ref": "#/components/parameters/Limit"}
+        ],
+        "responses": {
+          "200": {"description": "Snatched releases", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Release"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/events": {
+      "get": {
+        "summary": "Server-sent events stream of daemon activity. Reconnecting clients resume from the Last-Event-ID header, as long as the event is still in the buffer of recent events.",
+        "parameters": [
+          {"name": "type", "in": "query", "description": "Comma-separated event types", "schema": {"type": "string"}},
+          {"name": "tracker", "in": "query", "description": "Comma-separated trackers; events not related to a tracker are only sent to tokens allowed to read all trackers", "schema": {"type": "string"}},
+          {"name": "Last-Event-ID", "in": "header", "schema": {"type": "integer"}},
+          {"name": "last_event_id", "in": "query", "schema": {"type": "integer"}}
+        ],
+        "responses": {
+          "200": {"description": "Events, with their type as the event name", "content": {"text/event-stream": {"schema": {"$ref": "#/components/schemas/Event"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/downloads": {
+      "get": {
+        "summary": "Download entries",
+        "parameters": [
+          {"name": "state", "in": "query", "schema": {"$ref": "#/components/schemas/DownloadState"}},
+          {"name": "artist", "in": "query", "description": "Only downloads by this artist, ignoring case.", "schema": {"type": "string"}},
+          {"name": "q", "in": "query", "description": "Search query, such as: artist:\"Miles Davis\" tag:jazz year:1970..1979 -state:rejected. The state and artist parameters further restrict the results.", "schema": {"type": "string"}},
+          {"name": "sort", "in": "query", "description": "Field to sort by, in reverse order if it starts with '-'.", "schema": {"type": "string", "enum": ["id", "folder", "title", "label", "year", "size", "snatched", "state", "-id", "-folder", "-title", "-label", "-year", "-size", "-snatched", "-state"]}}
+        ],
+        "responses": {
+          "200": {"description": "Download entries", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Download"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/downloads/{id}": {
+      "get": {
+        "summary": "Download entry, with its tracker metadata",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "responses": {
+          "200": {"description": "Download entry", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Download"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/downloads/{id}/state": {
+      "put": {
+        "summary": "Change the state of a download entry",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "object", "required": ["state"], "properties": {"state": {"$ref": "#/components/schemas/DownloadState"}}}}}},
+        "responses": {
+          "200": {"description": "Updated download entry", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Download"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/filters": {
+      "get": {
+        "summary": "Configured filters",
+        "responses": {
+          "200": {"description": "Filters", "content": {"application/json": {"schema": {"type": "array", "items": {"type": "object"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/filters/test/{tracker}/{id}": {
+      "get": {
+        "summary": "Test a torrent against all filters",
+        "description": "Filters are checked as if the torrent had just been announced, including the snatch history for filters that do not allow duplicates or want a single torrent per group.",
+        "parameters": [{"$ref": "#/components/parameters/Tracker"}, {"$ref": "#/components/parameters/ID"}],
+        "responses": {
+          "200": {"description": "Filter results", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/FilterResult"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/snatch": {
+      "post": {
+        "summary": "Snatch a torrent by ID",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SnatchRequest"}}}},
+        "responses": {
+          "201": {"description": "Snatched release", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Release"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearer": {"type": "http", "scheme": "bearer"},
+      "header": {"type": "apiKey", "in": "header", "name": "X-Varroa-Token"}
+    },
+    "parameters": {
+      "ID": {"name": "id", "in": "path", "required": true, "schema": {"type": "integer"}},
+      "Tracker": {"name": "tracker", "in": "path", "required": true, "schema": {"type": "string"}},
+      "Limit": {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 1000, "default": 50}}
+    },
+    "responses": {
+      "Error": {"description": "Error", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "properties": {"error": {"type": "object", "properties": {"status": {"type": "integer"}, "message": {"type": "string"}}}}
+      },
+      "Status": {
+        "type": "object",
+        "properties": {
+          "version": {"type": "string"},
+          "start_time": {"type": "string", "format": "date-time"},
+          "uptime": {"type": "string"},
+          "autosnatch": {"type": "array", "items": {"type": "object", "properties": {"tracker": {"type": "string"}, "enabled": {"type": "boolean"}}}},
+          "subsystems": {"type": "object", "description": "Health of each subsystem: ok, stopped, or what went wrong", "additionalProperties": {"type": "string"}}
+        }
+      },
+      "Tracker": {
+        "type": "object",
+        "properties": {"name": {"type": "string"}, "url": {"type": "string"}, "autosnatch": {"type": "boolean"}, "stats": {"type": "boolean"}}
+      },
+      "StatsEntry": {
+        "type": "object",
+        "properties": {"Tracker": {"type": "string"}, "Up": {"type": "integer"}, "Down": {"type": "integer"}, "Ratio": {"type": "number"}, "Timestamp": {"type": "string", "format": "date-time"}}
+      },
+      "Release": {
+        "type": "object",
+        "properties": {"Tracker": {"type": "string"}, "TorrentID": {"type": "string"}, "Artists": {"type": "array", "items": {"type": "string"}}, "Title": {"type": "string"}, "Year": {"type": "integer"}, "Format": {"type": "string"}, "Quality": {"type": "string"}, "Source": {"type": "string"}, "Filter": {"type": "string"}, "Timestamp": {"type": "string", "format": "date-time"}}
+      },
+      "Event": {
+        "type": "object",
+        "properties": {"id": {"type": "integer"}, "type": {"type": "string", "enum": ["announce", "filter-match", "filter-reject", "snatch", "stats", "download-state", "notification", "auth-failure"]}, "tracker": {"type": "string"}, "time": {"type": "string", "format": "date-time"}, "message": {"type": "string"}, "data": {"type": "object"}}
+      },
+      "DownloadState": {"type": "string", "enum": ["unsorted", "accepted", "rejected"]},
+      "Download": {
+        "type": "object",
+        "properties": {"ID": {"type": "integer"}, "FolderName": {"type": "string"}, "state": {"$ref": "#/components/schemas/DownloadState"}, "Tracker": {"type": "array", "items": {"type": "string"}}, "TrackerID": {"type": "array", "items": {"type": "integer"}}, "Artists": {"type": "array", "items": {"type": "string"}}, "HasTrackerMetadata": {"type": "boolean"}, "Title": {"type": "string"}, "Tags": {"type": "array", "items": {"type": "string"}}, "RecordLabel": {"type": "string"}, "CatalogNumber": {"type": "string"}, "Year": {"type": "integer"}, "Format": {"type": "string"}, "Quality": {"type": "string"}, "Source": {"type": "string"}, "Size": {"type": "integer"}, "TimeSnatched": {"type": "integer"}, "metadata": {"type": "array", "items": {"type": "object"}}}
+      },
+      "FilterResult": {
+        "type": "object",
+        "properties": {"filter": {"type": "string"}, "matches": {"type": "boolean"}, "reason": {"type": "string", "description": "Why the filter would not snatch the torrent."}}
+      },
+      "SnatchRequest": {
+        "type": "object",
+        "required": ["tracker", "id"],
+        "properties": {"tracker": {"type": "string"}, "id": {"type": "string"}, "fltoken": {"type": "boolean"}}
+      }
+    }
+  }
+}
+`
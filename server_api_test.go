@@ -0,0 +1,157 @@
+package varroa
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIv1(t *testing.T) {
+	fmt.Println("+ Testing API v1...")
+	check := assert.New(t)
+
+	c, err := NewConfig("test/test_complete.yaml")
+	check.Nil(err)
+	e := NewEnvironment()
+	e.SetConfig(c)
+	rtr := mux.NewRouter()
+	registerAPIv1(rtr, e, nil, nil)
+
+	request := func(method, path, token string) (*httptest.ResponseRecorder, APIError) {
+		r := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		rtr.ServeHTTP(w, r)
+		var apiErr APIError
+		if w.Code >= 400 {
+			check.Nil(json.Unmarshal(w.Body.Bytes(), &apiErr))
+			check.Equal(w.Code, apiErr.Error.Status)
+		}
+		return w, apiErr
+	}
+
+	// the OpenAPI document is public
+	w, _ := request("GET", "/api/v1/openapi.json", "")
+	check.Equal(http.StatusOK, w.Code)
+	var doc map[string]interface{}
+	check.Nil(json.Unmarshal(w.Body.Bytes(), &doc))
+	check.Equal("3.0.3", doc["openapi"])
+
+	// authentication
+	w, apiErr := request("GET", "/api/v1/status", "")
+	check.Equal(http.StatusUnauthorized, w.Code)
+	check.Equal(errorNoToken, apiErr.Error.Message)
+	w, _ = request("GET", "/api/v1/status", "wrongtoken")
+	check.Equal(http.StatusForbidden, w.Code)
+	w, _ = request("GET", "/api/v1/status?token=thisisatoken", "")
+	check.Equal(http.StatusOK, w.Code)
+
+	// endpoints
+	w, _ = request("GET", "/api/v1/trackers", "thisisatoken")
+	check.Equal(http.StatusOK, w.Code)
+	var trackers []APITracker
+	check.Nil(json.Unmarshal(w.Body.Bytes(), &trackers))
+	check.Equal(3, len(trackers))
+	check.Equal(APITracker{Name: "blue", URL: "https://blue.ch", Autosnatch: true, Stats: true}, trackers[0])
+	check.Equal(APITracker{Name: "magenta", URL: "https://mangen.ta", Autosnatch: false, Stats: false}, trackers[2])
+
+	w, _ = request("GET", "/api/v1/stats/magenta", "thisisatoken")
+	check.Equal(http.StatusNotFound, w.Code)
+	w, _ = request("GET", "/api/v1/history?limit=0", "thisisatoken")
+	check.Equal(http.StatusBadRequest, w.Code)
+	w, _ = request("GET", "/api/v1/downloads", "thisisatoken")
+	check.Equal(http.StatusServiceUnavailable, w.Code)
+	w, _ = request("GET", "/api/v1/nothing", "thisisatoken")
+	check.Equal(http.StatusNotFound, w.Code)
+	w, _ = request("POST", "/api/v1/snatch", "thisisatoken")
+	check.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestAPIv1Reload(t *testing.T) {
+	fmt.Println("+ Testing API v1 during configuration reloads...")
+	check := assert.New(t)
+
+	c, err := NewConfig("test/test_complete.yaml")
+	check.Nil(err)
+	e := NewEnvironment()
+	e.SetConfig(c)
+	rtr := mux.NewRouter()
+	registerAPIv1(rtr, e, nil, nil)
+
+	// reloading while requests are being authenticated
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			reloaded, err := NewConfig("test/test_complete.yaml")
+			check.Nil(err)
+			e.swapConfiguration(reloaded)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		r := httptest.NewRequest("GET", "/api/v1/trackers", nil)
+		r.Header.Set("Authorization", "Bearer thisisatoken")
+		w := httptest.NewRecorder()
+		rtr.ServeHTTP(w, r)
+		check.Equal(http.StatusOK, w.Code)
+	}
+	wg.Wait()
+}
+
+func TestAPIv1Downloads(t *testing.T) {
+	fmt.Println("+ Testing API v1 downloads...")
+	check := assert.New(t)
+
+	c, err := NewConfig("test/test_complete.yaml")
+	check.Nil(err)
+	e := NewEnvironment()
+	e.SetConfig(c)
+	downloads, cleanup := newTestDownloadsDB(t)
+	defer cleanup()
+	check.Nil(writeFakeDownload(downloads.root, "First", 1, "Miles Davis"))
+	check.Nil(writeFakeDownload(downloads.root, "Second", 2, "Miles Davis"))
+	check.Nil(writeFakeDownload(downloads.root, "Third", 3, "John Coltrane"))
+	check.Nil(downloads.Scan())
+	second, err := downloads.FindByFolderName("Second")
+	check.Nil(err)
+	_, err = downloads.SetState(second.ID, stateAccepted)
+	check.Nil(err)
+	rtr := mux.NewRouter()
+	registerAPIv1(rtr, e, downloads, nil)
+
+	list := func(query string) []string {
+		r := httptest.NewRequest("GET", "/api/v1/downloads?"+query, nil)
+		r.Header.Set("Authorization", "Bearer thisisatoken")
+		w := httptest.NewRecorder()
+		rtr.ServeHTTP(w, r)
+		check.Equal(http.StatusOK, w.Code, query)
+		var entries []APIDownload
+		check.Nil(json.Unmarshal(w.Body.Bytes(), &entries))
+		var names []string
+		for _, dl := range entries {
+			names = append(names, dl.FolderName)
+		}
+		return names
+	}
+	// the artist and state filters apply the same way, whether there is a search query or not
+	check.Equal([]string{"First", "Second"}, list("artist=miles+davis"))
+	check.Equal([]string{"Second"}, list("artist=miles+davis&state="+DownloadFolderStates[stateAccepted]))
+	check.Equal([]string{"Second", "First"}, list("artist=miles+davis&sort=-id"))
+	check.Equal([]string{"Second"}, list("q=year:1975&state="+DownloadFolderStates[stateAccepted]))
+	check.Equal([]string{"Third"}, list("q=year:1975&artist=JOHN+COLTRANE"))
+
+	r := httptest.NewRequest("GET", "/api/v1/downloads?q=year:1975&state=nope", nil)
+	r.Header.Set("Authorization", "Bearer thisisatoken")
+	w := httptest.NewRecorder()
+	rtr.ServeHTTP(w, r)
+	check.Equal(http.StatusBadRequest, w.Code)
+}
@@ -92,12 +92,71 @@ const (
 			{{ if .HasTrackerMetadata}}
 			<li>
 				[{{.ShortState}}] <a href="downloads/{{.ID}}">{{.FolderName}}</a>
+				{{ if $.AllowSorting }}<a href="/downloads/{{.ID}}/sort">(sort)</a>{{ end }}
 			</li>
 			{{ end }}
 		{{end}}
 		</ul>
 `
 	htlmDownloadsInfoTemplate = `
+		{{ if .AllowSorting }}<p><a class="pure-button" href="/downloads/{{.DownloadID}}/sort">Sort this download</a></p>{{ end }}
+		{{.DownloadInfo}}
+		{{ if .Files }}
+		<h2 class="content-subhead">Files</h2>
+		<table class="stats-table" summary="Files">
+			<thead>
+				<tr>
+					<th>File</th>
+					<th>Size</th>
+					<th></th>
+				</tr>
+			</thead>
+			<tbody>
+			{{range .Files}}
+				<tr>
+					<td><a href="{{.URL}}">{{.Name}}</a></td>
+					<td>{{.Size}}</td>
+					<td>{{ if .Audio }}<audio controls preload="none" src="{{.URL}}"></audio>{{ end }}</td>
+				</tr>
+			{{end}}
+			</tbody>
+		</table>
+		{{ end }}
+`
+	htlmDownloadsSortTemplate = `
+		<h1>Sorting download #{{.SortForm.ID}}</h1>
+		<p>{{.SortForm.FolderName}} [{{.SortForm.State}}]</p>
+		{{ if .SortForm.Message }}<p><b>{{.SortForm.Message}}</b></p>{{ end }}
+		<form class="pure-form pure-form-stacked" method="POST" action="/downloads/{{.SortForm.ID}}/sort">
+			<fieldset>
+				<label for="main_artist">Main artist</label>
+				<select id="main_artist" name="main_artist">
+				{{range .SortForm.Options.MainArtists}}
+					<option {{if eq . $.SortForm.Options.Decision.MainArtist}}selected{{end}}>{{.}}</option>
+				{{end}}
+				</select>
+				<label for="main_artist_alias">Main artist alias</label>
+				<select id="main_artist_alias" name="main_artist_alias">
+				{{range .SortForm.Options.MainArtistAliases}}
+					<option {{if eq . $.SortForm.Options.Decision.MainArtistAlias}}selected{{end}}>{{.}}</option>
+				{{end}}
+				</select>
+				<label for="category">Category</label>
+				<select id="category" name="category">
+				{{range .SortForm.Options.Categories}}
+					<option {{if eq . $.SortForm.Options.Decision.Category}}selected{{end}}>{{.}}</option>
+				{{end}}
+				</select>
+				{{ if .SortForm.CanAddToPlaylists }}
+				<label for="playlists" class="pure-checkbox"><input id="playlists" name="playlists" type="checkbox" value="true" {{if .SortForm.Options.Decision.AddToPlaylists}}checked{{end}}> Add to daily/monthly playlists</label>
+				{{ end }}
+				<p>Exporting as: <code>{{.SortForm.Options.Path}}</code>{{ if .SortForm.Options.PathExists }} <b>(already exists in the library)</b>{{ end }}</p>
+				<button type="submit" name="action" value="preview" class="pure-button">Preview</button>
+				<button type="submit" name="action" value="accept" class="pure-button pure-button-primary">Accept and export</button>
+				<button type="submit" name="action" value="reject" class="pure-button">Reject</button>
+				<button type="submit" name="action" value="defer" class="pure-button">Defer</button>
+			</fieldset>
+		</form>
 		{{.DownloadInfo}}
 `
 )
@@ -117,6 +176,16 @@ type HTMLStats struct {
 	Graphs       []HTMLLink
 }
 
+// HTMLSortForm has all the information for sorting a download.
+type HTMLSortForm struct {
+	ID                int
+	FolderName        string
+	State             string
+	Options           SortOptions
+	CanAddToPlaylists bool
+	Message           string
+}
+
 // HTMLIndex provides data for the htmlIndexTemplate.
 type HTMLIndex struct {
 	Title         string
@@ -128,6 +197,10 @@ type HTMLIndex struct {
 	ShowDownloads bool
 	Downloads     []DownloadEntry
 	DownloadInfo  template.HTML
+	DownloadID    int
+	Files         []HTMLFile
+	AllowSorting  bool
+	SortForm      HTMLSortForm
 	MainContent   template.HTML
 	URLFolder     string
 }
@@ -205,6 +278,23 @@ func (hi *HTMLIndex) SetMainContentDownloadsInfo() error {
 	return nil
 }
 
+func (hi *HTMLIndex) IndexDownloadsSort() ([]byte, error) {
+	t, err := template.New("index_dlsort").Parse(htlmDownloadsSortTemplate)
+	if err != nil {
+		return []byte{}, errors.Wrap(err, "Error generating template for index")
+	}
+	return hi.execute(t)
+}
+
+func (hi *HTMLIndex) SetMainContentDownloadsSort() error {
+	dlSort, err := hi.IndexDownloadsSort()
+	if err != nil {
+		return err
+	}
+	hi.MainContent = template.HTML(dlSort)
+	return nil
+}
+
 func (hi *HTMLIndex) MainPage() ([]byte, error) {
 	if len(hi.MainContent) == 0 {
 		return []byte{}, errors.New("Error generating template for index: no main content")
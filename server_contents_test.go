@@ -73,5 +73,25 @@ func TestHTMLIndex(t *testing.T) {
 	check.Equal(len(expected), len(d))
 	check.Equal(expected, d)
 
+	// sorting form
+	data.SortForm = HTMLSortForm{
+		ID:         12,
+		FolderName: "Artist - Title",
+		State:      "unsorted",
+		Options: SortOptions{
+			MainArtists:       []string{"Artist", "Other <Artist>"},
+			MainArtistAliases: []string{"Alias"},
+			Categories:        []string{"tag1", "tag2"},
+			Decision:          SortDecision{MainArtist: "Artist", MainArtistAlias: "Alias", Category: "tag2"},
+			Path:              "tag2/Alias/Title",
+		},
+	}
+	dataBytes, err = data.IndexDownloadsSort()
+	check.Nil(err)
+	check.Contains(string(dataBytes), `action="/downloads/12/sort"`)
+	check.Contains(string(dataBytes), "<option selected>tag2</option>")
+	check.Contains(string(dataBytes), "<option >Other &lt;Artist&gt;</option>")
+	check.NotContains(string(dataBytes), "playlists")
+
 	// ioutil.WriteFile("test/generated.html", d, 0666)
 }
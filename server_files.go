@@ -0,0 +1,206 @@
+package varroa
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/logthis"
+	"gitlab.com/catastrophic/assistance/music"
+)
+
+const (
+	errorOutsideDownloads = "path is outside of the download directories"
+	errorNotAFile         = "not a file"
+)
+
+// audioContentTypes of the files that can be played in the browser.
+var audioContentTypes = map[string]string{
+	music.FlacExt: "audio/flac",
+	music.Mp3Ext:  "audio/mpeg",
+	music.OpusExt: "audio/ogg",
+	".ogg":        "audio/ogg",
+	".m4a":        "audio/mp4",
+	music.WavExt:  "audio/wav",
+}
+
+// HTMLFile is a file of a download, linked from its page.
+type HTMLFile struct {
+	Name  string
+	URL   string
+	Size  string
+	Audio bool
+}
+
+// confinedPath joins a relative path to a base directory, refusing anything that would end up outside of it, including
+// through symbolic links.
+func confinedPath(base, rel string) (string, error) {
+	resolvedBase, err := filepath.EvalSymlinks(base)
+	if err != nil {
+		return "", err
+	}
+	resolvedBase, err = filepath.Abs(resolvedBase)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(base, filepath.FromSlash(rel)))
+	if err != nil {
+		return "", err
+	}
+	resolved, err = filepath.Abs(resolved)
+	if err != nil {
+		return "", err
+	}
+	inside, err := filepath.Rel(resolvedBase, resolved)
+	if err != nil || inside == "." || inside == ".." || strings.HasPrefix(inside, ".."+string(filepath.Separator)) {
+		return "", errors.New(errorOutsideDownloads)
+	}
+	return resolved, nil
+}
+
+// Folder of a download, in the download directory or in one of the additional sources.
+func (d *DownloadsDB) Folder(dl *DownloadEntry) (string, error) {
+	for _, root := range d.roots() {
+		if folder, err := confinedPath(root, dl.FolderName); err == nil {
+			if info, err := os.Stat(folder); err == nil && info.IsDir() {
+				return folder, nil
+			}
+		}
+	}
+	return "", errors.New("could not find folder " + dl.FolderName)
+}
+
+// downloadFileURL for a file inside a download folder.
+func downloadFileURL(id int, rel string) string {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return fmt.Sprintf("/downloads/%d/files/%s", id, strings.Join(parts, "/"))
+}
+
+// downloadFiles in a download folder, with their sizes.
+func downloadFiles(dl *DownloadEntry, folder string) ([]HTMLFile, error) {
+	var files []HTMLFile
+	err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(folder, path)
+		if err != nil {
+			return err
+		}
+		_, isAudio := audioContentTypes[strings.ToLower(filepath.Ext(path))]
+		files = append(files, HTMLFile{Name: filepath.ToSlash(rel), URL: downloadFileURL(dl.ID, rel), Size: humanize.IBytes(uint64(info.Size())), Audio: isAudio})
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, err
+}
+
+// localCover saved with the tracker metadata of a download.
+func localCover(folder, tracker string) (string, error) {
+	covers, err := filepath.Glob(filepath.Join(folder, MetadataDir, tracker+" - "+trackerCoverFile+".*"))
+	if err != nil {
+		return "", err
+	}
+	if len(covers) == 0 {
+		return "", errors.New("no cover found for " + tracker)
+	}
+	return confinedPath(folder, filepath.Join(MetadataDir, filepath.Base(covers[0])))
+}
+
+// serveDownloadFile with support for range requests, so that audio files can be streamed.
+func serveDownloadFile(w http.ResponseWriter, r *http.Request, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		logthis.Info(errorNotAFile+": "+path, logthis.VERBOSE)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if contentType, ok := audioContentTypes[strings.ToLower(filepath.Ext(path))]; ok {
+		w.Header().Set("Content-Type", contentType)
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// metadataAuth protects the pages describing downloads with the web server user and password, if configured.
+func metadataAuth(e *Environment, h http.HandlerFunc) http.Handler {
+	if currentConfig().WebServer.Password == "" {
+		return h
+	}
+	return basicAuth(e, h)
+}
+
+// registerFilePages to get the covers and files of downloads, and stream their audio files.
+func registerFilePages(rtr *mux.Router, e *Environment, downloads *DownloadsDB) {
+	// finding the folder of the download in the request
+	downloadFolder := func(w http.ResponseWriter, r *http.Request) (string, bool) {
+		if !currentConfig().WebServer.ServeMetadata {
+			logthis.Error(errors.New("Error, not configured to serve metadata"), logthis.NORMAL)
+			w.WriteHeader(http.StatusUnauthorized)
+			return "", false
+		}
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return "", false
+		}
+		dl, err := downloads.FindByID(id)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return "", false
+		}
+		folder, err := downloads.Folder(&dl)
+		if err != nil {
+			logthis.Error(errors.Wrap(err, "Error finding download "+strconv.Itoa(id)), logthis.NORMAL)
+			w.WriteHeader(http.StatusNotFound)
+			return "", false
+		}
+		return folder, true
+	}
+	getCover := func(w http.ResponseWriter, r *http.Request) {
+		folder, ok := downloadFolder(w, r)
+		if !ok {
+			return
+		}
+		cover, err := localCover(folder, mux.Vars(r)["tracker"])
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		serveDownloadFile(w, r, cover)
+	}
+	getFile := func(w http.ResponseWriter, r *http.Request) {
+		folder, ok := downloadFolder(w, r)
+		if !ok {
+			return
+		}
+		path, err := confinedPath(folder, mux.Vars(r)["path"])
+		if err != nil {
+			logthis.Info("Refusing to serve "+mux.Vars(r)["path"]+": "+err.Error(), logthis.NORMAL)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		serveDownloadFile(w, r, path)
+	}
+	rtr.Handle("/downloads/{id:[0-9]+}/cover/{tracker}", metadataAuth(e, getCover)).Methods("GET", "HEAD")
+	rtr.Handle("/downloads/{id:[0-9]+}/files/{path:.+}", metadataAuth(e, getFile)).Methods("GET", "HEAD")
+}
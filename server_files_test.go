@@ -0,0 +1,75 @@
+package varroa
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeDownloadFiles(t *testing.T) {
+	fmt.Println("+ Testing Webserver/files...")
+	check := assert.New(t)
+
+	root, err := ioutil.TempDir("", "varroa_files")
+	check.Nil(err)
+	defer os.RemoveAll(root)
+	downloads := filepath.Join(root, "downloads")
+	release := filepath.Join(downloads, "Artist - Title #1")
+	check.Nil(os.MkdirAll(filepath.Join(release, MetadataDir), 0777))
+	check.Nil(os.MkdirAll(filepath.Join(release, "CD1"), 0777))
+	check.Nil(ioutil.WriteFile(filepath.Join(release, "CD1", "01. Track?.flac"), []byte("0123456789"), 0666))
+	check.Nil(ioutil.WriteFile(filepath.Join(release, MetadataDir, "blue - "+trackerCoverFile+".jpg"), []byte("cover"), 0666))
+	check.Nil(ioutil.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0666))
+	check.Nil(os.Symlink(filepath.Join(root, "secret.txt"), filepath.Join(release, "link.txt")))
+
+	// path traversal
+	path, err := confinedPath(release, "CD1/01. Track?.flac")
+	check.Nil(err)
+	check.Equal("01. Track?.flac", filepath.Base(path))
+	_, err = confinedPath(release, "../../secret.txt")
+	check.NotNil(err)
+	_, err = confinedPath(release, "CD1/../../../secret.txt")
+	check.NotNil(err)
+	_, err = confinedPath(release, "link.txt")
+	check.NotNil(err)
+	check.Equal(errorOutsideDownloads, err.Error())
+	_, err = confinedPath(release, ".")
+	check.NotNil(err)
+	_, err = confinedPath(downloads, "Artist - Title #1")
+	check.Nil(err)
+	_, err = confinedPath(downloads, "..")
+	check.NotNil(err)
+
+	// listing
+	dl := &DownloadEntry{ID: 12, FolderName: "Artist - Title #1"}
+	files, err := downloadFiles(dl, release)
+	check.Nil(err)
+	check.Equal(3, len(files))
+	check.Equal(HTMLFile{Name: "CD1/01. Track?.flac", URL: "/downloads/12/files/CD1/01.%20Track%3F.flac", Size: "10 B", Audio: true}, files[0])
+	check.False(files[1].Audio)
+
+	// covers
+	cover, err := localCover(release, "blue")
+	check.Nil(err)
+	check.Equal("blue - "+trackerCoverFile+".jpg", filepath.Base(cover))
+	_, err = localCover(release, "purple")
+	check.NotNil(err)
+
+	// range requests
+	r := httptest.NewRequest("GET", files[0].URL, nil)
+	r.Header.Set("Range", "bytes=2-5")
+	w := httptest.NewRecorder()
+	serveDownloadFile(w, r, filepath.Join(release, "CD1", "01. Track?.flac"))
+	check.Equal(http.StatusPartialContent, w.Code)
+	check.Equal("2345", w.Body.String())
+	check.Equal("audio/flac", w.Header().Get("Content-Type"))
+	w = httptest.NewRecorder()
+	serveDownloadFile(w, httptest.NewRequest("GET", "/", nil), release)
+	check.Equal(http.StatusNotFound, w.Code)
+}
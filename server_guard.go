@@ -0,0 +1,274 @@
+package varroa
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/logthis"
+)
+
+const (
+	endpointsDownloads = "downloads"
+	endpointsAPI       = "api"
+	endpointsPages     = "pages"
+
+	defaultRateLimitPerMinute = 120
+	defaultMaxFailedAuth      = 5
+	// lockouts double in length every time, up to the maximum
+	firstLockout   = time.Minute
+	maximumLockout = 24 * time.Hour
+	// clients are forgotten once they have been idle for a while
+	guardPruneInterval = 10 * time.Minute
+	guardIdleClient    = 24 * time.Hour
+
+	errorNotAllowedNetwork = "address not allowed"
+	errorTooManyRequests   = "too many requests"
+	errorLockedOut         = "locked out after too many failed authentications"
+	errorBasicAuth         = "wrong user or password"
+)
+
+// guardClient is what the guard knows about a remote address.
+type guardClient struct {
+	windowStart time.Time
+	requests    int
+	failures    int
+	lockouts    int
+	lockedUntil time.Time
+	lastSeen    time.Time
+}
+
+// webServerGuard rate limits requests by remote address, locks out addresses after repeated authentication failures,
+// and only lets allowed networks reach each group of endpoints.
+type webServerGuard struct {
+	sync.Mutex
+	e             *Environment
+	ratePerMinute int
+	maxFailures   int
+	allowed       map[string][]*net.IPNet
+	clients       map[string]*guardClient
+	lastPrune     time.Time
+	now           func() time.Time
+	notify        func(msg string)
+}
+
+// guardKey is the request context key for the guard.
+type guardKey struct{}
+
+func newWebServerGuard(e *Environment) *webServerGuard {
+	conf := currentConfig()
+	g := &webServerGuard{e: e, ratePerMinute: conf.WebServer.RateLimit, maxFailures: conf.WebServer.MaxFailedAuth, clients: make(map[string]*guardClient), now: time.Now}
+	g.notify = func(msg string) {
+		e.lifecycle.Go(func() {
+			if err := NotifyWithData(msg, FullName, "error", &NotificationData{Event: notificationEventAuthFailure}, e); err != nil {
+				logthis.Error(err, logthis.NORMAL)
+			}
+		})
+	}
+	if networks := conf.WebServer.AllowedNetworks; networks != nil {
+		g.allowed = map[string][]*net.IPNet{endpointsDownloads: networks.downloads, endpointsAPI: networks.api, endpointsPages: networks.pages}
+	}
+	return g
+}
+
+// endpointGroup of a request path, for the allowed networks.
+func endpointGroup(path string) string {
+	switch {
+	case strings.HasPrefix(path, apiV1Prefix+"/"):
+		return endpointsAPI
+	case path == "/ws" || path == "/dl.pywa" || strings.HasPrefix(path, "/get/") || strings.HasPrefix(path, "/getStats/"):
+		return endpointsDownloads
+	}
+	return endpointsPages
+}
+
+// clientIP of a request. Headers set by proxies are not trusted.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// client for an address, must be called with the lock.
+func (g *webServerGuard) client(ip string) *guardClient {
+	now := g.now()
+	if now.Sub(g.lastPrune) > guardPruneInterval {
+		for address, c := range g.clients {
+			if now.Sub(c.lastSeen) > guardIdleClient && now.After(c.lockedUntil) {
+				delete(g.clients, address)
+			}
+		}
+		g.lastPrune = now
+	}
+	c, ok := g.clients[ip]
+	if !ok {
+		c = &guardClient{windowStart: now}
+		g.clients[ip] = c
+	}
+	c.lastSeen = now
+	return c
+}
+
+// isAllowed address for a group of endpoints.
+func (g *webServerGuard) isAllowed(group, ip string) bool {
+	networks, ok := g.allowed[group]
+	if !ok || len(networks) == 0 {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range networks {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// admit a new request from an address, or return how long it must wait.
+func (g *webServerGuard) admit(ip string) (time.Duration, error) {
+	g.Lock()
+	defer g.Unlock()
+	c := g.client(ip)
+	now := g.now()
+	if now.Before(c.lockedUntil) {
+		return c.lockedUntil.Sub(now), errors.New(errorLockedOut)
+	}
+	if g.ratePerMinute <= 0 {
+		return 0, nil
+	}
+	if now.Sub(c.windowStart) >= time.Minute {
+		c.windowStart = now
+		c.requests = 0
+	}
+	c.requests++
+	if c.requests > g.ratePerMinute {
+		return c.windowStart.Add(time.Minute).Sub(now), errors.New(errorTooManyRequests)
+	}
+	return 0, nil
+}
+
+// isLockedOut address.
+func (g *webServerGuard) isLockedOut(ip string) bool {
+	if g == nil {
+		return false
+	}
+	g.Lock()
+	defer g.Unlock()
+	c, ok := g.clients[ip]
+	return ok && g.now().Before(c.lockedUntil)
+}
+
+// failed authentication from an address, locking it out for longer every time it fails too often.
+func (g *webServerGuard) failed(ip, path, reason string) {
+	msg := fmt.Sprintf("Failed authentication from %s on %s: %s", ip, path, reason)
+	logthis.Info(msg, logthis.NORMAL)
+	if g == nil {
+		return
+	}
+	g.Lock()
+	c := g.client(ip)
+	c.failures++
+	var lockout time.Duration
+	if g.maxFailures > 0 && c.failures >= g.maxFailures {
+		lockout = firstLockout << uint(c.lockouts)
+		if lockout > maximumLockout || lockout <= 0 {
+			lockout = maximumLockout
+		}
+		c.lockedUntil = g.now().Add(lockout)
+		c.lockouts++
+		c.failures = 0
+	}
+	g.Unlock()
+
+	data := EventAuthFailureData{Address: ip, Path: path, Reason: reason}
+	if lockout != 0 {
+		data.Lockout = lockout.String()
+	}
+	g.e.events.Publish(eventAuthFailure, "", msg, data)
+	if lockout != 0 {
+		lockedMsg := fmt.Sprintf("Locked out %s for %s after %d failed authentications.", ip, lockout, g.maxFailures)
+		logthis.Info(lockedMsg, logthis.NORMAL)
+		g.notify(lockedMsg)
+	}
+}
+
+// succeeded authentication from an address, forgetting its previous failures.
+func (g *webServerGuard) succeeded(ip string) {
+	if g == nil {
+		return
+	}
+	g.Lock()
+	defer g.Unlock()
+	if c, ok := g.clients[ip]; ok {
+		c.failures = 0
+		c.lockouts = 0
+	}
+}
+
+// protect all requests, checking their address is allowed, not locked out, and not sending too many requests.
+func (g *webServerGuard) protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if !g.isAllowed(endpointGroup(r.URL.Path), ip) {
+			logthis.Info(errorNotAllowedNetwork+": "+ip+" on "+r.URL.Path, logthis.VERBOSE)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if wait, err := g.admit(ip); err != nil {
+			logthis.Info(err.Error()+": "+ip+" on "+r.URL.Path, logthis.VERBOSE)
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), guardKey{}, g)))
+	})
+}
+
+// requestGuard protecting a request, if any.
+func requestGuard(r *http.Request) *webServerGuard {
+	if g, ok := r.Context().Value(guardKey{}).(*webServerGuard); ok {
+		return g
+	}
+	return nil
+}
+
+// authFailed for a request, counting toward a lockout of its address.
+func authFailed(r *http.Request, reason string) {
+	requestGuard(r).failed(clientIP(r), r.URL.Path, reason)
+}
+
+// authSucceeded for a request.
+func authSucceeded(r *http.Request) {
+	requestGuard(r).succeeded(clientIP(r))
+}
+
+// basicAuth protects a page with the web server user and password, counting failures toward a lockout.
+func basicAuth(e *Environment, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		conf := currentConfig()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(conf.WebServer.User)) != 1 || subtle.ConstantTimeCompare([]byte(password), []byte(conf.WebServer.Password)) != 1 {
+			// browsers first try without credentials
+			if ok {
+				authFailed(r, errorBasicAuth)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+FullName+`"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		authSucceeded(r)
+		next.ServeHTTP(w, r)
+	})
+}
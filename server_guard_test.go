@@ -0,0 +1,101 @@
+package varroa
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebServerGuard(t *testing.T) {
+	fmt.Println("+ Testing Webserver/guard...")
+	check := assert.New(t)
+
+	c, err := NewConfig("test/test_complete.yaml")
+	check.Nil(err)
+	e := NewEnvironment()
+	e.SetConfig(c)
+	now := time.Now()
+	guard := newWebServerGuard(e)
+	guard.ratePerMinute = 10
+	guard.now = func() time.Time { return now }
+	var notifications []string
+	guard.notify = func(msg string) { notifications = append(notifications, msg) }
+	sub, _ := e.events.Subscribe([]string{eventAuthFailure}, nil, false, 0)
+	defer e.events.Unsubscribe(sub)
+
+	rtr := mux.NewRouter()
+	rtr.Use(guard.protect)
+	rtr.Handle("/", basicAuth(e, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+	registerAPIv1(rtr, e, nil, nil)
+	request := func(path, address, user, password string) int {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = address + ":4321"
+		if user != "" {
+			r.SetBasicAuth(user, password)
+		}
+		w := httptest.NewRecorder()
+		rtr.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// groups of endpoints
+	check.Equal(endpointsAPI, endpointGroup("/api/v1/status"))
+	check.Equal(endpointsDownloads, endpointGroup("/get/1234"))
+	check.Equal(endpointsDownloads, endpointGroup("/ws"))
+	check.Equal(endpointsPages, endpointGroup("/downloads/12"))
+
+	// allowed networks
+	check.Equal(http.StatusForbidden, request("/api/v1/status?token=thisisatoken", "8.8.8.8", "", ""))
+	check.Equal(http.StatusUnauthorized, request("/api/v1/status", "10.1.2.3", "", ""))
+	check.Equal(http.StatusOK, request("/api/v1/status?token=thisisatoken", "10.1.2.3", "", ""))
+	check.Equal(http.StatusOK, request("/api/v1/status?token=thisisatoken", "192.168.1.12", "", ""))
+	check.Equal(http.StatusOK, request("/", "8.8.8.8", "httpuser", "httppassword"))
+
+	// progressive lockouts
+	check.Equal(http.StatusUnauthorized, request("/", "1.2.3.4", "", ""))
+	check.Equal(http.StatusUnauthorized, request("/", "1.2.3.4", "httpuser", "wrong"))
+	check.Equal(http.StatusForbidden, request("/api/v1/status?token=wrong", "10.0.0.1", "", ""))
+	check.Equal(http.StatusUnauthorized, request("/", "1.2.3.4", "httpuser", "wrong"))
+	// the correct password resets failures
+	check.Equal(http.StatusOK, request("/", "1.2.3.4", "httpuser", "httppassword"))
+	for i := 0; i < 3; i++ {
+		check.Equal(http.StatusUnauthorized, request("/", "1.2.3.4", "httpuser", "wrong"))
+	}
+	check.True(guard.isLockedOut("1.2.3.4"))
+	check.False(guard.isLockedOut("10.0.0.1"))
+	check.Equal(http.StatusTooManyRequests, request("/", "1.2.3.4", "httpuser", "httppassword"))
+	check.Equal(http.StatusOK, request("/", "1.2.3.5", "httpuser", "httppassword"))
+	now = now.Add(firstLockout + time.Second)
+	for i := 0; i < 3; i++ {
+		check.Equal(http.StatusUnauthorized, request("/", "1.2.3.4", "httpuser", "wrong"))
+	}
+	check.Equal(now.Add(2*firstLockout), guard.clients["1.2.3.4"].lockedUntil)
+	failures := make(map[string]int)
+	var locked int
+	for i := 0; i < 9; i++ {
+		data := (<-sub.Events).Data.(EventAuthFailureData)
+		failures[data.Address]++
+		if data.Lockout != "" {
+			locked++
+		}
+	}
+	check.Equal(map[string]int{"1.2.3.4": 8, "10.0.0.1": 1}, failures)
+	check.Equal(2, locked)
+	check.Equal([]string{"Locked out 1.2.3.4 for 1m0s after 3 failed authentications.", "Locked out 1.2.3.4 for 2m0s after 3 failed authentications."}, notifications)
+
+	// rate limiting
+	now = now.Add(time.Hour)
+	for i := 0; i < 10; i++ {
+		check.Equal(http.StatusOK, request("/", "5.6.7.8", "httpuser", "httppassword"))
+	}
+	check.Equal(http.StatusTooManyRequests, request("/", "5.6.7.8", "httpuser", "httppassword"))
+	now = now.Add(time.Minute)
+	check.Equal(http.StatusOK, request("/", "5.6.7.8", "httpuser", "httppassword"))
+}
@@ -1,14 +1,17 @@
 package varroa
 
 import (
+	"fmt"
 	"html/template"
 	"io/ioutil"
+	"net/url"
 	"path/filepath"
 	"strconv"
 
 	"github.com/asdine/storm"
 	"github.com/pkg/errors"
 	"github.com/russross/blackfriday"
+	"gitlab.com/catastrophic/assistance/fs"
 	"gitlab.com/catastrophic/assistance/logthis"
 )
 
@@ -133,6 +136,7 @@ func (sc *ServerPage) update(downloads *DownloadsDB) {
 
 	// rebuilding
 	sc.index.Stats = []HTMLStats{}
+	sc.index.AllowSorting = conf.webserverSorting
 	if conf.webserverMetadata && downloads != nil {
 		// fetch all dl entries
 		if err := downloads.db.DB.All(&sc.index.Downloads); err != nil {
@@ -204,14 +208,15 @@ func (sc *ServerPage) Index(downloads *DownloadsDB) ([]byte, error) {
 // SaveIndex is only used for Gitlab pages, so it never shows Downloads and will need to know the repository name (ie Pages subfolder).
 func (sc *ServerPage) SaveIndex(e *Environment, file string) error {
 	// building index
-	if e.config.gitlabPagesConfigured {
-		e.serverData.index.URLFolder = e.config.GitlabPages.Folder + "/"
+	conf := currentConfig()
+	if conf.gitlabPagesConfigured {
+		e.serverData.index.URLFolder = conf.GitlabPages.Folder + "/"
 	}
 	data, err := sc.Index(nil)
 	if err != nil {
 		return err
 	}
-	if e.config.gitlabPagesConfigured {
+	if conf.gitlabPagesConfigured {
 		e.serverData.index.URLFolder = ""
 	}
 	// write to file
@@ -244,14 +249,14 @@ func (sc *ServerPage) DownloadsInfo(e *Environment, downloads *DownloadsDB, id s
 		return []byte{}, errors.New("Error finding download ID " + id + " in db.")
 	}
 	// get description
-	sc.index.DownloadInfo = ""
-	if dl.HasTrackerMetadata {
-		// TODO if more than 1 tracker, make things prettier
-		for _, t := range dl.Tracker {
-			sc.index.DownloadInfo += template.HTML(blackfriday.Run(dl.getDescription(e.config.General.DownloadDir, t, true)))
-		}
-	} else {
-		sc.index.DownloadInfo = template.HTML(dl.RawShortString())
+	sc.index.DownloadID = dl.ID
+	sc.index.DownloadInfo = downloadInfoHTML(e, &dl)
+	// listing files
+	sc.index.Files = []HTMLFile{}
+	if folder, err := downloads.Folder(&dl); err != nil {
+		logthis.Error(err, logthis.NORMAL)
+	} else if sc.index.Files, err = downloadFiles(&dl, folder); err != nil {
+		logthis.Error(errors.Wrap(err, "Error listing files of download "+id), logthis.NORMAL)
 	}
 
 	// getting info
@@ -261,3 +266,47 @@ func (sc *ServerPage) DownloadsInfo(e *Environment, downloads *DownloadsDB, id s
 	// building and returning complete page
 	return sc.index.MainPage()
 }
+
+// DownloadsSort shows the sorting options for a download.
+func (sc *ServerPage) DownloadsSort(e *Environment, dl *DownloadEntry, options SortOptions, message string) ([]byte, error) {
+	// updating
+	sc.update(nil)
+	sc.index.DownloadID = dl.ID
+	sc.index.DownloadInfo = downloadInfoHTML(e, dl)
+	sc.index.Files = []HTMLFile{}
+	sc.index.SortForm = HTMLSortForm{
+		ID:                dl.ID,
+		FolderName:        dl.FolderName,
+		State:             DownloadFolderStates[dl.State],
+		Options:           options,
+		CanAddToPlaylists: currentConfig().playlistDirectoryConfigured,
+		Message:           message,
+	}
+	if err := sc.index.SetMainContentDownloadsSort(); err != nil {
+		return []byte{}, errors.Wrap(err, "Error generating downloads sort page")
+	}
+	// building and returning complete page
+	return sc.index.MainPage()
+}
+
+// downloadInfoHTML describes a download with its tracker metadata, if available.
+func downloadInfoHTML(e *Environment, dl *DownloadEntry) template.HTML {
+	if !dl.HasTrackerMetadata {
+		return template.HTML(template.HTMLEscapeString(dl.RawShortString()))
+	}
+	var info template.HTML
+	downloadDir := currentConfig().General.DownloadDir
+	// TODO if more than 1 tracker, make things prettier
+	for _, t := range dl.Tracker {
+		md, err := dl.getMetadata(downloadDir, t)
+		if err != nil {
+			continue
+		}
+		// showing the cover saved with the metadata rather than the one hosted by the tracker
+		if fs.FileExists(md.coverPath(filepath.Join(downloadDir, dl.FolderName))) {
+			md.CoverURL = fmt.Sprintf("/downloads/%d/cover/%s", dl.ID, url.PathEscape(t))
+		}
+		info += template.HTML(blackfriday.Run([]byte(md.HTMLDescription())))
+	}
+	return info
+}
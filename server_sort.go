@@ -0,0 +1,100 @@
+package varroa
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/logthis"
+)
+
+const (
+	sortActionPreview = "preview"
+	sortActionAccept  = "accept"
+	sortActionReject  = "reject"
+	sortActionDefer   = "defer"
+)
+
+// registerSortPages to sort downloads from the web interface, behind basic authentication.
+func registerSortPages(rtr *mux.Router, e *Environment, downloads *DownloadsDB) {
+	sortPage := func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		dl, err := downloads.FindByID(id)
+		if err != nil {
+			logthis.Error(errors.Wrap(err, "Error finding download "+strconv.Itoa(id)), logthis.NORMAL)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		decision := SortDecision{AddToPlaylists: true}
+		var message string
+		if r.Method == http.MethodPost {
+			if !isSameOrigin(r) {
+				logthis.Info("Refusing to sort download from another origin.", logthis.NORMAL)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			decision = SortDecision{
+				MainArtist:      r.PostFormValue("main_artist"),
+				MainArtistAlias: r.PostFormValue("main_artist_alias"),
+				Category:        r.PostFormValue("category"),
+				AddToPlaylists:  r.PostFormValue("playlists") == "true",
+			}
+			switch r.PostFormValue("action") {
+			case sortActionPreview:
+			case sortActionAccept:
+				decision.State = stateAccepted
+			case sortActionReject:
+				decision.State = stateRejected
+			case sortActionDefer:
+				decision.State = stateUnsorted
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if r.PostFormValue("action") != sortActionPreview {
+				if _, err = downloads.Decide(e, id, decision); err == nil {
+					http.Redirect(w, r, fmt.Sprintf("/downloads/%d", id), http.StatusSeeOther)
+					return
+				}
+				logthis.Error(errors.Wrap(err, "Error sorting download "+strconv.Itoa(id)), logthis.NORMAL)
+				message = "Error: " + err.Error()
+			}
+		}
+		options, err := dl.SortOptions(downloads.root, currentConfig(), decision)
+		if err != nil {
+			logthis.Error(errors.Wrap(err, "Error getting sort options for download "+strconv.Itoa(id)), logthis.NORMAL)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		response, err := e.serverData.DownloadsSort(e, &dl, options, message)
+		if err != nil {
+			logthis.Error(errors.Wrap(err, "Error generating sort page"), logthis.NORMAL)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(response)
+	}
+	rtr.Handle("/downloads/{id:[0-9]+}/sort", basicAuth(e, http.HandlerFunc(sortPage))).Methods("GET", "POST")
+}
+
+// isSameOrigin checks a form was posted from a page served by varroa.
+// Requests without Origin or Referer headers are rejected, they cannot be told apart from forged ones.
+func isSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
@@ -0,0 +1,34 @@
+package varroa
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSameOrigin(t *testing.T) {
+	fmt.Println("+ Testing Webserver/same origin...")
+	check := assert.New(t)
+
+	for _, c := range []struct {
+		origin, referer string
+		expected        bool
+	}{
+		{"https://varroa.example:8080", "", true},
+		{"", "https://varroa.example:8080/downloads/12/sort", true},
+		{"https://evil.example", "https://varroa.example:8080/downloads/12/sort", false},
+		{"", "https://evil.example/varroa.example:8080", false},
+		{"", "", false},
+	} {
+		r := httptest.NewRequest("POST", "https://varroa.example:8080/downloads/12/sort", nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if c.referer != "" {
+			r.Header.Set("Referer", c.referer)
+		}
+		check.Equal(c.expected, isSameOrigin(r), c)
+	}
+}
@@ -0,0 +1,125 @@
+package varroa
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/logthis"
+	"gitlab.com/catastrophic/assistance/strslice"
+)
+
+// certificateReloader serves a certificate, reloading it when its files change on disk.
+type certificateReloader struct {
+	sync.RWMutex
+	certFile    string
+	keyFile     string
+	certificate *tls.Certificate
+}
+
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	cr := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	return cr, cr.reload()
+}
+
+// reload the certificate, keeping the previous one if the files are not valid.
+func (cr *certificateReloader) reload() error {
+	certificate, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "could not load certificate "+cr.certFile)
+	}
+	cr.Lock()
+	cr.certificate = &certificate
+	cr.Unlock()
+	return nil
+}
+
+// GetCertificate for tls.Config.
+func (cr *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.RLock()
+	defer cr.RUnlock()
+	return cr.certificate, nil
+}
+
+// watch the certificate and key files, reloading them when they are modified.
+// Directories are watched because renewals usually replace the files instead of writing to them.
+// Watching stops when the context is done.
+func (cr *certificateReloader) watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "could not watch certificate files")
+	}
+	files := []string{filepath.Clean(cr.certFile), filepath.Clean(cr.keyFile)}
+	directories := []string{filepath.Dir(files[0]), filepath.Dir(files[1])}
+	strslice.RemoveDuplicates(&directories)
+	for _, d := range directories {
+		if err := watcher.Add(d); err != nil {
+			watcher.Close()
+			return errors.Wrap(err, "could not watch certificate directory "+d)
+		}
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 || !strslice.Contains(files, filepath.Clean(event.Name)) {
+					continue
+				}
+				// the key and certificate may not be updated at the same time, an error is expected until both are
+				if err := cr.reload(); err != nil {
+					logthis.Info("Could not reload certificate yet: "+err.Error(), logthis.VERBOSE)
+				} else {
+					logthis.Info("Reloaded certificate "+cr.certFile, logthis.NORMAL)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logthis.Error(errors.Wrap(err, "Error watching certificate files"), logthis.NORMAL)
+			}
+		}
+	}()
+	return nil
+}
+
+// webServerTLSConfig with the user-provided or self-signed certificate, and client certificate checks if required.
+// The certificate is reloaded when renewed, until the context is done.
+func webServerTLSConfig(ctx context.Context, config *ConfigWebServer) (*tls.Config, error) {
+	certFile, keyFile := filepath.Join(certificatesDir, certificate), filepath.Join(certificatesDir, certificateKey)
+	if config.CertFile != "" {
+		certFile, keyFile = config.CertFile, config.KeyFile
+	}
+	reloader, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := reloader.watch(ctx); err != nil {
+		// still serving the current certificate
+		logthis.Error(err, logthis.NORMAL)
+	}
+	tlsConfig := &tls.Config{GetCertificate: reloader.GetCertificate, MinVersion: tls.VersionTLS12}
+	if config.ClientCAFile != "" {
+		ca, err := ioutil.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read client CA file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no valid certificate found in client CA file " + config.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
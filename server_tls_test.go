@@ -0,0 +1,104 @@
+package varroa
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCertificate generates a self-signed certificate for a hostname.
+func writeTestCertificate(certFile, keyFile, hostname string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func TestCertificateReloader(t *testing.T) {
+	fmt.Println("+ Testing Webserver/certificates...")
+	check := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "varroa_certs")
+	check.Nil(err)
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	check.Nil(writeTestCertificate(certFile, keyFile, "first.example.com"))
+
+	// loading
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err = newCertificateReloader(certFile, filepath.Join(dir, "nothing.pem"))
+	check.NotNil(err)
+	tlsConfig, err := webServerTLSConfig(ctx, &ConfigWebServer{CertFile: certFile, KeyFile: keyFile})
+	check.Nil(err)
+	check.Nil(tlsConfig.ClientCAs)
+	served, err := tlsConfig.GetCertificate(nil)
+	check.Nil(err)
+	leaf, err := x509.ParseCertificate(served.Certificate[0])
+	check.Nil(err)
+	check.Equal("first.example.com", leaf.Subject.CommonName)
+
+	// renewal
+	check.Nil(writeTestCertificate(certFile, keyFile, "second.example.com"))
+	var renewed bool
+	for i := 0; i < 50 && !renewed; i++ {
+		time.Sleep(20 * time.Millisecond)
+		served, err = tlsConfig.GetCertificate(nil)
+		check.Nil(err)
+		leaf, err = x509.ParseCertificate(served.Certificate[0])
+		check.Nil(err)
+		renewed = leaf.Subject.CommonName == "second.example.com"
+	}
+	check.True(renewed)
+
+	// not watching anymore once the context is done
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	check.Nil(writeTestCertificate(certFile, keyFile, "third.example.com"))
+	time.Sleep(200 * time.Millisecond)
+	served, err = tlsConfig.GetCertificate(nil)
+	check.Nil(err)
+	leaf, err = x509.ParseCertificate(served.Certificate[0])
+	check.Nil(err)
+	check.Equal("second.example.com", leaf.Subject.CommonName)
+
+	// client certificates
+	_, err = webServerTLSConfig(ctx, &ConfigWebServer{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile})
+	check.NotNil(err)
+	tlsConfig, err = webServerTLSConfig(ctx, &ConfigWebServer{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile})
+	check.Nil(err)
+	check.NotNil(tlsConfig.ClientCAs)
+}
@@ -0,0 +1,248 @@
+package varroa
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/logthis"
+	"gitlab.com/catastrophic/assistance/strslice"
+)
+
+const (
+	scopeReadStats     = "read-stats"
+	scopeReadDownloads = "read-downloads"
+	scopeSnatch        = "snatch"
+	scopeAdmin         = "admin"
+
+	tokenAddCommand    = "token-add"
+	tokenListCommand   = "token-list"
+	tokenRevokeCommand = "token-revoke"
+
+	legacyTokenName = "legacy"
+	apiTokenBytes   = 32
+
+	errorTokenUnknown = "unknown token"
+	errorTokenExpired = "token has expired"
+	errorTokenScope   = "token does not allow this operation"
+	errorTokenTracker = "token does not allow this tracker"
+)
+
+// KnownTokenScopes for API tokens, admin allows everything.
+var KnownTokenScopes = []string{scopeReadStats, scopeReadDownloads, scopeSnatch, scopeAdmin}
+
+// APIToken allows remote access to the daemon. Only the hash of the actual token is kept.
+type APIToken struct {
+	ID       int    `storm:"id,increment"`
+	Name     string `storm:"unique"`
+	Hash     string
+	Scopes   []string
+	Trackers []string
+	Created  time.Time
+	Expires  time.Time
+}
+
+// NewAPIToken with a random value, returned along with the token since it cannot be retrieved later.
+func NewAPIToken(name string, scopes, trackers []string, validDays int) (*APIToken, string, error) {
+	if name == "" || name == legacyTokenName {
+		return nil, "", errors.New("invalid token name")
+	}
+	if len(scopes) == 0 {
+		return nil, "", errors.New("at least one scope is required")
+	}
+	for _, s := range scopes {
+		if !strslice.Contains(KnownTokenScopes, s) {
+			return nil, "", errors.New("unknown scope " + s + ", must be among: " + strings.Join(KnownTokenScopes, ", "))
+		}
+	}
+	if validDays < 0 {
+		return nil, "", errors.New("invalid token validity")
+	}
+	value := make([]byte, apiTokenBytes)
+	if _, err := rand.Read(value); err != nil {
+		return nil, "", errors.Wrap(err, "could not generate token")
+	}
+	plaintext := hex.EncodeToString(value)
+	token := &APIToken{Name: name, Hash: hashAPIToken(plaintext), Scopes: scopes, Trackers: trackers, Created: time.Now()}
+	if validDays != 0 {
+		token.Expires = token.Created.AddDate(0, 0, validDays)
+	}
+	return token, plaintext, nil
+}
+
+// legacyAPIToken is the token from the configuration file, with all scopes.
+func legacyAPIToken() *APIToken {
+	return &APIToken{Name: legacyTokenName, Scopes: []string{scopeAdmin}}
+}
+
+func hashAPIToken(plaintext string) string {
+	hash := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(hash[:])
+}
+
+// IsExpired if an expiration date was set and is in the past.
+func (t *APIToken) IsExpired() bool {
+	return !t.Expires.IsZero() && time.Now().After(t.Expires)
+}
+
+// Allows a scope, for a tracker if one is given. An empty scope only checks the tracker.
+func (t *APIToken) Allows(scope, tracker string) error {
+	if scope != "" && !strslice.Contains(t.Scopes, scopeAdmin) && !strslice.Contains(t.Scopes, scope) {
+		return errors.New(errorTokenScope)
+	}
+	if tracker != "" && len(t.Trackers) != 0 && !strslice.Contains(t.Trackers, tracker) {
+		return errors.New(errorTokenTracker)
+	}
+	return nil
+}
+
+func (t *APIToken) String() string {
+	txt := fmt.Sprintf("%s: scopes %s", t.Name, strings.Join(t.Scopes, ", "))
+	if len(t.Trackers) != 0 {
+		txt += ", trackers " + strings.Join(t.Trackers, ", ")
+	}
+	txt += ", created " + t.Created.Format("2006-01-02")
+	if !t.Expires.IsZero() {
+		if t.IsExpired() {
+			txt += ", expired " + t.Expires.Format("2006-01-02")
+		} else {
+			txt += ", expires " + t.Expires.Format("2006-01-02")
+		}
+	}
+	return txt
+}
+
+// -----------------------------------------------------------------------------
+
+var tokensDB *TokensDB
+var onceTokensDB sync.Once
+
+// TokensDB keeps the API tokens.
+type TokensDB struct {
+	db *Database
+}
+
+func NewTokensDB(path string) (*TokensDB, error) {
+	var returnErr error
+	onceTokensDB.Do(func() {
+		db, err := NewDatabase(path)
+		if err != nil {
+			returnErr = errors.Wrap(err, "Error opening tokens database")
+			return
+		}
+		tokensDB = &TokensDB{db: db}
+		if returnErr = tokensDB.db.DB.Init(&APIToken{}); returnErr != nil {
+			return
+		}
+	})
+	return tokensDB, returnErr
+}
+
+func (tdb *TokensDB) Close() error {
+	return tdb.db.Close()
+}
+
+// Add a new token.
+func (tdb *TokensDB) Add(token *APIToken) error {
+	return errors.Wrap(tdb.db.DB.Save(token), "could not save token "+token.Name)
+}
+
+// All tokens.
+func (tdb *TokensDB) All() ([]APIToken, error) {
+	var tokens []APIToken
+	err := tdb.db.DB.All(&tokens)
+	return tokens, err
+}
+
+// Revoke a token by name.
+func (tdb *TokensDB) Revoke(name string) error {
+	var token APIToken
+	if err := tdb.db.DB.One("Name", name, &token); err != nil {
+		return errors.Wrap(err, "could not find token "+name)
+	}
+	return tdb.db.DB.DeleteStruct(&token)
+}
+
+// Authenticate a plaintext token, against the legacy token from the configuration and the hashed tokens.
+func (tdb *TokensDB) Authenticate(plaintext, legacy string) (*APIToken, error) {
+	if plaintext == "" {
+		return nil, errors.New(errorNoToken)
+	}
+	if legacy != "" && subtle.ConstantTimeCompare([]byte(plaintext), []byte(legacy)) == 1 {
+		return legacyAPIToken(), nil
+	}
+	if tdb == nil {
+		return nil, errors.New(errorTokenUnknown)
+	}
+	tokens, err := tdb.All()
+	if err != nil {
+		return nil, err
+	}
+	hash := []byte(hashAPIToken(plaintext))
+	var found *APIToken
+	// going through all tokens to avoid leaking information about which ones exist
+	for i := range tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(tokens[i].Hash)) == 1 {
+			found = &tokens[i]
+		}
+	}
+	if found == nil {
+		return nil, errors.New(errorTokenUnknown)
+	}
+	if found.IsExpired() {
+		return nil, errors.New(errorTokenExpired)
+	}
+	return found, nil
+}
+
+// ManageAPITokens from CLI orders, either directly or through the daemon.
+// The plaintext token never goes through here, only its hash.
+func ManageAPITokens(orders IncomingJSON) error {
+	tokens, err := NewTokensDB(DefaultTokensDB)
+	if err != nil {
+		return err
+	}
+	switch orders.Command {
+	case tokenAddCommand:
+		if len(orders.Args) != 1 {
+			return errors.New("invalid token")
+		}
+		var token APIToken
+		if err := json.Unmarshal([]byte(orders.Args[0]), &token); err != nil {
+			return errors.Wrap(err, "invalid token")
+		}
+		if err := tokens.Add(&token); err != nil {
+			return err
+		}
+		logthis.Info("API token "+token.Name+" created.", logthis.NORMAL)
+	case tokenListCommand:
+		list, err := tokens.All()
+		if err != nil {
+			return err
+		}
+		if len(list) == 0 {
+			logthis.Info("No API token found.", logthis.NORMAL)
+		}
+		for i := range list {
+			logthis.Info(list[i].String(), logthis.NORMAL)
+		}
+	case tokenRevokeCommand:
+		if len(orders.Args) != 1 {
+			return errors.New("invalid token name")
+		}
+		if err := tokens.Revoke(orders.Args[0]); err != nil {
+			return err
+		}
+		logthis.Info("API token "+orders.Args[0]+" revoked.", logthis.NORMAL)
+	default:
+		return errors.New("unknown token command " + orders.Command)
+	}
+	return nil
+}
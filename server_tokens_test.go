@@ -0,0 +1,125 @@
+package varroa
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPITokens(t *testing.T) {
+	fmt.Println("+ Testing API tokens...")
+	check := assert.New(t)
+
+	// creating tokens
+	_, _, err := NewAPIToken("", []string{scopeSnatch}, nil, 0)
+	check.NotNil(err)
+	_, _, err = NewAPIToken(legacyTokenName, []string{scopeSnatch}, nil, 0)
+	check.NotNil(err)
+	_, _, err = NewAPIToken("test", []string{}, nil, 0)
+	check.NotNil(err)
+	_, _, err = NewAPIToken("test", []string{"everything"}, nil, 0)
+	check.NotNil(err)
+
+	snatcher, snatcherValue, err := NewAPIToken("snatcher", []string{scopeSnatch}, []string{"blue"}, 0)
+	check.Nil(err)
+	check.Equal(64, len(snatcherValue))
+	check.Equal(hashAPIToken(snatcherValue), snatcher.Hash)
+	check.NotEqual(snatcherValue, snatcher.Hash)
+	check.True(snatcher.Expires.IsZero())
+	check.False(snatcher.IsExpired())
+	reader, readerValue, err := NewAPIToken("reader", []string{scopeReadStats, scopeReadDownloads}, nil, 30)
+	check.Nil(err)
+	check.NotEqual(snatcherValue, readerValue)
+	check.False(reader.IsExpired())
+	check.Equal(reader.Created.AddDate(0, 0, 30), reader.Expires)
+	expired, expiredValue, err := NewAPIToken("expired", []string{scopeAdmin}, nil, 1)
+	check.Nil(err)
+	expired.Expires = time.Now().Add(-time.Hour)
+	check.True(expired.IsExpired())
+
+	// scopes
+	check.Nil(snatcher.Allows(scopeSnatch, "blue"))
+	check.Nil(snatcher.Allows(scopeSnatch, ""))
+	check.Nil(snatcher.Allows("", "blue"))
+	check.Equal(errorTokenTracker, snatcher.Allows(scopeSnatch, "purple").Error())
+	check.Equal(errorTokenScope, snatcher.Allows(scopeReadStats, "blue").Error())
+	check.Nil(reader.Allows(scopeReadStats, "purple"))
+	check.NotNil(reader.Allows(scopeAdmin, ""))
+	check.Nil(legacyAPIToken().Allows(scopeAdmin, "purple"))
+	check.Nil(legacyAPIToken().Allows(scopeSnatch, "blue"))
+
+	// authentication without a database only knows the legacy token
+	var noDB *TokensDB
+	token, err := noDB.Authenticate("legacytoken", "legacytoken")
+	check.Nil(err)
+	check.Equal(legacyTokenName, token.Name)
+	_, err = noDB.Authenticate(snatcherValue, "legacytoken")
+	check.NotNil(err)
+	_, err = noDB.Authenticate("", "")
+	check.Equal(errorNoToken, err.Error())
+
+	// database
+	testDB := "test/tokens.db"
+	defer os.Remove(testDB)
+	tokens, err := NewTokensDB(testDB)
+	check.Nil(err)
+	defer tokens.Close()
+	check.Nil(tokens.Add(snatcher))
+	check.Nil(tokens.Add(reader))
+	check.Nil(tokens.Add(expired))
+	duplicate, _, err := NewAPIToken("reader", []string{scopeAdmin}, nil, 0)
+	check.Nil(err)
+	check.NotNil(tokens.Add(duplicate))
+	all, err := tokens.All()
+	check.Nil(err)
+	check.Equal(3, len(all))
+
+	token, err = tokens.Authenticate(snatcherValue, "legacytoken")
+	check.Nil(err)
+	check.Equal("snatcher", token.Name)
+	check.Equal([]string{"blue"}, token.Trackers)
+	token, err = tokens.Authenticate("legacytoken", "legacytoken")
+	check.Nil(err)
+	check.Equal(legacyTokenName, token.Name)
+	_, err = tokens.Authenticate(snatcher.Hash, "legacytoken")
+	check.Equal(errorTokenUnknown, err.Error())
+	_, err = tokens.Authenticate(expiredValue, "")
+	check.Equal(errorTokenExpired, err.Error())
+	_, err = tokens.Authenticate("", "")
+	check.Equal(errorNoToken, err.Error())
+
+	// scopes in the API
+	c, err := NewConfig("test/test_complete.yaml")
+	check.Nil(err)
+	e := NewEnvironment()
+	e.SetConfig(c)
+	rtr := mux.NewRouter()
+	registerAPIv1(rtr, e, nil, tokens)
+	request := func(method, path, token string) int {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set(apiTokenHeader, token)
+		w := httptest.NewRecorder()
+		rtr.ServeHTTP(w, r)
+		return w.Code
+	}
+	check.Equal(http.StatusForbidden, request("GET", "/api/v1/status", snatcherValue))
+	check.Equal(http.StatusOK, request("GET", "/api/v1/status", readerValue))
+	check.Equal(http.StatusOK, request("GET", "/api/v1/status", c.WebServer.Token))
+	check.Equal(http.StatusForbidden, request("GET", "/api/v1/status", expiredValue))
+	check.Equal(http.StatusForbidden, request("GET", "/api/v1/filters", readerValue))
+	check.Equal(http.StatusServiceUnavailable, request("GET", "/api/v1/downloads", readerValue))
+	check.Equal(http.StatusForbidden, request("GET", "/api/v1/filters/test/purple/1234", snatcherValue))
+
+	// revoking
+	check.Nil(tokens.Revoke("snatcher"))
+	check.NotNil(tokens.Revoke("snatcher"))
+	_, err = tokens.Authenticate(snatcherValue, "")
+	check.NotNil(err)
+	check.Equal(http.StatusForbidden, request("POST", "/api/v1/snatch", snatcherValue))
+}
@@ -0,0 +1,340 @@
+package varroa
+
+import (
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/logthis"
+	"gitlab.com/passelecasque/obstruction/tracker"
+)
+
+const (
+	downloadCommand  = "get"
+	handshakeCommand = "hello"
+	statsCommand     = "stats"
+	// protocol v2
+	snatchCommand = "snatch"
+	lookupCommand = "lookup"
+	statusCommand = "status"
+
+	websocketProtocolVersion = 2
+	websocketMaximumBatch    = 100
+
+	errorUnsupportedProtocol = "unsupported protocol version"
+	errorTooManyIDs          = "too many torrent IDs, the maximum is "
+)
+
+const (
+	responseInfo = iota
+	responseError
+)
+
+const (
+	notificationArea = iota
+	statsArea
+)
+
+// WebSocketTorrent is the result of a command for one torrent ID, in protocol v2.
+type WebSocketTorrent struct {
+	ID      string
+	Status  int
+	Message string `json:",omitempty"`
+	// lookups
+	Snatched      bool     `json:",omitempty"`
+	Local         bool     `json:",omitempty"`
+	DownloadState string   `json:",omitempty"`
+	Filters       []string `json:",omitempty"`
+}
+
+// websocketCommandScope is the token scope required by a websocket command, any valid token can say hello.
+func websocketCommandScope(command string) string {
+	switch command {
+	case handshakeCommand:
+		return ""
+	case downloadCommand, snatchCommand:
+		return scopeSnatch
+	case lookupCommand:
+		return scopeReadDownloads
+	}
+	return scopeReadStats
+}
+
+// websocketHandler for the GM script.
+func websocketHandler(e *Environment, downloads *DownloadsDB, tokens *TokensDB) http.HandlerFunc {
+	upgrader := websocket.Upgrader{
+		// allows connection to websocket from anywhere
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logthis.Error(errors.Wrap(err, errorCreatingWebSocket), logthis.NORMAL)
+			return
+		}
+		defer c.Close()
+		// log messages and answers are written from different goroutines
+		var mutex sync.Mutex
+		write := func(out OutgoingJSON) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return c.WriteJSON(out)
+		}
+		// channel to know when the connection with a specific instance is over
+		endThisConnection := make(chan struct{})
+		defer close(endThisConnection)
+
+		// the logs are only sent once a token allowed to read them has been used on this connection
+		var followingLogs bool
+		for {
+			// TODO if server is shutting down, c.Close()
+			incoming := IncomingJSON{}
+			if err := c.ReadJSON(&incoming); err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+					logthis.Error(errors.Wrap(err, errorIncomingWebSocketJSON), logthis.VERBOSEST)
+				}
+				return
+			}
+			answers, token, authErr := answerWebSocket(e, downloads, tokens, incoming)
+			if authErr != nil {
+				authFailed(r, authErr.Error())
+			} else {
+				authSucceeded(r)
+				if !followingLogs && canFollowLogs(token) {
+					followingLogs = true
+					go forwardLogs(write, endThisConnection)
+				}
+			}
+			for _, answer := range answers {
+				if err := write(answer); err != nil {
+					if !websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+						logthis.Error(errors.Wrap(err, errorOutgoingWebSocketJSON+" (answer)"), logthis.VERBOSEST)
+					}
+					return
+				}
+			}
+			// closing the connection once locked out
+			if requestGuard(r).isLockedOut(clientIP(r)) {
+				return
+			}
+		}
+	}
+}
+
+// canFollowLogs if the token can read the stats of all trackers, since the daemon logs mention all of them.
+func canFollowLogs(token *APIToken) bool {
+	return token != nil && len(token.Trackers) == 0 && token.Allows(scopeReadStats, "") == nil
+}
+
+// forwardLogs of the daemon to the remote, until the connection is over.
+func forwardLogs(write func(OutgoingJSON) error, endThisConnection chan struct{}) {
+	logOutput := logthis.Subscribe()
+	defer logthis.Unsubscribe(logOutput)
+	for {
+		select {
+		case messageToLog := <-logOutput:
+			// TODO differentiate info / error
+			if err := write(OutgoingJSON{Status: responseInfo, Message: messageToLog.(string), Target: notificationArea}); err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+					logthis.Error(errors.Wrap(err, errorOutgoingWebSocketJSON), logthis.VERBOSEST)
+				}
+				return
+			}
+		case <-endThisConnection:
+			return
+		}
+	}
+}
+
+// answerWebSocket command, with one answer per torrent ID in protocol v1 and a single answer in protocol v2.
+// The token is returned once authenticated, or an error if it could not be.
+func answerWebSocket(e *Environment, downloads *DownloadsDB, tokens *TokensDB, incoming IncomingJSON) ([]OutgoingJSON, *APIToken, error) {
+	if incoming.Version > websocketProtocolVersion {
+		return []OutgoingJSON{{Status: responseError, Target: notificationArea, Message: errorUnsupportedProtocol + ": " + strconv.Itoa(incoming.Version), Version: websocketProtocolVersion, RequestID: incoming.RequestID, Command: incoming.Command}}, nil, nil
+	}
+	var answers []OutgoingJSON
+	token, authErr := tokens.Authenticate(incoming.Token, currentConfig().WebServer.Token)
+	if authErr != nil {
+		logthis.Info(errorIncorrectWebServerToken, logthis.NORMAL)
+		answers = append(answers, OutgoingJSON{Status: responseError, Target: notificationArea, Message: "Bad token!"})
+	} else if err := token.Allows(websocketCommandScope(incoming.Command), incoming.Site); err != nil {
+		logthis.Info(err.Error(), logthis.NORMAL)
+		answers = append(answers, OutgoingJSON{Status: responseError, Target: notificationArea, Message: "Token does not allow this command."})
+	} else if incoming.Version < 2 {
+		answers = answerWebSocketV1(e, incoming)
+	} else {
+		answers = append(answers, answerWebSocketV2(e, downloads, token, incoming))
+	}
+	// v2 answers are tied to their request
+	if incoming.Version >= 2 {
+		for i := range answers {
+			answers[i].Version = websocketProtocolVersion
+			answers[i].RequestID = incoming.RequestID
+			answers[i].Command = incoming.Command
+		}
+	}
+	return answers, token, authErr
+}
+
+// answerWebSocketV1 command, as expected by older versions of the GM script.
+func answerWebSocketV1(e *Environment, incoming IncomingJSON) []OutgoingJSON {
+	switch incoming.Command {
+	case handshakeCommand:
+		// say hello right back
+		return []OutgoingJSON{{Status: responseInfo, Target: notificationArea, Message: handshakeCommand}}
+	case downloadCommand:
+		var answers []OutgoingJSON
+		for _, result := range snatchFromWebSocket(e, incoming) {
+			answers = append(answers, OutgoingJSON{Status: result.Status, Target: notificationArea, Message: result.Message})
+		}
+		return answers
+	case statsCommand:
+		// TODO gather stats and send text (ie snatched today, this week, etc...)
+		return []OutgoingJSON{{Status: responseInfo, Target: statsArea, Message: statusString(e)}}
+	}
+	return []OutgoingJSON{{Status: responseError, Target: notificationArea, Message: errorUnknownCommand + incoming.Command}}
+}
+
+// answerWebSocketV2 command, with results for every torrent ID.
+func answerWebSocketV2(e *Environment, downloads *DownloadsDB, token *APIToken, incoming IncomingJSON) OutgoingJSON {
+	answer := OutgoingJSON{Status: responseInfo, Target: notificationArea}
+	switch incoming.Command {
+	case handshakeCommand:
+		answer.Message = handshakeCommand
+	case downloadCommand, snatchCommand, lookupCommand:
+		if len(incoming.Args) > websocketMaximumBatch {
+			answer.Status = responseError
+			answer.Message = errorTooManyIDs + strconv.Itoa(websocketMaximumBatch)
+			return answer
+		}
+		if incoming.Command == lookupCommand {
+			// filters are checked by getting the torrent information, as for a snatch
+			if incoming.Filters {
+				if err := token.Allows(scopeSnatch, incoming.Site); err != nil {
+					answer.Status = responseError
+					answer.Message = "Token does not allow checking filters."
+					return answer
+				}
+			}
+			answer.Torrents = lookupFromWebSocket(e, downloads, incoming)
+		} else {
+			answer.Torrents = snatchFromWebSocket(e, incoming)
+		}
+		var failed int
+		for _, result := range answer.Torrents {
+			if result.Status == responseError {
+				failed++
+			}
+		}
+		if failed != 0 {
+			answer.Status = responseError
+		}
+		answer.Message = strconv.Itoa(len(answer.Torrents)-failed) + "/" + strconv.Itoa(len(answer.Torrents)) + " torrent(s) processed."
+	case statsCommand, statusCommand:
+		status := newAPIStatus(e)
+		answer.Target = statsArea
+		answer.Message = statusString(e)
+		answer.Daemon = &status
+	default:
+		answer.Status = responseError
+		answer.Message = errorUnknownCommand + incoming.Command
+	}
+	return answer
+}
+
+// webSocketTracker of a command, or results for each torrent ID explaining why it is unknown.
+func webSocketTracker(e *Environment, incoming IncomingJSON) (*tracker.Gazelle, []WebSocketTorrent) {
+	t, err := e.Tracker(incoming.Site)
+	if err != nil {
+		logthis.Error(errors.Wrap(err, "Error identifying in configuration tracker "+incoming.Site), logthis.NORMAL)
+		var results []WebSocketTorrent
+		for _, id := range incoming.Args {
+			results = append(results, WebSocketTorrent{ID: id, Status: responseError, Message: "Unknown tracker " + incoming.Site + "."})
+		}
+		return nil, results
+	}
+	return t, nil
+}
+
+// snatchFromWebSocket every torrent ID, one at a time.
+func snatchFromWebSocket(e *Environment, incoming IncomingJSON) []WebSocketTorrent {
+	t, results := webSocketTracker(e, incoming)
+	if t == nil {
+		return results
+	}
+	for _, id := range incoming.Args {
+		release, err := manualSnatchFromID(e, t, id, incoming.FLToken)
+		if err != nil {
+			logthis.Info("Error snatching torrent: "+err.Error(), logthis.NORMAL)
+			results = append(results, WebSocketTorrent{ID: id, Status: responseError, Message: "Error snatching torrent."})
+		} else {
+			results = append(results, WebSocketTorrent{ID: id, Status: responseInfo, Message: "Successfully snatched torrent " + release.ShortString()})
+		}
+	}
+	return results
+}
+
+// lookupFromWebSocket tells for every torrent ID if it was snatched, if it is in the downloads, and which filters it
+// would trigger if requested.
+func lookupFromWebSocket(e *Environment, downloads *DownloadsDB, incoming IncomingJSON) []WebSocketTorrent {
+	t, results := webSocketTracker(e, incoming)
+	if t == nil {
+		return results
+	}
+	stats, err := NewStatsDB(filepath.Join(StatsDir, DefaultHistoryDB))
+	if err != nil {
+		logthis.Error(errors.Wrap(err, "could not access the stats database"), logthis.NORMAL)
+	}
+	for _, id := range incoming.Args {
+		result := WebSocketTorrent{ID: id, Status: responseInfo}
+		torrentID, err := strconv.Atoi(id)
+		if err != nil {
+			result.Status = responseError
+			result.Message = errorNoID
+			results = append(results, result)
+			continue
+		}
+		if stats != nil {
+			result.Snatched = stats.AlreadySnatched(t.Name, id)
+		}
+		if downloads != nil {
+			if dl, err := downloads.FindByTrackerID(t.Name, torrentID); err == nil {
+				result.Local = true
+				result.DownloadState = DownloadFolderStates[dl.State]
+			}
+		}
+		if incoming.Filters {
+			info := &TrackerMetadata{}
+			if err := info.LoadFromID(t, id); err != nil {
+				result.Status = responseError
+				result.Message = errorCouldNotGetTorrentInfo
+			} else {
+				result.Filters = []string{}
+				for _, f := range matchingFilters(e, t, info, stats) {
+					if f.Matches {
+						result.Filters = append(result.Filters, f.Filter)
+					}
+				}
+			}
+		}
+		var found []string
+		if result.Snatched {
+			found = append(found, "snatched")
+		}
+		if result.Local {
+			found = append(found, "in downloads ("+result.DownloadState+")")
+		}
+		if len(result.Filters) != 0 {
+			found = append(found, "matching "+strings.Join(result.Filters, ", "))
+		}
+		if result.Message == "" && len(found) != 0 {
+			result.Message = strings.Join(found, ", ")
+		}
+		results = append(results, result)
+	}
+	return results
+}
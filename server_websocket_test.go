@@ -0,0 +1,86 @@
+package varroa
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebSocketProtocol(t *testing.T) {
+	fmt.Println("+ Testing Webserver/websocket...")
+	check := assert.New(t)
+
+	c, err := NewConfig("test/test_complete.yaml")
+	check.Nil(err)
+	e := NewEnvironment()
+	e.SetConfig(c)
+	answer := func(incoming IncomingJSON) []OutgoingJSON {
+		answers, token, err := answerWebSocket(e, nil, nil, incoming)
+		check.Equal(incoming.Token == "wrongtoken", err != nil)
+		check.Equal(err == nil && incoming.Version <= websocketProtocolVersion, token != nil)
+		return answers
+	}
+
+	// protocol v1 is unchanged
+	answers := answer(IncomingJSON{Token: "thisisatoken", Command: handshakeCommand})
+	check.Equal([]OutgoingJSON{{Status: responseInfo, Target: notificationArea, Message: handshakeCommand}}, answers)
+	out, err := json.Marshal(answers[0])
+	check.Nil(err)
+	check.Equal(`{"Status":0,"Target":0,"Message":"hello"}`, string(out))
+	answers = answer(IncomingJSON{Token: "wrongtoken", Command: handshakeCommand})
+	check.Equal([]OutgoingJSON{{Status: responseError, Target: notificationArea, Message: "Bad token!"}}, answers)
+	answers = answer(IncomingJSON{Token: "thisisatoken", Command: lookupCommand})
+	check.Equal([]OutgoingJSON{{Status: responseError, Target: notificationArea, Message: errorUnknownCommand + lookupCommand}}, answers)
+	// one answer per ID
+	answers = answer(IncomingJSON{Token: "thisisatoken", Command: downloadCommand, Site: "unknown", Args: []string{"1", "2"}})
+	check.Equal(2, len(answers))
+	check.Equal(responseError, answers[1].Status)
+
+	// protocol v2
+	answers = answer(IncomingJSON{Token: "thisisatoken", Command: handshakeCommand, Version: 2, RequestID: "r1"})
+	check.Equal([]OutgoingJSON{{Status: responseInfo, Target: notificationArea, Message: handshakeCommand, Version: 2, RequestID: "r1", Command: handshakeCommand}}, answers)
+	answers = answer(IncomingJSON{Token: "wrongtoken", Command: handshakeCommand, Version: 2, RequestID: "r2"})
+	check.Equal(1, len(answers))
+	check.Equal(responseError, answers[0].Status)
+	check.Equal("r2", answers[0].RequestID)
+	answers = answer(IncomingJSON{Token: "thisisatoken", Command: handshakeCommand, Version: 3, RequestID: "r3"})
+	check.Equal(1, len(answers))
+	check.Equal(errorUnsupportedProtocol+": 3", answers[0].Message)
+	check.Equal(websocketProtocolVersion, answers[0].Version)
+
+	// status
+	answers = answer(IncomingJSON{Token: "thisisatoken", Command: statusCommand, Version: 2, RequestID: "r4"})
+	check.Equal(1, len(answers))
+	check.Equal(statsArea, answers[0].Target)
+	check.NotNil(answers[0].Daemon)
+	check.Equal(Version, answers[0].Daemon.Version)
+
+	// batches
+	answers = answer(IncomingJSON{Token: "thisisatoken", Command: snatchCommand, Site: "unknown", Args: []string{"1", "2"}, Version: 2, RequestID: "r5"})
+	check.Equal(1, len(answers))
+	check.Equal(responseError, answers[0].Status)
+	check.Equal([]WebSocketTorrent{{ID: "1", Status: responseError, Message: "Unknown tracker unknown."}, {ID: "2", Status: responseError, Message: "Unknown tracker unknown."}}, answers[0].Torrents)
+	check.Equal("0/2 torrent(s) processed.", answers[0].Message)
+	answers = answer(IncomingJSON{Token: "thisisatoken", Command: lookupCommand, Site: "unknown", Args: []string{"1"}, Version: 2, RequestID: "r6"})
+	check.Equal(1, len(answers[0].Torrents))
+	check.Equal(lookupCommand, answers[0].Command)
+	tooMany := make([]string, websocketMaximumBatch+1)
+	answers = answer(IncomingJSON{Token: "thisisatoken", Command: lookupCommand, Site: "blue", Args: tooMany, Version: 2})
+	check.Equal(responseError, answers[0].Status)
+	check.Nil(answers[0].Torrents)
+
+	// scopes
+	check.Equal(scopeSnatch, websocketCommandScope(snatchCommand))
+	check.Equal(scopeReadDownloads, websocketCommandScope(lookupCommand))
+	check.Equal(scopeReadStats, websocketCommandScope(statusCommand))
+	check.Equal("", websocketCommandScope(handshakeCommand))
+
+	// only tokens reading the stats of all trackers get the logs
+	check.False(canFollowLogs(nil))
+	check.True(canFollowLogs(legacyAPIToken()))
+	check.True(canFollowLogs(&APIToken{Scopes: []string{scopeReadStats}}))
+	check.False(canFollowLogs(&APIToken{Scopes: []string{scopeSnatch}}))
+	check.False(canFollowLogs(&APIToken{Scopes: []string{scopeReadStats}, Trackers: []string{"blue"}}))
+}
@@ -1,6 +1,7 @@
 package varroa
 
 import (
+	"context"
 	"path/filepath"
 	"reflect"
 	"time"
@@ -12,7 +13,7 @@ import (
 
 func updateStats(e *Environment, tracker string, stats *StatsDB) error {
 	// read configuration for this tracker
-	statsConfig, err := e.config.GetStats(tracker)
+	statsConfig, err := currentConfig().GetStats(tracker)
 	if err != nil {
 		return errors.Wrap(err, "Error loading stats config for "+tracker)
 	}
@@ -52,8 +53,10 @@ func updateStats(e *Environment, tracker string, stats *StatsDB) error {
 
 	// compare with new stats
 	logthis.Info(newStats.Progress(&previousStats), logthis.NORMAL)
+	e.events.Publish(eventStats, tracker, newStats.Progress(&previousStats), *newStats)
 	// send notification
-	if notifyErr := Notify("stats: "+newStats.Progress(&previousStats), tracker, "info", e); notifyErr != nil {
+	statsData := &NotificationData{Event: notificationEventStats, Stats: newStats}
+	if notifyErr := NotifyWithData(statsNotificationPrefix+newStats.Progress(&previousStats), tracker, "info", statsData, e); notifyErr != nil {
 		logthis.Error(notifyErr, logthis.NORMAL)
 	}
 
@@ -63,25 +66,26 @@ func updateStats(e *Environment, tracker string, stats *StatsDB) error {
 			// unacceptable because of low ratio
 			logthis.Info(tracker+": "+errorBelowWarningRatio, logthis.NORMAL)
 			// sending notification
-			if err := Notify(tracker+": "+errorBelowWarningRatio, tracker, "error", e); err != nil {
+			if err := NotifyWithData(tracker+": "+errorBelowWarningRatio, tracker, "error", statsData, e); err != nil {
 				logthis.Error(err, logthis.NORMAL)
 			}
 		} else {
 			// unacceptable because of ratio drop
 			logthis.Info(tracker+": "+errorBufferDrop, logthis.NORMAL)
 			// sending notification
-			if err := Notify(tracker+": "+errorBufferDrop, tracker, "error", e); err != nil {
+			if err := NotifyWithData(tracker+": "+errorBufferDrop, tracker, "error", statsData, e); err != nil {
 				logthis.Error(err, logthis.NORMAL)
 			}
 		}
 		// stopping things
+		e.mutex.Lock()
 		autosnatchConfig, err := e.config.GetAutosnatch(tracker)
+		if err == nil {
+			autosnatchConfig.disabledAutosnatching = true
+		}
+		e.mutex.Unlock()
 		if err != nil {
 			logthis.Error(errors.Wrap(err, "Cannot find autosnatch configuration for tracker "+tracker), logthis.NORMAL)
-		} else {
-			e.mutex.Lock()
-			autosnatchConfig.disabledAutosnatching = true
-			e.mutex.Unlock()
 		}
 	}
 
@@ -89,8 +93,46 @@ func updateStats(e *Environment, tracker string, stats *StatsDB) error {
 	return stats.GenerateAllGraphsForTracker(tracker)
 }
 
-func monitorAllStats(e *Environment) {
-	if !e.config.statsConfigured {
+// statsSubsystem periodically collects stats from the trackers.
+type statsSubsystem struct {
+	e    *Environment
+	done chan struct{}
+}
+
+func (ss *statsSubsystem) Name() string {
+	return subsystemStats
+}
+
+func (ss *statsSubsystem) Start(ctx context.Context) error {
+	ss.done = make(chan struct{})
+	go func() {
+		monitorAllStats(ctx, ss.e)
+		close(ss.done)
+	}()
+	return nil
+}
+
+// Stop once the current collection is over.
+func (ss *statsSubsystem) Stop(ctx context.Context) error {
+	select {
+	case <-ss.done:
+		return nil
+	case <-ctx.Done():
+		return errors.New("timeout waiting for stats collection")
+	}
+}
+
+func (ss *statsSubsystem) Health() error {
+	select {
+	case <-ss.done:
+		return errors.New("not collecting stats")
+	default:
+		return nil
+	}
+}
+
+func monitorAllStats(ctx context.Context, e *Environment) {
+	if !currentConfig().statsConfigured {
 		return
 	}
 	// access to statsDB
@@ -103,7 +145,7 @@ func monitorAllStats(e *Environment) {
 	// track all different periods
 	tickers := map[int][]string{}
 	for label, t := range e.Trackers {
-		if statsConfig, err := e.config.GetStats(t.Name); err == nil {
+		if statsConfig, err := currentConfig().GetStats(t.Name); err == nil {
 			// initial stats
 			if err := updateStats(e, label, stats); err != nil {
 				logthis.Error(errors.Wrap(err, ErrorGeneratingGraphs), logthis.NORMAL)
@@ -126,7 +168,9 @@ func monitorAllStats(e *Environment) {
 	tickerPeriods := make([]int, len(tickers))
 	cpt := 0
 	for p := range tickers {
-		tickerChans[cpt] = time.NewTicker(time.Hour * time.Duration(p)).C
+		ticker := time.NewTicker(time.Hour * time.Duration(p))
+		defer ticker.Stop()
+		tickerChans[cpt] = ticker.C
 		tickerPeriods[cpt] = p
 		cpt++
 	}
@@ -134,9 +178,14 @@ func monitorAllStats(e *Environment) {
 	for i, ch := range tickerChans {
 		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)}
 	}
+	// the last case is for stopping
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())})
 	// wait for ticks
 	for {
 		triggered, _, ok := reflect.Select(cases)
+		if triggered == len(cases)-1 {
+			return
+		}
 		if !ok {
 			// The triggered channel has been closed, so zero out the channel to disable the case
 			cases[triggered].Chan = reflect.ValueOf(nil)
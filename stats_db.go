@@ -499,6 +499,39 @@ func (sdb *StatsDB) AddSnatch(release Release) error {
 	return sdb.db.DB.Save(&release)
 }
 
+// GetLastSnatches from the history, most recent first.
+func (sdb *StatsDB) GetLastSnatches(limit int) ([]Release, error) {
+	var releases []Release
+	err := sdb.db.DB.Select().OrderBy("ID").Reverse().Limit(limit).Find(&releases)
+	return releases, err
+}
+
+// AlreadySnatched torrent, from its tracker ID.
+func (sdb *StatsDB) AlreadySnatched(trackerLabel, torrentID string) bool {
+	var snatched Release
+	err := sdb.db.DB.Select(q.And(q.Eq("Tracker", trackerLabel), q.Eq("TorrentID", torrentID))).First(&snatched)
+	if err != nil {
+		if err != storm.ErrNotFound {
+			logthis.Error(errors.Wrap(err, "error looking for snatched torrent"), logthis.NORMAL)
+		}
+		return false
+	}
+	return true
+}
+
+// SnatchFilter that snatched a torrent, from its tracker ID. It is empty if it was not snatched by a filter.
+func (sdb *StatsDB) SnatchFilter(trackerLabel, torrentID string) string {
+	var snatched Release
+	err := sdb.db.DB.Select(q.And(q.Eq("Tracker", trackerLabel), q.Eq("TorrentID", torrentID))).First(&snatched)
+	if err != nil {
+		if err != storm.ErrNotFound {
+			logthis.Error(errors.Wrap(err, "error looking for snatched torrent"), logthis.NORMAL)
+		}
+		return ""
+	}
+	return snatched.Filter
+}
+
 func (sdb *StatsDB) AlreadySnatchedDuplicate(release *Release) bool {
 	duplicateQuery := q.And(
 		q.Eq("Tracker", release.Tracker),
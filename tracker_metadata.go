@@ -1,7 +1,6 @@
 package varroa
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"html"
@@ -14,11 +13,9 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	"text/template"
 	"time"
 
 	humanize "github.com/dustin/go-humanize"
-	"github.com/mewkiz/flac"
 	"github.com/mgutz/ansi"
 	"github.com/pkg/errors"
 	"github.com/russross/blackfriday"
@@ -110,6 +107,7 @@ Direct link: %s
 type TrackerMetadataTrack struct {
 	Disc     string
 	Number   string
+	Artist   string
 	Title    string
 	Duration string
 	Size     string
@@ -428,20 +426,14 @@ func (tm *TrackerMetadata) checkAliasAndCategory(parentFolder string) error {
 	if conf.LibraryConfigured {
 		var changed bool
 		// try to find main artist alias
-		for alias, aliasArtists := range conf.Library.Aliases {
-			if artistInSlice(tm.MainArtist, tm.Title, aliasArtists) {
-				tm.MainArtistAlias = alias
-				changed = true
-				break
-			}
+		if alias, ok := libraryAlias(conf.Library, tm.MainArtist, tm.Title); ok {
+			tm.MainArtistAlias = alias
+			changed = true
 		}
 		// try to find category for main artist alias
-		for category, categoryArtists := range conf.Library.Categories {
-			if artistInSlice(tm.MainArtistAlias, tm.Title, categoryArtists) {
-				tm.Category = category
-				changed = true
-				break
-			}
+		if category, ok := libraryCategory(conf.Library, tm.MainArtistAlias, tm.Title); ok {
+			tm.Category = category
+			changed = true
 		}
 		if changed {
 			logthis.Info("Updating user metadata with information from the configuration.", logthis.VERBOSEST)
@@ -577,8 +569,7 @@ func (tm *TrackerMetadata) SaveCover(releaseFolder string) error {
 	if tm.CoverURL == "" {
 		return errors.New("unknown image url")
 	}
-	filename := filepath.Join(releaseFolder, MetadataDir, tm.Tracker+" - "+trackerCoverFile+filepath.Ext(tm.CoverURL))
-
+	filename := tm.coverPath(releaseFolder)
 	if fs.FileExists(filename) {
 		// already downloaded, or exists in folder already: do nothing
 		return nil
@@ -599,6 +590,11 @@ func (tm *TrackerMetadata) SaveCover(releaseFolder string) error {
 	return err
 }
 
+// coverPath of the tracker cover inside the metadata directory of a release.
+func (tm *TrackerMetadata) coverPath(releaseFolder string) string {
+	return filepath.Join(releaseFolder, MetadataDir, tm.Tracker+" - "+trackerCoverFile+filepath.Ext(tm.CoverURL))
+}
+
 func (tm *TrackerMetadata) HTMLDescription() string {
 	// TODO use HTML template directly!!
 
@@ -685,11 +681,10 @@ func (tm *TrackerMetadata) TextDescription(fancy bool) string {
 }
 
 func getAudioInfo(f string) (string, string, error) {
-	stream, err := flac.ParseFile(f)
+	stream, err := parseFLAC(f)
 	if err != nil {
 		return "", "", errors.Wrap(err, "could not get FLAC information")
 	}
-	defer stream.Close()
 
 	var format string
 	switch stream.Info.BitsPerSample {
@@ -722,11 +717,16 @@ func getFullAudioFormat(f string) (string, error) {
 	return fmt.Sprintf("%s-%skHz", format, sampleRate), nil
 }
 
-func (tm *TrackerMetadata) GeneratePath(folderTemplate, releaseFolder string) string {
+// GeneratePath of a release in the library, from a folder template. Without template, the original folder name is used.
+func (tm *TrackerMetadata) GeneratePath(folderTemplate, releaseFolder string) (string, error) {
 	if folderTemplate == "" {
-		return tm.FolderName
+		return tm.FolderName, nil
 	}
+	return executeTemplate(folderTemplate, tm.templateVariables(releaseFolder))
+}
 
+// templateVariables for a release, as they can be used in templates.
+func (tm *TrackerMetadata) templateVariables(releaseFolder string) map[string]string {
 	// usual edition specifiers, shortened
 	editionName := tracker.ShortEdition(tm.EditionName)
 
@@ -757,7 +757,7 @@ func (tm *TrackerMetadata) GeneratePath(folderTemplate, releaseFolder string) st
 	}
 
 	quality := tracker.ShortEncoding(tm.Quality)
-	if quality == "FLAC" || quality == "FLAC24" {
+	if (quality == "FLAC" || quality == "FLAC24") && releaseFolder != "" {
 		// get one music file then find sample rate
 		//firstTrackFilename := filepath.Join(releaseFolder, tm.Tracks[0].Title)
 		firstTrackFilename := music.GetFirstFLACFound(releaseFolder)
@@ -769,60 +769,22 @@ func (tm *TrackerMetadata) GeneratePath(folderTemplate, releaseFolder string) st
 		}
 	}
 
-	r := strings.NewReplacer(
-		"$id", "{{$id}}",
-		"$a", "{{$a}}",
-		"$ma", "{{$ma}}",
-		"$c", "{{$c}}",
-		"$t", "{{$t}}",
-		"$y", "{{$y}}",
-		"$f", "{{$f}}",
-		"$s", "{{$s}}",
-		"$l", "{{$l}}",
-		"$n", "{{$n}}",
-		"$e", "{{$e}}",
-		"$g", "{{$g}}",
-		"$r", "{{$r}}",
-		"$xar", "{{$xar}}",
-		"{", "ÆÆ", // otherwise golang's template throws a fit if '{' or '}' are in the user pattern
-		"}", "¢¢", // assuming these character sequences will probably not cause conflicts.
-	)
-
-	// replace with all valid epub parameters
-	tmpl := fmt.Sprintf(`{{$c := %q}}{{$ma := %q}}{{$a := %q}}{{$y := "%d"}}{{$t := %q}}{{$f := %q}}{{$s := %q}}{{$g := %q}}{{$l := %q}}{{$n := %q}}{{$e := %q}}{{$id := %q}}{{$r := %q}}{{$xar := %q}}%s`,
-		fs.SanitizePath(tm.Category),
-		fs.SanitizePath(tm.MainArtistAlias),
-		fs.SanitizePath(tm.MainArtist),
-		tm.OriginalYear,
-		fs.SanitizePath(tm.Title),
-		quality,
-		tm.Source,
-		tm.SourceFull, // source with indicator if 100%/log/cue or Silver/gold & lossy web/master
-		fs.SanitizePath(tm.RecordLabel),
-		tm.CatalogNumber,
-		fs.SanitizePath(editionName), // edition
-		fs.SanitizePath(id),          // identifying info
-		tm.ReleaseType,
-		releaseTypeExceptAlbum,
-		r.Replace(folderTemplate))
-
-	var doc bytes.Buffer
-	te := template.Must(template.New("hop").Parse(tmpl))
-	if err := te.Execute(&doc, nil); err != nil {
-		return tm.FolderName
-	}
-	newName := strings.TrimSpace(doc.String())
-	// trim spaces around all internal folder names
-	var trimmedParts = strings.Split(newName, "/")
-	for i, part := range trimmedParts {
-		trimmedParts[i] = strings.TrimSpace(part)
-	}
-	// recover brackets
-	r2 := strings.NewReplacer(
-		"ÆÆ", "{",
-		"¢¢", "}",
-	)
-	return r2.Replace(strings.Join(trimmedParts, "/"))
+	return map[string]string{
+		"c":   fs.SanitizePath(tm.Category),
+		"ma":  fs.SanitizePath(tm.MainArtistAlias),
+		"a":   fs.SanitizePath(tm.MainArtist),
+		"y":   fmt.Sprintf("%d", tm.OriginalYear),
+		"t":   fs.SanitizePath(tm.Title),
+		"f":   quality,
+		"s":   tm.Source,
+		"g":   tm.SourceFull, // source with indicator if 100%/log/cue or Silver/gold & lossy web/master
+		"l":   fs.SanitizePath(tm.RecordLabel),
+		"n":   tm.CatalogNumber,
+		"e":   fs.SanitizePath(editionName), // edition
+		"id":  fs.SanitizePath(id),          // identifying info
+		"r":   tm.ReleaseType,
+		"xar": releaseTypeExceptAlbum,
+	}
 }
 
 func (tm *TrackerMetadata) WriteUserJSON(destination string) error {
@@ -0,0 +1,219 @@
+package varroa
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/fs"
+	"gitlab.com/catastrophic/assistance/logthis"
+	"gitlab.com/passelecasque/obstruction/tracker"
+)
+
+const (
+	// tracker API calls are rate-limited, checking a limited number of releases per run leaves room for
+	// autosnatching and other requests. The releases checked the longest time ago come first, so the next
+	// runs carry on with the others.
+	metadataMonitorReleasesPerRun = 100
+)
+
+// metadataMonitorRunning is set while snatched releases are being checked, to avoid overlapping runs.
+var metadataMonitorRunning int32
+
+// snatchedRelease found in a download directory, with its metadata for one tracker.
+type snatchedRelease struct {
+	folderName  string
+	metadataDir string
+	label       string
+	origin      *OriginJSON
+}
+
+// MonitorSnatchedReleases refreshes the tracker metadata of releases in the download directories, and sends
+// notifications for releases that were deleted, reported, marked as trumpable, under-seeded, or edited.
+func MonitorSnatchedReleases(e *Environment) error {
+	if !atomic.CompareAndSwapInt32(&metadataMonitorRunning, 0, 1) {
+		return errors.New("snatched releases are already being checked")
+	}
+	defer atomic.StoreInt32(&metadataMonitorRunning, 0)
+
+	conf := currentConfig()
+	roots := []string{conf.General.DownloadDir}
+	if conf.LibraryConfigured {
+		roots = append(roots, conf.Library.AdditionalSources...)
+	}
+	for _, r := range snatchedReleasesToCheck(roots, metadataMonitorReleasesPerRun) {
+		t, err := e.Tracker(r.label)
+		if err != nil {
+			continue
+		}
+		releaseJSON, err := getReleaseJSONFile(r.metadataDir, r.label)
+		if err != nil {
+			continue
+		}
+		stored, err := loadStoredTrackerMetadata(r.label, r.origin, releaseJSON)
+		if err != nil {
+			logthis.Error(errors.Wrap(err, "Error loading stored metadata for "+r.folderName), logthis.VERBOSE)
+			continue
+		}
+		if err := checkSnatchedRelease(e, t, r.metadataDir, stored); err != nil {
+			logthis.Error(errors.Wrap(err, "Error checking "+r.folderName+" on "+r.label), logthis.VERBOSE)
+		}
+	}
+	return nil
+}
+
+// snatchedReleasesToCheck in the download directories, at most max of them, the least recently updated first.
+func snatchedReleasesToCheck(roots []string, max int) []snatchedRelease {
+	var releases []snatchedRelease
+	for _, root := range roots {
+		entries, err := ioutil.ReadDir(root)
+		if err != nil {
+			logthis.Error(errors.Wrap(err, "Error reading downloads directory "+root), logthis.NORMAL)
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			metadataDir := filepath.Join(root, entry.Name(), MetadataDir)
+			origin := TrackerOriginJSON{Path: filepath.Join(metadataDir, OriginJSONFile)}
+			if !fs.FileExists(origin.Path) {
+				continue
+			}
+			if err := origin.Load(); err != nil {
+				logthis.Error(err, logthis.VERBOSE)
+				continue
+			}
+			for label, o := range origin.Origins {
+				if !o.IsAlive {
+					// already known to be gone
+					continue
+				}
+				releases = append(releases, snatchedRelease{folderName: entry.Name(), metadataDir: metadataDir, label: label, origin: o})
+			}
+		}
+	}
+	sort.SliceStable(releases, func(i, j int) bool {
+		return releases[i].origin.LastUpdatedMetadata < releases[j].origin.LastUpdatedMetadata
+	})
+	if len(releases) > max {
+		releases = releases[:max]
+	}
+	return releases
+}
+
+// loadStoredTrackerMetadata as it was retrieved from the tracker, ignoring user-defined values.
+func loadStoredTrackerMetadata(label string, origin *OriginJSON, releaseJSON string) (*TrackerMetadata, error) {
+	data, err := ioutil.ReadFile(releaseJSON)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error loading JSON file "+releaseJSON)
+	}
+	var gt tracker.GazelleTorrent
+	if err := json.Unmarshal(data, &gt); err != nil {
+		return nil, errors.Wrap(err, "Error parsing torrent info JSON")
+	}
+	stored := &TrackerMetadata{Tracker: label, TrackerURL: origin.Tracker, TimeSnatched: origin.TimeSnatched, LastUpdated: origin.LastUpdatedMetadata, IsAlive: origin.IsAlive}
+	if err := stored.loadFromGazelle(&gt); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// checkSnatchedRelease against its current state on the tracker, updating the stored metadata and notifying of changes.
+func checkSnatchedRelease(e *Environment, t *tracker.Gazelle, metadataDir string, stored *TrackerMetadata) error {
+	current := &TrackerMetadata{}
+	if err := current.LoadFromID(t, strconv.Itoa(stored.ID)); err != nil {
+		deleted, reason, checkErr := t.IsTorrentDeleted(stored.ID)
+		if checkErr != nil || !deleted {
+			return err
+		}
+		stored.IsAlive = false
+		stored.LastUpdated = time.Now().Unix()
+		if err := stored.saveOriginJSON(metadataDir); err != nil {
+			return errors.Wrap(err, errorWithOriginJSON)
+		}
+		msg := fmt.Sprintf(snatchedReleaseUpdateNotification, filepath.Base(filepath.Dir(metadataDir)), "deleted ("+reason+")")
+		return NotifyWithData(msg, t.Name, "info", &NotificationData{Event: notificationEventUpdate, Metadata: stored, Release: stored.Release()}, e)
+	}
+
+	// keeping the snatch information
+	current.TimeSnatched = stored.TimeSnatched
+	if err := ioutil.WriteFile(filepath.Join(metadataDir, releaseMetadataFile(t.Name)), current.ReleaseJSON, 0666); err != nil {
+		return errors.Wrap(err, errorWritingJSONMetadata)
+	}
+	if err := current.saveOriginJSON(metadataDir); err != nil {
+		return errors.Wrap(err, errorWithOriginJSON)
+	}
+
+	changes := stored.changesSince(current)
+	if len(changes) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf(snatchedReleaseUpdateNotification, filepath.Base(filepath.Dir(metadataDir)), strings.Join(changes, ", "))
+	logthis.Info(msg, logthis.NORMAL)
+	return NotifyWithData(msg, t.Name, "info", &NotificationData{Event: notificationEventUpdate, Metadata: current, Release: current.Release()}, e)
+}
+
+// changesSince the stored metadata, worth notifying about.
+func (tm *TrackerMetadata) changesSince(current *TrackerMetadata) []string {
+	var changes []string
+	if current.Trumpable && !tm.Trumpable {
+		changes = append(changes, "now trumpable")
+	}
+	if current.Reported && !tm.Reported {
+		changes = append(changes, "reported")
+	}
+	if !current.IsWellSeeded() && tm.IsWellSeeded() {
+		changes = append(changes, fmt.Sprintf("under-seeded (%d seeders)", current.CurrentSeeders))
+	}
+	if changed := tm.editedFields(current); len(changed) != 0 {
+		changes = append(changes, "metadata edited ("+strings.Join(changed, ", ")+")")
+	}
+	return changes
+}
+
+// editedFields between two versions of the tracker metadata of a release.
+func (tm *TrackerMetadata) editedFields(current *TrackerMetadata) []string {
+	artists := func(m *TrackerMetadata) string {
+		var names []string
+		for _, a := range m.Artists {
+			names = append(names, a.Role+":"+a.Name)
+		}
+		return strings.Join(names, "|")
+	}
+	fields := []struct {
+		name            string
+		before, current string
+	}{
+		{"artists", artists(tm), artists(current)},
+		{"title", tm.Title, current.Title},
+		{"tags", strings.Join(tm.Tags, ","), strings.Join(current.Tags, ",")},
+		{"release type", tm.ReleaseType, current.ReleaseType},
+		{"record label", tm.RecordLabel, current.RecordLabel},
+		{"catalog number", tm.CatalogNumber, current.CatalogNumber},
+		{"year", strconv.Itoa(tm.OriginalYear), strconv.Itoa(current.OriginalYear)},
+		{"edition", tm.EditionName, current.EditionName},
+		{"edition year", strconv.Itoa(tm.EditionYear), strconv.Itoa(current.EditionYear)},
+		{"source", tm.SourceFull, current.SourceFull},
+		{"format", tm.Format, current.Format},
+		{"quality", tm.Quality, current.Quality},
+		{"log score", strconv.Itoa(tm.LogScore), strconv.Itoa(current.LogScore)},
+		{"group", strconv.Itoa(tm.GroupID), strconv.Itoa(current.GroupID)},
+		{"folder", tm.FolderName, current.FolderName},
+		{"description", tm.Description, current.Description},
+	}
+	var changed []string
+	for _, f := range fields {
+		if f.before != f.current {
+			changed = append(changed, f.name)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,205 @@
+package varroa
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"gitlab.com/catastrophic/assistance/fs"
+)
+
+/*
+Templates used to name releases and tracks in the library.
+
+Placeholders are replaced by the release metadata:
+	$a   main artist                  $ma  main artist alias
+	$t   title                        $y   original year
+	$c   category                     $r   release type
+	$xar release type, if not album   $l   record label
+	$n   catalog number               $e   edition, shortened
+	$id  edition year, edition and catalog number (or label)
+	$f   format (FLAC, FLAC24, V0...) $s   source
+	$g   source, with log/cue indicators
+Templates for tracks can also use, the file extension being added to the result:
+	$dn  disc number                  $tn  track number
+	$ta  track artist                 $tt  track title
+
+Everything between {{ and }} is a Go template action, where placeholders are variables. This allows conditionals,
+such as $t{{if $e}} [$e]{{end}}, and functions:
+	{{truncate 20 $t}}  the first 20 characters
+	{{initial $a}}      the first letter, or # if it is not a letter
+	{{the $a}}          "The Artist" becomes "Artist, The"
+	{{upper $a}}, {{lower $a}}, {{title $a}}
+Functions can also be chained: {{$a | the | initial}}.
+*/
+
+var (
+	// longest placeholders first
+	templatePlaceholderRegexp = regexp.MustCompile(`\$(xar|id|ma|dn|tn|ta|tt|[acytfsglner])`)
+	// braces outside of actions are kept as they are
+	templateBracesReplacer = strings.NewReplacer("{", `{{"{"}}`, "}", `{{"}"}}`)
+)
+
+var templateFunctions = template.FuncMap{
+	"truncate": truncateTemplateValue,
+	"initial":  initialTemplateValue,
+	"the":      theTemplateValue,
+	"upper":    strings.ToUpper,
+	"lower":    strings.ToLower,
+	"title":    strings.Title,
+}
+
+func truncateTemplateValue(length int, value string) string {
+	runes := []rune(value)
+	if len(runes) <= length {
+		return value
+	}
+	return strings.TrimSpace(string(runes[:length]))
+}
+
+func initialTemplateValue(value string) string {
+	if value == "" {
+		return ""
+	}
+	r, _ := utf8.DecodeRuneInString(value)
+	if !unicode.IsLetter(r) {
+		return "#"
+	}
+	return string(unicode.ToUpper(r))
+}
+
+func theTemplateValue(value string) string {
+	if len(value) > 4 && strings.EqualFold(value[:4], "the ") {
+		return value[4:] + ", " + value[:3]
+	}
+	return value
+}
+
+// templateText to parse as a Go template, with all variables defined.
+func templateText(userTemplate string, variables map[string]string) string {
+	var names []string
+	for name := range variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "{{$%s := index . %q}}", name, name)
+	}
+	// only the text outside of actions is modified
+	remaining := userTemplate
+	for {
+		start := strings.Index(remaining, "{{")
+		if start == -1 {
+			break
+		}
+		end := strings.Index(remaining[start:], "}}")
+		if end == -1 {
+			break
+		}
+		end += start + len("}}")
+		b.WriteString(placeholderText(remaining[:start]))
+		b.WriteString(remaining[start:end])
+		remaining = remaining[end:]
+	}
+	b.WriteString(placeholderText(remaining))
+	return b.String()
+}
+
+// placeholderText turned into template actions.
+func placeholderText(text string) string {
+	return templatePlaceholderRegexp.ReplaceAllString(templateBracesReplacer.Replace(text), "{{$$${1}}}")
+}
+
+// executeTemplate with the given variables, returns a path with trimmed folder names.
+func executeTemplate(userTemplate string, variables map[string]string) (string, error) {
+	t, err := template.New("path").Funcs(templateFunctions).Parse(templateText(userTemplate, variables))
+	if err != nil {
+		return "", errors.Wrap(err, "could not parse template "+userTemplate)
+	}
+	var doc bytes.Buffer
+	if err := t.Execute(&doc, variables); err != nil {
+		return "", errors.Wrap(err, "could not execute template "+userTemplate)
+	}
+	// trim spaces around all internal folder names
+	parts := strings.Split(strings.TrimSpace(doc.String()), "/")
+	for i, part := range parts {
+		parts[i] = strings.TrimSpace(part)
+		if parts[i] == "" {
+			return "", errors.New("template " + userTemplate + " generates an empty folder name: " + doc.String())
+		}
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// GenerateTrackName of a track of the release, from a template. Without template, its current name is used.
+func (tm *TrackerMetadata) GenerateTrackName(trackTemplate string, track TrackerMetadataTrack) (string, error) {
+	if trackTemplate == "" {
+		return filepath.Base(track.Title), nil
+	}
+	variables := tm.templateVariables("")
+	variables["dn"] = track.Disc
+	variables["tn"] = track.Number
+	// numbers are padded for sorting
+	if n, err := strconv.Atoi(track.Number); err == nil {
+		variables["tn"] = fmt.Sprintf("%02d", n)
+	}
+	variables["ta"] = fs.SanitizePath(track.Artist)
+	if track.Artist == "" {
+		variables["ta"] = variables["a"]
+	}
+	variables["tt"] = fs.SanitizePath(track.Title)
+	return executeTemplate(trackTemplate, variables)
+}
+
+// sampleTrackerMetadata to check templates.
+func sampleTrackerMetadata() (TrackerMetadata, TrackerMetadataTrack) {
+	tm := TrackerMetadata{
+		ID:              12345,
+		Tracker:         "tracker",
+		FolderName:      "The Artist - The Title (2001) [FLAC]",
+		Artists:         []TrackerMetadataArtist{{ID: 1, Name: "The Artist", Role: "Main"}},
+		Title:           "The Title",
+		Tags:            []string{"jazz"},
+		ReleaseType:     "Album",
+		RecordLabel:     "Label",
+		CatalogNumber:   "CAT-001",
+		OriginalYear:    1975,
+		EditionName:     "Deluxe Edition",
+		EditionYear:     2001,
+		Source:          "CD",
+		SourceFull:      "CD+",
+		Format:          "FLAC",
+		Quality:         "Lossless",
+		MainArtist:      "The Artist",
+		MainArtistAlias: "The Artist",
+		Category:        "jazz",
+	}
+	track := TrackerMetadataTrack{Disc: "1", Number: "1", Title: "The Track"}
+	tm.Tracks = []TrackerMetadataTrack{track}
+	return tm, track
+}
+
+// checkFolderTemplate with sample metadata, returns an example path.
+func checkFolderTemplate(folderTemplate string) (string, error) {
+	tm, _ := sampleTrackerMetadata()
+	return tm.GeneratePath(folderTemplate, "")
+}
+
+// checkTrackTemplate with sample metadata, returns an example track name.
+func checkTrackTemplate(trackTemplate string) (string, error) {
+	tm, track := sampleTrackerMetadata()
+	name, err := tm.GenerateTrackName(trackTemplate, track)
+	if err == nil && strings.Contains(name, "/") {
+		return name, errors.New("music file names cannot contain folders: " + name)
+	}
+	return name, err
+}
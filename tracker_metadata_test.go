@@ -1,7 +1,11 @@
 package varroa
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -101,37 +105,72 @@ func TestGeneratePath(t *testing.T) {
 	check.Equal(2, len(infod2.Tracks))
 
 	// checking GeneratePath
-	check.Equal("original_path", infod2.GeneratePath("", ""))
-	check.Equal("Artist A, Artist B", infod2.GeneratePath("$a", ""))
-	check.Equal("RELEASE 1", infod2.GeneratePath("$t", ""))
-	check.Equal("1987", infod2.GeneratePath("$y", ""))
-	check.Equal("FLAC", infod2.GeneratePath("$f", ""))
-	check.Equal("V0", infod4.GeneratePath("$f", ""))
-	check.Equal("FLAC24", infod5.GeneratePath("$f", ""))
-	check.Equal("WEB", infod2.GeneratePath("$s", ""))
-	check.Equal("LABEL 1", infod2.GeneratePath("$l", ""))
-	check.Equal("CATNUM", infod2.GeneratePath("$n", ""))
-	check.Equal("DLX", infod2.GeneratePath("$e", ""))
-	check.Equal("Artist A, Artist B (1987) RELEASE 1 [FLAC] [WEB]", infod2.GeneratePath("$a ($y) $t [$f] [$s]", ""))
-	check.Equal("Artist A, Artist B (1987) RELEASE 1 [FLAC] [WEB] {DLX, LABEL 1-CATNUM}", infod2.GeneratePath("$a ($y) $t [$f] [$s] {$e, $l-$n}", ""))
-	check.Equal("DLX/DLX", infod2.GeneratePath("$e/$e", "")) // sanitized to remove "/"
-	check.Equal("2017, DLX, CATNUM", infod2.GeneratePath("$id", ""))
-	check.Equal("Artist A, Artist B (1987) RELEASE 1 {2017, DLX, CATNUM} [FLAC WEB]", infod2.GeneratePath("$a ($y) $t {$id} [$f $s]", ""))
-	check.Equal("Artist A, Artist B (1987) RELEASE 1 {2017, DLX, CATNUM} [FLAC CD]", infod3.GeneratePath("$a ($y) $t {$id} [$f $s]", ""))
-	check.Equal("Artist A, Artist B (1987) RELEASE 1 {2017, DLX, CATNUM} [FLAC CD+]", infod3.GeneratePath("$a ($y) $t {$id} [$f $g]", ""))
-	check.Equal("Artist A, Artist B (1987) RELEASE 1 {2017, Bonus, CATNUM} [V0 CD]", infod4.GeneratePath("$a ($y) $t {$id} [$f $s]", ""))
-	check.Equal("Artist A, Artist B (1987) RELEASE 1 {2017, RM, CATNUM} [FLAC24 Vinyl]", infod5.GeneratePath("$a ($y) $t {$id} [$f $s]", ""))
-	check.Equal("Artist A, Artist B (1987) RELEASE 1 {2017, RM, CATNUM} [FLAC CD]", infod6.GeneratePath("$a ($y) $t {$id} [$f $s]", ""))
-	check.Equal("Artist A, Artist B (1987) RELEASE 1 {2017, RM, CATNUM} [FLAC CD++]", infod6.GeneratePath("$a ($y) $t {$id} [$f $g]", ""))
-	check.Equal("Artist A, Artist B (1987) RELEASE 1 {PR, CATNUM} [FLAC CD]", infod7.GeneratePath("$a ($y) $t {$id} [$f $s]", ""))
-	check.Equal("Artist A, Artist B (1987) RELEASE 1 {PR, CATNUM} [FLAC CD+]", infod7.GeneratePath("$a ($y) $t {$id} [$f $g]", ""))
-	check.Equal("[Artist A, Artist B]/Artist A, Artist B (1987) RELEASE 1 {PR, CATNUM} [FLAC CD+]", infod7.GeneratePath("[$a]/$a ($y) $t {$id} [$f $g]", ""))
-	check.Equal("[Artist A, Artist B]/Artist A, Artist B (1987) RELEASE 1 ∕ RELEASE 2!!&éçà©§Ð‘®¢ {PR, CATNUM} [FLAC CD+]", infod8.GeneratePath("[$a]/$a ($y) $t {$id} [$f $g]", ""))
-	check.Equal("Artist A, Artist B (1987) RELEASE 1 {2017, DLX, CATNUM} EP [FLAC WEB]", infod2.GeneratePath("$a ($y) $t {$id} $xar [$f $s]", ""))
-	check.Equal("Artist A, Artist B (1987) RELEASE 1 {2017, DLX, CATNUM} EP [FLAC WEB]", infod2.GeneratePath("$a ($y) $t {$id} $r [$f $s]", ""))
-	check.Equal("Artist A, Artist B (1987) RELEASE 1 {PR, CATNUM} [FLAC CD]", infod7.GeneratePath("$a ($y) $t {$id} [$f $s] $xar", ""))
-	check.Equal("Artist A, Artist B (1987) RELEASE 1 {PR, CATNUM} [FLAC CD] Album", infod7.GeneratePath("$a ($y) $t {$id} [$f $s] $r", ""))
-	check.Equal("Artist A, Artist B (1987) \"Thing\" {PR, CATNUM} [FLAC CD] Album", infod9.GeneratePath("$a ($y) $t {$id} [$f $s] $r", ""))
+	path := func(tm *TrackerMetadata, folderTemplate string) string {
+		p, err := tm.GeneratePath(folderTemplate, "")
+		check.Nil(err)
+		return p
+	}
+	check.Equal("original_path", path(infod2, ""))
+	check.Equal("Artist A, Artist B", path(infod2, "$a"))
+	check.Equal("RELEASE 1", path(infod2, "$t"))
+	check.Equal("1987", path(infod2, "$y"))
+	check.Equal("FLAC", path(infod2, "$f"))
+	check.Equal("V0", path(infod4, "$f"))
+	check.Equal("FLAC24", path(infod5, "$f"))
+	check.Equal("WEB", path(infod2, "$s"))
+	check.Equal("LABEL 1", path(infod2, "$l"))
+	check.Equal("CATNUM", path(infod2, "$n"))
+	check.Equal("DLX", path(infod2, "$e"))
+	check.Equal("Artist A, Artist B (1987) RELEASE 1 [FLAC] [WEB]", path(infod2, "$a ($y) $t [$f] [$s]"))
+	check.Equal("Artist A, Artist B (1987) RELEASE 1 [FLAC] [WEB] {DLX, LABEL 1-CATNUM}", path(infod2, "$a ($y) $t [$f] [$s] {$e, $l-$n}"))
+	check.Equal("DLX/DLX", path(infod2, "$e/$e")) // sanitized to remove "/"
+	check.Equal("2017, DLX, CATNUM", path(infod2, "$id"))
+	check.Equal("Artist A, Artist B (1987) RELEASE 1 {2017, DLX, CATNUM} [FLAC WEB]", path(infod2, "$a ($y) $t {$id} [$f $s]"))
+	check.Equal("Artist A, Artist B (1987) RELEASE 1 {2017, DLX, CATNUM} [FLAC CD]", path(infod3, "$a ($y) $t {$id} [$f $s]"))
+	check.Equal("Artist A, Artist B (1987) RELEASE 1 {2017, DLX, CATNUM} [FLAC CD+]", path(infod3, "$a ($y) $t {$id} [$f $g]"))
+	check.Equal("Artist A, Artist B (1987) RELEASE 1 {2017, Bonus, CATNUM} [V0 CD]", path(infod4, "$a ($y) $t {$id} [$f $s]"))
+	check.Equal("Artist A, Artist B (1987) RELEASE 1 {2017, RM, CATNUM} [FLAC24 Vinyl]", path(infod5, "$a ($y) $t {$id} [$f $s]"))
+	check.Equal("Artist A, Artist B (1987) RELEASE 1 {2017, RM, CATNUM} [FLAC CD]", path(infod6, "$a ($y) $t {$id} [$f $s]"))
+	check.Equal("Artist A, Artist B (1987) RELEASE 1 {2017, RM, CATNUM} [FLAC CD++]", path(infod6, "$a ($y) $t {$id} [$f $g]"))
+	check.Equal("Artist A, Artist B (1987) RELEASE 1 {PR, CATNUM} [FLAC CD]", path(infod7, "$a ($y) $t {$id} [$f $s]"))
+	check.Equal("Artist A, Artist B (1987) RELEASE 1 {PR, CATNUM} [FLAC CD+]", path(infod7, "$a ($y) $t {$id} [$f $g]"))
+	check.Equal("[Artist A, Artist B]/Artist A, Artist B (1987) RELEASE 1 {PR, CATNUM} [FLAC CD+]", path(infod7, "[$a]/$a ($y) $t {$id} [$f $g]"))
+	check.Equal("[Artist A, Artist B]/Artist A, Artist B (1987) RELEASE 1 ∕ RELEASE 2!!&éçà©§Ð‘®¢ {PR, CATNUM} [FLAC CD+]", path(infod8, "[$a]/$a ($y) $t {$id} [$f $g]"))
+	check.Equal("Artist A, Artist B (1987) RELEASE 1 {2017, DLX, CATNUM} EP [FLAC WEB]", path(infod2, "$a ($y) $t {$id} $xar [$f $s]"))
+	check.Equal("Artist A, Artist B (1987) RELEASE 1 {2017, DLX, CATNUM} EP [FLAC WEB]", path(infod2, "$a ($y) $t {$id} $r [$f $s]"))
+	check.Equal("Artist A, Artist B (1987) RELEASE 1 {PR, CATNUM} [FLAC CD]", path(infod7, "$a ($y) $t {$id} [$f $s] $xar"))
+	check.Equal("Artist A, Artist B (1987) RELEASE 1 {PR, CATNUM} [FLAC CD] Album", path(infod7, "$a ($y) $t {$id} [$f $s] $r"))
+	check.Equal("Artist A, Artist B (1987) \"Thing\" {PR, CATNUM} [FLAC CD] Album", path(infod9, "$a ($y) $t {$id} [$f $s] $r"))
+
+	// checking conditionals and functions
+	check.Equal("Artist A, Artist B (1987) RELEASE 1 [DLX] [FLAC]", path(infod2, "$a ($y) $t{{if $e}} [$e]{{end}} [$f]"))
+	noEdition := *infod2
+	noEdition.EditionName = ""
+	check.Equal("Artist A, Artist B (1987) RELEASE 1 [FLAC]", path(&noEdition, "$a ($y) $t{{if $e}} [$e]{{end}} [$f]"))
+	check.Equal("A/Artist A, Artist B/RELEASE", path(infod2, "{{initial $a}}/$a/{{truncate 8 $t}}"))
+	check.Equal("release 1 {LABEL 1}", path(infod2, "{{lower $t}} {$l}"))
+	check.Equal("Beatles, The", theTemplateValue("The Beatles"))
+	check.Equal("Theremin", theTemplateValue("Theremin"))
+	check.Equal("#", initialTemplateValue("2Pac"))
+	for _, invalid := range []string{"{{if $e}}[$e]", "{{unknown $a}}", "{{$unknown}}", "$a/{{if not $a}}$t{{end}}", "$a/$tt"} {
+		_, err := infod2.GeneratePath(invalid, "")
+		check.NotNil(err, invalid)
+	}
+
+	// checking GenerateTrackName
+	track := TrackerMetadataTrack{Disc: "1", Number: "3", Title: "Track"}
+	name, err := infod2.GenerateTrackName("$dn.$tn. $ta - $tt", track)
+	check.Nil(err)
+	check.Equal("1.03. Artist A, Artist B - Track", name)
+	track.Artist = "Artist C"
+	name, err = infod2.GenerateTrackName("{{if ne $ta $a}}$ta - {{end}}$tt", track)
+	check.Nil(err)
+	check.Equal("Artist C - Track", name)
+
+	// checking templates with sample metadata
+	example, err := checkFolderTemplate("{{$a | the}}/$y - $t {{if $e}}[$e]{{end}}")
+	check.Nil(err)
+	check.Equal("Artist, The/1975 - The Title [DLX]", example)
 
 	// checking TextDescription
 	fmt.Println(infod2.TextDescription(false))
@@ -155,3 +194,60 @@ func TestArtistInSlice(t *testing.T) {
 	check.False(artistInSlice("Various Artists", "VA | other thing", list))
 	check.False(artistInSlice("Various Artists", "VA| other thing", list))
 }
+
+func TestChangesSince(t *testing.T) {
+	fmt.Println("+ Testing TrackerMetadata/changesSince...")
+	check := assert.New(t)
+
+	stored := &TrackerMetadata{Title: "title", Tags: []string{"pop", "rock"}, Artists: []TrackerMetadataArtist{{Name: "artist", Role: "Main"}}, CurrentSeeders: 10, EditionYear: 2000}
+	current := &TrackerMetadata{Title: "title", Tags: []string{"pop", "rock"}, Artists: []TrackerMetadataArtist{{Name: "artist", Role: "Main"}}, CurrentSeeders: 8, EditionYear: 2000}
+	check.Equal(0, len(stored.changesSince(current)))
+
+	current.Trumpable = true
+	current.CurrentSeeders = 2
+	check.Equal([]string{"now trumpable", "under-seeded (2 seeders)"}, stored.changesSince(current))
+	// already known
+	stored.Trumpable = true
+	stored.CurrentSeeders = 3
+	check.Equal(0, len(stored.changesSince(current)))
+
+	current.Reported = true
+	current.Tags = []string{"pop"}
+	current.EditionYear = 2001
+	check.Equal([]string{"reported", "metadata edited (tags, edition year)"}, stored.changesSince(current))
+}
+
+func TestSnatchedReleasesToCheck(t *testing.T) {
+	fmt.Println("+ Testing TrackerMetadata/snatchedReleasesToCheck...")
+	check := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "varroa-monitor")
+	check.Nil(err)
+	defer os.RemoveAll(dir)
+	downloads, source := filepath.Join(dir, "downloads"), filepath.Join(dir, "source")
+	writeOrigin := func(root, folderName string, lastUpdated int64, alive bool) {
+		check.Nil(os.MkdirAll(filepath.Join(root, folderName, MetadataDir), 0777))
+		origin := TrackerOriginJSON{Origins: map[string]*OriginJSON{"blue": {Tracker: "https://blue.ch", ID: 1, LastUpdatedMetadata: lastUpdated, IsAlive: alive}}}
+		data, err := json.Marshal(origin)
+		check.Nil(err)
+		check.Nil(ioutil.WriteFile(filepath.Join(root, folderName, MetadataDir, OriginJSONFile), data, 0777))
+	}
+	writeOrigin(downloads, "Recent", 300, true)
+	writeOrigin(downloads, "Deleted", 100, false)
+	writeOrigin(source, "Old", 200, true)
+	writeOrigin(source, "Oldest", 50, true)
+	check.Nil(os.MkdirAll(filepath.Join(downloads, "No metadata"), 0777))
+
+	folderNames := func(releases []snatchedRelease) []string {
+		var names []string
+		for _, r := range releases {
+			names = append(names, r.folderName)
+		}
+		return names
+	}
+	// the additional sources are checked too, the least recently updated releases first
+	check.Equal([]string{"Oldest", "Old", "Recent"}, folderNames(snatchedReleasesToCheck([]string{downloads, source}, 10)))
+	check.Equal([]string{"Oldest", "Old"}, folderNames(snatchedReleasesToCheck([]string{downloads, source}, 2)))
+	// missing directories are skipped
+	check.Equal([]string{"Recent"}, folderNames(snatchedReleasesToCheck([]string{downloads, filepath.Join(dir, "missing")}, 10)))
+}